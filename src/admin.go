@@ -0,0 +1,488 @@
+package main
+
+import (
+	"errors"
+	log "github.com/Sirupsen/logrus"
+	audit "github.com/skyguy126/website/src/audit"
+	ledger "github.com/skyguy126/website/src/ledger"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var steam64idRegex = regexp.MustCompile(`^7656119\d{10}$`)
+
+//Dollars with up to 2 decimals, ex. "-12.5"
+var dollarsRegex = regexp.MustCompile(`^(-?)(\d{1,9})(?:\.(\d{1,2}))?$`)
+
+//Longest temporary ban, anything longer should be permanent
+const MAX_BAN_DAYS = 3650
+
+//Largest credit or debit in one adjustment, cents
+const MAX_ADJUSTMENT = 10000000
+
+var errAdminSid = errors.New("Invalid steam64 id")
+var errBanReason = errors.New("A reason is required")
+var errBanDays = errors.New("Days must be a whole number up to 3650, 0 bans permanently")
+var errNotBanned = errors.New("User is not banned")
+var errAdjustment = errors.New("Invalid adjustment, the amount must not be 0 and a reason is required")
+var errAdjustmentFunds = errors.New("The balance cannot go below 0")
+var errAdjustmentSelf = errors.New("You cannot adjust your own balance")
+var errAdjustmentAmount = errors.New("The amount must be in dollars with at most 2 decimals and up to $100000")
+
+//Records an admin action under the admin and under the user it was done to
+func recordAdminAudit(actor string, ip string, event audit.Event, target string, detail string) {
+	if err := recordAudit(actor, ip, audit.EVENT_ADMIN_ACTION, string(event)+" "+target+" "+detail); err != nil {
+		log.WithError(err).WithField("sid", actor).Error("Error writing admin audit entry")
+	}
+	if err := recordAudit(target, "", event, "by "+actor+" "+detail); err != nil {
+		log.WithError(err).WithField("sid", target).Error("Error writing admin audit entry")
+	}
+}
+
+type Login struct {
+	SessionId string
+	Sid       string
+	Ip        string
+	Created   time.Time
+	Expires   time.Time
+	//Zero while the session can still be used
+	Ended time.Time
+}
+
+//Short form of the session id, enough to tell sessions apart in the admin area
+func (l *Login) ShortId() string {
+	if len(l.SessionId) < 8 {
+		return l.SessionId
+	}
+	return l.SessionId[:8]
+}
+
+func recordLogin(sessionId string, steam64id string, ip string, expires int64) error {
+	_, err := db.Exec(`INSERT INTO logins (session_id, sid, ip, created, expires) VALUES (?, ?, ?, ?, ?)`,
+		sessionId, steam64id, ip, time.Now().Unix(), expires)
+	return err
+}
+
+func endLogin(sessionId string) error {
+	_, err := db.Exec(`UPDATE logins SET ended = ? WHERE session_id = ? AND ended = 0`, time.Now().Unix(), sessionId)
+	return err
+}
+
+func queryLogins(query string, args ...interface{}) ([]*Login, error) {
+	rows, queryErr := db.Query(`SELECT session_id, sid, ip, created, expires, ended FROM logins `+query, args...)
+	if queryErr != nil {
+		return nil, queryErr
+	}
+	defer rows.Close()
+	logins := make([]*Login, 0)
+	for rows.Next() {
+		login := &Login{}
+		var created, expires, ended int64
+		if err := rows.Scan(&login.SessionId, &login.Sid, &login.Ip, &created, &expires, &ended); err != nil {
+			return nil, err
+		}
+		login.Created = time.Unix(created, 0)
+		login.Expires = time.Unix(expires, 0)
+		if ended > 0 {
+			login.Ended = time.Unix(ended, 0)
+		}
+		logins = append(logins, login)
+	}
+	return logins, rows.Err()
+}
+
+func activeSessions() ([]*Login, error) {
+	return queryLogins(`WHERE ended = 0 AND expires > ? ORDER BY created DESC`, time.Now().Unix())
+}
+
+func recentLogins(limit int) ([]*Login, error) {
+	return queryLogins(`ORDER BY created DESC LIMIT ?`, limit)
+}
+
+//Revokes every session of steam64id so its cookies stop working
+func endSessions(steam64id string) error {
+	logins, err := queryLogins(`WHERE sid = ? AND ended = 0`, steam64id)
+	if err != nil {
+		return err
+	}
+	for _, login := range logins {
+		if err := store.DeleteSession(login.SessionId); err != nil {
+			return err
+		}
+		if err := endLogin(login.SessionId); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type OnlineUser struct {
+	Sid       string
+	Ip        string
+	Nickname  string
+	Connected time.Time
+}
+
+//Users with an open socket, taken from the broadcast loop
+func onlineUsers() []*OnlineUser {
+	list := make(chan []*SocketConn)
+	broadcastChan <- &Broadcast{
+		Code : 5,
+		List : list,
+	}
+	users := make([]*OnlineUser, 0)
+	for _, socketConn := range <-list {
+		user := &OnlineUser{Sid: socketConn.Sid, Ip: socketConn.Ip, Connected: socketConn.Connected}
+		if profile := profiles.Get(socketConn.Sid); profile != nil {
+			user.Nickname = profile.Nickname
+		}
+		users = append(users, user)
+	}
+	return users
+}
+
+//Closes the socket of steam64id, looked up the same way a second login finds
+//the first one. Returns false if the user was not connected
+func kickUser(steam64id string) bool {
+	callback := make(chan *SocketConn)
+	broadcastChan <- &Broadcast{
+		Code : 2,
+		Conn : &SocketConn{
+			Sid : steam64id,
+		},
+		Callback : callback,
+	}
+	client := <-callback
+	if client.Sync == nil {
+		return false
+	}
+	client.Sync.Lock()
+	defer client.Sync.Unlock()
+	if !client.ConnAlive {
+		return false
+	}
+	client.Callback <- 4
+	return <-client.Callback == 4
+}
+
+func adminKick(actor string, ip string, steam64id string) (bool, error) {
+	if !steam64idRegex.MatchString(steam64id) {
+		return false, errAdminSid
+	}
+	if err := checkOutranks(actor, steam64id); err != nil {
+		return false, err
+	}
+	kicked := kickUser(steam64id)
+	recordAdminAudit(actor, ip, audit.EVENT_KICK, steam64id, "connected "+strconv.FormatBool(kicked))
+	log.WithFields(log.Fields{"actor": actor, "target": steam64id}).Info("Kicked user")
+	return kicked, nil
+}
+
+type Ban struct {
+	Id       int64
+	Sid      string
+	Reason   string
+	BannedBy string
+	Created  time.Time
+	//Zero for permanent bans
+	Until time.Time
+}
+
+func (b *Ban) Permanent() bool {
+	return b.Until.IsZero()
+}
+
+func queryBans(query string, args ...interface{}) ([]*Ban, error) {
+	rows, queryErr := db.Query(`SELECT id, sid, reason, banned_by, created, until FROM bans `+query, args...)
+	if queryErr != nil {
+		return nil, queryErr
+	}
+	defer rows.Close()
+	bans := make([]*Ban, 0)
+	for rows.Next() {
+		ban := &Ban{}
+		var created, until int64
+		if err := rows.Scan(&ban.Id, &ban.Sid, &ban.Reason, &ban.BannedBy, &created, &until); err != nil {
+			return nil, err
+		}
+		ban.Created = time.Unix(created, 0)
+		if until > 0 {
+			ban.Until = time.Unix(until, 0)
+		}
+		bans = append(bans, ban)
+	}
+	return bans, rows.Err()
+}
+
+func activeBans() ([]*Ban, error) {
+	return queryBans(`WHERE lifted = 0 AND (until = 0 OR until > ?) ORDER BY created DESC`, time.Now().Unix())
+}
+
+//The ban keeping steam64id out, nil if there is none
+func activeBan(steam64id string) (*Ban, error) {
+	bans, err := queryBans(`WHERE sid = ? AND lifted = 0 AND (until = 0 OR until > ?) ORDER BY until = 0 DESC, until DESC LIMIT 1`,
+		steam64id, time.Now().Unix())
+	if err != nil || len(bans) == 0 {
+		return nil, err
+	}
+	return bans[0], nil
+}
+
+//Bans steam64id for days, 0 bans permanently. Sessions are revoked and the
+//socket is closed right away
+func banUser(actor string, ip string, steam64id string, reason string, days int) error {
+	reason = strings.TrimSpace(reason)
+	if !steam64idRegex.MatchString(steam64id) {
+		return errAdminSid
+	}
+	if days < 0 || days > MAX_BAN_DAYS {
+		return errBanDays
+	}
+	if reason == "" {
+		return errBanReason
+	}
+	if err := checkOutranks(actor, steam64id); err != nil {
+		return err
+	}
+	now := time.Now()
+	var until int64
+	detail := "permanently"
+	if days > 0 {
+		until = now.Add(time.Hour * 24 * time.Duration(days)).Unix()
+		detail = "for " + strconv.Itoa(days) + " days"
+	}
+	_, execErr := db.Exec(`INSERT INTO bans (sid, reason, banned_by, created, until) VALUES (?, ?, ?, ?, ?)`,
+		steam64id, reason, actor, now.Unix(), until)
+	if execErr != nil {
+		return execErr
+	}
+	recordAdminAudit(actor, ip, audit.EVENT_BAN, steam64id, detail+": "+reason)
+	log.WithFields(log.Fields{"actor": actor, "target": steam64id, "detail": detail}).Info("Banned user")
+
+	if err := endSessions(steam64id); err != nil {
+		log.WithError(err).WithField("target", steam64id).Error("Error revoking sessions of banned user")
+	}
+	kickUser(steam64id)
+	return nil
+}
+
+func unbanUser(actor string, ip string, steam64id string) error {
+	res, execErr := db.Exec(`UPDATE bans SET lifted = ? WHERE sid = ? AND lifted = 0`, time.Now().Unix(), steam64id)
+	if execErr != nil {
+		return execErr
+	}
+	if lifted, _ := res.RowsAffected(); lifted == 0 {
+		return errNotBanned
+	}
+	recordAdminAudit(actor, ip, audit.EVENT_UNBAN, steam64id, "")
+	log.WithFields(log.Fields{"actor": actor, "target": steam64id}).Info("Unbanned user")
+	return nil
+}
+
+//Credits or debits a balance against the adjustments account
+func adjustBalance(actor string, ip string, steam64id string, amount int64, reason string) error {
+	reason = strings.TrimSpace(reason)
+	if !steam64idRegex.MatchString(steam64id) {
+		return errAdminSid
+	}
+	if amount == 0 || reason == "" {
+		return errAdjustment
+	}
+	if amount > MAX_ADJUSTMENT || amount < -MAX_ADJUSTMENT {
+		return errAdjustmentAmount
+	}
+	if actor == steam64id {
+		return errAdjustmentSelf
+	}
+	if err := checkOutranks(actor, steam64id); err != nil {
+		return err
+	}
+	id, idErr := genRandomId()
+	if idErr != nil {
+		return idErr
+	}
+	_, postErr := books.Post(&ledger.Entry{
+		Key:  "adjustment:" + id,
+		Kind: "adjustment",
+		Ref:  steam64id,
+		Memo: reason + " (by " + actor + ")",
+		Postings: []ledger.Posting{
+			{Account: ledger.UserAccount(steam64id), Amount: amount},
+			{Account: ledger.ACCOUNT_ADJUSTMENTS, Amount: -amount},
+		},
+	})
+	if postErr == ledger.ErrInsufficientFunds {
+		return errAdjustmentFunds
+	}
+	if postErr != nil {
+		return postErr
+	}
+	recordAdminAudit(actor, ip, audit.EVENT_BALANCE, steam64id, strconv.FormatInt(amount, 10)+": "+reason)
+	log.WithFields(log.Fields{"actor": actor, "target": steam64id, "amount": amount}).Info("Adjusted balance")
+	sendBalance(steam64id)
+	return nil
+}
+
+func adminErrorText(err error) string {
+	switch err {
+	case errAdminSid, errBanReason, errBanDays, errNotBanned, errAdjustment, errAdjustmentFunds, errAdjustmentSelf,
+		errAdjustmentAmount, errRoleInvalid, errRoleSelf, errRoleRank, errFairGame:
+		return err.Error()
+	}
+	return "Internal server error"
+}
+
+type AdminView struct {
+	Role     string
+	Online   []*OnlineUser
+	Sessions []*Login
+	Logins   []*Login
+	Bans     []*Ban
+	Roles    []*RoleGrant
+	CanBan   bool
+	CanFunds bool
+	CanRoles bool
+	CanAudit bool
+	CanFair  bool
+	Games    []string
+	//Result of the last action, passed along the redirect
+	Message string
+	Error   string
+}
+
+//Lists online users, sessions, logins, bans and roles. Needs PERM_ADMIN_VIEW
+func AdminHandler(w http.ResponseWriter, r *http.Request) {
+	actor := actorSid(r)
+	view := &AdminView{
+		Online:  onlineUsers(),
+		Message: r.URL.Query().Get("done"),
+		Error:   r.URL.Query().Get("error"),
+	}
+
+	var err error
+	if view.Role, err = getRole(actor); err == nil {
+		view.CanBan = roleRanks[view.Role] >= roleRanks[permissionRoles[PERM_BAN]]
+		view.CanFunds = roleRanks[view.Role] >= roleRanks[permissionRoles[PERM_BALANCE]]
+		view.CanRoles = roleRanks[view.Role] >= roleRanks[permissionRoles[PERM_ROLES]]
+		view.CanAudit = roleRanks[view.Role] >= roleRanks[permissionRoles[PERM_AUDIT]]
+		view.CanFair = roleRanks[view.Role] >= roleRanks[permissionRoles[PERM_FAIR]]
+		view.Games = fairGames
+	}
+	if err == nil {
+		view.Sessions, err = activeSessions()
+	}
+	if err == nil {
+		view.Logins, err = recentLogins(50)
+	}
+	if err == nil {
+		view.Bans, err = activeBans()
+	}
+	if err == nil {
+		view.Roles, err = listRoles()
+	}
+	if err != nil {
+		requestLog(r).WithError(err).Error("Error loading admin area")
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	data := newPageData(r, actor)
+	data.Admin = view
+	renderPage(w, r, "admin.html", http.StatusOK, data)
+}
+
+//Sends the admin back to the overview with the outcome of an action
+func adminRedirect(w http.ResponseWriter, r *http.Request, done string, err error) {
+	query := url.Values{}
+	if err != nil {
+		if adminErrorText(err) != err.Error() {
+			requestLog(r).WithError(err).WithField("path", r.URL.Path).Error("Admin action failed")
+		}
+		query.Set("error", adminErrorText(err))
+	} else {
+		query.Set("done", done)
+	}
+	http.Redirect(w, r, "https://"+HOST_ADDR+"/admin?"+query.Encode(), http.StatusSeeOther)
+}
+
+//The forms below are posted from /admin, each route checks its own permission
+
+func AdminKickHandler(w http.ResponseWriter, r *http.Request) {
+	steam64id := strings.TrimSpace(r.PostFormValue("sid"))
+	kicked, err := adminKick(actorSid(r), remoteIp(r.RemoteAddr), steam64id)
+	done := steam64id + " was not connected"
+	if kicked {
+		done = "Kicked " + steam64id
+	}
+	adminRedirect(w, r, done, err)
+}
+
+func AdminBanHandler(w http.ResponseWriter, r *http.Request) {
+	steam64id := strings.TrimSpace(r.PostFormValue("sid"))
+	ip := remoteIp(r.RemoteAddr)
+	var err error
+	if r.PostFormValue("unban") != "" {
+		err = unbanUser(actorSid(r), ip, steam64id)
+		adminRedirect(w, r, "Unbanned "+steam64id, err)
+		return
+	}
+	days, parseErr := strconv.Atoi(r.PostFormValue("days"))
+	if parseErr != nil {
+		adminRedirect(w, r, "", errBanDays)
+		return
+	}
+	err = banUser(actorSid(r), ip, steam64id, r.PostFormValue("reason"), days)
+	adminRedirect(w, r, "Banned "+steam64id, err)
+}
+
+//Cents in raw dollars, parsed as a decimal so nothing is lost to floats
+func parseDollars(raw string) (int64, error) {
+	match := dollarsRegex.FindStringSubmatch(strings.TrimSpace(raw))
+	if match == nil {
+		return 0, errAdjustmentAmount
+	}
+	dollars, _ := strconv.ParseInt(match[2], 10, 64)
+	cents, _ := strconv.ParseInt((match[3] + "00")[:2], 10, 64)
+	amount := dollars*100 + cents
+	if match[1] == "-" {
+		amount = -amount
+	}
+	return amount, nil
+}
+
+//amount is in dollars, negative to debit
+func AdminBalanceHandler(w http.ResponseWriter, r *http.Request) {
+	steam64id := strings.TrimSpace(r.PostFormValue("sid"))
+	amount, parseErr := parseDollars(r.PostFormValue("amount"))
+	if parseErr != nil {
+		adminRedirect(w, r, "", parseErr)
+		return
+	}
+	err := adjustBalance(actorSid(r), remoteIp(r.RemoteAddr), steam64id, amount, r.PostFormValue("reason"))
+	adminRedirect(w, r, "Adjusted the balance of "+steam64id, err)
+}
+
+//Retires the server seed of a game early so it gets revealed
+func AdminFairRotateHandler(w http.ResponseWriter, r *http.Request) {
+	actor := actorSid(r)
+	game := r.PostFormValue("game")
+	err := rotateFairSeed(game)
+	if err == nil {
+		if auditErr := recordAudit(actor, remoteIp(r.RemoteAddr), audit.EVENT_ADMIN_ACTION, "rotated fair seed "+game); auditErr != nil {
+			requestLog(r).WithError(auditErr).Error("Error writing admin audit entry")
+		}
+		requestLog(r).WithField("game", game).Info("Rotated fair seed")
+	}
+	adminRedirect(w, r, "Rotated the "+game+" seed, it is revealed once its open rounds are resolved", err)
+}
+
+func AdminRoleHandler(w http.ResponseWriter, r *http.Request) {
+	steam64id := strings.TrimSpace(r.PostFormValue("sid"))
+	role := r.PostFormValue("role")
+	err := setRole(actorSid(r), remoteIp(r.RemoteAddr), steam64id, role)
+	adminRedirect(w, r, steam64id+" is now "+role, err)
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	log "github.com/Sirupsen/logrus"
+	"io/fs"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+//go:embed static
+var embeddedStatic embed.FS
+
+const ASSET_PREFIX = "/static/"
+
+//Fingerprinted urls never change content so they can be cached forever
+const IMMUTABLE_CACHE = "public, max-age=31536000, immutable"
+
+//Types worth gzipping at startup when no .gz variant was shipped
+var compressibleTypes = []string{"text/", "application/javascript", "application/json", "image/svg+xml"}
+
+type Asset struct {
+	//Path relative to static/, ex. bootstrap/css/bootstrap.min.css
+	Name string
+	//Name with the content hash inserted before the extension
+	Hashed      string
+	ContentType string
+	Etag        string
+	Data        []byte
+	Gzip        []byte
+	Brotli      []byte
+	ModTime     time.Time
+}
+
+//Serves everything under static/ and maps asset names to fingerprinted urls
+type AssetManager struct {
+	byName   map[string]*Asset
+	byHashed map[string]*Asset
+}
+
+var assets *AssetManager
+
+//Dev mode reads from disk so edits show up after a restart without rebuilding
+func loadAssets(devMode bool) (*AssetManager, error) {
+	if devMode {
+		return NewAssetManager(os.DirFS("static"))
+	}
+	sub, subErr := fs.Sub(embeddedStatic, "static")
+	if subErr != nil {
+		return nil, subErr
+	}
+	return NewAssetManager(sub)
+}
+
+func NewAssetManager(files fs.FS) (*AssetManager, error) {
+	m := &AssetManager{
+		byName:   make(map[string]*Asset),
+		byHashed: make(map[string]*Asset),
+	}
+	startTime := time.Now()
+
+	walkErr := fs.WalkDir(files, ".", func(name string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() || strings.HasSuffix(name, ".gz") || strings.HasSuffix(name, ".br") {
+			return nil
+		}
+		data, readErr := fs.ReadFile(files, name)
+		if readErr != nil {
+			return readErr
+		}
+
+		sum := sha256.Sum256(data)
+		hash := hex.EncodeToString(sum[:])[:12]
+		ext := path.Ext(name)
+		contentType := mime.TypeByExtension(ext)
+		if contentType == "" {
+			contentType = http.DetectContentType(data)
+		}
+
+		asset := &Asset{
+			Name:        name,
+			Hashed:      strings.TrimSuffix(name, ext) + "." + hash + ext,
+			ContentType: contentType,
+			Etag:        `"` + hash + `"`,
+			Data:        data,
+			ModTime:     startTime,
+		}
+		if info, infoErr := entry.Info(); infoErr == nil && !info.ModTime().IsZero() {
+			asset.ModTime = info.ModTime()
+		}
+
+		//Precompressed variants are produced by the build, ex. gzip -k9 / brotli -k
+		if gz, err := fs.ReadFile(files, name+".gz"); err == nil {
+			asset.Gzip = gz
+		} else if isCompressible(contentType) {
+			asset.Gzip = gzipBytes(data)
+		}
+		if br, err := fs.ReadFile(files, name+".br"); err == nil {
+			asset.Brotli = br
+		}
+
+		m.byName[asset.Name] = asset
+		m.byHashed[asset.Hashed] = asset
+		return nil
+	})
+	if walkErr != nil {
+		return nil, walkErr
+	}
+	return m, nil
+}
+
+func isCompressible(contentType string) bool {
+	for _, prefix := range compressibleTypes {
+		if strings.HasPrefix(contentType, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func gzipBytes(data []byte) []byte {
+	var buf bytes.Buffer
+	writer, _ := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	writer.Write(data)
+	writer.Close()
+	//Not worth it if it doesnt shrink
+	if buf.Len() >= len(data) {
+		return nil
+	}
+	return buf.Bytes()
+}
+
+//Template helper, returns the fingerprinted url for an asset
+func (m *AssetManager) URL(name string) string {
+	name = strings.TrimPrefix(name, "/")
+	asset, ok := m.byName[name]
+	if !ok {
+		log.WithField("asset", name).Warn("Unknown asset")
+		return ASSET_PREFIX + name
+	}
+	return ASSET_PREFIX + asset.Hashed
+}
+
+//Directories and unknown files are 404s so there is no directory listing
+func (m *AssetManager) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, ASSET_PREFIX)
+	cacheControl := IMMUTABLE_CACHE
+	asset, ok := m.byHashed[name]
+	if !ok {
+		//Unhashed names still work but must be revalidated
+		asset, ok = m.byName[name]
+		cacheControl = "no-cache"
+	}
+	if !ok {
+		NotFound(w, r)
+		return
+	}
+
+	h := w.Header()
+	h.Set("Cache-Control", cacheControl)
+	h.Set("Content-Type", asset.ContentType)
+	h.Add("Vary", "Accept-Encoding")
+
+	//Each encoding is a different representation so it gets its own etag
+	data := asset.Data
+	etag := asset.Etag
+	accept := r.Header.Get("Accept-Encoding")
+	if asset.Brotli != nil && acceptsEncoding(accept, "br") {
+		h.Set("Content-Encoding", "br")
+		data = asset.Brotli
+		etag = strings.TrimSuffix(etag, `"`) + `-br"`
+	} else if asset.Gzip != nil && acceptsEncoding(accept, "gzip") {
+		h.Set("Content-Encoding", "gzip")
+		data = asset.Gzip
+		etag = strings.TrimSuffix(etag, `"`) + `-gz"`
+	}
+	h.Set("Etag", etag)
+
+	http.ServeContent(w, r, asset.Name, asset.ModTime, bytes.NewReader(data))
+}
+
+func acceptsEncoding(header string, encoding string) bool {
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(strings.TrimSpace(part), ";")
+		if strings.TrimSpace(fields[0]) != encoding {
+			continue
+		}
+		//q=0 explicitly refuses the encoding
+		for _, param := range fields[1:] {
+			param = strings.Replace(param, " ", "", -1)
+			if param == "q=0" || param == "q=0.0" || param == "q=0.00" || param == "q=0.000" {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	audit "github.com/skyguy126/website/src/audit"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var auditLog *audit.Log
+
+//Records a security or account event for a steam64 id
+func recordAudit(sid string, ip string, event audit.Event, detail string) error {
+	_, err := auditLog.Append(sid, ip, event, detail)
+	return err
+}
+
+func startAuditLog() error {
+	auditLog = audit.New(db)
+	sealed, err := auditLog.Seal()
+	if sealed > 0 {
+		log.WithField("entries", sealed).Info("Sealed audit log entries from before hashing")
+	}
+	return err
+}
+
+func runVerifyAudit() bool {
+	database, databaseErr := openDatabase(config.DatabaseDriver, config.DatabaseDsn)
+	if databaseErr != nil {
+		log.WithError(databaseErr).Error("Error opening database")
+		return false
+	}
+	defer database.Close()
+
+	checked, brokenId, err := audit.New(database).Verify()
+	if err == audit.ErrBrokenChain {
+		fmt.Printf("Audit log chain breaks at entry %d after %d good entries\n", brokenId, checked)
+		return false
+	}
+	if err != nil {
+		log.WithError(err).Error("Error verifying audit log")
+		return false
+	}
+	fmt.Printf("Audit log chain intact, %d entries\n", checked)
+	return true
+}
+
+//Dates are YYYY-MM-DD in UTC or unix times
+func parseAuditTime(raw string) (time.Time, error) {
+	if raw == "" {
+		return time.Time{}, nil
+	}
+	if unix, err := strconv.ParseInt(raw, 10, 64); err == nil {
+		return time.Unix(unix, 0), nil
+	}
+	return time.Parse("2006-01-02", raw)
+}
+
+func parseAuditQuery(r *http.Request) (audit.Query, error) {
+	params := r.URL.Query()
+	q := audit.Query{Sid: params.Get("sid"), Event: audit.Event(params.Get("event"))}
+	var err error
+	if q.From, err = parseAuditTime(params.Get("from")); err != nil {
+		return q, err
+	}
+	if q.To, err = parseAuditTime(params.Get("to")); err != nil {
+		return q, err
+	}
+	if raw := params.Get("after"); raw != "" {
+		if q.AfterId, err = strconv.ParseInt(raw, 10, 64); err != nil {
+			return q, err
+		}
+	}
+	q.Limit = 100
+	if raw := params.Get("limit"); raw != "" {
+		if q.Limit, err = strconv.Atoi(raw); err != nil || q.Limit <= 0 || q.Limit > 1000 {
+			return q, fmt.Errorf("limit must be between 1 and 1000")
+		}
+	}
+	return q, nil
+}
+
+//GET ?sid=&event=&from=&to=&after=&limit= returns matching entries oldest first,
+//page with after set to the last id
+func AuditHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+
+	q, queryErr := parseAuditQuery(r)
+	if queryErr != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"error":"invalid query"}`)
+		return
+	}
+	entries, err := auditLog.Query(q)
+	if err != nil {
+		requestLog(r).WithError(err).Error("Error querying audit log")
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, `{"error":"internal"}`)
+		return
+	}
+	data, _ := json.Marshal(map[string]interface{}{"entries": entries})
+	w.Write(data)
+}
+
+//Same filters as AuditHandler without paging, streams every match as JSON lines
+func AuditExportHandler(w http.ResponseWriter, r *http.Request) {
+	q, queryErr := parseAuditQuery(r)
+	if queryErr != nil {
+		w.Header().Set("Content-type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"error":"invalid query"}`)
+		return
+	}
+	actor := actorSid(r)
+	if err := recordAudit(actor, remoteIp(r.RemoteAddr), audit.EVENT_ADMIN_ACTION, "audit export "+r.URL.RawQuery); err != nil {
+		requestLog(r).WithError(err).Error("Error writing audit export entry")
+	}
+
+	w.Header().Set("Content-type", "application/x-ndjson")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Disposition", `attachment; filename="audit-`+time.Now().UTC().Format("20060102-150405")+`.jsonl"`)
+	written, err := auditLog.Export(w, q)
+	if err != nil {
+		//Headers are gone by now, the truncated file is all the client gets
+		requestLog(r).WithError(err).WithField("entries", written).Error("Audit export failed")
+		return
+	}
+	requestLog(r).WithField("entries", written).Info("Exported audit log")
+}
@@ -0,0 +1,264 @@
+//Package audit is an append-only log of security and account events. Every
+//entry stores the hash of the one before it, so editing or removing an entry
+//breaks the chain from that point on and shows up in Verify. The table is
+//created by the site's migrations, which also add triggers refusing updates
+//and deletes
+package audit
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type Event string
+
+const (
+	EVENT_LOGIN  Event = "login"
+	EVENT_LOGOUT Event = "logout"
+	//Login refused because of a ban, self-exclusion or region block
+	EVENT_LOGIN_REFUSED Event = "login_refused"
+	//A single use socket token was presented twice
+	EVENT_TOKEN_REUSE Event = "token_reuse"
+	//A session or socket token was used from another ip than it was issued to
+	EVENT_IP_MISMATCH Event = "ip_mismatch"
+	EVENT_KICK        Event = "kick"
+	EVENT_BAN         Event = "ban"
+	EVENT_UNBAN       Event = "unban"
+	EVENT_ROLE        Event = "role"
+	EVENT_BALANCE     Event = "balance_adjustment"
+	EVENT_DEPOSIT     Event = "deposit"
+	EVENT_WITHDRAWAL  Event = "withdrawal"
+	//Recorded under the staff member, the user it affected gets its own entry
+	EVENT_ADMIN_ACTION Event = "admin_action"
+	EVENT_TRADE_URL    Event = "trade_url"
+	EVENT_CLIENT_SEED  Event = "client_seed"
+	EVENT_PRICE        Event = "price_override"
+	EVENT_LIMIT        Event = "limit"
+	EVENT_EXCLUSION    Event = "self_exclusion"
+	EVENT_TOS          Event = "tos"
+	EVENT_GAME_REFUND  Event = "game_refund"
+)
+
+var ErrBrokenChain = errors.New("audit: hash chain is broken")
+
+type Entry struct {
+	Id       int64     `json:"id"`
+	Time     time.Time `json:"time"`
+	Sid      string    `json:"sid"`
+	Ip       string    `json:"ip"`
+	Event    Event     `json:"event"`
+	Detail   string    `json:"detail"`
+	PrevHash string    `json:"prev_hash"`
+	Hash     string    `json:"hash"`
+}
+
+//Hex sha256 over the previous hash and every field of the entry except its
+//id. Fields are length prefixed so moving text between them changes the hash
+func (e *Entry) computeHash(prev string) string {
+	h := sha256.New()
+	for _, field := range []string{prev, strconv.FormatInt(e.Time.Unix(), 10), e.Sid, e.Ip, string(e.Event), e.Detail} {
+		fmt.Fprintf(h, "%d:%s", len(field), field)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+type Log struct {
+	db *sql.DB
+	//Appends read the last hash and insert after it, one at a time
+	lock sync.Mutex
+	now  func() time.Time
+}
+
+func New(db *sql.DB) *Log {
+	return &Log{db: db, now: time.Now}
+}
+
+func lastHash(tx *sql.Tx) (string, error) {
+	var hash string
+	err := tx.QueryRow(`SELECT hash FROM audit_log ORDER BY id DESC LIMIT 1`).Scan(&hash)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return hash, err
+}
+
+func (l *Log) Append(sid string, ip string, event Event, detail string) (*Entry, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	tx, txErr := l.db.Begin()
+	if txErr != nil {
+		return nil, txErr
+	}
+	defer tx.Rollback()
+
+	prev, hashErr := lastHash(tx)
+	if hashErr != nil {
+		return nil, hashErr
+	}
+	e := &Entry{Time: l.now(), Sid: sid, Ip: ip, Event: event, Detail: detail, PrevHash: prev}
+	e.Hash = e.computeHash(prev)
+	res, insertErr := tx.Exec(`INSERT INTO audit_log (time, sid, ip, event, detail, prev_hash, hash) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		e.Time.Unix(), e.Sid, e.Ip, string(e.Event), e.Detail, e.PrevHash, e.Hash)
+	if insertErr != nil {
+		return nil, insertErr
+	}
+	e.Id, _ = res.LastInsertId()
+	return e, tx.Commit()
+}
+
+//Chains entries written before the log was hashed, oldest first. Must run
+//before the first Append and returns the number of entries sealed
+func (l *Log) Seal() (int, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	tx, txErr := l.db.Begin()
+	if txErr != nil {
+		return 0, txErr
+	}
+	defer tx.Rollback()
+
+	entries, queryErr := queryTx(tx, `WHERE hash = '' ORDER BY id`)
+	if queryErr != nil || len(entries) == 0 {
+		return 0, queryErr
+	}
+	var prev string
+	err := tx.QueryRow(`SELECT hash FROM audit_log WHERE id < ? ORDER BY id DESC LIMIT 1`, entries[0].Id).Scan(&prev)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, err
+	}
+	for _, e := range entries {
+		e.PrevHash = prev
+		e.Hash = e.computeHash(prev)
+		if _, err := tx.Exec(`UPDATE audit_log SET prev_hash = ?, hash = ? WHERE id = ?`, e.PrevHash, e.Hash, e.Id); err != nil {
+			return 0, err
+		}
+		prev = e.Hash
+	}
+	return len(entries), tx.Commit()
+}
+
+type querier interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+func queryTx(q querier, where string, args ...interface{}) ([]*Entry, error) {
+	rows, queryErr := q.Query(`SELECT id, time, sid, ip, event, detail, prev_hash, hash FROM audit_log `+where, args...)
+	if queryErr != nil {
+		return nil, queryErr
+	}
+	defer rows.Close()
+	entries := make([]*Entry, 0)
+	for rows.Next() {
+		e := &Entry{}
+		var t int64
+		var event string
+		if err := rows.Scan(&e.Id, &t, &e.Sid, &e.Ip, &event, &e.Detail, &e.PrevHash, &e.Hash); err != nil {
+			return nil, err
+		}
+		e.Time = time.Unix(t, 0)
+		e.Event = Event(event)
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+//Filters for Query and Export, zero values match everything
+type Query struct {
+	Sid   string
+	Event Event
+	//Inclusive start and exclusive end
+	From time.Time
+	To   time.Time
+	//Only entries with a higher id, for paging
+	AfterId int64
+	Limit   int
+}
+
+//Matching entries oldest first
+func (l *Log) Query(q Query) ([]*Entry, error) {
+	where := `WHERE id > ?`
+	args := []interface{}{q.AfterId}
+	if q.Sid != "" {
+		where += ` AND sid = ?`
+		args = append(args, q.Sid)
+	}
+	if q.Event != "" {
+		where += ` AND event = ?`
+		args = append(args, string(q.Event))
+	}
+	if !q.From.IsZero() {
+		where += ` AND time >= ?`
+		args = append(args, q.From.Unix())
+	}
+	if !q.To.IsZero() {
+		where += ` AND time < ?`
+		args = append(args, q.To.Unix())
+	}
+	where += ` ORDER BY id`
+	if q.Limit > 0 {
+		where += ` LIMIT ?`
+		args = append(args, q.Limit)
+	}
+	return queryTx(l.db, where, args...)
+}
+
+const exportPage = 1000
+
+//Writes the matching entries as JSON lines, hashes included so the chain can
+//be checked outside the site. q.Limit is ignored
+func (l *Log) Export(w io.Writer, q Query) (int, error) {
+	encoder := json.NewEncoder(w)
+	q.Limit = exportPage
+	written := 0
+	for {
+		entries, err := l.Query(q)
+		if err != nil {
+			return written, err
+		}
+		for _, e := range entries {
+			if err := encoder.Encode(e); err != nil {
+				return written, err
+			}
+			written++
+		}
+		if len(entries) < exportPage {
+			return written, nil
+		}
+		q.AfterId = entries[len(entries)-1].Id
+	}
+}
+
+//Walks the whole chain. On ErrBrokenChain the id of the first entry that does
+//not match is returned
+func (l *Log) Verify() (int, int64, error) {
+	var prev string
+	checked := 0
+	q := Query{Limit: exportPage}
+	for {
+		entries, err := l.Query(q)
+		if err != nil {
+			return checked, 0, err
+		}
+		for _, e := range entries {
+			if e.PrevHash != prev || e.Hash != e.computeHash(prev) {
+				return checked, e.Id, ErrBrokenChain
+			}
+			prev = e.Hash
+			checked++
+		}
+		if len(entries) < exportPage {
+			return checked, 0, nil
+		}
+		q.AfterId = entries[len(entries)-1].Id
+	}
+}
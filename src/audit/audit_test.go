@@ -0,0 +1,234 @@
+package audit
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	_ "github.com/mattn/go-sqlite3"
+	"strconv"
+	"testing"
+	"time"
+)
+
+//audit_log as the site's migrations leave it, hash columns and triggers included
+var testSchema = []string{
+	`CREATE TABLE audit_log (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		time INTEGER NOT NULL,
+		sid TEXT NOT NULL,
+		ip TEXT NOT NULL,
+		event TEXT NOT NULL,
+		detail TEXT NOT NULL,
+		prev_hash TEXT NOT NULL DEFAULT '',
+		hash TEXT NOT NULL DEFAULT ''
+	)`,
+	`CREATE TRIGGER audit_log_no_update BEFORE UPDATE ON audit_log WHEN OLD.hash != ''
+	BEGIN
+		SELECT RAISE(ABORT, 'audit_log is append-only');
+	END`,
+	`CREATE TRIGGER audit_log_no_delete BEFORE DELETE ON audit_log
+	BEGIN
+		SELECT RAISE(ABORT, 'audit_log is append-only');
+	END`,
+}
+
+const testUser = "76561198000000001"
+const testOther = "76561198000000002"
+
+func newTestLog(t *testing.T) (*Log, *sql.DB) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	//Every connection to :memory: is its own database
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+	for _, statement := range testSchema {
+		if _, err := db.Exec(statement); err != nil {
+			t.Fatal(err)
+		}
+	}
+	l := New(db)
+	//One second per entry so times are distinct and predictable
+	clock := time.Unix(1600000000, 0)
+	l.now = func() time.Time {
+		clock = clock.Add(time.Second)
+		return clock
+	}
+	return l, db
+}
+
+func (l *Log) mustAppend(t *testing.T, sid string, detail string) *Entry {
+	t.Helper()
+	e, err := l.Append(sid, "127.0.0.1", EVENT_LOGIN, detail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func (l *Log) mustVerify(t *testing.T, expected int) {
+	t.Helper()
+	checked, badId, err := l.Verify()
+	if err != nil {
+		t.Fatalf("expected a clean chain, got %v at id %d", err, badId)
+	}
+	if checked != expected {
+		t.Fatalf("expected %d entries checked, got %d", expected, checked)
+	}
+}
+
+//Entries written before the hash columns existed are chained oldest first,
+//and entries appended after them continue the chain
+func TestSealChainsOldEntries(t *testing.T) {
+	l, db := newTestLog(t)
+	for n := 0; n < 3; n++ {
+		_, err := db.Exec(`INSERT INTO audit_log (time, sid, ip, event, detail) VALUES (?, ?, '', ?, ?)`,
+			1500000000+n, testUser, string(EVENT_LOGIN), "old "+strconv.Itoa(n))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, _, err := l.Verify(); err != ErrBrokenChain {
+		t.Fatalf("unsealed entries should not verify, got %v", err)
+	}
+
+	sealed, err := l.Seal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sealed != 3 {
+		t.Fatalf("expected 3 entries sealed, got %d", sealed)
+	}
+	appended := l.mustAppend(t, testUser, "new")
+	l.mustVerify(t, 4)
+
+	entries, err := l.Query(Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entries[0].PrevHash != "" {
+		t.Fatalf("first entry should start the chain, has prev hash %q", entries[0].PrevHash)
+	}
+	for n := 1; n < len(entries); n++ {
+		if entries[n].PrevHash != entries[n-1].Hash {
+			t.Fatalf("entry %d is not chained to entry %d", entries[n].Id, entries[n-1].Id)
+		}
+	}
+	if appended.PrevHash != entries[2].Hash {
+		t.Fatal("appended entry is not chained to the last sealed entry")
+	}
+
+	//Sealed entries are covered by the trigger, sealing again changes nothing
+	if sealed, err := l.Seal(); err != nil || sealed != 0 {
+		t.Fatalf("second seal: sealed %d, err %v", sealed, err)
+	}
+	l.mustVerify(t, 4)
+}
+
+func TestTriggersRefuseEdits(t *testing.T) {
+	l, db := newTestLog(t)
+	e := l.mustAppend(t, testUser, "login")
+	if _, err := db.Exec(`UPDATE audit_log SET detail = 'edited' WHERE id = ?`, e.Id); err == nil {
+		t.Fatal("update of a hashed entry was allowed")
+	}
+	if _, err := db.Exec(`DELETE FROM audit_log WHERE id = ?`, e.Id); err == nil {
+		t.Fatal("delete was allowed")
+	}
+	l.mustVerify(t, 1)
+}
+
+//With the triggers dropped an edit goes through, Verify still points at it
+func TestVerifyFindsEditedEntry(t *testing.T) {
+	l, db := newTestLog(t)
+	entries := make([]*Entry, 0)
+	for n := 0; n < 5; n++ {
+		entries = append(entries, l.mustAppend(t, testUser, "login "+strconv.Itoa(n)))
+	}
+	l.mustVerify(t, 5)
+	if _, err := db.Exec(`DROP TRIGGER audit_log_no_update`); err != nil {
+		t.Fatal(err)
+	}
+
+	edited := entries[2]
+	if _, err := db.Exec(`UPDATE audit_log SET detail = 'edited' WHERE id = ?`, edited.Id); err != nil {
+		t.Fatal(err)
+	}
+	checked, badId, err := l.Verify()
+	if err != ErrBrokenChain || badId != edited.Id || checked != 2 {
+		t.Fatalf("expected ErrBrokenChain at id %d after 2 entries, got %v at id %d after %d", edited.Id, err, badId, checked)
+	}
+
+	//Rehashing the edited entry moves the break to the next one
+	rehashed := *edited
+	rehashed.Detail = "edited"
+	if _, err := db.Exec(`UPDATE audit_log SET hash = ? WHERE id = ?`, rehashed.computeHash(edited.PrevHash), edited.Id); err != nil {
+		t.Fatal(err)
+	}
+	checked, badId, err = l.Verify()
+	if err != ErrBrokenChain || badId != entries[3].Id || checked != 3 {
+		t.Fatalf("expected ErrBrokenChain at id %d after 3 entries, got %v at id %d after %d", entries[3].Id, err, badId, checked)
+	}
+}
+
+//Deleted entries leave the next one pointing at a hash that is gone
+func TestVerifyFindsDeletedEntry(t *testing.T) {
+	l, db := newTestLog(t)
+	entries := make([]*Entry, 0)
+	for n := 0; n < 3; n++ {
+		entries = append(entries, l.mustAppend(t, testUser, "login "+strconv.Itoa(n)))
+	}
+	if _, err := db.Exec(`DROP TRIGGER audit_log_no_delete`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`DELETE FROM audit_log WHERE id = ?`, entries[1].Id); err != nil {
+		t.Fatal(err)
+	}
+	if _, badId, err := l.Verify(); err != ErrBrokenChain || badId != entries[2].Id {
+		t.Fatalf("expected ErrBrokenChain at id %d, got %v at id %d", entries[2].Id, err, badId)
+	}
+}
+
+//Export pages through everything matching, past the page size
+func TestExport(t *testing.T) {
+	l, _ := newTestLog(t)
+	for n := 0; n < exportPage+5; n++ {
+		l.mustAppend(t, testUser, "login "+strconv.Itoa(n))
+		if n%100 == 0 {
+			l.mustAppend(t, testOther, "login "+strconv.Itoa(n))
+		}
+	}
+
+	var buf bytes.Buffer
+	written, err := l.Export(&buf, Query{Sid: testUser, Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if written != exportPage+5 {
+		t.Fatalf("expected %d entries written, got %d", exportPage+5, written)
+	}
+
+	decoder := json.NewDecoder(&buf)
+	var last int64
+	lines := 0
+	for decoder.More() {
+		e := &Entry{}
+		if err := decoder.Decode(e); err != nil {
+			t.Fatal(err)
+		}
+		if e.Sid != testUser {
+			t.Fatalf("entry %d of %s does not match the query", e.Id, e.Sid)
+		}
+		if e.Id <= last {
+			t.Fatalf("entry %d written after entry %d", e.Id, last)
+		}
+		if e.Hash != e.computeHash(e.PrevHash) {
+			t.Fatalf("entry %d does not match its exported hash", e.Id)
+		}
+		last = e.Id
+		lines++
+	}
+	if lines != written {
+		t.Fatalf("wrote %d entries but %d lines", written, lines)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	ledger "github.com/skyguy126/website/src/ledger"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//Seconds between ledger balance snapshots
+const LEDGER_SNAPSHOT_INTERVAL = 86400
+
+var books *ledger.Ledger
+
+type userLock struct {
+	sync.Mutex
+	refs int
+}
+
+//Per user locks for anything that checks a balance or limit and then acts on
+//it, socket messages run concurrently so the check would race otherwise
+type userLocker struct {
+	lock  sync.Mutex
+	users map[string]*userLock
+}
+
+var userLocks = &userLocker{users: make(map[string]*userLock)}
+
+//Blocks until steam64id is free, call the returned func to release it
+func (l *userLocker) Lock(steam64id string) func() {
+	l.lock.Lock()
+	user, ok := l.users[steam64id]
+	if !ok {
+		user = &userLock{}
+		l.users[steam64id] = user
+	}
+	user.refs++
+	l.lock.Unlock()
+
+	user.Lock()
+	return func() {
+		user.Unlock()
+		l.lock.Lock()
+		user.refs--
+		if user.refs == 0 {
+			delete(l.users, steam64id)
+		}
+		l.lock.Unlock()
+	}
+}
+
+//Credits the value of an accepted deposit, inside the deposit's transaction
+func creditDeposit(tx *sql.Tx, steam64id string, offerId string) error {
+	var total int64
+	if err := tx.QueryRow(`SELECT COALESCE(SUM(price), 0) FROM deposit_items WHERE offer_id = ?`, offerId).Scan(&total); err != nil {
+		return err
+	}
+	if total == 0 {
+		return nil
+	}
+	_, err := books.PostTx(tx, &ledger.Entry{
+		Key:  "deposit:" + offerId,
+		Kind: "deposit",
+		Ref:  offerId,
+		Postings: []ledger.Posting{
+			{Account: ledger.UserAccount(steam64id), Amount: total},
+			{Account: ledger.ACCOUNT_DEPOSITS, Amount: -total},
+		},
+	})
+	return err
+}
+
+func userBalance(steam64id string) (int64, error) {
+	return books.Balance(ledger.UserAccount(steam64id))
+}
+
+//Pushes the current balance to every socket of steam64id
+func sendBalance(steam64id string) {
+	balance, err := userBalance(steam64id)
+	if err != nil {
+		log.WithError(err).WithField("sid", steam64id).Error("Error getting balance")
+		return
+	}
+	sendToSid(steam64id, map[string]string{"code": "12", "balance": strconv.FormatInt(balance, 10)})
+}
+
+func ledgerSnapshotLoop() {
+	for {
+		time.Sleep(time.Second * LEDGER_SNAPSHOT_INTERVAL)
+		if err := books.Snapshot(); err != nil {
+			log.WithError(err).Error("Error taking ledger snapshot")
+		}
+	}
+}
+
+//Run with -reconcile, prints the report and exits non-zero if the books do not balance
+func runReconcile() bool {
+	database, databaseErr := openDatabase(config.DatabaseDriver, config.DatabaseDsn)
+	if databaseErr != nil {
+		log.WithError(databaseErr).Error("Error opening database")
+		return false
+	}
+	defer database.Close()
+
+	report, reconcileErr := ledger.New(database).Reconcile()
+	if reconcileErr != nil {
+		log.WithError(reconcileErr).Error("Error reconciling ledger")
+		return false
+	}
+	fmt.Printf("%d accounts, %d entries, total %d\n", report.Accounts, report.Entries, report.Total)
+	for _, problem := range report.Problems {
+		fmt.Println(problem)
+	}
+	if !report.OK() {
+		fmt.Println("Ledger does not balance")
+		return false
+	}
+	fmt.Println("Ledger balances")
+	return true
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	steamguard "github.com/skyguy126/website/src/steamguard"
+	tradebot "github.com/skyguy126/website/src/tradebot"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type BotConfig struct {
+	Enabled bool `json:"enabled"`
+	//"steam" or "fake"
+	Backend string `json:"backend"`
+	//steam64 id of the bot account
+	SteamId string `json:"steam_id"`
+	//Offers from these steam64 ids are accepted, everything else unsolicited is declined
+	Admins       []string `json:"admins"`
+	PollInterval int      `json:"poll_interval"`
+}
+
+func defaultBotConfig() BotConfig {
+	return BotConfig{
+		Enabled:      false,
+		Backend:      "steam",
+		Admins:       []string{},
+		PollInterval: 10,
+	}
+}
+
+var errBotSession = errors.New("secure/bot_session.txt needs sessionid and steamLoginSecure lines")
+var errBotGuard = errors.New("secure/bot_guard.txt needs shared_secret and identity_secret lines")
+
+var tradeBot tradebot.TradeOfferService
+var tradeBotQuit chan bool
+
+//Poll data lives in the database instead of polldata.json
+type dbPollStore struct {
+	db *sql.DB
+}
+
+func (s *dbPollStore) LoadPollData() (*tradebot.PollData, error) {
+	var raw string
+	err := s.db.QueryRow(`SELECT data FROM tradebot_poll WHERE id = 0`).Scan(&raw)
+	if err == sql.ErrNoRows {
+		return &tradebot.PollData{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	data := &tradebot.PollData{}
+	if err := json.Unmarshal([]byte(raw), data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (s *dbPollStore) SavePollData(data *tradebot.PollData) error {
+	raw, jsonErr := json.Marshal(data)
+	if jsonErr != nil {
+		return jsonErr
+	}
+	_, err := s.db.Exec(`INSERT INTO tradebot_poll (id, data) VALUES (0, ?)
+		ON CONFLICT(id) DO UPDATE SET data = excluded.data`, string(raw))
+	return err
+}
+
+//sessionid on the first line, steamLoginSecure on the second
+func readBotSession() (tradebot.WebSession, error) {
+	sessionFile, sessionErr := ioutil.ReadFile("secure/bot_session.txt")
+	if sessionErr != nil {
+		return tradebot.WebSession{}, sessionErr
+	}
+	lines := strings.Split(strings.TrimSpace(string(sessionFile)), "\n")
+	if len(lines) < 2 {
+		return tradebot.WebSession{}, errBotSession
+	}
+	return tradebot.WebSession{
+		SessionId:        strings.TrimSpace(lines[0]),
+		SteamLoginSecure: strings.TrimSpace(lines[1]),
+	}, nil
+}
+
+//Mobile authenticator secrets from the maFile, shared_secret on the first
+//line and identity_secret on the second
+func readBotGuard() (string, string, error) {
+	guardFile, guardErr := ioutil.ReadFile("secure/bot_guard.txt")
+	if guardErr != nil {
+		return "", "", guardErr
+	}
+	lines := strings.Split(strings.TrimSpace(string(guardFile)), "\n")
+	if len(lines) < 2 {
+		return "", "", errBotGuard
+	}
+	return strings.TrimSpace(lines[0]), strings.TrimSpace(lines[1]), nil
+}
+
+func openTradeBot(conf BotConfig) (tradebot.TradeOfferService, error) {
+	if conf.Backend == "fake" {
+		log.Warn("Trade bot is using the fake steam backend")
+		return tradebot.NewFakeSteam(conf.SteamId), nil
+	}
+
+	apiKey, apiKeyErr := ioutil.ReadFile("secure/bot_apikey.txt")
+	if apiKeyErr != nil {
+		return nil, apiKeyErr
+	}
+	session, sessionErr := readBotSession()
+	if sessionErr != nil {
+		return nil, sessionErr
+	}
+	service := tradebot.NewSteamService(strings.TrimSpace(string(apiKey)), session)
+	service.Client.Transport = newSteamTransport()
+	return service, nil
+}
+
+//Whether offerId belongs to a deposit or withdrawal that is still waiting on
+//Steam, only those get confirmed
+func pendingOffer(offerId string) (bool, error) {
+	var pending int
+	err := db.QueryRow(`SELECT
+		(SELECT COUNT(*) FROM deposits WHERE offer_id = ? AND state IN (?, ?)) +
+		(SELECT COUNT(*) FROM withdrawals WHERE offer_id = ? AND state IN (?, ?))`,
+		offerId, DEPOSIT_SENT, DEPOSIT_ESCROW, offerId, WITHDRAW_SENT, WITHDRAW_ESCROW).Scan(&pending)
+	return pending > 0, err
+}
+
+//Offers the bot sends need a mobile confirmation before the partner sees them
+func startConfirmationChecker(conf BotConfig) error {
+	session, sessionErr := readBotSession()
+	if sessionErr != nil {
+		return sessionErr
+	}
+	_, identitySecret, guardErr := readBotGuard()
+	if guardErr != nil {
+		return guardErr
+	}
+
+	confirmations := steamguard.NewConfirmations(conf.SteamId, identitySecret, session.SessionId, session.SteamLoginSecure)
+	confirmations.Client.Transport = newSteamTransport()
+	offset, offsetErr := steamguard.QueryTimeOffset(confirmations.Client)
+	if offsetErr != nil {
+		log.WithError(offsetErr).Warn("Unable to get steam time offset")
+	}
+	confirmations.TimeOffset = offset
+
+	checker := steamguard.NewChecker(confirmations)
+	warned := make(map[string]bool)
+	checker.Decide = func(c *steamguard.Confirmation) (bool, bool) {
+		if c.Type != steamguard.ConfirmationTrade {
+			return false, false
+		}
+		pending, err := pendingOffer(c.Creator)
+		if err != nil {
+			log.WithError(err).WithField("offer_id", c.Creator).Error("Error looking up offer for confirmation")
+			return false, false
+		}
+		if !pending {
+			if !warned[c.Id] {
+				warned[c.Id] = true
+				log.WithFields(log.Fields{"confirmation_id": c.Id, "offer_id": c.Creator}).Warn("Confirmation is not for a pending deposit or withdrawal, leaving it unanswered")
+			}
+			return false, false
+		}
+		return true, true
+	}
+	checker.OnConfirmed = func(c *steamguard.Confirmation, accepted bool) {
+		log.WithFields(log.Fields{"confirmation_id": c.Id, "offer_id": c.Creator, "accepted": accepted}).Info("Answered confirmation")
+	}
+	checker.OnError = func(err error) {
+		log.WithError(err).Error("Error checking confirmations")
+	}
+	go checker.Run(tradeBotQuit)
+	return nil
+}
+
+//Prints the current login code for the bot account, used with -guard-code
+//when refreshing secure/bot_session.txt
+func printGuardCode() error {
+	sharedSecret, _, guardErr := readBotGuard()
+	if guardErr != nil {
+		return guardErr
+	}
+	offset, offsetErr := steamguard.QueryTimeOffset(&http.Client{Timeout: time.Second * 10})
+	if offsetErr != nil {
+		log.WithError(offsetErr).Warn("Unable to get steam time offset, using local clock")
+	}
+	code, codeErr := steamguard.GenerateAuthCode(sharedSecret, time.Now().Add(time.Second*time.Duration(offset)))
+	if codeErr != nil {
+		return codeErr
+	}
+	fmt.Println(code)
+	return nil
+}
+
+func startTradeBot(conf BotConfig) error {
+	service, openErr := openTradeBot(conf)
+	if openErr != nil {
+		return openErr
+	}
+	tradeBot = service
+	tradeBotQuit = make(chan bool)
+
+	poller := &tradebot.Poller{
+		Service:  service,
+		Store:    &dbPollStore{db: db},
+		Interval: time.Second * time.Duration(conf.PollInterval),
+		OnEvent:  handleOfferEvent,
+		OnError: func(err error) {
+			log.WithError(err).Error("Error polling trade offers")
+		},
+	}
+	go poller.Run(tradeBotQuit)
+	go depositSweepLoop(tradeBotQuit)
+	go withdrawalLoop(tradeBotQuit)
+
+	if conf.Backend == "steam" {
+		if err := startConfirmationChecker(conf); err != nil {
+			log.WithError(err).Error("Offers will need manual confirmation, unable to start confirmation checker")
+		}
+	}
+	return nil
+}
+
+func isBotAdmin(steam64id string) bool {
+	for _, admin := range config.Bot.Admins {
+		if admin == steam64id {
+			return true
+		}
+	}
+	return false
+}
+
+func handleOfferEvent(event *tradebot.OfferEvent) {
+	offer := event.Offer
+	if !offer.IsOurs && event.IsNew() && offer.State == tradebot.StateActive {
+		handleIncomingOffer(offer)
+		return
+	}
+	if offer.IsOurs {
+		if !event.IsNew() {
+			log.WithFields(log.Fields{"offer_id": offer.Id, "old_state": event.OldState, "state": offer.State}).Info("Sent offer changed state")
+		}
+		handleDepositEvent(offer)
+		handleWithdrawalEvent(offer)
+	}
+}
+
+//Unsolicited offers are only accepted from admins restocking the bot
+func handleIncomingOffer(offer *tradebot.Offer) {
+	log.WithFields(log.Fields{"offer_id": offer.Id, "partner": offer.Partner}).Info("New offer")
+	if isBotAdmin(offer.Partner) {
+		if err := tradeBot.AcceptOffer(offer.Id); err != nil {
+			log.WithError(err).WithField("offer_id", offer.Id).Error("Unable to accept offer")
+			return
+		}
+		log.WithFields(log.Fields{"offer_id": offer.Id, "partner": offer.Partner}).Info("Accepted offer from admin")
+		return
+	}
+	if err := tradeBot.DeclineOffer(offer.Id); err != nil {
+		log.WithError(err).WithField("offer_id", offer.Id).Error("Unable to decline offer")
+		return
+	}
+	log.WithField("offer_id", offer.Id).Info("Declined offer")
+}
@@ -1,16 +0,0 @@
-
-
-
-
-var config = {
- username: "",
- password: "",
- sharedsecret : "",
- identitySecret : "",
- itemList : [""],
- statuskek : '',
- tradeID : '',
- admin: ''
-};
-
-module.exports = config;
@@ -0,0 +1,546 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	log "github.com/Sirupsen/logrus"
+	audit "github.com/skyguy126/website/src/audit"
+	ledger "github.com/skyguy126/website/src/ledger"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type CoinflipConfig struct {
+	Enabled bool `json:"enabled"`
+	//Percent of the pot kept by the house
+	Fee int `json:"fee"`
+	//Percent the joiner's stake may differ from the creator's, the coin is
+	//weighted by stake so neither side gains from the difference
+	Tolerance int `json:"tolerance"`
+	//Cents
+	MinBet int64 `json:"min_bet"`
+	MaxBet int64 `json:"max_bet"`
+	//Seconds an unjoined lobby stays open before it is refunded
+	Expiry int `json:"expiry"`
+	//Open lobbies per user
+	MaxOpen int `json:"max_open"`
+}
+
+func defaultCoinflipConfig() CoinflipConfig {
+	return CoinflipConfig{
+		Enabled:   true,
+		Fee:       5,
+		Tolerance: 10,
+		MinBet:    10,
+		MaxBet:    100000,
+		Expiry:    1800,
+		MaxOpen:   3,
+	}
+}
+
+//Lobby states. Joined lobbies are only seen between the join and the payout,
+//or after a restart in between
+const (
+	COINFLIP_OPEN     = "open"
+	COINFLIP_JOINED   = "joined"
+	COINFLIP_FINISHED = "finished"
+	COINFLIP_CANCELED = "canceled"
+	COINFLIP_EXPIRED  = "expired"
+)
+
+const COINFLIP_GAME = "coinflip"
+const COINFLIP_HEADS = "heads"
+const COINFLIP_TAILS = "tails"
+const COINFLIP_SWEEP_INTERVAL = 10
+const COINFLIP_LIST_SIZE = 50
+
+var errCoinflipUnavailable = errors.New("Coinflip is unavailable right now")
+var errCoinflipBet = errors.New("Bet amount is out of range")
+var errCoinflipSide = errors.New("Pick heads or tails")
+var errCoinflipTooMany = errors.New("You have too many open lobbies")
+var errCoinflipNotFound = errors.New("Lobby not found or no longer open")
+var errCoinflipSelf = errors.New("You cannot join your own lobby")
+var errCoinflipMismatch = errors.New("Your stake must be close to the lobby's value")
+var errCoinflipNotOwner = errors.New("Only the creator can cancel a lobby")
+var errCoinflipFunds = errors.New("Not enough balance")
+
+type CoinflipLobby struct {
+	Id           int64
+	State        string
+	Creator      string
+	CreatorIp    string
+	Side         string
+	Amount       int64
+	Joiner       string
+	JoinerIp     string
+	JoinerAmount int64
+	FairId       int64
+	Winner       string
+	Fee          int64
+	Created      time.Time
+}
+
+func (l *CoinflipLobby) ref() string {
+	return strconv.FormatInt(l.Id, 10)
+}
+
+func (l *CoinflipLobby) account() string {
+	return ledger.GameAccount(COINFLIP_GAME, l.ref())
+}
+
+//Lobby changes are serialized, the database is the only copy of the state
+var coinflipLock sync.Mutex
+
+var coinflipConf *CoinflipConfig
+
+const coinflipColumns = `id, state, creator, creator_ip, side, amount, joiner, joiner_ip, joiner_amount, fair_id, winner, fee, created`
+
+func scanCoinflipLobby(row interface {
+	Scan(dest ...interface{}) error
+}) (*CoinflipLobby, error) {
+	lobby := &CoinflipLobby{}
+	var created int64
+	err := row.Scan(&lobby.Id, &lobby.State, &lobby.Creator, &lobby.CreatorIp, &lobby.Side, &lobby.Amount,
+		&lobby.Joiner, &lobby.JoinerIp, &lobby.JoinerAmount, &lobby.FairId, &lobby.Winner, &lobby.Fee, &created)
+	if err != nil {
+		return nil, err
+	}
+	lobby.Created = time.Unix(created, 0)
+	return lobby, nil
+}
+
+func getCoinflipLobby(id int64) (*CoinflipLobby, error) {
+	lobby, err := scanCoinflipLobby(db.QueryRow(`SELECT `+coinflipColumns+` FROM coinflip_lobbies WHERE id = ?`, id))
+	if err == sql.ErrNoRows {
+		return nil, errCoinflipNotFound
+	}
+	return lobby, err
+}
+
+func queryCoinflipLobbies(query string, args ...interface{}) ([]*CoinflipLobby, error) {
+	rows, queryErr := db.Query(`SELECT `+coinflipColumns+` FROM coinflip_lobbies `+query, args...)
+	if queryErr != nil {
+		return nil, queryErr
+	}
+	defer rows.Close()
+	lobbies := make([]*CoinflipLobby, 0)
+	for rows.Next() {
+		lobby, err := scanCoinflipLobby(rows)
+		if err != nil {
+			return nil, err
+		}
+		lobbies = append(lobbies, lobby)
+	}
+	return lobbies, rows.Err()
+}
+
+//Finishes lobbies that were joined right before a restart and starts expiring old ones
+func startCoinflip(conf CoinflipConfig) error {
+	coinflipConf = &conf
+	joined, queryErr := queryCoinflipLobbies(`WHERE state = ?`, COINFLIP_JOINED)
+	if queryErr != nil {
+		return queryErr
+	}
+	for _, lobby := range joined {
+		log.WithField("lobby_id", lobby.Id).Info("Finishing interrupted coinflip")
+		if err := finishCoinflip(lobby); err != nil {
+			return err
+		}
+	}
+	go coinflipLoop()
+	return nil
+}
+
+//Opens a lobby with the creator's stake held on the lobby's game account
+func createCoinflip(steam64id string, ip string, amount int64, side string) (*CoinflipLobby, error) {
+	if coinflipConf == nil {
+		return nil, errCoinflipUnavailable
+	}
+	if side != COINFLIP_HEADS && side != COINFLIP_TAILS {
+		return nil, errCoinflipSide
+	}
+	if amount < coinflipConf.MinBet || amount > coinflipConf.MaxBet {
+		return nil, errCoinflipBet
+	}
+
+	coinflipLock.Lock()
+	defer coinflipLock.Unlock()
+
+	var open int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM coinflip_lobbies WHERE creator = ? AND state = ?`, steam64id, COINFLIP_OPEN).Scan(&open); err != nil {
+		return nil, err
+	}
+	if open >= coinflipConf.MaxOpen {
+		return nil, errCoinflipTooMany
+	}
+	unlock := userLocks.Lock(steam64id)
+	defer unlock()
+	if err := checkWager(steam64id, amount); err != nil {
+		return nil, err
+	}
+
+	tx, txErr := db.Begin()
+	if txErr != nil {
+		return nil, txErr
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	res, execErr := tx.Exec(`INSERT INTO coinflip_lobbies (state, creator, creator_ip, side, amount, created, updated) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		COINFLIP_OPEN, steam64id, ip, side, amount, now.Unix(), now.Unix())
+	if execErr != nil {
+		return nil, execErr
+	}
+	id, _ := res.LastInsertId()
+	lobby := &CoinflipLobby{Id: id, State: COINFLIP_OPEN, Creator: steam64id, CreatorIp: ip, Side: side, Amount: amount, Created: now}
+	if err := postCoinflipStake(tx, lobby, steam64id, amount, "creator"); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	//Without a commit the lobby is still playable, the seed is committed when someone joins
+	if err := commitCoinflip(lobby); err != nil {
+		log.WithError(err).WithField("lobby_id", lobby.Id).Error("Error committing fair seed for coinflip")
+	}
+	log.WithFields(log.Fields{"lobby_id": lobby.Id, "sid": steam64id, "amount": amount, "side": side}).Info("Coinflip opened")
+	sendToAll(coinflipMessage(lobby))
+	sendBalance(steam64id)
+	return lobby, nil
+}
+
+func postCoinflipStake(tx *sql.Tx, lobby *CoinflipLobby, steam64id string, amount int64, role string) error {
+	_, postErr := books.PostTx(tx, &ledger.Entry{
+		Key:  "coinflip-stake:" + lobby.ref() + ":" + role,
+		Kind: "coinflip_stake",
+		Ref:  lobby.ref(),
+		Postings: []ledger.Posting{
+			{Account: ledger.UserAccount(steam64id), Amount: -amount},
+			{Account: lobby.account(), Amount: amount},
+		},
+	})
+	if postErr == ledger.ErrInsufficientFunds {
+		return errCoinflipFunds
+	}
+	return postErr
+}
+
+func commitCoinflip(lobby *CoinflipLobby) error {
+	commit, commitErr := commitFairRound(COINFLIP_GAME, lobby.ref())
+	if commitErr != nil {
+		return commitErr
+	}
+	if _, err := db.Exec(`UPDATE coinflip_lobbies SET fair_id = ? WHERE id = ?`, commit.Id, lobby.Id); err != nil {
+		return err
+	}
+	lobby.FairId = commit.Id
+	return nil
+}
+
+//Matches the joiner's stake against the lobby and flips the coin straight away
+func joinCoinflip(steam64id string, ip string, id int64, amount int64) (*CoinflipLobby, error) {
+	if coinflipConf == nil {
+		return nil, errCoinflipUnavailable
+	}
+
+	coinflipLock.Lock()
+	defer coinflipLock.Unlock()
+
+	lobby, lobbyErr := getCoinflipLobby(id)
+	if lobbyErr != nil {
+		return nil, lobbyErr
+	}
+	if lobby.State != COINFLIP_OPEN {
+		return nil, errCoinflipNotFound
+	}
+	if lobby.Creator == steam64id || lobby.CreatorIp == ip {
+		log.WithFields(log.Fields{"lobby_id": id, "sid": steam64id, "ip": ip}).Warn("Coinflip self play attempt")
+		return nil, errCoinflipSelf
+	}
+	diff := amount - lobby.Amount
+	if diff < 0 {
+		diff = -diff
+	}
+	if diff*100 > lobby.Amount*int64(coinflipConf.Tolerance) || amount > coinflipConf.MaxBet {
+		return nil, errCoinflipMismatch
+	}
+	unlock := userLocks.Lock(steam64id)
+	defer unlock()
+	if err := checkWager(steam64id, amount); err != nil {
+		return nil, err
+	}
+	if lobby.FairId == 0 {
+		if err := commitCoinflip(lobby); err != nil {
+			return nil, err
+		}
+	}
+
+	tx, txErr := db.Begin()
+	if txErr != nil {
+		return nil, txErr
+	}
+	defer tx.Rollback()
+
+	_, execErr := tx.Exec(`UPDATE coinflip_lobbies SET state = ?, joiner = ?, joiner_ip = ?, joiner_amount = ?, updated = ? WHERE id = ?`,
+		COINFLIP_JOINED, steam64id, ip, amount, time.Now().Unix(), id)
+	if execErr != nil {
+		return nil, execErr
+	}
+	if err := postCoinflipStake(tx, lobby, steam64id, amount, "joiner"); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	lobby.State = COINFLIP_JOINED
+	lobby.Joiner = steam64id
+	lobby.JoinerIp = ip
+	lobby.JoinerAmount = amount
+
+	if err := finishCoinflip(lobby); err != nil {
+		//Stakes stay in escrow until the sweep finishes the flip
+		return nil, err
+	}
+	return lobby, nil
+}
+
+//Flips the coin for a joined lobby and pays the winner. Safe to run again
+//for the same lobby, the result and the payout are only recorded once
+func finishCoinflip(lobby *CoinflipLobby) error {
+	commit, commitErr := loadFairCommit(lobby.FairId)
+	if commitErr != nil {
+		return commitErr
+	}
+	seeds, seedsErr := clientSeeds([]string{lobby.Creator, lobby.Joiner})
+	if seedsErr != nil {
+		return seedsErr
+	}
+	fair, fairErr := resolveFairRound(commit, seeds, lobby.flip)
+	if fairErr != nil {
+		return fairErr
+	}
+
+	result := lobby.flip(fair.Roll)
+	winner := lobby.Joiner
+	if result == lobby.Side {
+		winner = lobby.Creator
+	}
+	pot := lobby.Amount + lobby.JoinerAmount
+	fee := pot * int64(coinflipConf.Fee) / 100
+
+	tx, txErr := db.Begin()
+	if txErr != nil {
+		return txErr
+	}
+	defer tx.Rollback()
+
+	postings := []ledger.Posting{
+		{Account: lobby.account(), Amount: -pot},
+		{Account: ledger.UserAccount(winner), Amount: pot - fee},
+	}
+	if fee > 0 {
+		postings = append(postings, ledger.Posting{Account: ledger.ACCOUNT_FEES, Amount: fee})
+	}
+	_, postErr := books.PostTx(tx, &ledger.Entry{
+		Key:      "coinflip-win:" + lobby.ref(),
+		Kind:     "coinflip_win",
+		Ref:      lobby.ref(),
+		Postings: postings,
+	})
+	if postErr != nil {
+		return postErr
+	}
+	_, execErr := tx.Exec(`UPDATE coinflip_lobbies SET state = ?, winner = ?, fee = ?, updated = ? WHERE id = ?`,
+		COINFLIP_FINISHED, winner, fee, time.Now().Unix(), lobby.Id)
+	if execErr != nil {
+		return execErr
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	lobby.State = COINFLIP_FINISHED
+	lobby.Winner = winner
+	lobby.Fee = fee
+	log.WithFields(log.Fields{"lobby_id": lobby.Id, "side": result, "winner": winner}).Info("Coinflip finished")
+
+	msg := coinflipMessage(lobby)
+	msg["result"] = result
+	msg["roll"] = strconv.FormatFloat(fair.Roll, 'f', -1, 64)
+	sendToAll(msg)
+	sendBalance(lobby.Creator)
+	sendBalance(lobby.Joiner)
+	return nil
+}
+
+//Heads holds the first tickets of the pot and tails the rest, one ticket per
+//cent staked like the jackpot, so each side wins in proportion to its stake
+func (l *CoinflipLobby) flip(roll float64) string {
+	heads := l.Amount
+	if l.Side != COINFLIP_HEADS {
+		heads = l.JoinerAmount
+	}
+	pot := l.Amount + l.JoinerAmount
+	if int64(roll*float64(pot)) < heads {
+		return COINFLIP_HEADS
+	}
+	return COINFLIP_TAILS
+}
+
+func cancelCoinflip(steam64id string, ip string, id int64) error {
+	if coinflipConf == nil {
+		return errCoinflipUnavailable
+	}
+
+	coinflipLock.Lock()
+	defer coinflipLock.Unlock()
+
+	lobby, lobbyErr := getCoinflipLobby(id)
+	if lobbyErr != nil {
+		return lobbyErr
+	}
+	if lobby.State != COINFLIP_OPEN {
+		return errCoinflipNotFound
+	}
+	if lobby.Creator != steam64id {
+		return errCoinflipNotOwner
+	}
+	if err := refundCoinflip(lobby, COINFLIP_CANCELED); err != nil {
+		return err
+	}
+	if err := recordAudit(steam64id, ip, audit.EVENT_GAME_REFUND, "coinflip lobby "+lobby.ref()+" canceled"); err != nil {
+		log.WithError(err).WithField("sid", steam64id).Error("Error writing coinflip audit entry")
+	}
+	return nil
+}
+
+//Returns the creator's stake of an open lobby. Must be called with coinflipLock held
+func refundCoinflip(lobby *CoinflipLobby, state string) error {
+	tx, txErr := db.Begin()
+	if txErr != nil {
+		return txErr
+	}
+	defer tx.Rollback()
+
+	_, postErr := books.PostTx(tx, &ledger.Entry{
+		Key:  "coinflip-refund:" + lobby.ref(),
+		Kind: "coinflip_refund",
+		Ref:  lobby.ref(),
+		Postings: []ledger.Posting{
+			{Account: lobby.account(), Amount: -lobby.Amount},
+			{Account: ledger.UserAccount(lobby.Creator), Amount: lobby.Amount},
+		},
+	})
+	if postErr != nil {
+		return postErr
+	}
+	_, execErr := tx.Exec(`UPDATE coinflip_lobbies SET state = ?, updated = ? WHERE id = ?`, state, time.Now().Unix(), lobby.Id)
+	if execErr != nil {
+		return execErr
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	lobby.State = state
+	log.WithFields(log.Fields{"lobby_id": lobby.Id, "state": state, "sid": lobby.Creator}).Info("Coinflip closed, creator refunded")
+
+	//Closes the commit so the seed can still be revealed
+	if lobby.FairId != 0 {
+		if commit, err := loadFairCommit(lobby.FairId); err == nil {
+			if _, err := resolveFairRound(commit, nil, func(roll float64) string { return state }); err != nil {
+				log.WithError(err).WithField("lobby_id", lobby.Id).Error("Error closing fair commit of coinflip")
+			}
+		}
+	}
+	sendToAll(coinflipMessage(lobby))
+	sendBalance(lobby.Creator)
+	return nil
+}
+
+//Refunds lobbies nobody joined in time and retries flips that failed halfway
+func sweepCoinflips() {
+	coinflipLock.Lock()
+	defer coinflipLock.Unlock()
+
+	joined, joinedErr := queryCoinflipLobbies(`WHERE state = ? AND updated < ?`,
+		COINFLIP_JOINED, time.Now().Unix()-COINFLIP_SWEEP_INTERVAL)
+	if joinedErr != nil {
+		log.WithError(joinedErr).Error("Error finding unfinished coinflips")
+	}
+	for _, lobby := range joined {
+		if err := finishCoinflip(lobby); err != nil {
+			log.WithError(err).WithField("lobby_id", lobby.Id).Error("Error finishing coinflip")
+		}
+	}
+
+	stale, queryErr := queryCoinflipLobbies(`WHERE state = ? AND created < ?`,
+		COINFLIP_OPEN, time.Now().Unix()-int64(coinflipConf.Expiry))
+	if queryErr != nil {
+		log.WithError(queryErr).Error("Error finding stale coinflips")
+		return
+	}
+	for _, lobby := range stale {
+		if err := refundCoinflip(lobby, COINFLIP_EXPIRED); err != nil {
+			log.WithError(err).WithField("lobby_id", lobby.Id).Error("Error expiring coinflip")
+		}
+	}
+}
+
+func coinflipLoop() {
+	ticker := time.NewTicker(time.Second * COINFLIP_SWEEP_INTERVAL)
+	defer ticker.Stop()
+	for range ticker.C {
+		sweepCoinflips()
+	}
+}
+
+//Open lobbies, oldest first
+func listCoinflips() ([]map[string]string, error) {
+	lobbies, err := queryCoinflipLobbies(`WHERE state = ? ORDER BY id LIMIT ?`, COINFLIP_OPEN, COINFLIP_LIST_SIZE)
+	if err != nil {
+		return nil, err
+	}
+	list := make([]map[string]string, 0, len(lobbies))
+	for _, lobby := range lobbies {
+		list = append(list, coinflipMessage(lobby))
+	}
+	return list, nil
+}
+
+//Pushed to every client with code 24 whenever a lobby changes
+func coinflipMessage(lobby *CoinflipLobby) map[string]string {
+	msg := map[string]string{
+		"code":          "24",
+		"lobby_id":      lobby.ref(),
+		"state":         lobby.State,
+		"creator":       lobby.Creator,
+		"side":          lobby.Side,
+		"amount":        strconv.FormatInt(lobby.Amount, 10),
+		"joiner":        lobby.Joiner,
+		"joiner_amount": strconv.FormatInt(lobby.JoinerAmount, 10),
+		"winner":        lobby.Winner,
+		"expires":       strconv.FormatInt(lobby.Created.Unix()+int64(coinflipConf.Expiry), 10),
+		"fair_id":       "",
+		"fair_hash":     "",
+		"verify_url":    "",
+	}
+	if lobby.FairId != 0 {
+		if commit, err := loadFairCommit(lobby.FairId); err == nil {
+			for key, value := range fairRoundInfo(commit) {
+				msg[key] = value
+			}
+		}
+	}
+	return msg
+}
+
+func coinflipErrorText(err error) string {
+	switch err {
+	case errCoinflipUnavailable, errCoinflipBet, errCoinflipSide, errCoinflipTooMany, errCoinflipNotFound,
+		errCoinflipSelf, errCoinflipMismatch, errCoinflipNotOwner, errCoinflipFunds,
+		errSelfExcluded, errWagerLimit:
+		return err.Error()
+	}
+	return "Internal server error"
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"errors"
+	log "github.com/Sirupsen/logrus"
+	maxminddb "github.com/oschwald/maxminddb-golang"
+	audit "github.com/skyguy126/website/src/audit"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type ComplianceConfig struct {
+	//Bumping the version sends every user back to the terms page
+	TosVersion string `json:"tos_version"`
+	MinAge     int    `json:"min_age"`
+	//MaxMind country or city database, leave empty to disable region blocking
+	GeoIPDatabase string `json:"geoip_database"`
+	//ISO country codes like "US" or subdivisions like "US-WA"
+	BlockedRegions []string `json:"blocked_regions"`
+}
+
+func defaultComplianceConfig() ComplianceConfig {
+	return ComplianceConfig{
+		TosVersion:     "1",
+		MinAge:         18,
+		GeoIPDatabase:  "",
+		BlockedRegions: []string{},
+	}
+}
+
+var errTosRequired = errors.New("The terms of service have to be accepted first")
+var errTosVersion = errors.New("The terms of service have changed, please review them again")
+var errBirthDate = errors.New("Invalid date of birth")
+var errUnderage = errors.New("You are not old enough to use this site")
+var errRegionBlocked = errors.New("This site is not available in your region")
+
+var geoDb *maxminddb.Reader
+
+type geoRecord struct {
+	Country struct {
+		IsoCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	Subdivisions []struct {
+		IsoCode string `maxminddb:"iso_code"`
+	} `maxminddb:"subdivisions"`
+}
+
+func startCompliance(conf ComplianceConfig) error {
+	if conf.GeoIPDatabase == "" {
+		return nil
+	}
+	reader, openErr := maxminddb.Open(conf.GeoIPDatabase)
+	if openErr != nil {
+		return openErr
+	}
+	geoDb = reader
+	return nil
+}
+
+//Host part of a remote address, works for IPv6 addresses like "[::1]:443"
+//that splitting on the first colon mangles
+func remoteIp(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+//Regions of ip from most to least specific, ex. ["US-WA", "US"]. Addresses
+//missing from the database, like private ones, have no regions
+func ipRegions(ip string) ([]string, error) {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return nil, errors.New("invalid ip " + ip)
+	}
+	var record geoRecord
+	if err := geoDb.Lookup(parsed, &record); err != nil {
+		return nil, err
+	}
+	if record.Country.IsoCode == "" {
+		return nil, nil
+	}
+	regions := make([]string, 0, len(record.Subdivisions)+1)
+	for _, subdivision := range record.Subdivisions {
+		regions = append(regions, record.Country.IsoCode+"-"+subdivision.IsoCode)
+	}
+	return append(regions, record.Country.IsoCode), nil
+}
+
+//Returns the blocked region ip is in, empty when it is allowed. Addresses
+//that cannot be looked up are let through with a warning
+func blockedRegion(ip string) string {
+	if geoDb == nil || len(config.Compliance.BlockedRegions) == 0 {
+		return ""
+	}
+	regions, err := ipRegions(ip)
+	if err != nil {
+		log.WithError(err).WithField("ip", ip).Warn("GeoIP lookup failed, not checking region")
+		return ""
+	}
+	for _, region := range regions {
+		for _, blocked := range config.Compliance.BlockedRegions {
+			if strings.EqualFold(region, blocked) {
+				return region
+			}
+		}
+	}
+	return ""
+}
+
+func hasAcceptedTos(steam64id string) (bool, error) {
+	var accepted int
+	err := db.QueryRow(`SELECT COUNT(*) FROM tos_acceptances WHERE sid = ? AND version = ?`,
+		steam64id, config.Compliance.TosVersion).Scan(&accepted)
+	return accepted > 0, err
+}
+
+//Whether steam64id was turned away for being underage, that is final
+func hasRefusedTos(steam64id string) (bool, error) {
+	var refused int
+	err := db.QueryRow(`SELECT COUNT(*) FROM tos_refusals WHERE sid = ?`, steam64id).Scan(&refused)
+	return refused > 0, err
+}
+
+//Records that steam64id accepted version of the terms and attested to being
+//born on birthDate (YYYY-MM-DD). An underage date of birth refuses the account
+//for good, later attempts return errUnderage whatever date they give
+func acceptTos(steam64id string, ip string, version string, birthDate string) error {
+	refused, refusedErr := hasRefusedTos(steam64id)
+	if refusedErr != nil {
+		return refusedErr
+	}
+	if refused {
+		return errUnderage
+	}
+	if version != config.Compliance.TosVersion {
+		return errTosVersion
+	}
+	born, parseErr := time.Parse("2006-01-02", birthDate)
+	now := time.Now().UTC()
+	if parseErr != nil || born.After(now) || born.Year() < 1900 {
+		return errBirthDate
+	}
+	if born.AddDate(config.Compliance.MinAge, 0, 0).After(now) {
+		_, execErr := db.Exec(`INSERT OR IGNORE INTO tos_refusals (sid, birth_date, ip, time) VALUES (?, ?, ?, ?)`,
+			steam64id, birthDate, ip, now.Unix())
+		if execErr != nil {
+			return execErr
+		}
+		if err := recordAudit(steam64id, ip, audit.EVENT_TOS, "refused, born "+birthDate); err != nil {
+			log.WithError(err).WithField("sid", steam64id).Error("Error writing terms audit entry")
+		}
+		return errUnderage
+	}
+
+	_, execErr := db.Exec(`INSERT OR IGNORE INTO tos_acceptances (sid, version, birth_date, ip, time) VALUES (?, ?, ?, ?, ?)`,
+		steam64id, version, birthDate, ip, now.Unix())
+	if execErr != nil {
+		return execErr
+	}
+	if err := recordAudit(steam64id, ip, audit.EVENT_TOS, "accepted version "+version+", born "+birthDate); err != nil {
+		log.WithError(err).WithField("sid", steam64id).Error("Error writing terms audit entry")
+	}
+	log.WithFields(log.Fields{"sid": steam64id, "version": version}).Info("Accepted terms")
+	return nil
+}
+
+//Checks a logged in user may use the site from ip, returns errRegionBlocked,
+//errUnderage or errTosRequired otherwise
+func checkCompliance(steam64id string, ip string) error {
+	if blockedRegion(ip) != "" {
+		return errRegionBlocked
+	}
+	refused, refusedErr := hasRefusedTos(steam64id)
+	if refusedErr != nil {
+		return refusedErr
+	}
+	if refused {
+		return errUnderage
+	}
+	accepted, err := hasAcceptedTos(steam64id)
+	if err != nil {
+		return err
+	}
+	if !accepted {
+		return errTosRequired
+	}
+	return nil
+}
+
+func renderRegionBlocked(w http.ResponseWriter, r *http.Request) {
+	renderPage(w, r, "blocked.html", http.StatusForbidden, newPageData(r, ""))
+}
+
+//GET shows the current terms, POST accepts them along with a date of birth
+func TermsHandler(w http.ResponseWriter, r *http.Request) {
+	steam64id, sessionErr := checkSession(w, r)
+	if sessionErr == errSessionLookup {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if sessionErr != nil {
+		http.Redirect(w, r, "https://"+HOST_ADDR+"/oid/login", http.StatusFound)
+		return
+	}
+	ip := remoteIp(r.RemoteAddr)
+	if blockedRegion(ip) != "" {
+		renderRegionBlocked(w, r)
+		return
+	}
+
+	data := newPageData(r, steam64id)
+	data.TosVersion = config.Compliance.TosVersion
+	data.MinAge = config.Compliance.MinAge
+	refused, refusedErr := hasRefusedTos(steam64id)
+	if refusedErr != nil {
+		requestLog(r).WithError(refusedErr).Error("Error checking terms refusal")
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if refused {
+		data.TosRefused = true
+		data.TermsError = errUnderage.Error()
+		renderPage(w, r, "terms.html", http.StatusForbidden, data)
+		return
+	}
+	if r.Method != "POST" {
+		renderPage(w, r, "terms.html", http.StatusOK, data)
+		return
+	}
+
+	var err error
+	if r.PostFormValue("accept") != "on" {
+		err = errTosRequired
+	} else {
+		err = acceptTos(steam64id, ip, r.PostFormValue("version"), r.PostFormValue("birth_date"))
+	}
+	if err != nil {
+		switch err {
+		case errTosRequired, errTosVersion, errBirthDate, errUnderage:
+			data.TosRefused = err == errUnderage
+			data.TermsError = err.Error()
+		default:
+			requestLog(r).WithError(err).Error("Error accepting terms")
+			data.TermsError = "Internal server error"
+		}
+		renderPage(w, r, "terms.html", http.StatusBadRequest, data)
+		return
+	}
+	http.Redirect(w, r, "https://"+HOST_ADDR+"/home", http.StatusSeeOther)
+}
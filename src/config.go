@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+//Runtime settings loaded from config.json, anything missing keeps its default
+type Config struct {
+	//"redis" or "memory"
+	Store     string `json:"store"`
+	RedisAddr string `json:"redis_addr"`
+	//Only used by the memory store, leave empty to disable snapshots
+	SnapshotFile     string `json:"snapshot_file"`
+	SnapshotInterval int    `json:"snapshot_interval"`
+	//Origins allowed to open /sock, must include scheme and port if not default
+	AllowedOrigins []string `json:"allowed_origins"`
+	//database/sql driver and data source, the default is a local sqlite file.
+	//sqlite3 is the only driver supported
+	DatabaseDriver string `json:"database_driver"`
+	DatabaseDsn    string `json:"database_dsn"`
+	//Re-parses templates on every request and serves static files from disk
+	DevMode bool `json:"dev_mode"`
+	//Security headers added to every page and static file
+	Headers  HeaderConfig   `json:"headers"`
+	Bot      BotConfig      `json:"bot"`
+	Pricing  PricingConfig  `json:"pricing"`
+	Jackpot     JackpotConfig     `json:"jackpot"`
+	Coinflip    CoinflipConfig    `json:"coinflip"`
+	Roulette    RouletteConfig    `json:"roulette"`
+	Responsible ResponsibleConfig `json:"responsible"`
+	Compliance  ComplianceConfig  `json:"compliance"`
+	Metrics     MetricsConfig     `json:"metrics"`
+	Log         LogConfig         `json:"log"`
+	//steam64 ids that always have the superadmin role, other roles are given out in /admin
+	Superadmins []string `json:"superadmins"`
+}
+
+var config = defaultConfig()
+
+func defaultConfig() *Config {
+	return &Config{
+		Store:            "redis",
+		RedisAddr:        ":6379",
+		SnapshotFile:     "",
+		SnapshotInterval: 60,
+		AllowedOrigins:   []string{"https://" + HOST_ADDR, "https://" + strings.TrimSuffix(HOST_ADDR, ":443")},
+		DatabaseDriver:   DATABASE_DRIVER,
+		DatabaseDsn:      "site.db?_foreign_keys=on&_busy_timeout=5000",
+		Headers:          defaultHeaderConfig(),
+		Bot:              defaultBotConfig(),
+		Pricing:          defaultPricingConfig(),
+		Jackpot:          defaultJackpotConfig(),
+		Coinflip:         defaultCoinflipConfig(),
+		Roulette:         defaultRouletteConfig(),
+		Responsible:      defaultResponsibleConfig(),
+		Compliance:       defaultComplianceConfig(),
+		Metrics:          defaultMetricsConfig(),
+		Log:              defaultLogConfig(),
+		Superadmins:      []string{},
+	}
+}
+
+func loadConfig(path string) (*Config, error) {
+	conf := defaultConfig()
+	data, readErr := ioutil.ReadFile(path)
+	if readErr != nil {
+		if os.IsNotExist(readErr) {
+			return conf, nil
+		}
+		return nil, readErr
+	}
+	if err := json.Unmarshal(data, conf); err != nil {
+		return nil, err
+	}
+	return conf, nil
+}
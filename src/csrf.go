@@ -0,0 +1,50 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	csrf "github.com/gorilla/csrf"
+	"net/http"
+)
+
+//Wraps every route, gorilla/csrf only enforces tokens on
+//state-changing methods so GET pages just get a token generated
+func newCsrfHandler(secret []byte) func(http.Handler) http.Handler {
+	key := sha256.Sum256(secret)
+	return csrf.Protect(key[:],
+		csrf.Secure(true),
+		csrf.HttpOnly(true),
+		csrf.Path("/"),
+		csrf.CookieName("csrf"),
+		csrf.ErrorHandler(http.HandlerFunc(CsrfFailureHandler)),
+	)
+}
+
+func CsrfFailureHandler(w http.ResponseWriter, r *http.Request) {
+	requestLog(r).WithFields(log.Fields{"method": r.Method, "path": r.URL.Path}).WithError(csrf.FailureReason(r)).Warn("CSRF check failed")
+	w.Header().Set("Content-type", "application/json")
+	w.WriteHeader(http.StatusForbidden)
+	fmt.Fprint(w, `{"error":"forbidden"}`)
+}
+
+//Same origin scripts read their token here, other origins are stopped by the browser
+func CsrfTokenHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	data, _ := json.Marshal(map[string]string{"token": csrf.Token(r)})
+	w.Write(data)
+}
+
+//Rejects websocket upgrades from origins not listed in config
+func checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	for _, allowed := range config.AllowedOrigins {
+		if origin == allowed {
+			return true
+		}
+	}
+	requestLog(r).WithField("origin", origin).Warn("Rejected websocket origin")
+	return false
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	log "github.com/Sirupsen/logrus"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+var db *sql.DB
+
+//The schema and queries use sqlite syntax (? placeholders, AUTOINCREMENT,
+//INSERT OR IGNORE, ON CONFLICT, scalar MAX, triggers) so no other driver works
+const DATABASE_DRIVER = "sqlite3"
+
+var errDatabaseDriver = errors.New("Only the sqlite3 database driver is supported")
+
+//Schema changes are appended here, never edited once released.
+//Each one runs once and is tracked by index in schema_migrations
+var migrations = []string{
+	`CREATE TABLE trade_urls (
+		sid TEXT PRIMARY KEY,
+		url TEXT NOT NULL,
+		partner TEXT NOT NULL,
+		token TEXT NOT NULL,
+		updated INTEGER NOT NULL
+	)`,
+	`CREATE TABLE audit_log (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		time INTEGER NOT NULL,
+		sid TEXT NOT NULL,
+		ip TEXT NOT NULL,
+		event TEXT NOT NULL,
+		detail TEXT NOT NULL
+	)`,
+	`CREATE INDEX audit_log_sid ON audit_log (sid, time)`,
+	`CREATE TABLE tradebot_poll (
+		id INTEGER PRIMARY KEY CHECK (id = 0),
+		data TEXT NOT NULL
+	)`,
+	`CREATE TABLE deposits (
+		offer_id TEXT PRIMARY KEY,
+		sid TEXT NOT NULL,
+		state TEXT NOT NULL,
+		security_code TEXT NOT NULL,
+		created INTEGER NOT NULL,
+		updated INTEGER NOT NULL
+	)`,
+	`CREATE INDEX deposits_sid ON deposits (sid, state)`,
+	`CREATE TABLE deposit_items (
+		offer_id TEXT NOT NULL REFERENCES deposits (offer_id),
+		asset_id TEXT NOT NULL,
+		class_id TEXT NOT NULL,
+		instance_id TEXT NOT NULL,
+		name TEXT NOT NULL,
+		market_hash_name TEXT NOT NULL,
+		PRIMARY KEY (offer_id, asset_id)
+	)`,
+	`CREATE TABLE item_ledger (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		time INTEGER NOT NULL,
+		sid TEXT NOT NULL,
+		kind TEXT NOT NULL,
+		ref TEXT NOT NULL,
+		asset_id TEXT NOT NULL,
+		market_hash_name TEXT NOT NULL,
+		amount INTEGER NOT NULL,
+		UNIQUE (kind, ref, asset_id)
+	)`,
+	`CREATE TABLE price_overrides (
+		market_hash_name TEXT PRIMARY KEY,
+		cents INTEGER NOT NULL,
+		sid TEXT NOT NULL,
+		updated INTEGER NOT NULL
+	)`,
+	`ALTER TABLE deposit_items ADD COLUMN price INTEGER NOT NULL DEFAULT 0`,
+	`CREATE TABLE ledger_entries (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		idempotency_key TEXT NOT NULL UNIQUE,
+		kind TEXT NOT NULL,
+		ref TEXT NOT NULL,
+		memo TEXT NOT NULL,
+		time INTEGER NOT NULL
+	)`,
+	`CREATE TABLE ledger_postings (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		entry_id INTEGER NOT NULL REFERENCES ledger_entries (id),
+		account TEXT NOT NULL,
+		amount INTEGER NOT NULL
+	)`,
+	`CREATE INDEX ledger_postings_account ON ledger_postings (account, entry_id)`,
+	`CREATE TABLE ledger_balances (
+		account TEXT PRIMARY KEY,
+		balance INTEGER NOT NULL,
+		entry_id INTEGER NOT NULL
+	)`,
+	`CREATE TABLE ledger_snapshots (
+		snapshot INTEGER NOT NULL,
+		time INTEGER NOT NULL,
+		entry_id INTEGER NOT NULL,
+		account TEXT NOT NULL,
+		balance INTEGER NOT NULL,
+		PRIMARY KEY (snapshot, account)
+	)`,
+	`CREATE TABLE withdrawals (
+		id TEXT PRIMARY KEY,
+		sid TEXT NOT NULL,
+		state TEXT NOT NULL,
+		offer_id TEXT NOT NULL,
+		total INTEGER NOT NULL,
+		attempts INTEGER NOT NULL,
+		next_attempt INTEGER NOT NULL,
+		created INTEGER NOT NULL,
+		updated INTEGER NOT NULL
+	)`,
+	`CREATE INDEX withdrawals_state ON withdrawals (state, next_attempt)`,
+	`CREATE INDEX withdrawals_offer ON withdrawals (offer_id)`,
+	`CREATE TABLE withdrawal_items (
+		withdrawal_id TEXT NOT NULL REFERENCES withdrawals (id),
+		asset_id TEXT NOT NULL,
+		market_hash_name TEXT NOT NULL,
+		price INTEGER NOT NULL,
+		PRIMARY KEY (withdrawal_id, asset_id)
+	)`,
+	`CREATE TABLE bot_reservations (
+		asset_id TEXT PRIMARY KEY,
+		withdrawal_id TEXT NOT NULL REFERENCES withdrawals (id)
+	)`,
+	`CREATE TABLE fair_seeds (
+		id TEXT PRIMARY KEY,
+		game TEXT NOT NULL,
+		server_seed TEXT NOT NULL,
+		hash TEXT NOT NULL,
+		next_nonce INTEGER NOT NULL DEFAULT 0,
+		created INTEGER NOT NULL,
+		retired INTEGER NOT NULL DEFAULT 0,
+		revealed INTEGER NOT NULL DEFAULT 0
+	)`,
+	`CREATE INDEX fair_seeds_game ON fair_seeds (game, retired)`,
+	`CREATE TABLE fair_results (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		seed_id TEXT NOT NULL REFERENCES fair_seeds (id),
+		game TEXT NOT NULL,
+		ref TEXT NOT NULL,
+		client_seed TEXT NOT NULL DEFAULT '',
+		nonce INTEGER NOT NULL,
+		outcome TEXT NOT NULL DEFAULT '',
+		created INTEGER NOT NULL,
+		resolved INTEGER NOT NULL DEFAULT 0,
+		UNIQUE (game, ref)
+	)`,
+	`CREATE TABLE fair_client_seeds (
+		sid TEXT PRIMARY KEY,
+		seed TEXT NOT NULL,
+		updated INTEGER NOT NULL
+	)`,
+	`CREATE TABLE jackpot_rounds (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		state TEXT NOT NULL,
+		fair_id INTEGER NOT NULL DEFAULT 0,
+		pot INTEGER NOT NULL DEFAULT 0,
+		fee INTEGER NOT NULL DEFAULT 0,
+		ends INTEGER NOT NULL DEFAULT 0,
+		winner TEXT NOT NULL DEFAULT '',
+		ticket INTEGER NOT NULL DEFAULT 0,
+		created INTEGER NOT NULL,
+		updated INTEGER NOT NULL
+	)`,
+	`CREATE INDEX jackpot_rounds_state ON jackpot_rounds (state)`,
+	`CREATE TABLE jackpot_bets (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		round_id INTEGER NOT NULL REFERENCES jackpot_rounds (id),
+		sid TEXT NOT NULL,
+		ip TEXT NOT NULL,
+		amount INTEGER NOT NULL,
+		created INTEGER NOT NULL
+	)`,
+	`CREATE INDEX jackpot_bets_round ON jackpot_bets (round_id, id)`,
+	`CREATE TABLE coinflip_lobbies (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		state TEXT NOT NULL,
+		creator TEXT NOT NULL,
+		creator_ip TEXT NOT NULL,
+		side TEXT NOT NULL,
+		amount INTEGER NOT NULL,
+		joiner TEXT NOT NULL DEFAULT '',
+		joiner_ip TEXT NOT NULL DEFAULT '',
+		joiner_amount INTEGER NOT NULL DEFAULT 0,
+		fair_id INTEGER NOT NULL DEFAULT 0,
+		winner TEXT NOT NULL DEFAULT '',
+		fee INTEGER NOT NULL DEFAULT 0,
+		created INTEGER NOT NULL,
+		updated INTEGER NOT NULL
+	)`,
+	`CREATE INDEX coinflip_lobbies_state ON coinflip_lobbies (state, created)`,
+	`CREATE TABLE roulette_rounds (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		state TEXT NOT NULL,
+		fair_id INTEGER NOT NULL DEFAULT 0,
+		slot INTEGER NOT NULL DEFAULT -1,
+		created INTEGER NOT NULL,
+		updated INTEGER NOT NULL
+	)`,
+	`CREATE TABLE roulette_bets (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		round_id INTEGER NOT NULL REFERENCES roulette_rounds (id),
+		sid TEXT NOT NULL,
+		ip TEXT NOT NULL,
+		color TEXT NOT NULL,
+		amount INTEGER NOT NULL,
+		created INTEGER NOT NULL
+	)`,
+	`CREATE INDEX roulette_bets_round ON roulette_bets (round_id, id)`,
+	`CREATE TABLE rg_limits (
+		sid TEXT NOT NULL,
+		kind TEXT NOT NULL,
+		period TEXT NOT NULL,
+		amount INTEGER NOT NULL,
+		pending INTEGER NOT NULL DEFAULT -1,
+		pending_from INTEGER NOT NULL DEFAULT 0,
+		updated INTEGER NOT NULL,
+		PRIMARY KEY (sid, kind, period)
+	)`,
+	`CREATE TABLE rg_exclusions (
+		sid TEXT PRIMARY KEY,
+		until INTEGER NOT NULL,
+		created INTEGER NOT NULL
+	)`,
+	`CREATE TABLE tos_acceptances (
+		sid TEXT NOT NULL,
+		version TEXT NOT NULL,
+		birth_date TEXT NOT NULL,
+		ip TEXT NOT NULL,
+		time INTEGER NOT NULL,
+		PRIMARY KEY (sid, version)
+	)`,
+	`CREATE TABLE roles (
+		sid TEXT PRIMARY KEY,
+		role TEXT NOT NULL,
+		granted_by TEXT NOT NULL,
+		updated INTEGER NOT NULL
+	)`,
+	`CREATE TABLE bans (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		sid TEXT NOT NULL,
+		reason TEXT NOT NULL,
+		banned_by TEXT NOT NULL,
+		created INTEGER NOT NULL,
+		until INTEGER NOT NULL,
+		lifted INTEGER NOT NULL DEFAULT 0
+	)`,
+	`CREATE INDEX bans_sid ON bans (sid)`,
+	`CREATE TABLE logins (
+		session_id TEXT PRIMARY KEY,
+		sid TEXT NOT NULL,
+		ip TEXT NOT NULL,
+		created INTEGER NOT NULL,
+		expires INTEGER NOT NULL,
+		ended INTEGER NOT NULL DEFAULT 0
+	)`,
+	`CREATE INDEX logins_sid ON logins (sid, ended)`,
+	`CREATE INDEX logins_created ON logins (created)`,
+	`ALTER TABLE audit_log ADD COLUMN prev_hash TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE audit_log ADD COLUMN hash TEXT NOT NULL DEFAULT ''`,
+	`CREATE INDEX audit_log_time ON audit_log (time)`,
+	//Entries from before hashing are sealed once at startup, after that the log only grows
+	`CREATE TRIGGER audit_log_no_update BEFORE UPDATE ON audit_log WHEN OLD.hash != ''
+	BEGIN
+		SELECT RAISE(ABORT, 'audit_log is append-only');
+	END`,
+	`CREATE TRIGGER audit_log_no_delete BEFORE DELETE ON audit_log
+	BEGIN
+		SELECT RAISE(ABORT, 'audit_log is append-only');
+	END`,
+	//One deposit per user waiting on Steam
+	`CREATE UNIQUE INDEX deposits_pending ON deposits (sid) WHERE state IN ('sent', 'escrow')`,
+	//Accounts that gave an underage date of birth, kept so another date cannot be tried
+	`CREATE TABLE tos_refusals (
+		sid TEXT PRIMARY KEY,
+		birth_date TEXT NOT NULL,
+		ip TEXT NOT NULL,
+		time INTEGER NOT NULL
+	)`,
+}
+
+func openDatabase(driver string, dsn string) (*sql.DB, error) {
+	if driver != DATABASE_DRIVER {
+		return nil, errDatabaseDriver
+	}
+	conn, openErr := sql.Open(driver, dsn)
+	if openErr != nil {
+		return nil, openErr
+	}
+	if err := conn.Ping(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := migrate(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func migrate(conn *sql.DB) error {
+	if _, err := conn.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY)`); err != nil {
+		return err
+	}
+	var applied int
+	if err := conn.QueryRow(`SELECT COUNT(*) FROM schema_migrations`).Scan(&applied); err != nil {
+		return err
+	}
+	for version := applied; version < len(migrations); version++ {
+		tx, txErr := conn.Begin()
+		if txErr != nil {
+			return txErr
+		}
+		if _, err := tx.Exec(migrations[version]); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if _, err := tx.Exec(`INSERT INTO schema_migrations (version) VALUES (?)`, version); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		log.WithField("version", version).Info("Applied database migration")
+	}
+	return nil
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	log "github.com/Sirupsen/logrus"
+	audit "github.com/skyguy126/website/src/audit"
+	tradebot "github.com/skyguy126/website/src/tradebot"
+	"strings"
+	"time"
+)
+
+const MAX_DEPOSIT_ITEMS = 20
+
+//Seconds a deposit offer stays open before the bot cancels it
+const DEPOSIT_TIMEOUT = 600
+const DEPOSIT_SWEEP_INTERVAL = 60
+
+//Deposit states pushed to the client with code 10
+const (
+	DEPOSIT_SENT      = "sent"
+	DEPOSIT_ESCROW    = "escrow"
+	DEPOSIT_ACCEPTED  = "accepted"
+	DEPOSIT_DECLINED  = "declined"
+	DEPOSIT_COUNTERED = "countered"
+	DEPOSIT_EXPIRED   = "expired"
+	DEPOSIT_CANCELED  = "canceled"
+	DEPOSIT_FAILED    = "failed"
+)
+
+var errDepositUnavailable = errors.New("Deposits are unavailable right now")
+var errDepositNoTradeUrl = errors.New("Set your trade url before depositing")
+var errDepositPending = errors.New("You already have a deposit waiting to be accepted")
+var errDepositItems = errors.New("Select between 1 and 20 items")
+var errDepositItemNotFound = errors.New("An item is no longer in your inventory or is not tradable")
+var errDepositUnpriced = errors.New("An item has no current price and cannot be deposited")
+
+type Deposit struct {
+	OfferId      string
+	Sid          string
+	State        string
+	SecurityCode string
+	Items        []tradebot.Item
+	//Cents per item at the time of the deposit, same order as Items
+	Prices []int64
+}
+
+func depositState(state tradebot.OfferState) string {
+	switch state {
+	case tradebot.StateActive, tradebot.StateCreatedNeedsConfirmation:
+		return DEPOSIT_SENT
+	case tradebot.StateInEscrow:
+		return DEPOSIT_ESCROW
+	case tradebot.StateAccepted:
+		return DEPOSIT_ACCEPTED
+	case tradebot.StateDeclined:
+		return DEPOSIT_DECLINED
+	case tradebot.StateCountered:
+		return DEPOSIT_COUNTERED
+	case tradebot.StateExpired:
+		return DEPOSIT_EXPIRED
+	case tradebot.StateCanceled, tradebot.StateCanceledBySecondFactor:
+		return DEPOSIT_CANCELED
+	}
+	return DEPOSIT_FAILED
+}
+
+//Final deposits never change again, later offer events are ignored
+func depositFinal(state string) bool {
+	return state != DEPOSIT_SENT && state != DEPOSIT_ESCROW
+}
+
+//Pushes a message to every open socket of steam64id through the broadcast loop
+func sendToSid(steam64id string, msg map[string]string) {
+	broadcastChan <- &Broadcast{
+		Code: 4,
+		Msg:  msg,
+		Conn: &SocketConn{Sid: steam64id},
+	}
+}
+
+//Pushes a message to every open socket
+func sendToAll(msg interface{}) {
+	broadcastChan <- &Broadcast{
+		Code: 3,
+		Msg:  msg,
+	}
+}
+
+func sendDepositState(steam64id string, offerId string, state string) {
+	sendToSid(steam64id, map[string]string{"code": "10", "offer_id": offerId, "state": state})
+}
+
+//Picks the requested assets out of the user's tradable CS:GO inventory and
+//prices them, items without a fresh price are refused
+func selectDepositItems(steam64id string, assetIds []string) ([]tradebot.Item, []int64, error) {
+	if len(assetIds) < 1 || len(assetIds) > MAX_DEPOSIT_ITEMS {
+		return nil, nil, errDepositItems
+	}
+	inventory, invErr := tradeBot.LoadInventory(steam64id, tradebot.APPID_CSGO, tradebot.CONTEXTID_CSGO, true)
+	if invErr != nil {
+		return nil, nil, invErr
+	}
+	byAsset := make(map[string]tradebot.Item, len(inventory))
+	for _, item := range inventory {
+		byAsset[item.AssetId] = item
+	}
+
+	items := make([]tradebot.Item, 0, len(assetIds))
+	prices := make([]int64, 0, len(assetIds))
+	seen := make(map[string]bool, len(assetIds))
+	for _, assetId := range assetIds {
+		item, ok := byAsset[assetId]
+		if !ok {
+			return nil, nil, errDepositItemNotFound
+		}
+		if seen[assetId] {
+			return nil, nil, errDepositItems
+		}
+		price, priced := itemPrice(item.MarketHashName)
+		if !priced {
+			return nil, nil, errDepositUnpriced
+		}
+		seen[assetId] = true
+		items = append(items, item)
+		prices = append(prices, price)
+	}
+	return items, prices, nil
+}
+
+//Sends the user a trade offer asking for the items and starts tracking it
+func createDeposit(steam64id string, ip string, assetIds []string) (*Deposit, error) {
+	if tradeBot == nil {
+		return nil, errDepositUnavailable
+	}
+
+	tradeUrl, urlErr := getTradeUrl(steam64id)
+	if urlErr != nil {
+		return nil, urlErr
+	}
+	if tradeUrl == nil {
+		return nil, errDepositNoTradeUrl
+	}
+
+	//Held until the deposit is stored so a second request cannot send another
+	//offer before this one counts as pending
+	unlock := userLocks.Lock(steam64id)
+	defer unlock()
+
+	var pending int
+	countErr := db.QueryRow(`SELECT COUNT(*) FROM deposits WHERE sid = ? AND state IN (?, ?)`,
+		steam64id, DEPOSIT_SENT, DEPOSIT_ESCROW).Scan(&pending)
+	if countErr != nil {
+		return nil, countErr
+	}
+	if pending > 0 {
+		return nil, errDepositPending
+	}
+
+	items, prices, itemsErr := selectDepositItems(steam64id, assetIds)
+	if itemsErr != nil {
+		return nil, itemsErr
+	}
+	var total int64
+	for _, price := range prices {
+		total += price
+	}
+	if err := checkDepositLimit(steam64id, total); err != nil {
+		return nil, err
+	}
+
+	//Shown on the site and in the offer so users can spot fake offers
+	randomId, idErr := genRandomId()
+	if idErr != nil {
+		return nil, idErr
+	}
+	securityCode := strings.ToUpper(randomId[:8])
+
+	offer, offerErr := tradeBot.CreateOffer(&tradebot.NewOffer{
+		Partner:        steam64id,
+		Token:          tradeUrl.Token,
+		Message:        "EnemyPC deposit, security code " + securityCode,
+		ItemsToReceive: items,
+	})
+	if offerErr != nil {
+		return nil, offerErr
+	}
+
+	deposit := &Deposit{
+		OfferId:      offer.Id,
+		Sid:          steam64id,
+		State:        DEPOSIT_SENT,
+		SecurityCode: securityCode,
+		Items:        items,
+		Prices:       prices,
+	}
+	if err := insertDeposit(deposit); err != nil {
+		//The offer is useless if we cant track it
+		if cancelErr := tradeBot.CancelOffer(offer.Id); cancelErr != nil {
+			log.WithError(cancelErr).WithField("offer_id", offer.Id).Error("Error canceling untracked deposit offer")
+		}
+		return nil, err
+	}
+
+	if err := recordAudit(steam64id, ip, audit.EVENT_DEPOSIT, "offer "+offer.Id+" sent"); err != nil {
+		log.WithError(err).WithField("sid", steam64id).Error("Error writing deposit audit entry")
+	}
+	log.WithFields(log.Fields{"offer_id": offer.Id, "sid": steam64id, "items": len(items)}).Info("Deposit offer sent")
+	return deposit, nil
+}
+
+func insertDeposit(deposit *Deposit) error {
+	tx, txErr := db.Begin()
+	if txErr != nil {
+		return txErr
+	}
+	now := time.Now().Unix()
+	_, execErr := tx.Exec(`INSERT INTO deposits (offer_id, sid, state, security_code, created, updated) VALUES (?, ?, ?, ?, ?, ?)`,
+		deposit.OfferId, deposit.Sid, deposit.State, deposit.SecurityCode, now, now)
+	if execErr != nil {
+		tx.Rollback()
+		return execErr
+	}
+	for n, item := range deposit.Items {
+		_, execErr = tx.Exec(`INSERT INTO deposit_items (offer_id, asset_id, class_id, instance_id, name, market_hash_name, price) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+			deposit.OfferId, item.AssetId, item.ClassId, item.InstanceId, item.Name, item.MarketHashName, deposit.Prices[n])
+		if execErr != nil {
+			tx.Rollback()
+			return execErr
+		}
+	}
+	return tx.Commit()
+}
+
+//Moves a deposit to state, crediting the items and their value when it is accepted. Returns
+//the owner and false if the offer is not a deposit or the deposit is already final
+func setDepositState(offerId string, state string) (string, bool, error) {
+	tx, txErr := db.Begin()
+	if txErr != nil {
+		return "", false, txErr
+	}
+	defer tx.Rollback()
+
+	var steam64id, current string
+	err := tx.QueryRow(`SELECT sid, state FROM deposits WHERE offer_id = ?`, offerId).Scan(&steam64id, &current)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	if current == state || depositFinal(current) {
+		return steam64id, false, nil
+	}
+
+	now := time.Now().Unix()
+	if _, err := tx.Exec(`UPDATE deposits SET state = ?, updated = ? WHERE offer_id = ?`, state, now, offerId); err != nil {
+		return "", false, err
+	}
+	if state == DEPOSIT_ACCEPTED {
+		_, err = tx.Exec(`INSERT INTO item_ledger (time, sid, kind, ref, asset_id, market_hash_name, amount)
+			SELECT ?, ?, 'deposit', offer_id, asset_id, market_hash_name, 1 FROM deposit_items WHERE offer_id = ?
+			ON CONFLICT (kind, ref, asset_id) DO NOTHING`, now, steam64id, offerId)
+		if err != nil {
+			return "", false, err
+		}
+		if err := creditDeposit(tx, steam64id, offerId); err != nil {
+			return "", false, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return "", false, err
+	}
+	return steam64id, true, nil
+}
+
+//Called by the trade bot for every change to an offer it sent
+func handleDepositEvent(offer *tradebot.Offer) {
+	state := depositState(offer.State)
+	steam64id, changed, err := setDepositState(offer.Id, state)
+	if err != nil {
+		log.WithError(err).WithField("offer_id", offer.Id).Error("Error updating deposit")
+		return
+	}
+	if !changed {
+		return
+	}
+	if err := recordAudit(steam64id, "", audit.EVENT_DEPOSIT, "offer "+offer.Id+" "+state); err != nil {
+		log.WithError(err).WithField("sid", steam64id).Error("Error writing deposit audit entry")
+	}
+	log.WithFields(log.Fields{"offer_id": offer.Id, "sid": steam64id, "state": state}).Info("Deposit changed state")
+	sendDepositState(steam64id, offer.Id, state)
+	if state == DEPOSIT_ACCEPTED {
+		inventories.Forget(steam64id)
+		sendBalance(steam64id)
+	}
+}
+
+//Cancels deposit offers nobody answered within DEPOSIT_TIMEOUT
+func expireDeposits() {
+	rows, queryErr := db.Query(`SELECT offer_id FROM deposits WHERE state = ? AND created < ?`,
+		DEPOSIT_SENT, time.Now().Unix()-DEPOSIT_TIMEOUT)
+	if queryErr != nil {
+		log.WithError(queryErr).Error("Error finding stale deposits")
+		return
+	}
+	offerIds := make([]string, 0)
+	for rows.Next() {
+		var offerId string
+		if err := rows.Scan(&offerId); err == nil {
+			offerIds = append(offerIds, offerId)
+		}
+	}
+	rows.Close()
+
+	for _, offerId := range offerIds {
+		cancelErr := tradeBot.CancelOffer(offerId)
+		if cancelErr == tradebot.ErrOfferNotActive {
+			//Answered before the cancel got there, the user may have accepted
+			//so take whatever state Steam has instead of expiring it
+			offer, getErr := tradeBot.GetOffer(offerId)
+			if getErr != nil {
+				log.WithError(getErr).WithField("offer_id", offerId).Error("Error loading stale deposit offer")
+				continue
+			}
+			handleDepositEvent(offer)
+			continue
+		}
+		if cancelErr != nil {
+			log.WithError(cancelErr).WithField("offer_id", offerId).Error("Error canceling stale deposit")
+			continue
+		}
+		//Marked expired before the poller sees the cancel so the user gets the right reason
+		steam64id, changed, err := setDepositState(offerId, DEPOSIT_EXPIRED)
+		if err != nil {
+			log.WithError(err).WithField("offer_id", offerId).Error("Error expiring deposit")
+			continue
+		}
+		if changed {
+			log.WithFields(log.Fields{"offer_id": offerId, "sid": steam64id}).Info("Deposit expired")
+			sendDepositState(steam64id, offerId, DEPOSIT_EXPIRED)
+		}
+	}
+}
+
+func depositSweepLoop(quit chan bool) {
+	ticker := time.NewTicker(time.Second * DEPOSIT_SWEEP_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			expireDeposits()
+		case <-quit:
+			return
+		}
+	}
+}
+
+//Message shown to the user for a failed deposit
+func depositErrorText(err error) string {
+	switch err {
+	case errDepositUnavailable, errDepositNoTradeUrl, errDepositPending, errDepositItems, errDepositItemNotFound, errDepositUnpriced,
+		errSelfExcluded, errDepositLimit:
+		return err.Error()
+	}
+	if tradebot.IsTransient(err) {
+		return "Steam is not responding, try again in a few minutes"
+	}
+	return "Unable to send trade offer"
+}
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	audit "github.com/skyguy126/website/src/audit"
+	fairness "github.com/skyguy126/website/src/fairness"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//A game server seed is retired after this many rounds or seconds, whichever
+//comes first, and revealed once its last round is resolved
+const FAIR_ROUNDS_PER_SEED = 1000
+const FAIR_SEED_MAX_AGE = 86400
+
+var errFairCommitNotFound = errors.New("Round not found")
+var errFairVerify = errors.New("Give a round id or a server seed, client seed and nonce")
+var errFairGame = errors.New("Unknown game")
+
+//Games with their own server seed
+var fairGames = []string{JACKPOT_GAME, COINFLIP_GAME, ROULETTE_GAME}
+
+//Seed operations read then update the active seed, one at a time keeps the
+//nonces unique
+var fairLock sync.Mutex
+
+//A round's slot in a server seed, taken when the round opens so the hash shown
+//to players is the one the result is computed with
+type FairCommit struct {
+	Id    int64
+	Game  string
+	Ref   string
+	Hash  string
+	Nonce uint64
+}
+
+type FairResult struct {
+	FairCommit
+	ClientSeed string
+	Roll       float64
+}
+
+//Active seed of game, creating one when there is none or the current one is
+//used up. Must be called with fairLock held
+func activeFairSeed(tx *sql.Tx, game string) (string, string, uint64, error) {
+	var id, hash string
+	var nonce uint64
+	var created int64
+	err := tx.QueryRow(`SELECT id, hash, next_nonce, created FROM fair_seeds WHERE game = ? AND retired = 0`, game).
+		Scan(&id, &hash, &nonce, &created)
+	if err != nil && err != sql.ErrNoRows {
+		return "", "", 0, err
+	}
+	now := time.Now().Unix()
+	if err == nil && nonce < FAIR_ROUNDS_PER_SEED && now-created < FAIR_SEED_MAX_AGE {
+		return id, hash, nonce, nil
+	}
+	if err == nil {
+		if _, err := tx.Exec(`UPDATE fair_seeds SET retired = ? WHERE id = ?`, now, id); err != nil {
+			return "", "", 0, err
+		}
+	}
+
+	serverSeed, seedErr := fairness.NewServerSeed()
+	if seedErr != nil {
+		return "", "", 0, seedErr
+	}
+	newId, idErr := genRandomId()
+	if idErr != nil {
+		return "", "", 0, idErr
+	}
+	hash = fairness.Hash(serverSeed)
+	_, execErr := tx.Exec(`INSERT INTO fair_seeds (id, game, server_seed, hash, created) VALUES (?, ?, ?, ?, ?)`,
+		newId, game, serverSeed, hash, now)
+	if execErr != nil {
+		return "", "", 0, execErr
+	}
+	log.WithFields(log.Fields{"game": game, "hash": hash}).Info("New server seed")
+	return newId, hash, 0, nil
+}
+
+//Reserves the next nonce of the game seed for the round ref
+func commitFairRound(game string, ref string) (*FairCommit, error) {
+	fairLock.Lock()
+	defer fairLock.Unlock()
+
+	tx, txErr := db.Begin()
+	if txErr != nil {
+		return nil, txErr
+	}
+	defer tx.Rollback()
+
+	seedId, hash, nonce, seedErr := activeFairSeed(tx, game)
+	if seedErr != nil {
+		return nil, seedErr
+	}
+	if _, err := tx.Exec(`UPDATE fair_seeds SET next_nonce = ? WHERE id = ?`, nonce+1, seedId); err != nil {
+		return nil, err
+	}
+	res, execErr := tx.Exec(`INSERT INTO fair_results (seed_id, game, ref, nonce, created) VALUES (?, ?, ?, ?, ?)`,
+		seedId, game, ref, nonce, time.Now().Unix())
+	if execErr != nil {
+		return nil, execErr
+	}
+	id, _ := res.LastInsertId()
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return &FairCommit{Id: id, Game: game, Ref: ref, Hash: hash, Nonce: nonce}, nil
+}
+
+//Commit of a round that was opened before a restart
+func loadFairCommit(id int64) (*FairCommit, error) {
+	commit := &FairCommit{Id: id}
+	err := db.QueryRow(`SELECT r.game, r.ref, s.hash, r.nonce FROM fair_results r JOIN fair_seeds s ON s.id = r.seed_id WHERE r.id = ?`, id).
+		Scan(&commit.Game, &commit.Ref, &commit.Hash, &commit.Nonce)
+	if err == sql.ErrNoRows {
+		return nil, errFairCommitNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return commit, nil
+}
+
+//Computes the outcome of a committed round from the client seeds of its
+//players and stores what the game made of it, ex. the winning ticket. A round
+//that was already resolved keeps its stored client seeds, so a game finishing
+//a round again after a restart gets the same result
+func resolveFairRound(commit *FairCommit, clientSeeds []string, outcome func(roll float64) string) (*FairResult, error) {
+	fairLock.Lock()
+	defer fairLock.Unlock()
+
+	tx, txErr := db.Begin()
+	if txErr != nil {
+		return nil, txErr
+	}
+	defer tx.Rollback()
+
+	var serverSeed, storedSeed string
+	var resolved int64
+	err := tx.QueryRow(`SELECT s.server_seed, r.client_seed, r.resolved FROM fair_results r JOIN fair_seeds s ON s.id = r.seed_id WHERE r.id = ?`,
+		commit.Id).Scan(&serverSeed, &storedSeed, &resolved)
+	if err == sql.ErrNoRows {
+		return nil, errFairCommitNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if resolved != 0 {
+		roll := fairness.Roll(serverSeed, storedSeed, commit.Nonce)
+		return &FairResult{FairCommit: *commit, ClientSeed: storedSeed, Roll: roll}, nil
+	}
+
+	clientSeed := fairness.CombineClientSeeds(clientSeeds...)
+	roll := fairness.Roll(serverSeed, clientSeed, commit.Nonce)
+	now := time.Now().Unix()
+	_, err = tx.Exec(`UPDATE fair_results SET client_seed = ?, outcome = ?, resolved = ? WHERE id = ?`,
+		clientSeed, outcome(roll), now, commit.Id)
+	if err != nil {
+		return nil, err
+	}
+	if err := revealFairSeeds(tx, now); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return &FairResult{FairCommit: *commit, ClientSeed: clientSeed, Roll: roll}, nil
+}
+
+//Reveals retired seeds that have no open rounds left
+func revealFairSeeds(tx *sql.Tx, now int64) error {
+	_, err := tx.Exec(`UPDATE fair_seeds SET revealed = ? WHERE retired != 0 AND revealed = 0
+		AND NOT EXISTS (SELECT 1 FROM fair_results WHERE seed_id = fair_seeds.id AND resolved = 0)`, now)
+	return err
+}
+
+//Retires the active seed of game now instead of waiting for it to run out.
+//It is revealed as soon as its open rounds are resolved
+func rotateFairSeed(game string) error {
+	known := false
+	for _, fairGame := range fairGames {
+		if fairGame == game {
+			known = true
+		}
+	}
+	if !known {
+		return errFairGame
+	}
+
+	fairLock.Lock()
+	defer fairLock.Unlock()
+
+	tx, txErr := db.Begin()
+	if txErr != nil {
+		return txErr
+	}
+	defer tx.Rollback()
+
+	now := time.Now().Unix()
+	if _, err := tx.Exec(`UPDATE fair_seeds SET retired = ? WHERE game = ? AND retired = 0`, now, game); err != nil {
+		return err
+	}
+	if _, _, _, err := activeFairSeed(tx, game); err != nil {
+		return err
+	}
+	if err := revealFairSeeds(tx, now); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+//Client seed of steam64id, users who never set one get a random seed
+func getClientSeed(steam64id string) (string, error) {
+	var seed string
+	err := db.QueryRow(`SELECT seed FROM fair_client_seeds WHERE sid = ?`, steam64id).Scan(&seed)
+	if err == nil {
+		return seed, nil
+	}
+	if err != sql.ErrNoRows {
+		return "", err
+	}
+	seed, seedErr := fairness.NewClientSeed()
+	if seedErr != nil {
+		return "", seedErr
+	}
+	_, execErr := db.Exec(`INSERT INTO fair_client_seeds (sid, seed, updated) VALUES (?, ?, ?) ON CONFLICT(sid) DO NOTHING`,
+		steam64id, seed, time.Now().Unix())
+	if execErr != nil {
+		return "", execErr
+	}
+	//Another connection may have won the insert
+	return seed, db.QueryRow(`SELECT seed FROM fair_client_seeds WHERE sid = ?`, steam64id).Scan(&seed)
+}
+
+func setClientSeed(steam64id string, seed string, ip string) error {
+	if !fairness.ValidClientSeed(seed) {
+		return fairness.ErrInvalidClientSeed
+	}
+	_, execErr := db.Exec(`INSERT INTO fair_client_seeds (sid, seed, updated) VALUES (?, ?, ?)
+		ON CONFLICT(sid) DO UPDATE SET seed = excluded.seed, updated = excluded.updated`,
+		steam64id, seed, time.Now().Unix())
+	if execErr != nil {
+		return execErr
+	}
+	if err := recordAudit(steam64id, ip, audit.EVENT_CLIENT_SEED, seed); err != nil {
+		log.WithError(err).WithField("sid", steam64id).Error("Error writing client seed audit entry")
+	}
+	return nil
+}
+
+//Client seeds of every player in a round
+func clientSeeds(steam64ids []string) ([]string, error) {
+	seeds := make([]string, 0, len(steam64ids))
+	for _, steam64id := range steam64ids {
+		seed, err := getClientSeed(steam64id)
+		if err != nil {
+			return nil, err
+		}
+		seeds = append(seeds, seed)
+	}
+	return seeds, nil
+}
+
+//Everything needed to check a result by hand. ServerSeed is empty until the
+//seed is revealed
+type FairVerification struct {
+	Id         int64  `json:"id"`
+	Game       string `json:"game"`
+	Ref        string `json:"ref"`
+	Hash       string `json:"hash"`
+	ServerSeed string `json:"server_seed"`
+	ClientSeed string `json:"client_seed"`
+	Nonce      uint64 `json:"nonce"`
+	Outcome    string `json:"outcome"`
+	Resolved   bool   `json:"resolved"`
+	Revealed   bool   `json:"revealed"`
+	//Recomputed from the revealed seed
+	Roll      string `json:"roll"`
+	HashMatch bool   `json:"hash_match"`
+}
+
+func lookupFairResult(id int64) (*FairVerification, error) {
+	v := &FairVerification{Id: id}
+	var serverSeed string
+	var resolved, revealed int64
+	err := db.QueryRow(`SELECT r.game, r.ref, s.hash, s.server_seed, r.client_seed, r.nonce, r.outcome, r.resolved, s.revealed
+		FROM fair_results r JOIN fair_seeds s ON s.id = r.seed_id WHERE r.id = ?`, id).
+		Scan(&v.Game, &v.Ref, &v.Hash, &serverSeed, &v.ClientSeed, &v.Nonce, &v.Outcome, &resolved, &revealed)
+	if err == sql.ErrNoRows {
+		return nil, errFairCommitNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	v.Resolved = resolved != 0
+	v.Revealed = revealed != 0
+	if v.Revealed {
+		v.ServerSeed = serverSeed
+		v.HashMatch = fairness.Verify(serverSeed, v.Hash)
+		v.Roll = strconv.FormatFloat(fairness.Roll(serverSeed, v.ClientSeed, v.Nonce), 'f', -1, 64)
+	}
+	return v, nil
+}
+
+//Recomputes a roll from seeds given by the user, nothing is looked up
+func manualFairVerification(serverSeed string, clientSeed string, rawNonce string) (*FairVerification, error) {
+	nonce, nonceErr := strconv.ParseUint(rawNonce, 10, 64)
+	if nonceErr != nil || !fairness.ValidServerSeed(serverSeed) || clientSeed == "" || len(clientSeed) > 4096 {
+		return nil, errFairVerify
+	}
+	return &FairVerification{
+		Hash:       fairness.Hash(serverSeed),
+		ServerSeed: serverSeed,
+		ClientSeed: clientSeed,
+		Nonce:      nonce,
+		Resolved:   true,
+		Revealed:   true,
+		HashMatch:  true,
+		Roll:       strconv.FormatFloat(fairness.Roll(serverSeed, clientSeed, nonce), 'f', -1, 64),
+	}, nil
+}
+
+//?id=123 looks up a stored round, ?server_seed=...&client_seed=...&nonce=...
+//recomputes any roll
+func fairVerification(r *http.Request) (*FairVerification, error) {
+	query := r.URL.Query()
+	if raw := query.Get("id"); raw != "" {
+		id, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return nil, errFairCommitNotFound
+		}
+		return lookupFairResult(id)
+	}
+	return manualFairVerification(strings.ToLower(strings.TrimSpace(query.Get("server_seed"))),
+		query.Get("client_seed"), strings.TrimSpace(query.Get("nonce")))
+}
+
+//Public page, works without a session
+func VerifyHandler(w http.ResponseWriter, r *http.Request) {
+	steam64id, _ := checkSession(w, r)
+	data := newPageData(r, steam64id)
+	if len(r.URL.Query()) > 0 {
+		verification, err := fairVerification(r)
+		if err != nil && err != errFairCommitNotFound && err != errFairVerify {
+			requestLog(r).WithError(err).Error("Error verifying result")
+			err = errors.New("Internal server error")
+		}
+		data.Verify = verification
+		if err != nil {
+			data.VerifyError = err.Error()
+		}
+	}
+	renderPage(w, r, "verify.html", http.StatusOK, data)
+}
+
+//JSON version of /verify
+func VerifyApiHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+
+	verification, err := fairVerification(r)
+	if err != nil {
+		status := http.StatusBadRequest
+		msg := err.Error()
+		if err == errFairCommitNotFound {
+			status = http.StatusNotFound
+		} else if err != errFairVerify {
+			requestLog(r).WithError(err).Error("Error verifying result")
+			status = http.StatusInternalServerError
+			msg = "Internal server error"
+		}
+		w.WriteHeader(status)
+		data, _ := json.Marshal(map[string]string{"error": msg})
+		w.Write(data)
+		return
+	}
+	data, _ := json.Marshal(verification)
+	w.Write(data)
+}
+
+func fairErrorText(err error) string {
+	if err == fairness.ErrInvalidClientSeed {
+		return err.Error()
+	}
+	return "Internal server error"
+}
+
+//Shown next to a round so players can check it later
+func fairRoundInfo(commit *FairCommit) map[string]string {
+	return map[string]string{
+		"fair_id":    strconv.FormatInt(commit.Id, 10),
+		"fair_hash":  commit.Hash,
+		"fair_nonce": strconv.FormatUint(commit.Nonce, 10),
+		"verify_url": fmt.Sprintf("https://%s/verify?id=%d", HOST_ADDR, commit.Id),
+	}
+}
@@ -0,0 +1,97 @@
+//Package fairness makes game outcomes provably fair. The server commits to a
+//secret seed by publishing its SHA-256 hash, every outcome is derived from
+//HMAC-SHA256(server seed, client seed:nonce) and the seed is revealed once it
+//is rotated out, so anyone can recompute every result it produced
+package fairness
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const SEED_BYTES = 32
+const MAX_CLIENT_SEED_LEN = 64
+
+var clientSeedRegex = regexp.MustCompile(`^[A-Za-z0-9_\-]{1,64}$`)
+
+var ErrInvalidClientSeed = errors.New("Client seed must be 1 to 64 letters, numbers, - or _")
+var ErrInvalidServerSeed = errors.New("Server seed must be 64 hex characters")
+
+//Random hex encoded server seed
+func NewServerSeed() (string, error) {
+	buf := make([]byte, SEED_BYTES)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+//Random client seed for users that have not picked one
+func NewClientSeed() (string, error) {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+//The commitment published before the seed is used
+func Hash(serverSeed string) string {
+	sum := sha256.Sum256([]byte(serverSeed))
+	return hex.EncodeToString(sum[:])
+}
+
+//Checks a revealed seed against the hash that was published
+func Verify(serverSeed string, hash string) bool {
+	return hmac.Equal([]byte(Hash(serverSeed)), []byte(strings.ToLower(hash)))
+}
+
+func ValidClientSeed(clientSeed string) bool {
+	return clientSeedRegex.MatchString(clientSeed)
+}
+
+func ValidServerSeed(serverSeed string) bool {
+	if len(serverSeed) != SEED_BYTES*2 {
+		return false
+	}
+	_, err := hex.DecodeString(serverSeed)
+	return err == nil
+}
+
+//Client seeds of everyone in a round joined in a fixed order, so the result
+//does not depend on who joined first
+func CombineClientSeeds(clientSeeds ...string) string {
+	sorted := append([]string(nil), clientSeeds...)
+	sort.Strings(sorted)
+	return strings.Join(sorted, ",")
+}
+
+//HMAC-SHA256 keyed with the server seed over "clientSeed:nonce"
+func Digest(serverSeed string, clientSeed string, nonce uint64) []byte {
+	mac := hmac.New(sha256.New, []byte(serverSeed))
+	mac.Write([]byte(clientSeed + ":" + strconv.FormatUint(nonce, 10)))
+	return mac.Sum(nil)
+}
+
+//Uniform float in [0, 1) from the first 52 bits of the digest
+func Roll(serverSeed string, clientSeed string, nonce uint64) float64 {
+	digest := Digest(serverSeed, clientSeed, nonce)
+	bits := binary.BigEndian.Uint64(digest[:8]) >> 12
+	return float64(bits) / float64(uint64(1)<<52)
+}
+
+//Integer in [0, n), ex. the winning ticket of a jackpot or a roulette slot
+func Pick(serverSeed string, clientSeed string, nonce uint64, n int64) int64 {
+	if n <= 0 {
+		return 0
+	}
+	return int64(Roll(serverSeed, clientSeed, nonce) * float64(n))
+}
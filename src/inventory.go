@@ -0,0 +1,347 @@
+package main
+
+import (
+	"errors"
+	log "github.com/Sirupsen/logrus"
+	tradebot "github.com/skyguy126/website/src/tradebot"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Seconds a loaded inventory is served from cache
+const INVENTORY_CACHE_TIME = 300
+
+//Seconds between forced reloads, steam rate limits the inventory endpoint hard
+const INVENTORY_REFRESH_COOLDOWN = 30
+const INVENTORY_PAGE_SIZE = 48
+
+var errInventoryRefresh = errors.New("Inventory was refreshed recently, try again in a few seconds")
+var errInventoryPrivate = errors.New("Inventory is private or steam is not responding")
+
+//Anything that can load a steam inventory. tradebot.SteamService talks to
+//steamcommunity.com and tradebot.FakeSteam serves a local fake
+type InventoryClient interface {
+	LoadInventory(steam64id string, appId int, contextId string, tradableOnly bool) ([]tradebot.Item, error)
+}
+
+var inventoryClient InventoryClient
+
+//Wear order, best first
+var exteriors = []string{"Factory New", "Minimal Wear", "Field-Tested", "Well-Worn", "Battle-Scarred"}
+var exteriorShort = map[string]string{
+	"Factory New":    "FN",
+	"Minimal Wear":   "MW",
+	"Field-Tested":   "FT",
+	"Well-Worn":      "WW",
+	"Battle-Scarred": "BS",
+}
+
+var stickerImageRegex = regexp.MustCompile(`<img[^>]+src="([^"]+)"`)
+var stickerNameRegex = regexp.MustCompile(`(?:Sticker|Patch): ([^<]+)</center>`)
+var tradableAfterRegex = regexp.MustCompile(`Tradable After (.+?) GMT`)
+
+type Sticker struct {
+	Name  string `json:"name"`
+	Image string `json:"image"`
+}
+
+//Item as shown on /home, built from the raw steam description
+type InventoryItem struct {
+	AssetId        string    `json:"asset_id"`
+	ClassId        string    `json:"class_id"`
+	InstanceId     string    `json:"instance_id"`
+	Name           string    `json:"name"`
+	MarketHashName string    `json:"market_hash_name"`
+	Type           string    `json:"type"`
+	Rarity         string    `json:"rarity"`
+	Exterior       string    `json:"exterior"`
+	ExteriorShort  string    `json:"exterior_short"`
+	StatTrak       bool      `json:"stattrak"`
+	Souvenir       bool      `json:"souvenir"`
+	Icon           string    `json:"icon"`
+	Stickers       []Sticker `json:"stickers"`
+	Tradable       bool      `json:"tradable"`
+	//Unix time the trade hold ends, 0 if there is none
+	TradableAfter int64 `json:"tradable_after"`
+	//Cents, only meaningful when Priced. Unpriced items cannot be deposited
+	Price  int64 `json:"price"`
+	Priced bool  `json:"priced"`
+}
+
+//Exterior from the item tags, falling back to the "(Field-Tested)" suffix of
+//the market name for items with incomplete descriptions
+func parseExterior(item *tradebot.Item) string {
+	if tag := item.Tag("Exterior"); tag != nil {
+		for _, exterior := range exteriors {
+			if tag.Name == exterior {
+				return exterior
+			}
+		}
+	}
+	name := item.MarketHashName
+	if open := strings.LastIndex(name, " ("); open != -1 && strings.HasSuffix(name, ")") {
+		suffix := name[open+2 : len(name)-1]
+		for _, exterior := range exteriors {
+			if suffix == exterior {
+				return exterior
+			}
+		}
+	}
+	return ""
+}
+
+func exteriorRank(exterior string) int {
+	for n, e := range exteriors {
+		if e == exterior {
+			return n
+		}
+	}
+	return len(exteriors)
+}
+
+//Stickers are described by an html block with one image per sticker followed
+//by "Sticker: name, name" in the same order
+func parseStickers(descriptions []string) []Sticker {
+	stickers := make([]Sticker, 0)
+	for _, line := range descriptions {
+		if !strings.Contains(line, "sticker_info") {
+			continue
+		}
+		images := stickerImageRegex.FindAllStringSubmatch(line, -1)
+		var names []string
+		if match := stickerNameRegex.FindStringSubmatch(line); match != nil {
+			names = strings.Split(match[1], ", ")
+		}
+		for n, image := range images {
+			sticker := Sticker{Image: image[1]}
+			if n < len(names) {
+				sticker.Name = strings.TrimSpace(names[n])
+			}
+			stickers = append(stickers, sticker)
+		}
+	}
+	return stickers
+}
+
+//Trade hold end from "Tradable After Jun 12, 2024 (7:00:00) GMT"
+func parseTradableAfter(ownerDescriptions []string) time.Time {
+	for _, line := range ownerDescriptions {
+		match := tradableAfterRegex.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+		if t, err := time.Parse("Jan 2, 2006 (15:04:05)", match[1]); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+func normalizeItem(item tradebot.Item) InventoryItem {
+	normalized := InventoryItem{
+		AssetId:        item.AssetId,
+		ClassId:        item.ClassId,
+		InstanceId:     item.InstanceId,
+		Name:           item.Name,
+		MarketHashName: item.MarketHashName,
+		Type:           item.Type,
+		Exterior:       parseExterior(&item),
+		Stickers:       parseStickers(item.Descriptions),
+		Tradable:       item.Tradable,
+	}
+	normalized.ExteriorShort = exteriorShort[normalized.Exterior]
+	if item.IconUrl != "" {
+		normalized.Icon = "https://community.cloudflare.steamstatic.com/economy/image/" + item.IconUrl
+	}
+	if tag := item.Tag("Rarity"); tag != nil {
+		normalized.Rarity = tag.Name
+	}
+	if tag := item.Tag("Quality"); tag != nil {
+		normalized.StatTrak = tag.InternalName == "strange"
+		normalized.Souvenir = tag.InternalName == "tournament"
+	}
+
+	tradableAfter := item.TradableAfter
+	if tradableAfter.IsZero() && !item.Tradable {
+		tradableAfter = parseTradableAfter(item.OwnerDescriptions)
+	}
+	if !tradableAfter.IsZero() {
+		normalized.TradableAfter = tradableAfter.Unix()
+	}
+	return normalized
+}
+
+type cachedInventory struct {
+	Items   []InventoryItem
+	Fetched time.Time
+}
+
+type inventoryCache struct {
+	lock        sync.Mutex
+	inventories map[string]*cachedInventory
+}
+
+var inventories = &inventoryCache{inventories: make(map[string]*cachedInventory)}
+
+//Returns the normalized CS:GO inventory of steam64id, reloading it when the
+//cache is stale or refresh is set
+func (c *inventoryCache) Load(steam64id string, refresh bool) ([]InventoryItem, error) {
+	c.lock.Lock()
+	cached, ok := c.inventories[steam64id]
+	c.lock.Unlock()
+
+	if ok {
+		age := time.Since(cached.Fetched)
+		if refresh && age < time.Second*INVENTORY_REFRESH_COOLDOWN {
+			return nil, errInventoryRefresh
+		}
+		if !refresh && age < time.Second*INVENTORY_CACHE_TIME {
+			return cached.Items, nil
+		}
+	}
+
+	if inventoryClient == nil {
+		return nil, errInventoryPrivate
+	}
+	raw, loadErr := inventoryClient.LoadInventory(steam64id, tradebot.APPID_CSGO, tradebot.CONTEXTID_CSGO, false)
+	if loadErr != nil {
+		log.WithError(loadErr).WithField("sid", steam64id).Error("Error loading inventory")
+		return nil, errInventoryPrivate
+	}
+	items := make([]InventoryItem, 0, len(raw))
+	for _, item := range raw {
+		items = append(items, normalizeItem(item))
+	}
+
+	c.lock.Lock()
+	c.inventories[steam64id] = &cachedInventory{Items: items, Fetched: time.Now()}
+	c.lock.Unlock()
+	return items, nil
+}
+
+//Drops a cached inventory, called when items leave or enter it
+func (c *inventoryCache) Forget(steam64id string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.inventories, steam64id)
+}
+
+type InventoryQuery struct {
+	Search   string
+	Exterior string
+	//Only items that can be deposited right now
+	Tradable bool
+	StatTrak bool
+	//"name", "price", "exterior" or "rarity"
+	Sort string
+	Desc bool
+	Page int
+}
+
+type InventoryPage struct {
+	Items []InventoryItem
+	Page  int
+	Pages int
+	Total int
+}
+
+func (q *InventoryQuery) matches(item *InventoryItem) bool {
+	if q.Search != "" && !strings.Contains(strings.ToLower(item.Name), strings.ToLower(q.Search)) {
+		return false
+	}
+	if q.Exterior != "" && item.ExteriorShort != q.Exterior && item.Exterior != q.Exterior {
+		return false
+	}
+	if q.Tradable && !item.Tradable {
+		return false
+	}
+	if q.StatTrak && !item.StatTrak {
+		return false
+	}
+	return true
+}
+
+//Filters, sorts and pages an inventory without touching the cached slice.
+//Prices are looked up on every query since they move faster than the cache
+func queryInventory(items []InventoryItem, q *InventoryQuery) *InventoryPage {
+	filtered := make([]InventoryItem, 0, len(items))
+	for n := range items {
+		if q.matches(&items[n]) {
+			item := items[n]
+			item.Price, item.Priced = itemPrice(item.MarketHashName)
+			filtered = append(filtered, item)
+		}
+	}
+
+	var less func(a *InventoryItem, b *InventoryItem) bool
+	switch q.Sort {
+	case "exterior":
+		less = func(a *InventoryItem, b *InventoryItem) bool {
+			return exteriorRank(a.Exterior) < exteriorRank(b.Exterior)
+		}
+	case "price":
+		less = func(a *InventoryItem, b *InventoryItem) bool {
+			return a.Price < b.Price
+		}
+	case "rarity":
+		less = func(a *InventoryItem, b *InventoryItem) bool {
+			return a.Rarity < b.Rarity
+		}
+	default:
+		less = func(a *InventoryItem, b *InventoryItem) bool {
+			return a.Name < b.Name
+		}
+	}
+	sort.SliceStable(filtered, func(i int, j int) bool {
+		if q.Desc {
+			return less(&filtered[j], &filtered[i])
+		}
+		return less(&filtered[i], &filtered[j])
+	})
+
+	pages := (len(filtered) + INVENTORY_PAGE_SIZE - 1) / INVENTORY_PAGE_SIZE
+	page := q.Page
+	if page >= pages {
+		page = pages - 1
+	}
+	if page < 0 {
+		page = 0
+	}
+	start := page * INVENTORY_PAGE_SIZE
+	end := start + INVENTORY_PAGE_SIZE
+	if end > len(filtered) {
+		end = len(filtered)
+	}
+	return &InventoryPage{
+		Items: filtered[start:end],
+		Page:  page,
+		Pages: pages,
+		Total: len(filtered),
+	}
+}
+
+//Builds a query from a {"code":"11",...} message, missing fields keep defaults
+func parseInventoryQuery(get func(key string) string) *InventoryQuery {
+	page, _ := strconv.Atoi(get("page"))
+	return &InventoryQuery{
+		Search:   strings.TrimSpace(trimNullBytes(get("search"))),
+		Exterior: get("exterior"),
+		Tradable: get("tradable") == "true",
+		StatTrak: get("stattrak") == "true",
+		Sort:     get("sort"),
+		Desc:     get("order") == "desc",
+		Page:     page,
+	}
+}
+
+func inventoryErrorText(err error) string {
+	switch err {
+	case errInventoryRefresh, errInventoryPrivate:
+		return err.Error()
+	}
+	return "Internal server error"
+}
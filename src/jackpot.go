@@ -0,0 +1,582 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	audit "github.com/skyguy126/website/src/audit"
+	ledger "github.com/skyguy126/website/src/ledger"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type JackpotConfig struct {
+	Enabled bool `json:"enabled"`
+	//Percent of the pot kept by the house
+	Fee int `json:"fee"`
+	//Seconds from the second player joining until the draw
+	Timer int `json:"timer"`
+	//Cents
+	MinBet     int64 `json:"min_bet"`
+	MaxBet     int64 `json:"max_bet"`
+	MaxPlayers int   `json:"max_players"`
+	//A round whose timer ran out more than this many seconds before a restart
+	//is refunded instead of drawn
+	ResumeWindow int `json:"resume_window"`
+}
+
+func defaultJackpotConfig() JackpotConfig {
+	return JackpotConfig{
+		Enabled:      true,
+		Fee:          5,
+		Timer:        60,
+		MinBet:       10,
+		MaxBet:       100000,
+		MaxPlayers:   20,
+		ResumeWindow: 600,
+	}
+}
+
+//Round states, open rounds have less than two players and no timer yet
+const (
+	JACKPOT_OPEN     = "open"
+	JACKPOT_RUNNING  = "running"
+	JACKPOT_FINISHED = "finished"
+	JACKPOT_REFUNDED = "refunded"
+)
+
+const JACKPOT_GAME = "jackpot"
+
+var errJackpotUnavailable = errors.New("Jackpot is unavailable right now")
+var errJackpotClosed = errors.New("Betting is closed for this round")
+var errJackpotBet = errors.New("Bet amount is out of range")
+var errJackpotFull = errors.New("This round is full")
+var errJackpotFunds = errors.New("Not enough balance")
+
+type JackpotBet struct {
+	Id     int64
+	Sid    string
+	Ip     string
+	Amount int64
+}
+
+type JackpotRound struct {
+	Id    int64
+	State string
+	Fair  *FairCommit
+	//In the order they were placed, bet n holds the tickets right after bet n-1
+	Bets []JackpotBet
+	Pot  int64
+	//Zero until the second player joins
+	Ends time.Time
+}
+
+//Steam64 ids in the order they first joined
+func (r *JackpotRound) players() []string {
+	players := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, bet := range r.Bets {
+		if !seen[bet.Sid] {
+			seen[bet.Sid] = true
+			players = append(players, bet.Sid)
+		}
+	}
+	return players
+}
+
+func (r *JackpotRound) stakes() map[string]int64 {
+	stakes := make(map[string]int64)
+	for _, bet := range r.Bets {
+		stakes[bet.Sid] += bet.Amount
+	}
+	return stakes
+}
+
+//Owner of ticket, tickets are numbered from 0 with one per cent in the pot
+func (r *JackpotRound) ticketOwner(ticket int64) string {
+	for _, bet := range r.Bets {
+		if ticket < bet.Amount {
+			return bet.Sid
+		}
+		ticket -= bet.Amount
+	}
+	return ""
+}
+
+func (r *JackpotRound) account() string {
+	return ledger.GameAccount(JACKPOT_GAME, strconv.FormatInt(r.Id, 10))
+}
+
+type jackpotManager struct {
+	lock  sync.Mutex
+	conf  JackpotConfig
+	round *JackpotRound
+}
+
+var jackpot *jackpotManager
+
+//Resumes or settles rounds left over from the last run and starts the timer loop
+func startJackpot(conf JackpotConfig) error {
+	manager := &jackpotManager{conf: conf}
+	if err := manager.restore(); err != nil {
+		return err
+	}
+	jackpot = manager
+	go manager.loop()
+	return nil
+}
+
+func (m *jackpotManager) restore() error {
+	rows, queryErr := db.Query(`SELECT id, state, fair_id, ends FROM jackpot_rounds WHERE state IN (?, ?) ORDER BY id`,
+		JACKPOT_OPEN, JACKPOT_RUNNING)
+	if queryErr != nil {
+		return queryErr
+	}
+	rounds := make([]*JackpotRound, 0)
+	fairIds := make([]int64, 0)
+	for rows.Next() {
+		round := &JackpotRound{}
+		var fairId, ends int64
+		if err := rows.Scan(&round.Id, &round.State, &fairId, &ends); err != nil {
+			rows.Close()
+			return err
+		}
+		if ends != 0 {
+			round.Ends = time.Unix(ends, 0)
+		}
+		rounds = append(rounds, round)
+		fairIds = append(fairIds, fairId)
+	}
+	rows.Close()
+
+	for n, round := range rounds {
+		if err := m.loadRound(round, fairIds[n]); err != nil {
+			return err
+		}
+		//Only the newest round can still be running, older ones were cut off mid-draw.
+		//A round whose winner was already drawn is always paid out
+		late := !round.Ends.IsZero() && time.Since(round.Ends) > time.Second*time.Duration(m.conf.ResumeWindow)
+		if late {
+			var resolved int64
+			if err := db.QueryRow(`SELECT resolved FROM fair_results WHERE id = ?`, round.Fair.Id).Scan(&resolved); err != nil {
+				return err
+			}
+			late = resolved == 0
+		}
+		if n < len(rounds)-1 || late {
+			if err := m.refund(round); err != nil {
+				return err
+			}
+			log.WithField("round_id", round.Id).Warn("Refunded interrupted jackpot round")
+			continue
+		}
+		log.WithFields(log.Fields{"round_id": round.Id, "bets": len(round.Bets)}).Info("Resuming jackpot round")
+		m.round = round
+	}
+	if m.round == nil {
+		return m.newRound()
+	}
+	return nil
+}
+
+func (m *jackpotManager) loadRound(round *JackpotRound, fairId int64) error {
+	rows, queryErr := db.Query(`SELECT id, sid, ip, amount FROM jackpot_bets WHERE round_id = ? ORDER BY id`, round.Id)
+	if queryErr != nil {
+		return queryErr
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var bet JackpotBet
+		if err := rows.Scan(&bet.Id, &bet.Sid, &bet.Ip, &bet.Amount); err != nil {
+			return err
+		}
+		round.Bets = append(round.Bets, bet)
+		round.Pot += bet.Amount
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	//A crash between creating the round and committing its seed leaves no commit
+	if fairId == 0 {
+		return m.commitRound(round)
+	}
+	commit, commitErr := loadFairCommit(fairId)
+	if commitErr != nil {
+		return commitErr
+	}
+	round.Fair = commit
+	return nil
+}
+
+func (m *jackpotManager) commitRound(round *JackpotRound) error {
+	commit, commitErr := commitFairRound(JACKPOT_GAME, strconv.FormatInt(round.Id, 10))
+	if commitErr != nil {
+		return commitErr
+	}
+	if _, err := db.Exec(`UPDATE jackpot_rounds SET fair_id = ? WHERE id = ?`, commit.Id, round.Id); err != nil {
+		return err
+	}
+	round.Fair = commit
+	return nil
+}
+
+//Must be called with the lock held
+func (m *jackpotManager) newRound() error {
+	now := time.Now().Unix()
+	res, execErr := db.Exec(`INSERT INTO jackpot_rounds (state, created, updated) VALUES (?, ?, ?)`, JACKPOT_OPEN, now, now)
+	if execErr != nil {
+		return execErr
+	}
+	id, _ := res.LastInsertId()
+	round := &JackpotRound{Id: id, State: JACKPOT_OPEN}
+	if err := m.commitRound(round); err != nil {
+		return err
+	}
+	m.round = round
+	return nil
+}
+
+//Opens the next round, retried every tick until it works. Returns the state
+//to broadcast or nil. Must be called with the lock held
+func (m *jackpotManager) reopen() map[string]interface{} {
+	if err := m.newRound(); err != nil {
+		log.WithError(err).Error("Error opening jackpot round")
+		return nil
+	}
+	return m.stateMessage()
+}
+
+//Moves amount from the user's balance into the current pot
+func (m *jackpotManager) Bet(steam64id string, ip string, amount int64) error {
+	m.lock.Lock()
+	round := m.round
+	if round == nil {
+		m.lock.Unlock()
+		return errJackpotUnavailable
+	}
+	err := m.bet(round, steam64id, ip, amount)
+	var state map[string]interface{}
+	if err == nil {
+		state = m.stateMessage()
+	}
+	m.lock.Unlock()
+
+	if err != nil {
+		return err
+	}
+	sendToAll(state)
+	sendBalance(steam64id)
+	return nil
+}
+
+func (m *jackpotManager) bet(round *JackpotRound, steam64id string, ip string, amount int64) error {
+	if round.State != JACKPOT_OPEN && round.State != JACKPOT_RUNNING {
+		return errJackpotClosed
+	}
+	if !round.Ends.IsZero() && !time.Now().Before(round.Ends) {
+		return errJackpotClosed
+	}
+	if amount < m.conf.MinBet || amount > m.conf.MaxBet {
+		return errJackpotBet
+	}
+	unlock := userLocks.Lock(steam64id)
+	defer unlock()
+	if err := checkWager(steam64id, amount); err != nil {
+		return err
+	}
+	players := round.players()
+	isNew := true
+	for _, player := range players {
+		if player == steam64id {
+			isNew = false
+		}
+	}
+	if isNew && len(players) >= m.conf.MaxPlayers {
+		return errJackpotFull
+	}
+
+	tx, txErr := db.Begin()
+	if txErr != nil {
+		return txErr
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	res, execErr := tx.Exec(`INSERT INTO jackpot_bets (round_id, sid, ip, amount, created) VALUES (?, ?, ?, ?, ?)`,
+		round.Id, steam64id, ip, amount, now.Unix())
+	if execErr != nil {
+		return execErr
+	}
+	betId, _ := res.LastInsertId()
+	_, postErr := books.PostTx(tx, &ledger.Entry{
+		Key:  "jackpot-bet:" + strconv.FormatInt(betId, 10),
+		Kind: "jackpot_bet",
+		Ref:  strconv.FormatInt(round.Id, 10),
+		Postings: []ledger.Posting{
+			{Account: ledger.UserAccount(steam64id), Amount: -amount},
+			{Account: round.account(), Amount: amount},
+		},
+	})
+	if postErr == ledger.ErrInsufficientFunds {
+		return errJackpotFunds
+	}
+	if postErr != nil {
+		return postErr
+	}
+
+	state := round.State
+	ends := round.Ends
+	if isNew && len(players) == 1 {
+		state = JACKPOT_RUNNING
+		ends = now.Add(time.Second * time.Duration(m.conf.Timer))
+	}
+	var endsUnix int64
+	if !ends.IsZero() {
+		endsUnix = ends.Unix()
+	}
+	_, execErr = tx.Exec(`UPDATE jackpot_rounds SET state = ?, pot = pot + ?, ends = ?, updated = ? WHERE id = ?`,
+		state, amount, endsUnix, now.Unix(), round.Id)
+	if execErr != nil {
+		return execErr
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	round.Bets = append(round.Bets, JackpotBet{Id: betId, Sid: steam64id, Ip: ip, Amount: amount})
+	round.Pot += amount
+	round.State = state
+	round.Ends = ends
+	log.WithFields(log.Fields{"round_id": round.Id, "sid": steam64id, "amount": amount}).Info("Jackpot bet")
+	return nil
+}
+
+func (m *jackpotManager) loop() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		m.tick()
+	}
+}
+
+//Draws the round once its timer runs out and opens the next one
+func (m *jackpotManager) tick() {
+	m.lock.Lock()
+	if m.round == nil {
+		state := m.reopen()
+		m.lock.Unlock()
+		if state != nil {
+			sendToAll(state)
+		}
+		return
+	}
+	round := m.round
+	if round.State != JACKPOT_RUNNING || time.Now().Before(round.Ends) {
+		m.lock.Unlock()
+		return
+	}
+
+	result, drawErr := m.draw(round)
+	if drawErr != nil {
+		//Tried again next tick, bets stay closed since the timer has run out
+		m.lock.Unlock()
+		log.WithError(drawErr).WithField("round_id", round.Id).Error("Error drawing jackpot round")
+		return
+	}
+	m.round = nil
+	state := m.reopen()
+	m.lock.Unlock()
+
+	sendToAll(result)
+	sendBalance(result["winner"])
+	if state != nil {
+		sendToAll(state)
+	}
+}
+
+//Picks the winning ticket and pays the pot minus the fee to its owner
+func (m *jackpotManager) draw(round *JackpotRound) (map[string]string, error) {
+	seeds, seedsErr := clientSeeds(round.players())
+	if seedsErr != nil {
+		return nil, seedsErr
+	}
+	var ticket int64
+	var winner string
+	fair, fairErr := resolveFairRound(round.Fair, seeds, func(roll float64) string {
+		ticket = int64(roll * float64(round.Pot))
+		winner = round.ticketOwner(ticket)
+		return fmt.Sprintf("ticket %d of %d won by %s", ticket, round.Pot, winner)
+	})
+	if fairErr != nil {
+		return nil, fairErr
+	}
+	//Already resolved before a restart, the callback did not run
+	if winner == "" {
+		ticket = int64(fair.Roll * float64(round.Pot))
+		winner = round.ticketOwner(ticket)
+	}
+	fee := round.Pot * int64(m.conf.Fee) / 100
+	payout := round.Pot - fee
+
+	tx, txErr := db.Begin()
+	if txErr != nil {
+		return nil, txErr
+	}
+	defer tx.Rollback()
+
+	postings := []ledger.Posting{
+		{Account: round.account(), Amount: -round.Pot},
+		{Account: ledger.UserAccount(winner), Amount: payout},
+	}
+	if fee > 0 {
+		postings = append(postings, ledger.Posting{Account: ledger.ACCOUNT_FEES, Amount: fee})
+	}
+	_, postErr := books.PostTx(tx, &ledger.Entry{
+		Key:      "jackpot-win:" + strconv.FormatInt(round.Id, 10),
+		Kind:     "jackpot_win",
+		Ref:      strconv.FormatInt(round.Id, 10),
+		Postings: postings,
+	})
+	if postErr != nil {
+		return nil, postErr
+	}
+	_, execErr := tx.Exec(`UPDATE jackpot_rounds SET state = ?, fee = ?, winner = ?, ticket = ?, updated = ? WHERE id = ?`,
+		JACKPOT_FINISHED, fee, winner, ticket, time.Now().Unix(), round.Id)
+	if execErr != nil {
+		return nil, execErr
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	round.State = JACKPOT_FINISHED
+	log.WithFields(log.Fields{"round_id": round.Id, "winner": winner, "ticket": ticket, "pot": round.Pot}).Info("Jackpot round won")
+
+	result := map[string]string{
+		"code":     "19",
+		"round_id": strconv.FormatInt(round.Id, 10),
+		"winner":   winner,
+		"nickname": "",
+		"avatar":   "",
+		"ticket":   strconv.FormatInt(ticket, 10),
+		"pot":      strconv.FormatInt(round.Pot, 10),
+		"payout":   strconv.FormatInt(payout, 10),
+		//The client spins to the same spot on every screen
+		"animation_seed": strconv.FormatFloat(fair.Roll, 'f', -1, 64),
+	}
+	if profile := profiles.Get(winner); profile != nil {
+		result["nickname"] = profile.Nickname
+		result["avatar"] = profile.Avatar
+	}
+	for key, value := range fairRoundInfo(round.Fair) {
+		result[key] = value
+	}
+	return result, nil
+}
+
+//Returns every stake of a round that cannot be finished
+func (m *jackpotManager) refund(round *JackpotRound) error {
+	tx, txErr := db.Begin()
+	if txErr != nil {
+		return txErr
+	}
+	defer tx.Rollback()
+
+	if round.Pot > 0 {
+		postings := []ledger.Posting{{Account: round.account(), Amount: -round.Pot}}
+		for _, steam64id := range round.players() {
+			postings = append(postings, ledger.Posting{Account: ledger.UserAccount(steam64id), Amount: round.stakes()[steam64id]})
+		}
+		_, postErr := books.PostTx(tx, &ledger.Entry{
+			Key:      "jackpot-refund:" + strconv.FormatInt(round.Id, 10),
+			Kind:     "jackpot_refund",
+			Ref:      strconv.FormatInt(round.Id, 10),
+			Postings: postings,
+		})
+		if postErr != nil {
+			return postErr
+		}
+	}
+	_, execErr := tx.Exec(`UPDATE jackpot_rounds SET state = ?, updated = ? WHERE id = ?`, JACKPOT_REFUNDED, time.Now().Unix(), round.Id)
+	if execErr != nil {
+		return execErr
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	round.State = JACKPOT_REFUNDED
+
+	//Closes the commit so the seed can still be revealed
+	if _, err := resolveFairRound(round.Fair, nil, func(roll float64) string { return "refunded" }); err != nil {
+		log.WithError(err).WithField("round_id", round.Id).Error("Error closing fair commit of jackpot round")
+	}
+	for _, steam64id := range round.players() {
+		if err := recordAudit(steam64id, "", audit.EVENT_GAME_REFUND, "jackpot round "+strconv.FormatInt(round.Id, 10)); err != nil {
+			log.WithError(err).WithField("sid", steam64id).Error("Error writing jackpot refund audit entry")
+		}
+	}
+	return nil
+}
+
+//Must be called with the lock held
+func (m *jackpotManager) stateMessage() map[string]interface{} {
+	round := m.round
+	stakes := round.stakes()
+	players := make([]map[string]string, 0)
+	for _, steam64id := range round.players() {
+		player := map[string]string{
+			"sid":      steam64id,
+			"nickname": "",
+			"avatar":   "",
+			"amount":   strconv.FormatInt(stakes[steam64id], 10),
+			"chance":   strconv.FormatFloat(float64(stakes[steam64id])*100/float64(round.Pot), 'f', 2, 64),
+		}
+		if profile := profiles.Get(steam64id); profile != nil {
+			player["nickname"] = profile.Nickname
+			player["avatar"] = profile.Avatar
+		}
+		players = append(players, player)
+	}
+	var ends, timeLeft int64
+	if !round.Ends.IsZero() {
+		ends = round.Ends.Unix()
+		timeLeft = int64(time.Until(round.Ends).Seconds())
+		if timeLeft < 0 {
+			timeLeft = 0
+		}
+	}
+	msg := map[string]interface{}{
+		"code":      "18",
+		"round_id":  strconv.FormatInt(round.Id, 10),
+		"state":     round.State,
+		"pot":       strconv.FormatInt(round.Pot, 10),
+		"fee":       strconv.Itoa(m.conf.Fee),
+		"ends":      strconv.FormatInt(ends, 10),
+		"time_left": strconv.FormatInt(timeLeft, 10),
+		"players":   players,
+	}
+	for key, value := range fairRoundInfo(round.Fair) {
+		msg[key] = value
+	}
+	return msg
+}
+
+//Current round for a client that just connected
+func (m *jackpotManager) State() map[string]interface{} {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.round == nil {
+		return nil
+	}
+	return m.stateMessage()
+}
+
+func jackpotErrorText(err error) string {
+	switch err {
+	case errJackpotUnavailable, errJackpotClosed, errJackpotBet, errJackpotFull, errJackpotFunds,
+		errSelfExcluded, errWagerLimit:
+		return err.Error()
+	}
+	return "Internal server error"
+}
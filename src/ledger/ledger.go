@@ -0,0 +1,219 @@
+//Package ledger is a double-entry journal of user balances in cents. Every
+//entry moves value between accounts and its postings sum to zero, so the
+//balances of all accounts always sum to zero as well. The tables are created
+//by the site's migrations and the queries are written for sqlite
+package ledger
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+)
+
+//User accounts are "user:<steam64 id>" and can never go negative
+const USER_PREFIX = "user:"
+
+//Value of items held by the bots, debited when items come in
+const ACCOUNT_DEPOSITS = "system:deposits"
+
+//Value of items sent out by the bots
+const ACCOUNT_WITHDRAWALS = "system:withdrawals"
+
+//House edge taken from games
+const ACCOUNT_FEES = "system:fees"
+
+//Bankroll of games played against the house, ex. roulette. Takes losing bets
+//and pays winning ones
+const ACCOUNT_HOUSE = "system:house"
+
+//Manual corrections by admins
+const ACCOUNT_ADJUSTMENTS = "system:adjustments"
+
+var ErrUnbalanced = errors.New("ledger: postings do not sum to zero")
+var ErrEmptyEntry = errors.New("ledger: entry has no postings")
+var ErrNoKey = errors.New("ledger: entry needs an idempotency key")
+var ErrInsufficientFunds = errors.New("ledger: insufficient funds")
+
+func UserAccount(steam64id string) string {
+	return USER_PREFIX + steam64id
+}
+
+//Escrow account holding the stakes of one game round
+func GameAccount(game string, round string) string {
+	return "game:" + game + ":" + round
+}
+
+type Posting struct {
+	Account string
+	//Positive credits the account, negative debits it
+	Amount int64
+}
+
+type Entry struct {
+	Id int64
+	//Posting an entry twice with the same key only records it once
+	Key      string
+	Kind     string
+	Ref      string
+	Memo     string
+	Time     time.Time
+	Postings []Posting
+}
+
+type Ledger struct {
+	db  *sql.DB
+	now func() time.Time
+}
+
+func New(db *sql.DB) *Ledger {
+	return &Ledger{db: db, now: time.Now}
+}
+
+func (e *Entry) validate() error {
+	if e.Key == "" {
+		return ErrNoKey
+	}
+	if len(e.Postings) == 0 {
+		return ErrEmptyEntry
+	}
+	var sum int64
+	for _, posting := range e.Postings {
+		sum += posting.Amount
+	}
+	if sum != 0 {
+		return ErrUnbalanced
+	}
+	return nil
+}
+
+//Records an entry in its own transaction. Returns false without error if an
+//entry with the same key was already posted
+func (l *Ledger) Post(e *Entry) (bool, error) {
+	tx, txErr := l.db.Begin()
+	if txErr != nil {
+		return false, txErr
+	}
+	defer tx.Rollback()
+	created, postErr := l.PostTx(tx, e)
+	if postErr != nil {
+		return false, postErr
+	}
+	return created, tx.Commit()
+}
+
+//Records an entry inside the caller's transaction, so it commits or rolls
+//back together with whatever caused it
+func (l *Ledger) PostTx(tx *sql.Tx, e *Entry) (bool, error) {
+	if err := e.validate(); err != nil {
+		return false, err
+	}
+
+	var existing int64
+	err := tx.QueryRow(`SELECT id FROM ledger_entries WHERE idempotency_key = ?`, e.Key).Scan(&existing)
+	if err == nil {
+		e.Id = existing
+		return false, nil
+	}
+	if err != sql.ErrNoRows {
+		return false, err
+	}
+
+	if e.Time.IsZero() {
+		e.Time = l.now()
+	}
+	result, insertErr := tx.Exec(`INSERT INTO ledger_entries (idempotency_key, kind, ref, memo, time) VALUES (?, ?, ?, ?, ?)`,
+		e.Key, e.Kind, e.Ref, e.Memo, e.Time.Unix())
+	if insertErr != nil {
+		return false, insertErr
+	}
+	entryId, idErr := result.LastInsertId()
+	if idErr != nil {
+		return false, idErr
+	}
+	e.Id = entryId
+
+	for _, posting := range e.Postings {
+		if _, err := tx.Exec(`INSERT INTO ledger_postings (entry_id, account, amount) VALUES (?, ?, ?)`,
+			entryId, posting.Account, posting.Amount); err != nil {
+			return false, err
+		}
+		if _, err := tx.Exec(`INSERT INTO ledger_balances (account, balance, entry_id) VALUES (?, 0, 0)
+			ON CONFLICT(account) DO NOTHING`, posting.Account); err != nil {
+			return false, err
+		}
+		if _, err := tx.Exec(`UPDATE ledger_balances SET balance = balance + ?, entry_id = ? WHERE account = ?`,
+			posting.Amount, entryId, posting.Account); err != nil {
+			return false, err
+		}
+		if strings.HasPrefix(posting.Account, USER_PREFIX) && posting.Amount < 0 {
+			var balance int64
+			if err := tx.QueryRow(`SELECT balance FROM ledger_balances WHERE account = ?`, posting.Account).Scan(&balance); err != nil {
+				return false, err
+			}
+			if balance < 0 {
+				return false, ErrInsufficientFunds
+			}
+		}
+	}
+	return true, nil
+}
+
+//Balance of an account, 0 if it has never been posted to
+func (l *Ledger) Balance(account string) (int64, error) {
+	var balance int64
+	err := l.db.QueryRow(`SELECT balance FROM ledger_balances WHERE account = ?`, account).Scan(&balance)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return balance, err
+}
+
+//Most recent entries touching an account, newest first, with only that
+//account's postings filled in
+func (l *Ledger) History(account string, limit int) ([]*Entry, error) {
+	rows, queryErr := l.db.Query(`SELECT e.id, e.idempotency_key, e.kind, e.ref, e.memo, e.time, p.amount
+		FROM ledger_postings p JOIN ledger_entries e ON e.id = p.entry_id
+		WHERE p.account = ? ORDER BY e.id DESC LIMIT ?`, account, limit)
+	if queryErr != nil {
+		return nil, queryErr
+	}
+	defer rows.Close()
+
+	entries := make([]*Entry, 0)
+	for rows.Next() {
+		entry := &Entry{}
+		var t, amount int64
+		if err := rows.Scan(&entry.Id, &entry.Key, &entry.Kind, &entry.Ref, &entry.Memo, &t, &amount); err != nil {
+			return nil, err
+		}
+		entry.Time = time.Unix(t, 0)
+		entry.Postings = []Posting{{Account: account, Amount: amount}}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+//Copies every balance into ledger_snapshots. Reconcile replays postings on
+//top of the latest snapshot, so snapshots also bound how much it has to read
+func (l *Ledger) Snapshot() error {
+	tx, txErr := l.db.Begin()
+	if txErr != nil {
+		return txErr
+	}
+	defer tx.Rollback()
+
+	var lastEntry, lastSnapshot int64
+	if err := tx.QueryRow(`SELECT COALESCE(MAX(id), 0) FROM ledger_entries`).Scan(&lastEntry); err != nil {
+		return err
+	}
+	if err := tx.QueryRow(`SELECT COALESCE(MAX(snapshot), 0) FROM ledger_snapshots`).Scan(&lastSnapshot); err != nil {
+		return err
+	}
+	_, execErr := tx.Exec(`INSERT INTO ledger_snapshots (snapshot, time, entry_id, account, balance)
+		SELECT ?, ?, ?, account, balance FROM ledger_balances`, lastSnapshot+1, l.now().Unix(), lastEntry)
+	if execErr != nil {
+		return execErr
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,215 @@
+package ledger
+
+import (
+	"database/sql"
+	_ "github.com/mattn/go-sqlite3"
+	"testing"
+)
+
+//Same tables as the site's migrations
+var testSchema = []string{
+	`CREATE TABLE ledger_entries (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		idempotency_key TEXT NOT NULL UNIQUE,
+		kind TEXT NOT NULL,
+		ref TEXT NOT NULL,
+		memo TEXT NOT NULL,
+		time INTEGER NOT NULL
+	)`,
+	`CREATE TABLE ledger_postings (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		entry_id INTEGER NOT NULL REFERENCES ledger_entries (id),
+		account TEXT NOT NULL,
+		amount INTEGER NOT NULL
+	)`,
+	`CREATE INDEX ledger_postings_account ON ledger_postings (account, entry_id)`,
+	`CREATE TABLE ledger_balances (
+		account TEXT PRIMARY KEY,
+		balance INTEGER NOT NULL,
+		entry_id INTEGER NOT NULL
+	)`,
+	`CREATE TABLE ledger_snapshots (
+		snapshot INTEGER NOT NULL,
+		time INTEGER NOT NULL,
+		entry_id INTEGER NOT NULL,
+		account TEXT NOT NULL,
+		balance INTEGER NOT NULL,
+		PRIMARY KEY (snapshot, account)
+	)`,
+}
+
+const testUser = "76561198000000001"
+
+func newTestLedger(t *testing.T) (*Ledger, *sql.DB) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	//Every connection to :memory: is its own database
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+	for _, statement := range testSchema {
+		if _, err := db.Exec(statement); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return New(db), db
+}
+
+func deposit(key string, amount int64) *Entry {
+	return &Entry{
+		Key:  key,
+		Kind: "deposit",
+		Postings: []Posting{
+			{Account: UserAccount(testUser), Amount: amount},
+			{Account: ACCOUNT_DEPOSITS, Amount: -amount},
+		},
+	}
+}
+
+func bet(key string, amount int64) *Entry {
+	return &Entry{
+		Key:  key,
+		Kind: "roulette_bet",
+		Postings: []Posting{
+			{Account: UserAccount(testUser), Amount: -amount},
+			{Account: ACCOUNT_HOUSE, Amount: amount},
+		},
+	}
+}
+
+func (l *Ledger) mustBalance(t *testing.T, account string, expected int64) {
+	t.Helper()
+	balance, err := l.Balance(account)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if balance != expected {
+		t.Fatalf("%s: expected balance %d, got %d", account, expected, balance)
+	}
+}
+
+func countRows(t *testing.T, db *sql.DB, table string) int {
+	t.Helper()
+	var count int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM ` + table).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	return count
+}
+
+func TestPostSameKeyOnce(t *testing.T) {
+	books, db := newTestLedger(t)
+	first := deposit("deposit:1", 500)
+	created, err := books.Post(first)
+	if err != nil || !created {
+		t.Fatalf("first post: created %v, err %v", created, err)
+	}
+
+	again := deposit("deposit:1", 500)
+	created, err = books.Post(again)
+	if err != nil || created {
+		t.Fatalf("second post with the same key: created %v, err %v", created, err)
+	}
+	if again.Id != first.Id {
+		t.Fatalf("second post should return entry %d, got %d", first.Id, again.Id)
+	}
+	books.mustBalance(t, UserAccount(testUser), 500)
+	books.mustBalance(t, ACCOUNT_DEPOSITS, -500)
+	if entries := countRows(t, db, "ledger_entries"); entries != 1 {
+		t.Fatalf("expected 1 entry, got %d", entries)
+	}
+	if postings := countRows(t, db, "ledger_postings"); postings != 2 {
+		t.Fatalf("expected 2 postings, got %d", postings)
+	}
+}
+
+func TestUserCannotGoNegative(t *testing.T) {
+	books, db := newTestLedger(t)
+	if _, err := books.Post(deposit("deposit:1", 500)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := books.Post(bet("bet:1", 501)); err != ErrInsufficientFunds {
+		t.Fatalf("expected ErrInsufficientFunds, got %v", err)
+	}
+	//The failed entry is rolled back completely
+	books.mustBalance(t, UserAccount(testUser), 500)
+	books.mustBalance(t, ACCOUNT_HOUSE, 0)
+	if entries := countRows(t, db, "ledger_entries"); entries != 1 {
+		t.Fatalf("expected only the deposit entry, got %d", entries)
+	}
+
+	//Spending the whole balance is fine, system accounts may go negative
+	if _, err := books.Post(bet("bet:2", 500)); err != nil {
+		t.Fatal(err)
+	}
+	books.mustBalance(t, UserAccount(testUser), 0)
+	books.mustBalance(t, ACCOUNT_DEPOSITS, -500)
+}
+
+func TestRejectsInvalidEntries(t *testing.T) {
+	books, db := newTestLedger(t)
+	unbalanced := deposit("deposit:1", 500)
+	unbalanced.Postings[1].Amount = -499
+	entries := map[error]*Entry{
+		ErrUnbalanced: unbalanced,
+		ErrEmptyEntry: {Key: "empty", Kind: "deposit"},
+		ErrNoKey:      {Kind: "deposit", Postings: deposit("", 500).Postings},
+	}
+	for expected, entry := range entries {
+		if _, err := books.Post(entry); err != expected {
+			t.Errorf("expected %v, got %v", expected, err)
+		}
+	}
+	if count := countRows(t, db, "ledger_entries"); count != 0 {
+		t.Fatalf("invalid entries were recorded: %d", count)
+	}
+	books.mustBalance(t, UserAccount(testUser), 0)
+}
+
+func TestReconcile(t *testing.T) {
+	books, db := newTestLedger(t)
+	books.Post(deposit("deposit:1", 1000))
+	books.Post(bet("bet:1", 300))
+	if err := books.Snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	books.Post(bet("bet:2", 200))
+
+	report, err := books.Reconcile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() || report.Entries != 3 || report.Accounts != 3 {
+		t.Fatalf("expected clean books with 3 entries and 3 accounts, got %+v", report)
+	}
+
+	//A stored balance that no longer matches snapshot plus postings
+	if _, err := db.Exec(`UPDATE ledger_balances SET balance = balance + 1 WHERE account = ?`, UserAccount(testUser)); err != nil {
+		t.Fatal(err)
+	}
+	report, err = books.Reconcile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.OK() || report.Total != 1 {
+		t.Fatalf("expected the edited balance to be reported, got %+v", report)
+	}
+}
+
+func TestReconcileUnbalancedEntry(t *testing.T) {
+	books, db := newTestLedger(t)
+	entry := deposit("deposit:1", 1000)
+	books.Post(entry)
+	//Written around PostTx, which would have refused it
+	if _, err := db.Exec(`INSERT INTO ledger_postings (entry_id, account, amount) VALUES (?, ?, 5)`, entry.Id, ACCOUNT_FEES); err != nil {
+		t.Fatal(err)
+	}
+	report, err := books.Reconcile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.OK() {
+		t.Fatal("expected the unbalanced entry to be reported")
+	}
+}
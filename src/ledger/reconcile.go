@@ -0,0 +1,133 @@
+package ledger
+
+import (
+	"fmt"
+	"strings"
+)
+
+type Report struct {
+	Accounts int
+	Entries  int
+	//Sum of every balance, anything but zero means value was created or lost
+	Total    int64
+	Problems []string
+}
+
+func (r *Report) OK() bool {
+	return len(r.Problems) == 0
+}
+
+func (r *Report) problem(format string, args ...interface{}) {
+	r.Problems = append(r.Problems, fmt.Sprintf(format, args...))
+}
+
+//Checks that the books balance: every entry sums to zero, all accounts sum to
+//zero, no user is overdrawn and every stored balance matches the latest
+//snapshot plus the postings made since
+func (l *Ledger) Reconcile() (*Report, error) {
+	report := &Report{}
+
+	if err := l.db.QueryRow(`SELECT COUNT(*) FROM ledger_entries`).Scan(&report.Entries); err != nil {
+		return nil, err
+	}
+
+	balances := make(map[string]int64)
+	rows, queryErr := l.db.Query(`SELECT account, balance FROM ledger_balances`)
+	if queryErr != nil {
+		return nil, queryErr
+	}
+	for rows.Next() {
+		var account string
+		var balance int64
+		if err := rows.Scan(&account, &balance); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		balances[account] = balance
+		report.Total += balance
+		if strings.HasPrefix(account, USER_PREFIX) && balance < 0 {
+			report.problem("%s is overdrawn: %d", account, balance)
+		}
+	}
+	rows.Close()
+	report.Accounts = len(balances)
+	if report.Total != 0 {
+		report.problem("accounts sum to %d instead of 0", report.Total)
+	}
+
+	rows, queryErr = l.db.Query(`SELECT e.id, COALESCE(SUM(p.amount), 0), COUNT(p.id)
+		FROM ledger_entries e LEFT JOIN ledger_postings p ON p.entry_id = e.id
+		GROUP BY e.id HAVING COALESCE(SUM(p.amount), 0) != 0 OR COUNT(p.id) = 0`)
+	if queryErr != nil {
+		return nil, queryErr
+	}
+	for rows.Next() {
+		var id, sum, count int64
+		if err := rows.Scan(&id, &sum, &count); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if count == 0 {
+			report.problem("entry %d has no postings", id)
+		} else {
+			report.problem("entry %d sums to %d", id, sum)
+		}
+	}
+	rows.Close()
+
+	expected, replayErr := l.replay()
+	if replayErr != nil {
+		return nil, replayErr
+	}
+	for account, balance := range balances {
+		if expected[account] != balance {
+			report.problem("%s balance is %d but snapshot and postings give %d", account, balance, expected[account])
+		}
+	}
+	for account, balance := range expected {
+		if _, ok := balances[account]; !ok {
+			report.problem("%s has postings totalling %d but no balance", account, balance)
+		}
+	}
+	return report, nil
+}
+
+//Balances rebuilt from the latest snapshot and the postings after it
+func (l *Ledger) replay() (map[string]int64, error) {
+	var snapshot, snapshotEntry int64
+	err := l.db.QueryRow(`SELECT COALESCE(MAX(snapshot), 0) FROM ledger_snapshots`).Scan(&snapshot)
+	if err != nil {
+		return nil, err
+	}
+
+	expected := make(map[string]int64)
+	rows, queryErr := l.db.Query(`SELECT account, balance, entry_id FROM ledger_snapshots WHERE snapshot = ?`, snapshot)
+	if queryErr != nil {
+		return nil, queryErr
+	}
+	for rows.Next() {
+		var account string
+		var balance int64
+		if err := rows.Scan(&account, &balance, &snapshotEntry); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		expected[account] = balance
+	}
+	rows.Close()
+
+	rows, queryErr = l.db.Query(`SELECT account, SUM(amount) FROM ledger_postings WHERE entry_id > ? GROUP BY account`, snapshotEntry)
+	if queryErr != nil {
+		return nil, queryErr
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var account string
+		var sum int64
+		if err := rows.Scan(&account, &sum); err != nil {
+			return nil, err
+		}
+		expected[account] += sum
+	}
+	return expected, rows.Err()
+}
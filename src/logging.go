@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	log "github.com/Sirupsen/logrus"
+	"net/http"
+	"sync"
+)
+
+type LogConfig struct {
+	//debug, info, warn or error
+	Level string `json:"level"`
+	//"text" or "json", json writes one object per line for log shippers
+	Format string `json:"format"`
+}
+
+func defaultLogConfig() LogConfig {
+	return LogConfig{
+		Level:  "info",
+		Format: "text",
+	}
+}
+
+var errLogFormat = errors.New("Log format must be text or json")
+
+func setupLogging(conf LogConfig) error {
+	level, levelErr := log.ParseLevel(conf.Level)
+	if levelErr != nil {
+		return levelErr
+	}
+	switch conf.Format {
+	case "text":
+		log.SetFormatter(&log.TextFormatter{FullTimestamp: true})
+	case "json":
+		log.SetFormatter(&log.JSONFormatter{})
+	default:
+		return errLogFormat
+	}
+	log.SetLevel(level)
+	return nil
+}
+
+const requestLogKey contextKey = 1
+
+//Short random id for requests and socket connections, only has to be unique
+//enough to grep the logs with
+func genLogId() string {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(buf)
+}
+
+//Logger of a single request, checkSession adds the sid to it so every line
+//after the session check carries it
+type requestLogger struct {
+	lock  sync.Mutex
+	entry *log.Entry
+}
+
+//Assigns every request an id, sent back in X-Request-Id, and a logger carrying it
+func RequestIdHandler(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		requestId := genLogId()
+		w.Header().Set("X-Request-Id", requestId)
+		logger := &requestLogger{entry: log.WithFields(log.Fields{
+			"request_id": requestId,
+			"ip":         remoteIp(r.RemoteAddr),
+		})}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestLogKey, logger)))
+	}
+	return http.HandlerFunc(fn)
+}
+
+//Logger for r, falls back to one with only the ip outside RequestIdHandler
+func requestLog(r *http.Request) *log.Entry {
+	logger, ok := r.Context().Value(requestLogKey).(*requestLogger)
+	if !ok {
+		return log.WithField("ip", remoteIp(r.RemoteAddr))
+	}
+	logger.lock.Lock()
+	defer logger.lock.Unlock()
+	return logger.entry
+}
+
+func setRequestSid(r *http.Request, steam64id string) {
+	logger, ok := r.Context().Value(requestLogKey).(*requestLogger)
+	if !ok {
+		return
+	}
+	logger.lock.Lock()
+	defer logger.lock.Unlock()
+	logger.entry = logger.entry.WithField("sid", steam64id)
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/json"
+	log "github.com/Sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+//In-memory Store for single node deployments and development,
+//optionally snapshotted to a local file so sessions survive restarts
+type memoryStore struct {
+	lock         sync.Mutex
+	entries      map[string]*memEntry
+	snapshotFile string
+	quit         chan bool
+	done         chan bool
+}
+
+type memEntry struct {
+	Value  string            `json:"value,omitempty"`
+	Fields map[string]string `json:"fields,omitempty"`
+	Count  int64             `json:"count,omitempty"`
+	//Unix time, 0 never expires
+	Expires int64 `json:"expires"`
+}
+
+func (e *memEntry) expired(now int64) bool {
+	return e.Expires != 0 && e.Expires <= now
+}
+
+func newMemoryStore(snapshotFile string, interval int) (*memoryStore, error) {
+	s := &memoryStore{
+		entries:      make(map[string]*memEntry),
+		snapshotFile: snapshotFile,
+	}
+	if snapshotFile == "" {
+		return s, nil
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	if interval > 0 {
+		s.quit = make(chan bool)
+		s.done = make(chan bool)
+		go s.snapshotLoop(time.Second * time.Duration(interval))
+	}
+	return s, nil
+}
+
+//Caller must hold lock
+func (s *memoryStore) get(key string) *memEntry {
+	entry, ok := s.entries[key]
+	if !ok {
+		return nil
+	}
+	if entry.expired(time.Now().Unix()) {
+		delete(s.entries, key)
+		return nil
+	}
+	return entry
+}
+
+func expiry(ttl int) int64 {
+	if ttl <= 0 {
+		return 0
+	}
+	return time.Now().Unix() + int64(ttl)
+}
+
+func (s *memoryStore) ClaimToken(token string, sid string, ttl int) (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.get("token."+token) != nil {
+		return false, nil
+	}
+	s.entries["token."+token] = &memEntry{Value: sid, Expires: expiry(ttl)}
+	return true, nil
+}
+
+func (s *memoryStore) SetOnline(sid string) (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.get("online."+sid) != nil {
+		return false, nil
+	}
+	s.entries["online."+sid] = &memEntry{Value: sid}
+	return true, nil
+}
+
+func (s *memoryStore) SetOffline(sid string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.entries, "online."+sid)
+	return nil
+}
+
+func (s *memoryStore) PutSession(id string, values map[string]string, ttl int) error {
+	fields := make(map[string]string, len(values))
+	for k, v := range values {
+		fields[k] = v
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.entries["sess."+id] = &memEntry{Fields: fields, Expires: expiry(ttl)}
+	return nil
+}
+
+func (s *memoryStore) GetSession(id string) (map[string]string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	entry := s.get("sess." + id)
+	if entry == nil {
+		return nil, nil
+	}
+	values := make(map[string]string, len(entry.Fields))
+	for k, v := range entry.Fields {
+		values[k] = v
+	}
+	return values, nil
+}
+
+func (s *memoryStore) DeleteSession(id string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.entries, "sess."+id)
+	return nil
+}
+
+func (s *memoryStore) Hit(key string, window int) (int64, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	entry := s.get("rate." + key)
+	if entry == nil {
+		entry = &memEntry{Expires: expiry(window)}
+		s.entries["rate."+key] = entry
+	}
+	entry.Count++
+	return entry.Count, nil
+}
+
+func (s *memoryStore) Reset() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for key := range s.entries {
+		if strings.HasPrefix(key, "token.") || strings.HasPrefix(key, "online.") || strings.HasPrefix(key, "rate.") {
+			delete(s.entries, key)
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) Close() error {
+	if s.quit != nil {
+		s.quit <- true
+		<-s.done
+	}
+	if s.snapshotFile == "" {
+		return nil
+	}
+	return s.snapshot()
+}
+
+func (s *memoryStore) snapshotLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.snapshot(); err != nil {
+				log.WithError(err).Error("Error writing store snapshot")
+			}
+		case <-s.quit:
+			s.done <- true
+			return
+		}
+	}
+}
+
+//Writes to a temp file first so a crash mid-write never leaves a truncated snapshot
+func (s *memoryStore) snapshot() error {
+	s.lock.Lock()
+	now := time.Now().Unix()
+	live := make(map[string]*memEntry, len(s.entries))
+	for key, entry := range s.entries {
+		if !entry.expired(now) {
+			live[key] = entry
+		}
+	}
+	data, jsonErr := json.Marshal(live)
+	s.lock.Unlock()
+	if jsonErr != nil {
+		return jsonErr
+	}
+
+	tmpFile := s.snapshotFile + ".tmp"
+	if err := ioutil.WriteFile(tmpFile, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, s.snapshotFile)
+}
+
+func (s *memoryStore) load() error {
+	data, readErr := ioutil.ReadFile(s.snapshotFile)
+	if readErr != nil {
+		if os.IsNotExist(readErr) {
+			return nil
+		}
+		return readErr
+	}
+	entries := make(map[string]*memEntry)
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return err
+	}
+	now := time.Now().Unix()
+	for key, entry := range entries {
+		if !entry.expired(now) {
+			s.entries[key] = entry
+		}
+	}
+	log.WithField("entries", len(s.entries)).Info("Loaded store snapshot")
+	return nil
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	redigo "github.com/garyburd/redigo/redis"
+	mux "github.com/gorilla/mux"
+	websocket "github.com/gorilla/websocket"
+	prometheus "github.com/prometheus/client_golang/prometheus"
+	collectors "github.com/prometheus/client_golang/prometheus/collectors"
+	promauto "github.com/prometheus/client_golang/prometheus/promauto"
+	promhttp "github.com/prometheus/client_golang/prometheus/promhttp"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type MetricsConfig struct {
+	Enabled bool `json:"enabled"`
+	//Separate plain http listener for /metrics, ex. "127.0.0.1:9100". Leave
+	//empty to serve /metrics on the main https server instead
+	Listen string `json:"listen"`
+	//Bearer token scrapers must send when /metrics is on the main server
+	Token string `json:"token"`
+}
+
+func defaultMetricsConfig() MetricsConfig {
+	return MetricsConfig{
+		Enabled: true,
+		Listen:  "127.0.0.1:9100",
+		Token:   "",
+	}
+}
+
+var errMetricsToken = errors.New("metrics on the main server need a token")
+
+//Everything is registered here instead of the global registry so only our
+//collectors, Go runtime and process stats end up on /metrics
+var metricsRegistry = prometheus.NewRegistry()
+var metrics = promauto.With(metricsRegistry)
+
+var (
+	httpRequests = metrics.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_requests_total",
+		Help: "HTTP requests by route template, method and status code",
+	}, []string{"route", "method", "code"})
+	httpDuration = metrics.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "http_request_duration_seconds",
+		Help:    "HTTP request latency by route template and method",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method"})
+
+	wsConnects = metrics.NewCounter(prometheus.CounterOpts{
+		Name: "websocket_connects_total",
+		Help: "Websocket upgrades, authenticated or not",
+	})
+	wsOpen = metrics.NewGauge(prometheus.GaugeOpts{
+		Name: "websocket_connections",
+		Help: "Open websocket connections",
+	})
+	wsDisconnects = metrics.NewCounterVec(prometheus.CounterOpts{
+		Name: "websocket_disconnects_total",
+		Help: "Authenticated sockets closed, by reason",
+	}, []string{"reason"})
+	wsCloseCodes = metrics.NewCounterVec(prometheus.CounterOpts{
+		Name: "websocket_close_codes_total",
+		Help: "Close codes of client side closes, none when the connection dropped without one",
+	}, []string{"code"})
+	wsMessages = metrics.NewCounterVec(prometheus.CounterOpts{
+		Name: "websocket_messages_total",
+		Help: "Client messages by code",
+	}, []string{"code"})
+	wsRejected = metrics.NewCounterVec(prometheus.CounterOpts{
+		Name: "websocket_messages_rejected_total",
+		Help: "Client messages dropped before reaching a handler, by reason",
+	}, []string{"reason"})
+
+	authFailures = metrics.NewCounterVec(prometheus.CounterOpts{
+		Name: "auth_failures_total",
+		Help: "Refused logins, sessions and socket tickets, by stage and reason",
+	}, []string{"stage", "reason"})
+
+	redisDuration = metrics.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "redis_command_duration_seconds",
+		Help:    "Redis command latency by command",
+		Buckets: prometheus.ExponentialBuckets(0.0001, 4, 8),
+	}, []string{"command"})
+	redisErrors = metrics.NewCounterVec(prometheus.CounterOpts{
+		Name: "redis_command_errors_total",
+		Help: "Failed redis commands by command",
+	}, []string{"command"})
+
+	steamRequests = metrics.NewCounterVec(prometheus.CounterOpts{
+		Name: "steam_requests_total",
+		Help: "Requests to Steam by call and outcome (ok, client_error, rate_limited, server_error, network_error)",
+	}, []string{"call", "outcome"})
+	steamDuration = metrics.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "steam_request_duration_seconds",
+		Help:    "Steam request latency by call",
+		Buckets: []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 15},
+	}, []string{"call"})
+)
+
+func init() {
+	metricsRegistry.MustRegister(collectors.NewGoCollector())
+	metricsRegistry.MustRegister(collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+
+	//Both channels block their senders once full
+	metrics.NewGaugeFunc(prometheus.GaugeOpts{
+		Name:        "channel_depth",
+		Help:        "Messages waiting in an internal channel",
+		ConstLabels: prometheus.Labels{"channel": "broadcast"},
+	}, func() float64 { return float64(len(broadcastChan)) })
+	metrics.NewGaugeFunc(prometheus.GaugeOpts{
+		Name:        "channel_depth",
+		Help:        "Messages waiting in an internal channel",
+		ConstLabels: prometheus.Labels{"channel": "redis"},
+	}, func() float64 { return float64(len(redisChan)) })
+	metrics.NewGaugeFunc(prometheus.GaugeOpts{
+		Name:        "channel_capacity",
+		Help:        "Buffer size of an internal channel",
+		ConstLabels: prometheus.Labels{"channel": "broadcast"},
+	}, func() float64 { return float64(cap(broadcastChan)) })
+	metrics.NewGaugeFunc(prometheus.GaugeOpts{
+		Name:        "channel_capacity",
+		Help:        "Buffer size of an internal channel",
+		ConstLabels: prometheus.Labels{"channel": "redis"},
+	}, func() float64 { return float64(cap(redisChan)) })
+}
+
+//Serves /metrics on its own listener when conf.Listen is set, otherwise
+//returns a handler for the main router that checks the bearer token
+func startMetrics(conf MetricsConfig) (http.Handler, error) {
+	handler := promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})
+	if conf.Listen != "" {
+		serveMux := http.NewServeMux()
+		serveMux.Handle("/metrics", handler)
+		listener, listenErr := net.Listen("tcp", conf.Listen)
+		if listenErr != nil {
+			return nil, listenErr
+		}
+		go http.Serve(listener, serveMux)
+		return nil, nil
+	}
+	if conf.Token == "" {
+		return nil, errMetricsToken
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer "+conf.Token {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}), nil
+}
+
+//Route template the request matched, so ids in paths do not each get a series
+func routeLabel(r *http.Request) string {
+	if route := mux.CurrentRoute(r); route != nil {
+		if template, err := route.GetPathTemplate(); err == nil {
+			return template
+		}
+	}
+	return "unmatched"
+}
+
+//Remembers the status code for LogHandler. Hijack has to pass through or
+//websocket upgrades fail
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer does not support hijacking")
+	}
+	w.status = http.StatusSwitchingProtocols
+	return hijacker.Hijack()
+}
+
+func (w *statusWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *statusWriter) Status() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
+
+//Standard close codes keep their number, anything a client makes up is "other"
+func closeCodeLabel(err error) string {
+	closeErr, ok := err.(*websocket.CloseError)
+	if !ok {
+		return "none"
+	}
+	if closeErr.Code >= 1000 && closeErr.Code <= 1015 {
+		return strconv.Itoa(closeErr.Code)
+	}
+	return "other"
+}
+
+//Codes past the ones clients send would give every made up number its own series
+func messageCodeLabel(code int) string {
+	if code < MSG_TRADE_URL || code > MSG_ADMIN_BAN {
+		return "unknown"
+	}
+	return strconv.Itoa(code)
+}
+
+//Times every command sent over the redis store's connection
+type timedRedisConn struct {
+	redigo.Conn
+}
+
+func (c *timedRedisConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	startTime := time.Now()
+	reply, err := c.Conn.Do(cmd, args...)
+	redisDuration.WithLabelValues(cmd).Observe(time.Since(startTime).Seconds())
+	if err != nil {
+		redisErrors.WithLabelValues(cmd).Inc()
+	}
+	return reply, err
+}
+
+//Call name for a Steam url, "ISteamUser/GetPlayerSummaries" for the web api
+//and the first path segment, like "openid" or "inventory", for the community site
+func steamCallLabel(r *http.Request) string {
+	segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch r.URL.Host {
+	case "api.steampowered.com":
+		if len(segments) >= 2 {
+			return segments[0] + "/" + segments[1]
+		}
+	case "steamcommunity.com":
+		return segments[0]
+	}
+	return r.URL.Host
+}
+
+//Transport for every client that talks to Steam, records outcome and latency
+type steamTransport struct {
+	next http.RoundTripper
+}
+
+func (t *steamTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	call := steamCallLabel(r)
+	startTime := time.Now()
+	resp, err := t.next.RoundTrip(r)
+	steamDuration.WithLabelValues(call).Observe(time.Since(startTime).Seconds())
+
+	outcome := "ok"
+	if err != nil {
+		outcome = "network_error"
+	} else if resp.StatusCode == http.StatusTooManyRequests {
+		outcome = "rate_limited"
+	} else if resp.StatusCode >= 500 {
+		outcome = "server_error"
+	} else if resp.StatusCode >= 400 {
+		outcome = "client_error"
+	}
+	steamRequests.WithLabelValues(call, outcome).Inc()
+	return resp, err
+}
+
+func newSteamTransport() http.RoundTripper {
+	return &steamTransport{next: http.DefaultTransport}
+}
+
+var steamClient = &http.Client{Timeout: time.Second * 15, Transport: newSteamTransport()}
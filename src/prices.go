@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	audit "github.com/skyguy126/website/src/audit"
+	pricing "github.com/skyguy126/website/src/pricing"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type PricingConfig struct {
+	//"min" or "median" across sources
+	Rule string `json:"rule"`
+	//Seconds before a quote is considered stale and its item stops being accepted
+	MaxAge          int `json:"max_age"`
+	RefreshInterval int `json:"refresh_interval"`
+	//JSON price dumps keyed by market_hash_name
+	Files []string `json:"files"`
+	//Local mock market for development, priced items are listed in MockItems
+	Mock      bool     `json:"mock"`
+	MockItems []string `json:"mock_items"`
+}
+
+func defaultPricingConfig() PricingConfig {
+	return PricingConfig{
+		Rule:            pricing.RULE_MIN,
+		MaxAge:          21600,
+		RefreshInterval: 300,
+		Files:           []string{"prices.json"},
+		Mock:            false,
+		MockItems:       []string{},
+	}
+}
+
+//Largest price an override can set, $100k
+const MAX_PRICE_OVERRIDE = 10000000
+
+var errPriceOverride = errors.New("Invalid price override")
+
+var priceBook *pricing.Aggregator
+
+func startPricing(conf PricingConfig) error {
+	providers := make([]pricing.PriceProvider, 0)
+	for _, path := range conf.Files {
+		providers = append(providers, pricing.NewFileSource(path))
+	}
+	if conf.Mock {
+		log.Warn("Pricing is using the mock market")
+		providers = append(providers, pricing.NewMockMarket(conf.MockItems...))
+	}
+
+	book, bookErr := pricing.NewAggregator(conf.Rule, time.Second*time.Duration(conf.MaxAge), providers...)
+	if bookErr != nil {
+		return bookErr
+	}
+	if err := loadPriceOverrides(book); err != nil {
+		return err
+	}
+	priceBook = book
+	refreshPrices()
+	go pricingLoop(conf.RefreshInterval)
+	return nil
+}
+
+func refreshPrices() {
+	for _, err := range priceBook.Refresh() {
+		log.WithError(err).Error("Error refreshing prices")
+	}
+}
+
+func pricingLoop(interval int) {
+	for {
+		time.Sleep(time.Second * time.Duration(interval))
+		refreshPrices()
+	}
+}
+
+//Price in cents, false when the item has no fresh price and must not be accepted
+func itemPrice(marketHashName string) (int64, bool) {
+	if priceBook == nil {
+		return 0, false
+	}
+	price, ok := priceBook.Get(marketHashName)
+	if !ok {
+		return 0, false
+	}
+	return price.Cents, true
+}
+
+func loadPriceOverrides(book *pricing.Aggregator) error {
+	rows, queryErr := db.Query(`SELECT market_hash_name, cents FROM price_overrides`)
+	if queryErr != nil {
+		return queryErr
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		var cents int64
+		if err := rows.Scan(&name, &cents); err != nil {
+			return err
+		}
+		book.SetOverride(name, cents)
+	}
+	return rows.Err()
+}
+
+func setPriceOverride(marketHashName string, cents int64, steam64id string, ip string) error {
+	if marketHashName == "" || cents <= 0 || cents > MAX_PRICE_OVERRIDE {
+		return errPriceOverride
+	}
+	_, execErr := db.Exec(`INSERT INTO price_overrides (market_hash_name, cents, sid, updated) VALUES (?, ?, ?, ?)
+		ON CONFLICT(market_hash_name) DO UPDATE SET cents = excluded.cents, sid = excluded.sid, updated = excluded.updated`,
+		marketHashName, cents, steam64id, time.Now().Unix())
+	if execErr != nil {
+		return execErr
+	}
+	priceBook.SetOverride(marketHashName, cents)
+	if err := recordAudit(steam64id, ip, audit.EVENT_PRICE, fmt.Sprintf("%s set to %d", marketHashName, cents)); err != nil {
+		log.WithError(err).WithField("sid", steam64id).Error("Error writing price override audit entry")
+	}
+	return nil
+}
+
+func removePriceOverride(marketHashName string, steam64id string, ip string) error {
+	if _, err := db.Exec(`DELETE FROM price_overrides WHERE market_hash_name = ?`, marketHashName); err != nil {
+		return err
+	}
+	priceBook.RemoveOverride(marketHashName)
+	if err := recordAudit(steam64id, ip, audit.EVENT_PRICE, marketHashName+" removed"); err != nil {
+		log.WithError(err).WithField("sid", steam64id).Error("Error writing price override audit entry")
+	}
+	return nil
+}
+
+type priceOverrideJson struct {
+	MarketHashName string `json:"market_hash_name"`
+	Cents          int64  `json:"cents"`
+}
+
+//GET lists overrides, POST {"market_hash_name":"...","cents":123} sets one and
+//DELETE ?market_hash_name=... removes it
+func PriceOverrideHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+
+	steam64id := actorSid(r)
+	ip := remoteIp(r.RemoteAddr)
+
+	var err error
+	switch r.Method {
+	case "POST":
+		var body priceOverrideJson
+		if decodeErr := json.NewDecoder(http.MaxBytesReader(w, r.Body, 2048)).Decode(&body); decodeErr != nil {
+			err = errPriceOverride
+		} else {
+			err = setPriceOverride(strings.TrimSpace(body.MarketHashName), body.Cents, steam64id, ip)
+		}
+	case "DELETE":
+		err = removePriceOverride(r.URL.Query().Get("market_hash_name"), steam64id, ip)
+	}
+	if err != nil {
+		if err == errPriceOverride {
+			w.WriteHeader(http.StatusBadRequest)
+		} else {
+			requestLog(r).WithError(err).Error("Error updating price override")
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		msg := "Internal server error"
+		if err == errPriceOverride {
+			msg = err.Error()
+		}
+		data, _ := json.Marshal(map[string]string{"error": msg})
+		w.Write(data)
+		return
+	}
+
+	overrides := make([]priceOverrideJson, 0)
+	for _, price := range priceBook.Overrides() {
+		overrides = append(overrides, priceOverrideJson{MarketHashName: price.MarketHashName, Cents: price.Cents})
+	}
+	data, _ := json.Marshal(map[string]interface{}{"overrides": overrides})
+	w.Write(data)
+}
@@ -0,0 +1,64 @@
+package pricing
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"os"
+	"time"
+)
+
+//Prices imported from a JSON file keyed by market_hash_name. Values are either
+//a plain USD price or {"price": 1.23, "updated": unix time}. Prices without
+//an updated time are as old as the file
+type FileSource struct {
+	Path string
+}
+
+func NewFileSource(path string) *FileSource {
+	return &FileSource{Path: path}
+}
+
+func (s *FileSource) Name() string {
+	return "file:" + s.Path
+}
+
+type fileEntry struct {
+	Price   float64 `json:"price"`
+	Updated int64   `json:"updated"`
+}
+
+func (s *FileSource) Fetch() ([]Price, error) {
+	info, statErr := os.Stat(s.Path)
+	if statErr != nil {
+		return nil, statErr
+	}
+	data, readErr := ioutil.ReadFile(s.Path)
+	if readErr != nil {
+		return nil, readErr
+	}
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+
+	prices := make([]Price, 0, len(raw))
+	for name, value := range raw {
+		entry := fileEntry{}
+		if err := json.Unmarshal(value, &entry.Price); err != nil {
+			if err := json.Unmarshal(value, &entry); err != nil {
+				return nil, err
+			}
+		}
+		updated := info.ModTime()
+		if entry.Updated != 0 {
+			updated = time.Unix(entry.Updated, 0)
+		}
+		prices = append(prices, Price{
+			MarketHashName: name,
+			Cents:          int64(math.Round(entry.Price * 100)),
+			Updated:        updated,
+		})
+	}
+	return prices, nil
+}
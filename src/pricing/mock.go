@@ -0,0 +1,76 @@
+package pricing
+
+import (
+	"hash/fnv"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+//Local stand-in for a market api. Every item gets a stable base price derived
+//from its name that drifts a little on each fetch, like a live market would
+type MockMarket struct {
+	lock   sync.Mutex
+	prices map[string]int64
+	//Largest move per fetch as a fraction of the price
+	Volatility float64
+	rand       *rand.Rand
+	now        func() time.Time
+}
+
+func NewMockMarket(names ...string) *MockMarket {
+	m := &MockMarket{
+		prices:     make(map[string]int64),
+		Volatility: 0.02,
+		rand:       rand.New(rand.NewSource(time.Now().UnixNano())),
+		now:        time.Now,
+	}
+	for _, name := range names {
+		m.prices[name] = basePrice(name)
+	}
+	return m
+}
+
+//Between $0.03 and about $500, cheap items far more common than expensive ones
+func basePrice(name string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	x := float64(h.Sum64()%10000) / 10000
+	return 3 + int64(x*x*x*x*50000)
+}
+
+func (m *MockMarket) Name() string {
+	return "mock"
+}
+
+//Lists an item, cents of 0 uses the name derived base price
+func (m *MockMarket) Set(name string, cents int64) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if cents == 0 {
+		cents = basePrice(name)
+	}
+	m.prices[name] = cents
+}
+
+func (m *MockMarket) Delist(name string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.prices, name)
+}
+
+func (m *MockMarket) Fetch() ([]Price, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	now := m.now()
+	prices := make([]Price, 0, len(m.prices))
+	for name, cents := range m.prices {
+		drift := int64(float64(cents) * m.Volatility * (m.rand.Float64()*2 - 1))
+		if cents+drift > 0 {
+			cents += drift
+		}
+		m.prices[name] = cents
+		prices = append(prices, Price{MarketHashName: name, Cents: cents, Updated: now})
+	}
+	return prices, nil
+}
@@ -0,0 +1,210 @@
+//Package pricing values CS:GO items by market_hash_name. Prices come from any
+//number of PriceProviders and are combined by an Aggregator, which drops stale
+//quotes and applies manual overrides
+package pricing
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+//How quotes from several providers are combined
+const (
+	RULE_MEDIAN = "median"
+	//Lowest quote, the safe choice when crediting deposits
+	RULE_MIN = "min"
+)
+
+var ErrUnknownRule = errors.New("pricing: unknown aggregation rule")
+
+//Price in US cents
+type Price struct {
+	MarketHashName string
+	Cents          int64
+	Updated        time.Time
+	//Provider name, "override" for manual prices
+	Source string
+}
+
+type PriceProvider interface {
+	Name() string
+	//Returns every price the provider knows about
+	Fetch() ([]Price, error)
+}
+
+type Aggregator struct {
+	lock      sync.RWMutex
+	providers []PriceProvider
+	rule      string
+	//Quotes older than this are ignored
+	maxAge time.Duration
+	//Last good fetch from each provider, kept when a refresh fails
+	quotes    map[string]map[string]Price
+	book      map[string]Price
+	overrides map[string]Price
+	now       func() time.Time
+}
+
+func NewAggregator(rule string, maxAge time.Duration, providers ...PriceProvider) (*Aggregator, error) {
+	if rule != RULE_MEDIAN && rule != RULE_MIN {
+		return nil, ErrUnknownRule
+	}
+	return &Aggregator{
+		providers: providers,
+		rule:      rule,
+		maxAge:    maxAge,
+		quotes:    make(map[string]map[string]Price),
+		book:      make(map[string]Price),
+		overrides: make(map[string]Price),
+		now:       time.Now,
+	}, nil
+}
+
+//Fetches every provider and rebuilds the price book. A failing provider keeps
+//its previous quotes until they go stale, the errors are returned together
+func (a *Aggregator) Refresh() []error {
+	errs := make([]error, 0)
+	fetched := make(map[string][]Price, len(a.providers))
+	for _, provider := range a.providers {
+		prices, fetchErr := provider.Fetch()
+		if fetchErr != nil {
+			errs = append(errs, &ProviderError{Provider: provider.Name(), Err: fetchErr})
+			continue
+		}
+		fetched[provider.Name()] = prices
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	for name, prices := range fetched {
+		quotes := make(map[string]Price, len(prices))
+		for _, price := range prices {
+			if price.Cents <= 0 || price.MarketHashName == "" {
+				continue
+			}
+			price.Source = name
+			quotes[price.MarketHashName] = price
+		}
+		a.quotes[name] = quotes
+	}
+	a.rebuild()
+	return errs
+}
+
+//Caller must hold lock
+func (a *Aggregator) rebuild() {
+	byName := make(map[string][]Price)
+	for _, quotes := range a.quotes {
+		for name, price := range quotes {
+			byName[name] = append(byName[name], price)
+		}
+	}
+	book := make(map[string]Price, len(byName))
+	for name, prices := range byName {
+		book[name] = a.combine(prices)
+	}
+	a.book = book
+}
+
+//Oldest quote wins the Updated time so a combined price is only as fresh as its inputs
+//Caller must hold lock
+func (a *Aggregator) combine(prices []Price) Price {
+	sort.Slice(prices, func(i int, j int) bool {
+		return prices[i].Cents < prices[j].Cents
+	})
+	combined := prices[0]
+	combined.Source = "aggregate"
+	if len(prices) == 1 {
+		combined.Source = prices[0].Source
+	}
+	for _, price := range prices {
+		if price.Updated.Before(combined.Updated) {
+			combined.Updated = price.Updated
+		}
+	}
+	if a.rule == RULE_MEDIAN {
+		mid := len(prices) / 2
+		if len(prices)%2 == 1 {
+			combined.Cents = prices[mid].Cents
+		} else {
+			combined.Cents = (prices[mid-1].Cents + prices[mid].Cents) / 2
+		}
+	}
+	return combined
+}
+
+//Fresh quotes only, stale ones are dropped before combining
+//Caller must hold lock
+func (a *Aggregator) fresh(name string) (Price, bool) {
+	prices := make([]Price, 0, len(a.quotes))
+	cutoff := a.now().Add(-a.maxAge)
+	for _, quotes := range a.quotes {
+		if price, ok := quotes[name]; ok && !price.Updated.Before(cutoff) {
+			prices = append(prices, price)
+		}
+	}
+	if len(prices) == 0 {
+		return Price{}, false
+	}
+	return a.combine(prices), true
+}
+
+//Current price of an item, false if no provider has a fresh quote and there
+//is no override. Callers must treat false as "do not accept this item"
+func (a *Aggregator) Get(marketHashName string) (Price, bool) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	if price, ok := a.overrides[marketHashName]; ok {
+		return price, true
+	}
+	if price, ok := a.book[marketHashName]; ok && !price.Updated.Before(a.now().Add(-a.maxAge)) {
+		return price, true
+	}
+	return a.fresh(marketHashName)
+}
+
+//Overrides take precedence over every provider and never go stale
+func (a *Aggregator) SetOverride(marketHashName string, cents int64) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.overrides[marketHashName] = Price{
+		MarketHashName: marketHashName,
+		Cents:          cents,
+		Updated:        a.now(),
+		Source:         "override",
+	}
+}
+
+func (a *Aggregator) RemoveOverride(marketHashName string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	delete(a.overrides, marketHashName)
+}
+
+func (a *Aggregator) Overrides() []Price {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	overrides := make([]Price, 0, len(a.overrides))
+	for _, price := range a.overrides {
+		overrides = append(overrides, price)
+	}
+	sort.Slice(overrides, func(i int, j int) bool {
+		return overrides[i].MarketHashName < overrides[j].MarketHashName
+	})
+	return overrides
+}
+
+type ProviderError struct {
+	Provider string
+	Err      error
+}
+
+func (e *ProviderError) Error() string {
+	return "pricing: " + e.Provider + ": " + e.Err.Error()
+}
+
+func (e *ProviderError) Unwrap() error {
+	return e.Err
+}
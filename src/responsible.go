@@ -0,0 +1,292 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	audit "github.com/skyguy126/website/src/audit"
+	ledger "github.com/skyguy126/website/src/ledger"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type ResponsibleConfig struct {
+	//Seconds before a raised or removed limit takes effect, lowering is immediate
+	LimitCooldown int `json:"limit_cooldown"`
+	//Self-exclusion lengths users can pick from
+	ExclusionDays []int `json:"exclusion_days"`
+}
+
+func defaultResponsibleConfig() ResponsibleConfig {
+	return ResponsibleConfig{
+		LimitCooldown: 86400,
+		ExclusionDays: []int{1, 7, 30, 90, 180, 365, 1825},
+	}
+}
+
+//Limit kinds
+const (
+	LIMIT_DEPOSIT = "deposit"
+	LIMIT_WAGER   = "wager"
+)
+
+//Rolling window of each limit period in seconds
+var limitPeriods = map[string]int64{
+	"day":   86400,
+	"week":  604800,
+	"month": 2592000,
+}
+
+//Ledger entry kinds counted towards each limit
+var limitEntryKinds = map[string][]string{
+	LIMIT_DEPOSIT: {"deposit"},
+	LIMIT_WAGER:   {"jackpot_bet", "coinflip_stake", "roulette_bet"},
+}
+
+var errSelfExcluded = errors.New("Your account is self-excluded")
+var errDepositLimit = errors.New("This deposit would go over your deposit limit")
+var errWagerLimit = errors.New("This bet would go over your wager limit")
+var errLimitInvalid = errors.New("Invalid limit")
+var errExclusionInvalid = errors.New("Invalid self-exclusion length")
+
+type GamblingLimit struct {
+	Kind   string `json:"kind"`
+	Period string `json:"period"`
+	//Cents, 0 when there is no limit
+	Amount int64 `json:"amount"`
+	//Amount that takes effect at PendingFrom, -1 when nothing is pending
+	Pending     int64 `json:"pending"`
+	PendingFrom int64 `json:"pending_from"`
+	//Cents counted against the limit in the current window
+	Used int64 `json:"used"`
+}
+
+//Limits of steam64id with matured pending changes applied
+func getLimits(steam64id string) ([]*GamblingLimit, error) {
+	now := time.Now().Unix()
+	if err := applyPendingLimits(steam64id, now); err != nil {
+		return nil, err
+	}
+
+	rows, queryErr := db.Query(`SELECT kind, period, amount, pending, pending_from FROM rg_limits WHERE sid = ? ORDER BY kind, period`, steam64id)
+	if queryErr != nil {
+		return nil, queryErr
+	}
+	limits := make([]*GamblingLimit, 0)
+	for rows.Next() {
+		limit := &GamblingLimit{}
+		if err := rows.Scan(&limit.Kind, &limit.Period, &limit.Amount, &limit.Pending, &limit.PendingFrom); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		limits = append(limits, limit)
+	}
+	rows.Close()
+
+	for _, limit := range limits {
+		used, err := limitUsage(steam64id, limit.Kind, now-limitPeriods[limit.Period])
+		if err != nil {
+			return nil, err
+		}
+		limit.Used = used
+	}
+	return limits, nil
+}
+
+func applyPendingLimits(steam64id string, now int64) error {
+	rows, queryErr := db.Query(`SELECT kind, period, pending FROM rg_limits WHERE sid = ? AND pending >= 0 AND pending_from <= ?`, steam64id, now)
+	if queryErr != nil {
+		return queryErr
+	}
+	applied := make([]string, 0)
+	for rows.Next() {
+		var kind, period string
+		var pending int64
+		if err := rows.Scan(&kind, &period, &pending); err != nil {
+			rows.Close()
+			return err
+		}
+		applied = append(applied, fmt.Sprintf("%s %s limit now %d", period, kind, pending))
+	}
+	rows.Close()
+	if len(applied) == 0 {
+		return nil
+	}
+
+	_, execErr := db.Exec(`UPDATE rg_limits SET amount = pending, pending = -1, pending_from = 0, updated = ?
+		WHERE sid = ? AND pending >= 0 AND pending_from <= ?`, now, steam64id, now)
+	if execErr != nil {
+		return execErr
+	}
+	for _, detail := range applied {
+		if err := recordAudit(steam64id, "", audit.EVENT_LIMIT, "applied "+detail); err != nil {
+			log.WithError(err).WithField("sid", steam64id).Error("Error writing limit audit entry")
+		}
+	}
+	return nil
+}
+
+//Sets a limit, 0 removes it. Lower limits apply right away, higher or removed
+//ones only after the cooling-off period
+func setLimit(steam64id string, ip string, kind string, period string, amount int64) (*GamblingLimit, error) {
+	if _, ok := limitEntryKinds[kind]; !ok {
+		return nil, errLimitInvalid
+	}
+	if _, ok := limitPeriods[period]; !ok || amount < 0 {
+		return nil, errLimitInvalid
+	}
+	now := time.Now().Unix()
+	if err := applyPendingLimits(steam64id, now); err != nil {
+		return nil, err
+	}
+
+	var current int64
+	err := db.QueryRow(`SELECT amount FROM rg_limits WHERE sid = ? AND kind = ? AND period = ?`, steam64id, kind, period).Scan(&current)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	limit := &GamblingLimit{Kind: kind, Period: period, Amount: current, Pending: -1}
+	stricter := current == 0 || (amount > 0 && amount <= current)
+	var detail string
+	if stricter {
+		limit.Amount = amount
+		detail = fmt.Sprintf("%s %s limit set to %d", period, kind, amount)
+	} else {
+		limit.Pending = amount
+		limit.PendingFrom = now + int64(config.Responsible.LimitCooldown)
+		detail = fmt.Sprintf("%s %s limit raised to %d from %d", period, kind, amount, limit.PendingFrom)
+	}
+	_, execErr := db.Exec(`INSERT INTO rg_limits (sid, kind, period, amount, pending, pending_from, updated) VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(sid, kind, period) DO UPDATE SET amount = excluded.amount, pending = excluded.pending,
+		pending_from = excluded.pending_from, updated = excluded.updated`,
+		steam64id, kind, period, limit.Amount, limit.Pending, limit.PendingFrom, now)
+	if execErr != nil {
+		return nil, execErr
+	}
+	if err := recordAudit(steam64id, ip, audit.EVENT_LIMIT, detail); err != nil {
+		log.WithError(err).WithField("sid", steam64id).Error("Error writing limit audit entry")
+	}
+	return limit, nil
+}
+
+//Cents moved by ledger entries of kind since the unix time. The deposit
+//limit also counts deposits still waiting on Steam
+func limitUsage(steam64id string, kind string, since int64) (int64, error) {
+	kinds := limitEntryKinds[kind]
+	args := []interface{}{ledger.UserAccount(steam64id), since}
+	for _, entryKind := range kinds {
+		args = append(args, entryKind)
+	}
+	var sum int64
+	err := db.QueryRow(`SELECT COALESCE(SUM(ABS(p.amount)), 0) FROM ledger_postings p JOIN ledger_entries e ON e.id = p.entry_id
+		WHERE p.account = ? AND e.time >= ? AND e.kind IN (?`+strings.Repeat(", ?", len(kinds)-1)+`)`, args...).Scan(&sum)
+	if err != nil || kind != LIMIT_DEPOSIT {
+		return sum, err
+	}
+
+	//Deposits waiting on Steam only reach the ledger once accepted, they count
+	//right away so offers sent in the meantime cannot go past the limit
+	var pending int64
+	err = db.QueryRow(`SELECT COALESCE(SUM(i.price), 0) FROM deposit_items i JOIN deposits d ON d.offer_id = i.offer_id
+		WHERE d.sid = ? AND d.state IN (?, ?)`, steam64id, DEPOSIT_SENT, DEPOSIT_ESCROW).Scan(&pending)
+	return sum + pending, err
+}
+
+//Refuses amount if it would go over any limit of kind
+func checkLimit(steam64id string, kind string, amount int64) error {
+	limits, err := getLimits(steam64id)
+	if err != nil {
+		return err
+	}
+	for _, limit := range limits {
+		if limit.Kind != kind || limit.Amount == 0 {
+			continue
+		}
+		if limit.Used+amount > limit.Amount {
+			if kind == LIMIT_DEPOSIT {
+				return errDepositLimit
+			}
+			return errWagerLimit
+		}
+	}
+	return nil
+}
+
+//Called before any stake leaves the balance. Callers hold userLocks for
+//steam64id until the stake is posted, or concurrent bets in different games
+//would all pass the limit
+func checkWager(steam64id string, amount int64) error {
+	if until, err := exclusionUntil(steam64id); err != nil {
+		return err
+	} else if !until.IsZero() {
+		return errSelfExcluded
+	}
+	return checkLimit(steam64id, LIMIT_WAGER, amount)
+}
+
+//Called with userLocks held for steam64id until the deposit is stored
+func checkDepositLimit(steam64id string, amount int64) error {
+	if until, err := exclusionUntil(steam64id); err != nil {
+		return err
+	} else if !until.IsZero() {
+		return errSelfExcluded
+	}
+	return checkLimit(steam64id, LIMIT_DEPOSIT, amount)
+}
+
+//End of the self-exclusion of steam64id, zero if there is none
+func exclusionUntil(steam64id string) (time.Time, error) {
+	var until int64
+	err := db.QueryRow(`SELECT until FROM rg_exclusions WHERE sid = ? AND until > ?`, steam64id, time.Now().Unix()).Scan(&until)
+	if err == sql.ErrNoRows {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(until, 0), nil
+}
+
+//Blocks login and socket auth for days. An exclusion can only be extended,
+//never shortened or lifted early
+func selfExclude(steam64id string, ip string, days int) (time.Time, error) {
+	allowed := false
+	for _, option := range config.Responsible.ExclusionDays {
+		if option == days {
+			allowed = true
+		}
+	}
+	if !allowed {
+		return time.Time{}, errExclusionInvalid
+	}
+
+	now := time.Now()
+	until := now.Add(time.Hour * 24 * time.Duration(days)).Unix()
+	_, execErr := db.Exec(`INSERT INTO rg_exclusions (sid, until, created) VALUES (?, ?, ?)
+		ON CONFLICT(sid) DO UPDATE SET until = MAX(until, excluded.until), created = excluded.created`,
+		steam64id, until, now.Unix())
+	if execErr != nil {
+		return time.Time{}, execErr
+	}
+	end, err := exclusionUntil(steam64id)
+	if err != nil {
+		return time.Time{}, err
+	}
+	detail := strconv.Itoa(days) + " days, until " + strconv.FormatInt(end.Unix(), 10)
+	if err := recordAudit(steam64id, ip, audit.EVENT_EXCLUSION, detail); err != nil {
+		log.WithError(err).WithField("sid", steam64id).Error("Error writing self-exclusion audit entry")
+	}
+	log.WithFields(log.Fields{"sid": steam64id, "until": end}).Info("Self-excluded")
+	return end, nil
+}
+
+func responsibleErrorText(err error) string {
+	switch err {
+	case errLimitInvalid, errExclusionInvalid:
+		return err.Error()
+	}
+	return "Internal server error"
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	audit "github.com/skyguy126/website/src/audit"
+	"net/http"
+	"strings"
+	"time"
+)
+
+//Every role can do everything the roles below it can
+const (
+	ROLE_USER       = "user"
+	ROLE_MODERATOR  = "moderator"
+	ROLE_ADMIN      = "admin"
+	ROLE_SUPERADMIN = "superadmin"
+)
+
+var roleRanks = map[string]int{
+	ROLE_USER:       0,
+	ROLE_MODERATOR:  1,
+	ROLE_ADMIN:      2,
+	ROLE_SUPERADMIN: 3,
+}
+
+const (
+	PERM_ADMIN_VIEW = "admin.view"
+	PERM_KICK       = "users.kick"
+	PERM_BAN        = "users.ban"
+	PERM_BALANCE    = "balance.adjust"
+	PERM_PRICES     = "prices.override"
+	PERM_ROLES      = "roles.set"
+	PERM_AUDIT      = "audit.read"
+	PERM_FAIR       = "fair.rotate"
+)
+
+//Lowest role holding each permission
+var permissionRoles = map[string]string{
+	PERM_ADMIN_VIEW: ROLE_MODERATOR,
+	PERM_KICK:       ROLE_MODERATOR,
+	PERM_BAN:        ROLE_ADMIN,
+	PERM_BALANCE:    ROLE_ADMIN,
+	PERM_PRICES:     ROLE_ADMIN,
+	PERM_ROLES:      ROLE_SUPERADMIN,
+	PERM_AUDIT:      ROLE_ADMIN,
+	PERM_FAIR:       ROLE_ADMIN,
+}
+
+var errRoleInvalid = errors.New("Invalid role")
+var errRoleSelf = errors.New("You cannot change your own role")
+var errRoleRank = errors.New("You cannot act on staff of your own role or above")
+
+type RoleGrant struct {
+	Sid       string
+	Role      string
+	GrantedBy string
+	Updated   time.Time
+}
+
+//Superadmins from the config always keep their role, they hand out the first ones
+func getRole(steam64id string) (string, error) {
+	for _, superadmin := range config.Superadmins {
+		if superadmin == steam64id {
+			return ROLE_SUPERADMIN, nil
+		}
+	}
+	var role string
+	err := db.QueryRow(`SELECT role FROM roles WHERE sid = ?`, steam64id).Scan(&role)
+	if err == sql.ErrNoRows {
+		return ROLE_USER, nil
+	}
+	return role, err
+}
+
+func hasPermission(steam64id string, permission string) (bool, error) {
+	needed, ok := permissionRoles[permission]
+	if !ok || steam64id == "" {
+		return false, nil
+	}
+	role, err := getRole(steam64id)
+	if err != nil {
+		return false, err
+	}
+	return roleRanks[role] >= roleRanks[needed], nil
+}
+
+//Refuses actions of actor on steam64id unless actor ranks above them, so
+//staff cannot kick, ban or pay each other or themselves
+func checkOutranks(actor string, steam64id string) error {
+	actorRole, actorErr := getRole(actor)
+	if actorErr != nil {
+		return actorErr
+	}
+	targetRole, targetErr := getRole(steam64id)
+	if targetErr != nil {
+		return targetErr
+	}
+	if roleRanks[targetRole] >= roleRanks[actorRole] {
+		return errRoleRank
+	}
+	return nil
+}
+
+//Gives steam64id role, ROLE_USER removes any role it had
+func setRole(actor string, ip string, steam64id string, role string) error {
+	if _, ok := roleRanks[role]; !ok || !steam64idRegex.MatchString(steam64id) {
+		return errRoleInvalid
+	}
+	if actor == steam64id {
+		return errRoleSelf
+	}
+
+	var err error
+	if role == ROLE_USER {
+		_, err = db.Exec(`DELETE FROM roles WHERE sid = ?`, steam64id)
+	} else {
+		_, err = db.Exec(`INSERT INTO roles (sid, role, granted_by, updated) VALUES (?, ?, ?, ?)
+			ON CONFLICT(sid) DO UPDATE SET role = excluded.role, granted_by = excluded.granted_by, updated = excluded.updated`,
+			steam64id, role, actor, time.Now().Unix())
+	}
+	if err != nil {
+		return err
+	}
+	recordAdminAudit(actor, ip, audit.EVENT_ROLE, steam64id, role)
+	log.WithFields(log.Fields{"actor": actor, "target": steam64id, "role": role}).Info("Role set")
+	return nil
+}
+
+//Everyone with a role above user, highest first
+func listRoles() ([]*RoleGrant, error) {
+	rows, queryErr := db.Query(`SELECT sid, role, granted_by, updated FROM roles ORDER BY updated DESC`)
+	if queryErr != nil {
+		return nil, queryErr
+	}
+	defer rows.Close()
+	grants := make([]*RoleGrant, 0)
+	for rows.Next() {
+		grant := &RoleGrant{}
+		var updated int64
+		if err := rows.Scan(&grant.Sid, &grant.Role, &grant.GrantedBy, &updated); err != nil {
+			return nil, err
+		}
+		grant.Updated = time.Unix(updated, 0)
+		grants = append(grants, grant)
+	}
+	for _, superadmin := range config.Superadmins {
+		grants = append(grants, &RoleGrant{Sid: superadmin, Role: ROLE_SUPERADMIN, GrantedBy: "config"})
+	}
+	for i := 1; i < len(grants); i++ {
+		for j := i; j > 0 && roleRanks[grants[j].Role] > roleRanks[grants[j-1].Role]; j-- {
+			grants[j], grants[j-1] = grants[j-1], grants[j]
+		}
+	}
+	return grants, rows.Err()
+}
+
+type actorKey struct{}
+
+//steam64 id of the user that passed requirePermission
+func actorSid(r *http.Request) string {
+	steam64id, _ := r.Context().Value(actorKey{}).(string)
+	return steam64id
+}
+
+//Middleware that only lets sessions holding permission through. Api routes
+//get a json 403, pages a 404 so the admin area does not show up to others
+func requirePermission(permission string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			steam64id, sessionErr := checkSession(w, r)
+			allowed := false
+			if sessionErr == nil {
+				var err error
+				allowed, err = hasPermission(steam64id, permission)
+				if err != nil {
+					requestLog(r).WithError(err).WithField("permission", permission).Error("Error checking permission")
+				}
+			}
+			if !allowed {
+				requestLog(r).WithFields(log.Fields{"path": r.URL.Path, "permission": permission}).Warn("Request without permission")
+				if strings.HasPrefix(r.URL.Path, "/api/") {
+					w.Header().Set("Content-type", "application/json")
+					w.WriteHeader(http.StatusForbidden)
+					fmt.Fprint(w, `{"error":"forbidden"}`)
+					return
+				}
+				NotFound(w, r)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), actorKey{}, steam64id)))
+		})
+	}
+}
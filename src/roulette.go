@@ -0,0 +1,464 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	log "github.com/Sirupsen/logrus"
+	ledger "github.com/skyguy126/website/src/ledger"
+	rounds "github.com/skyguy126/website/src/rounds"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type RouletteConfig struct {
+	Enabled bool `json:"enabled"`
+	//Seconds of each phase
+	Betting int `json:"betting"`
+	Lock    int `json:"lock"`
+	Spin    int `json:"spin"`
+	Payout  int `json:"payout"`
+	//Cents
+	MinBet int64 `json:"min_bet"`
+	MaxBet int64 `json:"max_bet"`
+}
+
+func defaultRouletteConfig() RouletteConfig {
+	return RouletteConfig{
+		Enabled: true,
+		Betting: 20,
+		Lock:    2,
+		Spin:    6,
+		Payout:  4,
+		MinBet:  10,
+		MaxBet:  50000,
+	}
+}
+
+//Milliseconds between state broadcasts of the timed games
+const ROUND_TICK = 1000
+
+//Slot 0 is green, 1 to 7 are red and 8 to 14 are black
+const ROULETTE_SLOTS = 15
+const ROULETTE_GAME = "roulette"
+const ROULETTE_HISTORY = 10
+
+const (
+	ROULETTE_RED   = "red"
+	ROULETTE_BLACK = "black"
+	ROULETTE_GREEN = "green"
+)
+
+//Winning bets are paid the stake times this, the stake included
+var rouletteMultipliers = map[string]int64{
+	ROULETTE_RED:   2,
+	ROULETTE_BLACK: 2,
+	ROULETTE_GREEN: 14,
+}
+
+//Round states in the database
+const (
+	ROULETTE_BETTING  = "betting"
+	ROULETTE_RESOLVED = "resolved"
+	ROULETTE_PAID     = "paid"
+)
+
+var errRouletteUnavailable = errors.New("Roulette is unavailable right now")
+var errRouletteBet = errors.New("Bet amount is out of range")
+var errRouletteColor = errors.New("Pick red, black or green")
+var errRouletteFunds = errors.New("Not enough balance")
+
+func rouletteColor(slot int64) string {
+	if slot == 0 {
+		return ROULETTE_GREEN
+	}
+	if slot <= 7 {
+		return ROULETTE_RED
+	}
+	return ROULETTE_BLACK
+}
+
+//Implements rounds.Game, the engine serializes every call
+type rouletteGame struct {
+	conf RouletteConfig
+	//Guards everything below, State is read on the scheduler goroutine while
+	//bets come in on socket goroutines
+	lock sync.Mutex
+	fair *FairCommit
+	//Cents bet on each color and number of bets in the current round
+	totals  map[string]int64
+	bets    int
+	slot    int64
+	roll    float64
+	history []int64
+}
+
+var rouletteEngine *rounds.Engine
+var roulette *rouletteGame
+
+var gameScheduler = &rounds.Scheduler{
+	Tick:      time.Millisecond * ROUND_TICK,
+	Broadcast: sendToAll,
+	OnError: func(engine *rounds.Engine, err error) {
+		log.WithError(err).WithField("game", engine.Name).Error("Error running round")
+	},
+}
+
+//Registers every timed game and starts the scheduler goroutine
+func startRoundGames() error {
+	if config.Roulette.Enabled {
+		conf := config.Roulette
+		roulette = &rouletteGame{conf: conf, totals: make(map[string]int64), slot: -1}
+		if err := roulette.loadHistory(); err != nil {
+			return err
+		}
+		rouletteEngine = rounds.NewEngine(ROULETTE_GAME, roulette, rounds.Timing{
+			Betting: time.Second * time.Duration(conf.Betting),
+			Lock:    time.Second * time.Duration(conf.Lock),
+			Resolve: time.Second * time.Duration(conf.Spin),
+			Payout:  time.Second * time.Duration(conf.Payout),
+		})
+		if err := gameScheduler.Add(rouletteEngine); err != nil {
+			return err
+		}
+	}
+	go gameScheduler.Run(nil)
+	return nil
+}
+
+func (g *rouletteGame) account(round int64) string {
+	return ledger.GameAccount(ROULETTE_GAME, strconv.FormatInt(round, 10))
+}
+
+func (g *rouletteGame) loadHistory() error {
+	rows, queryErr := db.Query(`SELECT slot FROM roulette_rounds WHERE state = ? ORDER BY id DESC LIMIT ?`,
+		ROULETTE_PAID, ROULETTE_HISTORY)
+	if queryErr != nil {
+		return queryErr
+	}
+	defer rows.Close()
+	history := make([]int64, 0)
+	for rows.Next() {
+		var slot int64
+		if err := rows.Scan(&slot); err != nil {
+			return err
+		}
+		history = append([]int64{slot}, history...)
+	}
+	g.history = history
+	return rows.Err()
+}
+
+func (g *rouletteGame) Open() (int64, error) {
+	now := time.Now().Unix()
+	res, execErr := db.Exec(`INSERT INTO roulette_rounds (state, created, updated) VALUES (?, ?, ?)`, ROULETTE_BETTING, now, now)
+	if execErr != nil {
+		return 0, execErr
+	}
+	round, _ := res.LastInsertId()
+	commit, commitErr := commitFairRound(ROULETTE_GAME, strconv.FormatInt(round, 10))
+	if commitErr != nil {
+		return 0, commitErr
+	}
+	if _, err := db.Exec(`UPDATE roulette_rounds SET fair_id = ? WHERE id = ?`, commit.Id, round); err != nil {
+		return 0, err
+	}
+
+	g.lock.Lock()
+	g.fair = commit
+	g.totals = make(map[string]int64)
+	g.bets = 0
+	g.slot = -1
+	g.roll = 0
+	g.lock.Unlock()
+	return round, nil
+}
+
+//The last round that was not paid out, with its bet totals
+func (g *rouletteGame) Resume() (int64, rounds.Phase, bool, error) {
+	var round, fairId int64
+	var state string
+	err := db.QueryRow(`SELECT id, state, fair_id FROM roulette_rounds WHERE state != ? ORDER BY id DESC LIMIT 1`, ROULETTE_PAID).
+		Scan(&round, &state, &fairId)
+	if err == sql.ErrNoRows {
+		return 0, "", false, nil
+	}
+	if err != nil {
+		return 0, "", false, err
+	}
+
+	//Opened but crashed before committing a seed, nobody could have bet on it
+	if fairId == 0 {
+		_, err := db.Exec(`UPDATE roulette_rounds SET state = ?, updated = ? WHERE id = ?`, ROULETTE_PAID, time.Now().Unix(), round)
+		return 0, "", false, err
+	}
+	commit, commitErr := loadFairCommit(fairId)
+	if commitErr != nil {
+		return 0, "", false, commitErr
+	}
+
+	rows, queryErr := db.Query(`SELECT color, SUM(amount), COUNT(*) FROM roulette_bets WHERE round_id = ? GROUP BY color`, round)
+	if queryErr != nil {
+		return 0, "", false, queryErr
+	}
+	defer rows.Close()
+	totals := make(map[string]int64)
+	bets := 0
+	for rows.Next() {
+		var color string
+		var total int64
+		var count int
+		if err := rows.Scan(&color, &total, &count); err != nil {
+			return 0, "", false, err
+		}
+		totals[color] = total
+		bets += count
+	}
+
+	g.lock.Lock()
+	g.fair = commit
+	g.totals = totals
+	g.bets = bets
+	g.slot = -1
+	g.lock.Unlock()
+	log.WithFields(log.Fields{"round_id": round, "bets": bets}).Info("Resuming roulette round")
+
+	if state == ROULETTE_RESOLVED {
+		//Resolving again returns the stored roll
+		if err := g.Resolve(round); err != nil {
+			return 0, "", false, err
+		}
+		return round, rounds.PHASE_RESOLVE, true, nil
+	}
+	return round, rounds.PHASE_BETTING, true, nil
+}
+
+//Places a bet, refused with rounds.ErrBettingClosed once the round is locked
+func (g *rouletteGame) Bet(steam64id string, ip string, color string, amount int64) error {
+	if _, ok := rouletteMultipliers[color]; !ok {
+		return errRouletteColor
+	}
+	if amount < g.conf.MinBet || amount > g.conf.MaxBet {
+		return errRouletteBet
+	}
+
+	return rouletteEngine.Bet(func(round int64) error {
+		unlock := userLocks.Lock(steam64id)
+		defer unlock()
+		if err := checkWager(steam64id, amount); err != nil {
+			return err
+		}
+		tx, txErr := db.Begin()
+		if txErr != nil {
+			return txErr
+		}
+		defer tx.Rollback()
+
+		res, execErr := tx.Exec(`INSERT INTO roulette_bets (round_id, sid, ip, color, amount, created) VALUES (?, ?, ?, ?, ?, ?)`,
+			round, steam64id, ip, color, amount, time.Now().Unix())
+		if execErr != nil {
+			return execErr
+		}
+		betId, _ := res.LastInsertId()
+		_, postErr := books.PostTx(tx, &ledger.Entry{
+			Key:  "roulette-bet:" + strconv.FormatInt(betId, 10),
+			Kind: "roulette_bet",
+			Ref:  strconv.FormatInt(round, 10),
+			Postings: []ledger.Posting{
+				{Account: ledger.UserAccount(steam64id), Amount: -amount},
+				{Account: g.account(round), Amount: amount},
+			},
+		})
+		if postErr == ledger.ErrInsufficientFunds {
+			return errRouletteFunds
+		}
+		if postErr != nil {
+			return postErr
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+
+		g.lock.Lock()
+		g.totals[color] += amount
+		g.bets++
+		g.lock.Unlock()
+		return nil
+	})
+}
+
+func (g *rouletteGame) bettors(round int64) ([]string, error) {
+	rows, queryErr := db.Query(`SELECT DISTINCT sid FROM roulette_bets WHERE round_id = ?`, round)
+	if queryErr != nil {
+		return nil, queryErr
+	}
+	defer rows.Close()
+	bettors := make([]string, 0)
+	for rows.Next() {
+		var steam64id string
+		if err := rows.Scan(&steam64id); err != nil {
+			return nil, err
+		}
+		bettors = append(bettors, steam64id)
+	}
+	return bettors, rows.Err()
+}
+
+func (g *rouletteGame) Resolve(round int64) error {
+	bettors, bettorsErr := g.bettors(round)
+	if bettorsErr != nil {
+		return bettorsErr
+	}
+	seeds, seedsErr := clientSeeds(bettors)
+	if seedsErr != nil {
+		return seedsErr
+	}
+	g.lock.Lock()
+	commit := g.fair
+	g.lock.Unlock()
+
+	var slot int64
+	fair, fairErr := resolveFairRound(commit, seeds, func(roll float64) string {
+		slot = int64(roll * ROULETTE_SLOTS)
+		return "slot " + strconv.FormatInt(slot, 10) + " " + rouletteColor(slot)
+	})
+	if fairErr != nil {
+		return fairErr
+	}
+	slot = int64(fair.Roll * ROULETTE_SLOTS)
+	_, execErr := db.Exec(`UPDATE roulette_rounds SET state = ?, slot = ?, updated = ? WHERE id = ? AND state = ?`,
+		ROULETTE_RESOLVED, slot, time.Now().Unix(), round, ROULETTE_BETTING)
+	if execErr != nil {
+		return execErr
+	}
+
+	g.lock.Lock()
+	g.slot = slot
+	g.roll = fair.Roll
+	g.lock.Unlock()
+	log.WithFields(log.Fields{"round_id": round, "slot": slot, "color": rouletteColor(slot)}).Info("Roulette round landed")
+	return nil
+}
+
+//Pays winning bets from the round's account, the rest goes to the house
+func (g *rouletteGame) Payout(round int64) error {
+	g.lock.Lock()
+	slot := g.slot
+	g.lock.Unlock()
+	winning := rouletteColor(slot)
+
+	rows, queryErr := db.Query(`SELECT sid, color, amount FROM roulette_bets WHERE round_id = ?`, round)
+	if queryErr != nil {
+		return queryErr
+	}
+	var staked int64
+	payouts := make(map[string]int64)
+	winners := make([]string, 0)
+	for rows.Next() {
+		var steam64id, color string
+		var amount int64
+		if err := rows.Scan(&steam64id, &color, &amount); err != nil {
+			rows.Close()
+			return err
+		}
+		staked += amount
+		if color == winning {
+			if _, ok := payouts[steam64id]; !ok {
+				winners = append(winners, steam64id)
+			}
+			payouts[steam64id] += amount * rouletteMultipliers[color]
+		}
+	}
+	rows.Close()
+
+	tx, txErr := db.Begin()
+	if txErr != nil {
+		return txErr
+	}
+	defer tx.Rollback()
+
+	if staked > 0 {
+		postings := []ledger.Posting{{Account: g.account(round), Amount: -staked}}
+		var paid int64
+		for _, steam64id := range winners {
+			postings = append(postings, ledger.Posting{Account: ledger.UserAccount(steam64id), Amount: payouts[steam64id]})
+			paid += payouts[steam64id]
+		}
+		if staked != paid {
+			postings = append(postings, ledger.Posting{Account: ledger.ACCOUNT_HOUSE, Amount: staked - paid})
+		}
+		_, postErr := books.PostTx(tx, &ledger.Entry{
+			Key:      "roulette-payout:" + strconv.FormatInt(round, 10),
+			Kind:     "roulette_payout",
+			Ref:      strconv.FormatInt(round, 10),
+			Postings: postings,
+		})
+		if postErr != nil {
+			return postErr
+		}
+	}
+	_, execErr := tx.Exec(`UPDATE roulette_rounds SET state = ?, updated = ? WHERE id = ?`, ROULETTE_PAID, time.Now().Unix(), round)
+	if execErr != nil {
+		return execErr
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	g.lock.Lock()
+	g.history = append(g.history, slot)
+	if len(g.history) > ROULETTE_HISTORY {
+		g.history = g.history[len(g.history)-ROULETTE_HISTORY:]
+	}
+	g.lock.Unlock()
+	for _, steam64id := range winners {
+		sendBalance(steam64id)
+	}
+	return nil
+}
+
+func (g *rouletteGame) State(round int64, phase rounds.Phase, left time.Duration) interface{} {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	history := make([]string, 0, len(g.history))
+	for _, slot := range g.history {
+		history = append(history, strconv.FormatInt(slot, 10))
+	}
+	msg := map[string]interface{}{
+		"code":      "26",
+		"round_id":  strconv.FormatInt(round, 10),
+		"phase":     string(phase),
+		"time_left": strconv.FormatInt(int64(left/time.Millisecond), 10),
+		"red":       strconv.FormatInt(g.totals[ROULETTE_RED], 10),
+		"black":     strconv.FormatInt(g.totals[ROULETTE_BLACK], 10),
+		"green":     strconv.FormatInt(g.totals[ROULETTE_GREEN], 10),
+		"bets":      strconv.Itoa(g.bets),
+		"slot":      "",
+		"color":     "",
+		"roll":      "",
+		"history":   history,
+	}
+	if g.fair != nil {
+		for key, value := range fairRoundInfo(g.fair) {
+			msg[key] = value
+		}
+	}
+	//The outcome is only shown once the wheel starts spinning
+	if (phase == rounds.PHASE_RESOLVE || phase == rounds.PHASE_PAYOUT) && g.slot >= 0 {
+		msg["slot"] = strconv.FormatInt(g.slot, 10)
+		msg["color"] = rouletteColor(g.slot)
+		msg["roll"] = strconv.FormatFloat(g.roll, 'f', -1, 64)
+	}
+	return msg
+}
+
+func rouletteErrorText(err error) string {
+	switch err {
+	case errRouletteUnavailable, errRouletteBet, errRouletteColor, errRouletteFunds, errSelfExcluded, errWagerLimit:
+		return err.Error()
+	case rounds.ErrBettingClosed:
+		return "Betting is closed for this round"
+	}
+	return "Internal server error"
+}
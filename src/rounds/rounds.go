@@ -0,0 +1,215 @@
+//Package rounds runs multiplayer games that are played in timed rounds. Every
+//round goes through the same phases: betting, lock, resolve and payout. A
+//single Scheduler goroutine moves every Engine from phase to phase and
+//broadcasts the state of each one at a fixed tick
+package rounds
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+type Phase string
+
+const (
+	//Bets are accepted until the phase ends
+	PHASE_BETTING Phase = "betting"
+	//No more bets, gives in flight bets a moment to settle before the draw
+	PHASE_LOCK Phase = "lock"
+	//The outcome is drawn at the start of this phase and shown while it lasts
+	PHASE_RESOLVE Phase = "resolve"
+	//Winnings are paid at the start of this phase
+	PHASE_PAYOUT Phase = "payout"
+	//No round is running, ex. opening one failed. Retried every tick
+	PHASE_IDLE Phase = "idle"
+)
+
+//Returned by Engine.Bet once the betting phase of the round is over
+var ErrBettingClosed = errors.New("rounds: betting is closed")
+
+//A game played in rounds. Errors leave the engine in the same phase and the
+//call is retried on the next tick, so every method must be safe to repeat
+type Game interface {
+	//Starts a new round and returns its id
+	Open() (int64, error)
+	//Draws the outcome of a round whose bets are locked
+	Resolve(round int64) error
+	//Settles every bet of a resolved round
+	Payout(round int64) error
+	//Message broadcast every tick. left is the time until the phase ends
+	State(round int64, phase Phase, left time.Duration) interface{}
+}
+
+//Games that keep their rounds across restarts return the round that was
+//running and the phase it reached. Rounds that were taking bets continue in
+//PHASE_LOCK since their betting window has passed
+type Resumer interface {
+	Resume() (round int64, phase Phase, ok bool, err error)
+}
+
+//Length of each phase
+type Timing struct {
+	Betting time.Duration
+	Lock    time.Duration
+	Resolve time.Duration
+	Payout  time.Duration
+}
+
+type Engine struct {
+	Name   string
+	lock   sync.Mutex
+	game   Game
+	timing Timing
+	round  int64
+	phase  Phase
+	ends   time.Time
+	now    func() time.Time
+}
+
+func NewEngine(name string, game Game, timing Timing) *Engine {
+	return &Engine{Name: name, game: game, timing: timing, phase: PHASE_IDLE, now: time.Now}
+}
+
+//Picks up the round a Resumer game was running before a restart
+func (e *Engine) resume() error {
+	resumer, ok := e.game.(Resumer)
+	if !ok {
+		return nil
+	}
+	round, phase, found, err := resumer.Resume()
+	if err != nil || !found {
+		return err
+	}
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.round = round
+	switch phase {
+	case PHASE_BETTING, PHASE_LOCK:
+		e.enter(PHASE_LOCK, e.timing.Lock)
+	case PHASE_RESOLVE:
+		e.enter(PHASE_RESOLVE, e.timing.Resolve)
+	default:
+		e.enter(PHASE_PAYOUT, e.timing.Payout)
+	}
+	return nil
+}
+
+//Must be called with the lock held
+func (e *Engine) enter(phase Phase, length time.Duration) {
+	e.phase = phase
+	e.ends = e.now().Add(length)
+}
+
+//Runs place while the round is taking bets. The lock is held throughout, so a
+//bet that started before the lock is always part of the round
+func (e *Engine) Bet(place func(round int64) error) error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if e.phase != PHASE_BETTING || !e.now().Before(e.ends) {
+		return ErrBettingClosed
+	}
+	return place(e.round)
+}
+
+//Current round, phase and time left in the phase
+func (e *Engine) Status() (int64, Phase, time.Duration) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return e.round, e.phase, e.left()
+}
+
+func (e *Engine) left() time.Duration {
+	left := e.ends.Sub(e.now())
+	if left < 0 {
+		return 0
+	}
+	return left
+}
+
+//Moves to the next phase when less than slack is left of the current one and
+//returns the state to broadcast. Errors from the game are returned after the
+//state is built
+func (e *Engine) step(slack time.Duration) (interface{}, error) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	var err error
+	if e.phase == PHASE_IDLE || e.ends.Sub(e.now()) < slack {
+		err = e.advance()
+	}
+	if e.phase == PHASE_IDLE {
+		return nil, err
+	}
+	return e.game.State(e.round, e.phase, e.left()), err
+}
+
+//Must be called with the lock held
+func (e *Engine) advance() error {
+	switch e.phase {
+	case PHASE_BETTING:
+		e.enter(PHASE_LOCK, e.timing.Lock)
+	case PHASE_LOCK:
+		if err := e.game.Resolve(e.round); err != nil {
+			return err
+		}
+		e.enter(PHASE_RESOLVE, e.timing.Resolve)
+	case PHASE_RESOLVE:
+		if err := e.game.Payout(e.round); err != nil {
+			return err
+		}
+		e.enter(PHASE_PAYOUT, e.timing.Payout)
+	default:
+		round, err := e.game.Open()
+		if err != nil {
+			e.phase = PHASE_IDLE
+			return err
+		}
+		e.round = round
+		e.enter(PHASE_BETTING, e.timing.Betting)
+	}
+	return nil
+}
+
+//Drives every engine from one goroutine
+type Scheduler struct {
+	Tick time.Duration
+	//Called with the state of every running engine on each tick
+	Broadcast func(state interface{})
+	//Called when a game call fails, the call is retried on the next tick
+	OnError func(engine *Engine, err error)
+	engines []*Engine
+}
+
+//Adds an engine, resuming its last round if the game supports it. Must be
+//called before Run
+func (s *Scheduler) Add(engine *Engine) error {
+	if err := engine.resume(); err != nil {
+		return err
+	}
+	s.engines = append(s.engines, engine)
+	return nil
+}
+
+func (s *Scheduler) Run(quit <-chan bool) {
+	ticker := time.NewTicker(s.Tick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			for _, engine := range s.engines {
+				//Ticks rarely land on a phase end, without slack every phase
+				//would run up to a tick longer than its timing
+				state, err := engine.step(s.Tick / 2)
+				if err != nil && s.OnError != nil {
+					s.OnError(engine, err)
+				}
+				if state != nil && s.Broadcast != nil {
+					s.Broadcast(state)
+				}
+			}
+		case <-quit:
+			return
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+//Largest violation report we bother reading
+const CSP_REPORT_LIMIT = 16 * 1024
+
+//Empty values disable the header. "{nonce}" in the CSP is replaced per request
+type HeaderConfig struct {
+	ContentSecurityPolicy string `json:"content_security_policy"`
+	CspReportOnly         bool   `json:"csp_report_only"`
+	StrictTransport       string `json:"strict_transport_security"`
+	FrameOptions          string `json:"frame_options"`
+	ContentTypeOptions    string `json:"content_type_options"`
+	ReferrerPolicy        string `json:"referrer_policy"`
+	PermissionsPolicy     string `json:"permissions_policy"`
+}
+
+func defaultHeaderConfig() HeaderConfig {
+	return HeaderConfig{
+		ContentSecurityPolicy: "default-src 'self'; " +
+			"script-src 'self' 'nonce-{nonce}' https://ajax.googleapis.com; " +
+			"style-src 'self' 'nonce-{nonce}'; " +
+			"img-src 'self' data: https://steamcommunity-a.akamaihd.net https://steamcdn-a.akamaihd.net; " +
+			"connect-src 'self' wss://" + HOST_ADDR + "; " +
+			"frame-ancestors 'none'; base-uri 'self'; form-action 'self'; " +
+			"report-uri /csp-report",
+		CspReportOnly:      false,
+		StrictTransport:    "max-age=31536000; includeSubDomains",
+		FrameOptions:       "DENY",
+		ContentTypeOptions: "nosniff",
+		ReferrerPolicy:     "same-origin",
+		PermissionsPolicy:  "camera=(), microphone=(), geolocation=(), payment=()",
+	}
+}
+
+type contextKey int
+
+const cspNonceKey contextKey = 0
+
+func genCspNonce() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(buf), nil
+}
+
+//Returns the nonce assigned by SecurityHeaders, empty if there is none
+func cspNonce(r *http.Request) string {
+	nonce, _ := r.Context().Value(cspNonceKey).(string)
+	return nonce
+}
+
+func SecurityHeaders(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		headers := config.Headers
+		h := w.Header()
+
+		if headers.ContentSecurityPolicy != "" {
+			nonce, nonceErr := genCspNonce()
+			if nonceErr != nil {
+				requestLog(r).WithError(nonceErr).Error("Error generating csp nonce")
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+			r = r.WithContext(context.WithValue(r.Context(), cspNonceKey, nonce))
+			policy := strings.Replace(headers.ContentSecurityPolicy, "{nonce}", nonce, -1)
+			if headers.CspReportOnly {
+				h.Set("Content-Security-Policy-Report-Only", policy)
+			} else {
+				h.Set("Content-Security-Policy", policy)
+			}
+		}
+		if headers.StrictTransport != "" {
+			h.Set("Strict-Transport-Security", headers.StrictTransport)
+		}
+		if headers.FrameOptions != "" {
+			h.Set("X-Frame-Options", headers.FrameOptions)
+		}
+		if headers.ContentTypeOptions != "" {
+			h.Set("X-Content-Type-Options", headers.ContentTypeOptions)
+		}
+		if headers.ReferrerPolicy != "" {
+			h.Set("Referrer-Policy", headers.ReferrerPolicy)
+		}
+		if headers.PermissionsPolicy != "" {
+			h.Set("Permissions-Policy", headers.PermissionsPolicy)
+		}
+		next.ServeHTTP(w, r)
+	}
+	return http.HandlerFunc(fn)
+}
+
+//Browsers post violations here as application/csp-report json, we only log them
+func CspReportHandler(w http.ResponseWriter, r *http.Request) {
+	body, readErr := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, CSP_REPORT_LIMIT))
+	if readErr != nil {
+		requestLog(r).WithError(readErr).Warn("Error reading csp report")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	requestLog(r).WithField("report", strings.TrimSpace(string(body))).Warn("CSP violation reported")
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,512 @@
+package main
+
+import (
+	log "github.com/Sirupsen/logrus"
+	rounds "github.com/skyguy126/website/src/rounds"
+	"strconv"
+)
+
+//Codes sent by the client, replies use the same code
+const (
+	MSG_TRADE_URL       = 8
+	MSG_DEPOSIT         = 9
+	MSG_INVENTORY       = 11
+	MSG_BALANCE         = 12
+	MSG_BOT_ITEMS       = 13
+	MSG_WITHDRAW        = 14
+	MSG_FAIRNESS        = 16
+	MSG_JACKPOT         = 17
+	MSG_JACKPOT_STATE   = 18
+	MSG_COINFLIP_NEW    = 20
+	MSG_COINFLIP_JOIN   = 21
+	MSG_COINFLIP_CANCEL = 22
+	MSG_COINFLIP_LIST   = 23
+	MSG_ROULETTE        = 25
+	MSG_LIMITS          = 27
+	MSG_SELF_EXCLUDE    = 28
+	MSG_ADMIN_KICK      = 29
+	MSG_ADMIN_BAN       = 30
+)
+
+//Codes only staff can send, checked before the message is handled
+var socketPermissions = map[int]string{
+	MSG_ADMIN_KICK: PERM_KICK,
+	MSG_ADMIN_BAN:  PERM_BAN,
+}
+
+//Handles an authenticated client message, runs on the SockHandler goroutine
+func handleSocketMessage(socketConn *SocketConn, msg *WebsocketMessage) {
+	wsMessages.WithLabelValues(messageCodeLabel(msg.Code)).Inc()
+	if permission, ok := socketPermissions[msg.Code]; ok {
+		allowed, err := hasPermission(socketConn.Sid, permission)
+		if err != nil {
+			socketConn.Log.WithError(err).WithField("permission", permission).Error("Error checking permission")
+		}
+		if !allowed {
+			socketConn.Log.WithFields(log.Fields{"code": msg.Code, "permission": permission}).Warn("Message without permission")
+			wsRejected.WithLabelValues("forbidden").Inc()
+			marshalAndSend(map[string]string{"code": strconv.Itoa(msg.Code), "status": "error", "error": "Forbidden"}, socketConn, true)
+			return
+		}
+	}
+
+	switch msg.Code {
+	case MSG_TRADE_URL:
+		handleTradeUrlMessage(socketConn, msg)
+	case MSG_DEPOSIT:
+		handleDepositMessage(socketConn, msg)
+	case MSG_INVENTORY:
+		handleInventoryMessage(socketConn, msg)
+	case MSG_BALANCE:
+		handleBalanceMessage(socketConn)
+	case MSG_BOT_ITEMS:
+		handleBotItemsMessage(socketConn, msg)
+	case MSG_WITHDRAW:
+		handleWithdrawMessage(socketConn, msg)
+	case MSG_FAIRNESS:
+		handleFairnessMessage(socketConn, msg)
+	case MSG_JACKPOT:
+		handleJackpotMessage(socketConn, msg)
+	case MSG_JACKPOT_STATE:
+		handleJackpotStateMessage(socketConn)
+	case MSG_COINFLIP_NEW:
+		handleCoinflipNewMessage(socketConn, msg)
+	case MSG_COINFLIP_JOIN:
+		handleCoinflipJoinMessage(socketConn, msg)
+	case MSG_COINFLIP_CANCEL:
+		handleCoinflipCancelMessage(socketConn, msg)
+	case MSG_COINFLIP_LIST:
+		handleCoinflipListMessage(socketConn)
+	case MSG_ROULETTE:
+		handleRouletteMessage(socketConn, msg)
+	case MSG_LIMITS:
+		handleLimitsMessage(socketConn, msg)
+	case MSG_SELF_EXCLUDE:
+		handleSelfExcludeMessage(socketConn, msg)
+	case MSG_ADMIN_KICK:
+		handleAdminKickMessage(socketConn, msg)
+	case MSG_ADMIN_BAN:
+		handleAdminBanMessage(socketConn, msg)
+	default:
+		socketConn.Log.WithField("code", msg.Code).Warn("Unknown message code")
+		marshalAndSend(map[string]string{"code": "4"}, socketConn, true)
+	}
+}
+
+//{"code":"8"} fetches the trade url, {"code":"8","trade_url":"..."} sets it
+func handleTradeUrlMessage(socketConn *SocketConn, msg *WebsocketMessage) {
+	raw, _ := msg.Msg.GetString("trade_url")
+
+	var tradeUrl *TradeUrl
+	var err error
+	if raw == "" {
+		tradeUrl, err = getTradeUrl(socketConn.Sid)
+	} else {
+		tradeUrl, err = setTradeUrl(socketConn.Sid, raw, socketConn.Ip)
+	}
+
+	if err != nil {
+		if err != errTradeUrlInvalid && err != errTradeUrlPartner && err != errTradeUrlCooldown {
+			socketConn.Log.WithError(err).Error("Error handling trade url")
+		}
+		marshalAndSend(map[string]string{"code": "8", "status": "error", "error": tradeUrlErrorText(err)}, socketConn, true)
+		return
+	}
+
+	resp := map[string]string{"code": "8", "status": "ok", "trade_url": ""}
+	if tradeUrl != nil {
+		resp["trade_url"] = tradeUrl.Url
+	}
+	marshalAndSend(resp, socketConn, true)
+}
+
+//{"code":"9","items":["assetid",...]} sends a deposit offer for the items.
+//Steam can take a while so the offer is created off the socket goroutine
+func handleDepositMessage(socketConn *SocketConn, msg *WebsocketMessage) {
+	assetIds, itemsErr := msg.Msg.GetStringArray("items")
+	if itemsErr != nil {
+		marshalAndSend(map[string]string{"code": "9", "status": "error", "error": errDepositItems.Error()}, socketConn, true)
+		return
+	}
+
+	go func() {
+		deposit, err := createDeposit(socketConn.Sid, socketConn.Ip, assetIds)
+		if err != nil {
+			if depositErrorText(err) != err.Error() {
+				socketConn.Log.WithError(err).Error("Error creating deposit")
+			}
+			marshalAndSend(map[string]string{"code": "9", "status": "error", "error": depositErrorText(err)}, socketConn, true)
+			return
+		}
+		marshalAndSend(map[string]string{
+			"code":          "9",
+			"status":        "ok",
+			"offer_id":      deposit.OfferId,
+			"security_code": deposit.SecurityCode,
+		}, socketConn, true)
+		marshalAndSend(map[string]string{"code": "10", "offer_id": deposit.OfferId, "state": deposit.State}, socketConn, true)
+	}()
+}
+
+//{"code":"11","page":"0","sort":"name","order":"asc","search":"","exterior":"FT","tradable":"true","refresh":"false"}
+//returns one page of the user's inventory, loading it can hit steam so it runs off the socket goroutine
+func handleInventoryMessage(socketConn *SocketConn, msg *WebsocketMessage) {
+	get := func(key string) string {
+		value, _ := msg.Msg.GetString(key)
+		return value
+	}
+	query := parseInventoryQuery(get)
+	refresh := get("refresh") == "true"
+
+	go func() {
+		items, err := inventories.Load(socketConn.Sid, refresh)
+		if err != nil {
+			marshalAndSend(map[string]string{"code": "11", "status": "error", "error": inventoryErrorText(err)}, socketConn, true)
+			return
+		}
+		page := queryInventory(items, query)
+		marshalAndSend(map[string]interface{}{
+			"code":   "11",
+			"status": "ok",
+			"page":   strconv.Itoa(page.Page),
+			"pages":  strconv.Itoa(page.Pages),
+			"total":  strconv.Itoa(page.Total),
+			"items":  page.Items,
+		}, socketConn, true)
+	}()
+}
+
+//{"code":"12"} returns the balance in cents, it is also pushed whenever it changes
+func handleBalanceMessage(socketConn *SocketConn) {
+	balance, err := userBalance(socketConn.Sid)
+	if err != nil {
+		socketConn.Log.WithError(err).Error("Error getting balance")
+		marshalAndSend(map[string]string{"code": "4"}, socketConn, true)
+		return
+	}
+	marshalAndSend(map[string]string{"code": "12", "balance": strconv.FormatInt(balance, 10)}, socketConn, true)
+}
+
+//{"code":"13"} takes the same fields as code 11 except refresh and pages through
+//the bot items that can be withdrawn
+func handleBotItemsMessage(socketConn *SocketConn, msg *WebsocketMessage) {
+	get := func(key string) string {
+		value, _ := msg.Msg.GetString(key)
+		return value
+	}
+	query := parseInventoryQuery(get)
+
+	go func() {
+		if tradeBot == nil {
+			marshalAndSend(map[string]string{"code": "13", "status": "error", "error": errWithdrawUnavailable.Error()}, socketConn, true)
+			return
+		}
+		items, err := availableBotItems()
+		if err != nil {
+			socketConn.Log.WithError(err).Error("Error loading bot items")
+			marshalAndSend(map[string]string{"code": "13", "status": "error", "error": inventoryErrorText(err)}, socketConn, true)
+			return
+		}
+		page := queryInventory(items, query)
+		marshalAndSend(map[string]interface{}{
+			"code":   "13",
+			"status": "ok",
+			"page":   strconv.Itoa(page.Page),
+			"pages":  strconv.Itoa(page.Pages),
+			"total":  strconv.Itoa(page.Total),
+			"items":  page.Items,
+		}, socketConn, true)
+	}()
+}
+
+//{"code":"14","items":["assetid",...]} withdraws bot items paid for with the balance
+func handleWithdrawMessage(socketConn *SocketConn, msg *WebsocketMessage) {
+	assetIds, itemsErr := msg.Msg.GetStringArray("items")
+	if itemsErr != nil {
+		marshalAndSend(map[string]string{"code": "14", "status": "error", "error": errWithdrawItems.Error()}, socketConn, true)
+		return
+	}
+
+	go func() {
+		withdrawal, err := createWithdrawal(socketConn.Sid, socketConn.Ip, assetIds)
+		if err != nil {
+			if withdrawErrorText(err) != err.Error() {
+				socketConn.Log.WithError(err).Error("Error creating withdrawal")
+			}
+			marshalAndSend(map[string]string{"code": "14", "status": "error", "error": withdrawErrorText(err)}, socketConn, true)
+			return
+		}
+		marshalAndSend(map[string]string{
+			"code":          "14",
+			"status":        "ok",
+			"withdrawal_id": withdrawal.Id,
+			"total":         strconv.FormatInt(withdrawal.Total, 10),
+		}, socketConn, true)
+		marshalAndSend(map[string]string{"code": "15", "withdrawal_id": withdrawal.Id, "state": withdrawal.State, "offer_id": ""}, socketConn, true)
+		sendBalance(socketConn.Sid)
+	}()
+}
+
+//{"code":"16"} fetches the client seed, {"code":"16","client_seed":"..."} sets it
+func handleFairnessMessage(socketConn *SocketConn, msg *WebsocketMessage) {
+	seed, _ := msg.Msg.GetString("client_seed")
+
+	var err error
+	if seed == "" {
+		seed, err = getClientSeed(socketConn.Sid)
+	} else {
+		err = setClientSeed(socketConn.Sid, seed, socketConn.Ip)
+	}
+	if err != nil {
+		if fairErrorText(err) != err.Error() {
+			socketConn.Log.WithError(err).Error("Error handling client seed")
+		}
+		marshalAndSend(map[string]string{"code": "16", "status": "error", "error": fairErrorText(err)}, socketConn, true)
+		return
+	}
+	marshalAndSend(map[string]string{"code": "16", "status": "ok", "client_seed": seed}, socketConn, true)
+}
+
+//{"code":"17","amount":"cents"} bets part of the balance on the current jackpot round
+func handleJackpotMessage(socketConn *SocketConn, msg *WebsocketMessage) {
+	raw, _ := msg.Msg.GetString("amount")
+	amount, parseErr := strconv.ParseInt(raw, 10, 64)
+	if parseErr != nil {
+		marshalAndSend(map[string]string{"code": "17", "status": "error", "error": errJackpotBet.Error()}, socketConn, true)
+		return
+	}
+	if jackpot == nil {
+		marshalAndSend(map[string]string{"code": "17", "status": "error", "error": errJackpotUnavailable.Error()}, socketConn, true)
+		return
+	}
+
+	go func() {
+		if err := jackpot.Bet(socketConn.Sid, socketConn.Ip, amount); err != nil {
+			if jackpotErrorText(err) != err.Error() {
+				socketConn.Log.WithError(err).Error("Error placing jackpot bet")
+			}
+			marshalAndSend(map[string]string{"code": "17", "status": "error", "error": jackpotErrorText(err)}, socketConn, true)
+			return
+		}
+		marshalAndSend(map[string]string{"code": "17", "status": "ok"}, socketConn, true)
+	}()
+}
+
+//{"code":"18"} sends the current jackpot round, later changes are pushed
+func handleJackpotStateMessage(socketConn *SocketConn) {
+	if jackpot == nil {
+		marshalAndSend(map[string]string{"code": "18", "state": "unavailable"}, socketConn, true)
+		return
+	}
+	if state := jackpot.State(); state != nil {
+		marshalAndSend(state, socketConn, true)
+	}
+}
+
+func sendCoinflipError(socketConn *SocketConn, code string, err error) {
+	if coinflipErrorText(err) != err.Error() {
+		socketConn.Log.WithError(err).Error("Error handling coinflip")
+	}
+	marshalAndSend(map[string]string{"code": code, "status": "error", "error": coinflipErrorText(err)}, socketConn, true)
+}
+
+//{"code":"20","amount":"cents","side":"heads"} opens a lobby
+func handleCoinflipNewMessage(socketConn *SocketConn, msg *WebsocketMessage) {
+	raw, _ := msg.Msg.GetString("amount")
+	side, _ := msg.Msg.GetString("side")
+	amount, parseErr := strconv.ParseInt(raw, 10, 64)
+	if parseErr != nil {
+		sendCoinflipError(socketConn, "20", errCoinflipBet)
+		return
+	}
+
+	go func() {
+		lobby, err := createCoinflip(socketConn.Sid, socketConn.Ip, amount, side)
+		if err != nil {
+			sendCoinflipError(socketConn, "20", err)
+			return
+		}
+		marshalAndSend(map[string]string{"code": "20", "status": "ok", "lobby_id": lobby.ref()}, socketConn, true)
+	}()
+}
+
+//{"code":"21","lobby_id":"...","amount":"cents"} joins a lobby, the coin is flipped right away
+func handleCoinflipJoinMessage(socketConn *SocketConn, msg *WebsocketMessage) {
+	rawId, _ := msg.Msg.GetString("lobby_id")
+	rawAmount, _ := msg.Msg.GetString("amount")
+	id, idErr := strconv.ParseInt(rawId, 10, 64)
+	amount, amountErr := strconv.ParseInt(rawAmount, 10, 64)
+	if idErr != nil || amountErr != nil {
+		sendCoinflipError(socketConn, "21", errCoinflipNotFound)
+		return
+	}
+
+	go func() {
+		lobby, err := joinCoinflip(socketConn.Sid, socketConn.Ip, id, amount)
+		if err != nil {
+			sendCoinflipError(socketConn, "21", err)
+			return
+		}
+		marshalAndSend(map[string]string{"code": "21", "status": "ok", "lobby_id": lobby.ref(), "winner": lobby.Winner}, socketConn, true)
+	}()
+}
+
+//{"code":"22","lobby_id":"..."} cancels an open lobby and refunds the creator
+func handleCoinflipCancelMessage(socketConn *SocketConn, msg *WebsocketMessage) {
+	rawId, _ := msg.Msg.GetString("lobby_id")
+	id, idErr := strconv.ParseInt(rawId, 10, 64)
+	if idErr != nil {
+		sendCoinflipError(socketConn, "22", errCoinflipNotFound)
+		return
+	}
+
+	go func() {
+		if err := cancelCoinflip(socketConn.Sid, socketConn.Ip, id); err != nil {
+			sendCoinflipError(socketConn, "22", err)
+			return
+		}
+		marshalAndSend(map[string]string{"code": "22", "status": "ok", "lobby_id": rawId}, socketConn, true)
+	}()
+}
+
+//{"code":"23"} lists open lobbies, later changes are pushed with code 24
+func handleCoinflipListMessage(socketConn *SocketConn) {
+	if coinflipConf == nil {
+		sendCoinflipError(socketConn, "23", errCoinflipUnavailable)
+		return
+	}
+	go func() {
+		lobbies, err := listCoinflips()
+		if err != nil {
+			sendCoinflipError(socketConn, "23", err)
+			return
+		}
+		marshalAndSend(map[string]interface{}{"code": "23", "status": "ok", "lobbies": lobbies}, socketConn, true)
+	}()
+}
+
+//{"code":"25","color":"red","amount":"cents"} bets on the current roulette round.
+//Bets that arrive after the lock get status "locked" instead of "error"
+func handleRouletteMessage(socketConn *SocketConn, msg *WebsocketMessage) {
+	color, _ := msg.Msg.GetString("color")
+	raw, _ := msg.Msg.GetString("amount")
+	amount, parseErr := strconv.ParseInt(raw, 10, 64)
+	if parseErr != nil {
+		marshalAndSend(map[string]string{"code": "25", "status": "error", "error": errRouletteBet.Error()}, socketConn, true)
+		return
+	}
+	if roulette == nil {
+		marshalAndSend(map[string]string{"code": "25", "status": "error", "error": errRouletteUnavailable.Error()}, socketConn, true)
+		return
+	}
+
+	go func() {
+		err := roulette.Bet(socketConn.Sid, socketConn.Ip, color, amount)
+		if err == rounds.ErrBettingClosed {
+			marshalAndSend(map[string]string{"code": "25", "status": "locked", "error": rouletteErrorText(err)}, socketConn, true)
+			return
+		}
+		if err != nil {
+			if rouletteErrorText(err) != err.Error() {
+				socketConn.Log.WithError(err).Error("Error placing roulette bet")
+			}
+			marshalAndSend(map[string]string{"code": "25", "status": "error", "error": rouletteErrorText(err)}, socketConn, true)
+			return
+		}
+		marshalAndSend(map[string]string{"code": "25", "status": "ok", "color": color, "amount": raw}, socketConn, true)
+		sendBalance(socketConn.Sid)
+	}()
+}
+
+//{"code":"27"} returns the deposit and wager limits, {"code":"27","kind":"wager","period":"day","amount":"cents"}
+//sets one. An amount of 0 removes the limit, raising or removing one only takes effect after the cooling-off period
+func handleLimitsMessage(socketConn *SocketConn, msg *WebsocketMessage) {
+	kind, _ := msg.Msg.GetString("kind")
+	period, _ := msg.Msg.GetString("period")
+	raw, _ := msg.Msg.GetString("amount")
+
+	go func() {
+		if kind != "" {
+			amount, parseErr := strconv.ParseInt(raw, 10, 64)
+			if parseErr != nil {
+				marshalAndSend(map[string]string{"code": "27", "status": "error", "error": errLimitInvalid.Error()}, socketConn, true)
+				return
+			}
+			if _, err := setLimit(socketConn.Sid, socketConn.Ip, kind, period, amount); err != nil {
+				if responsibleErrorText(err) != err.Error() {
+					socketConn.Log.WithError(err).Error("Error setting limit")
+				}
+				marshalAndSend(map[string]string{"code": "27", "status": "error", "error": responsibleErrorText(err)}, socketConn, true)
+				return
+			}
+		}
+		limits, err := getLimits(socketConn.Sid)
+		if err != nil {
+			socketConn.Log.WithError(err).Error("Error getting limits")
+			marshalAndSend(map[string]string{"code": "27", "status": "error", "error": responsibleErrorText(err)}, socketConn, true)
+			return
+		}
+		marshalAndSend(map[string]interface{}{"code": "27", "status": "ok", "limits": limits}, socketConn, true)
+	}()
+}
+
+//{"code":"28","days":"30"} self-excludes the user. The socket is closed after the reply
+//and login is refused until the exclusion ends
+func handleSelfExcludeMessage(socketConn *SocketConn, msg *WebsocketMessage) {
+	raw, _ := msg.Msg.GetString("days")
+	days, parseErr := strconv.Atoi(raw)
+	if parseErr != nil {
+		marshalAndSend(map[string]string{"code": "28", "status": "error", "error": errExclusionInvalid.Error()}, socketConn, true)
+		return
+	}
+
+	until, err := selfExclude(socketConn.Sid, socketConn.Ip, days)
+	if err != nil {
+		if responsibleErrorText(err) != err.Error() {
+			socketConn.Log.WithError(err).Error("Error self-excluding")
+		}
+		marshalAndSend(map[string]string{"code": "28", "status": "error", "error": responsibleErrorText(err)}, socketConn, true)
+		return
+	}
+	marshalAndSend(map[string]string{"code": "28", "status": "ok", "until": strconv.FormatInt(until.Unix(), 10)}, socketConn, true)
+	socketConn.Conn.Close()
+}
+
+//{"code":"29","sid":"steam64id"} closes the user's socket, moderators and up
+func handleAdminKickMessage(socketConn *SocketConn, msg *WebsocketMessage) {
+	steam64id, _ := msg.Msg.GetString("sid")
+	//Kicking waits on the other socket, which may be waiting on this one
+	go func() {
+		kicked, err := adminKick(socketConn.Sid, socketConn.Ip, steam64id)
+		if err != nil {
+			if adminErrorText(err) != err.Error() {
+				socketConn.Log.WithError(err).WithField("target", steam64id).Error("Error kicking")
+			}
+			marshalAndSend(map[string]string{"code": "29", "status": "error", "error": adminErrorText(err)}, socketConn, true)
+			return
+		}
+		marshalAndSend(map[string]string{"code": "29", "status": "ok", "sid": steam64id, "kicked": strconv.FormatBool(kicked)}, socketConn, true)
+	}()
+}
+
+//{"code":"30","sid":"steam64id","reason":"...","days":"7"} bans a user, days 0 bans permanently. Admins and up
+func handleAdminBanMessage(socketConn *SocketConn, msg *WebsocketMessage) {
+	steam64id, _ := msg.Msg.GetString("sid")
+	reason, _ := msg.Msg.GetString("reason")
+	raw, _ := msg.Msg.GetString("days")
+	days, parseErr := strconv.Atoi(raw)
+	if parseErr != nil {
+		marshalAndSend(map[string]string{"code": "30", "status": "error", "error": errBanDays.Error()}, socketConn, true)
+		return
+	}
+	go func() {
+		if err := banUser(socketConn.Sid, socketConn.Ip, steam64id, reason, days); err != nil {
+			if adminErrorText(err) != err.Error() {
+				socketConn.Log.WithError(err).WithField("target", steam64id).Error("Error banning")
+			}
+			marshalAndSend(map[string]string{"code": "30", "status": "error", "error": adminErrorText(err)}, socketConn, true)
+			return
+		}
+		marshalAndSend(map[string]string{"code": "30", "status": "ok", "sid": steam64id}, socketConn, true)
+	}()
+}
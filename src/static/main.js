@@ -3,16 +3,120 @@
 $(document).ready(function () {
     console.log("Ready!");
 
-    socket = new WebSocket("wss://24.4.237.252:443/sock");
-    socket.onopen = function(evt) { onOpen(evt) };
-    socket.onclose = function(evt) { onClose(evt) };
-    socket.onmessage = function(evt) { onMessage(evt) };
-    socket.onerror = function(evt) { onError(evt) };
+    var ticket = null;
+    var socket = null;
+    var inventoryPage = 0;
+    var inventoryPages = 0;
+    var selected = {};
+
+    //Every POST needs the csrf token in the X-CSRF-Token header or a gorilla.csrf.Token form field
+    var csrfToken = $("meta[name='csrf-token']").attr("content");
+    connect();
+
+    $("#logout").click(function(evt) {
+        evt.preventDefault();
+        $("#logout-form").submit();
+    });
+
+    $("#inventory-filters").on("change", function() {
+        inventoryPage = 0;
+        loadInventory(false);
+    });
+    $("#inventory-filters input[name='search']").on("keyup", function() {
+        inventoryPage = 0;
+        loadInventory(false);
+    });
+    $("#inventory-refresh").click(function() { loadInventory(true); });
+    $("#inventory-prev").click(function(evt) {
+        evt.preventDefault();
+        if (inventoryPage > 0) {
+            inventoryPage--;
+            loadInventory(false);
+        }
+    });
+    $("#inventory-next").click(function(evt) {
+        evt.preventDefault();
+        if (inventoryPage + 1 < inventoryPages) {
+            inventoryPage++;
+            loadInventory(false);
+        }
+    });
+    $("#deposit-button").click(function() {
+        deposit(Object.keys(selected));
+    });
+    $("#jackpot-form").submit(function(evt) {
+        evt.preventDefault();
+        var dollars = parseFloat($(this).find("input[name='amount']").val());
+        socket.send(JSON.stringify({ code: "17", amount: String(Math.round(dollars * 100)) }));
+    });
+    $("#coinflip-form").submit(function(evt) {
+        evt.preventDefault();
+        var dollars = parseFloat($(this).find("input[name='amount']").val());
+        socket.send(JSON.stringify({
+            code: "20",
+            amount: String(Math.round(dollars * 100)),
+            side: $(this).find("select[name='side']").val()
+        }));
+    });
+    $("#roulette-form button").click(function() {
+        var dollars = parseFloat($("#roulette-form input[name='amount']").val());
+        socket.send(JSON.stringify({
+            code: "25",
+            color: $(this).data("color"),
+            amount: String(Math.round(dollars * 100))
+        }));
+    });
+    $("#client-seed-form").submit(function(evt) {
+        evt.preventDefault();
+        var seed = $(this).find("input[name='client_seed']").val();
+        socket.send(JSON.stringify({ code: "16", client_seed: seed }));
+    });
+    $("#limit-form").submit(function(evt) {
+        evt.preventDefault();
+        var dollars = parseFloat($(this).find("input[name='amount']").val()) || 0;
+        socket.send(JSON.stringify({
+            code: "27",
+            kind: $(this).find("select[name='kind']").val(),
+            period: $(this).find("select[name='period']").val(),
+            amount: String(Math.round(dollars * 100))
+        }));
+    });
+    $("#exclude-form").submit(function(evt) {
+        evt.preventDefault();
+        if (!confirm("You will not be able to log in until the exclusion ends. Continue?")) {
+            return;
+        }
+        socket.send(JSON.stringify({ code: "28", days: $(this).find("select[name='days']").val() }));
+    });
+
+    //Ticket is single use and only valid for a few seconds, fetch it right before connecting
+    function connect()
+    {
+        $.ajax({
+            url: "/api/sock-ticket",
+            method: "POST",
+            dataType: "json",
+            headers: { "X-CSRF-Token": csrfToken }
+        }).done(function(data) {
+            ticket = data.ticket;
+            socket = new WebSocket("wss://24.4.237.252:443/sock");
+            socket.onopen = function(evt) { onOpen(evt) };
+            socket.onclose = function(evt) { onClose(evt) };
+            socket.onmessage = function(evt) { onMessage(evt) };
+            socket.onerror = function(evt) { onError(evt) };
+        }).fail(function(xhr) {
+            if (xhr.responseJSON && xhr.responseJSON.error == "terms") {
+                window.location.href = "/terms";
+                return;
+            }
+            console.log("could not get socket ticket")
+        });
+    }
 
     function onOpen(evt)
     {
         console.log("opened socket")
-        socket.send(document.cookie);
+        socket.send(ticket);
     }
 
     function onClose(evt)
@@ -23,6 +127,258 @@ $(document).ready(function () {
     function onMessage(evt)
     {
         console.log(evt.data)
+        var msg = JSON.parse(evt.data);
+        if (msg.code == "1") {
+            $("#user-nickname").text(msg.nickname);
+            $("#user-avatar").attr("src", msg.avatar);
+            loadInventory(false);
+            socket.send(JSON.stringify({ code: "12" }));
+            socket.send(JSON.stringify({ code: "16" }));
+            socket.send(JSON.stringify({ code: "18" }));
+            socket.send(JSON.stringify({ code: "23" }));
+            socket.send(JSON.stringify({ code: "27" }));
+        } else if (msg.code == "12") {
+            $("#user-balance").text("$" + (parseInt(msg.balance, 10) / 100).toFixed(2));
+        } else if (msg.code == "11") {
+            showInventory(msg);
+        } else if (msg.code == "9") {
+            if (msg.status == "ok") {
+                $("#deposit-status").text("Trade offer sent, security code " + msg.security_code);
+            } else {
+                $("#deposit-status").text(msg.error);
+            }
+        } else if (msg.code == "10") {
+            showDepositState(msg.offer_id, msg.state);
+        } else if (msg.code == "14") {
+            if (msg.status != "ok") {
+                $("#withdraw-status").text(msg.error);
+            }
+        } else if (msg.code == "15") {
+            showWithdrawalState(msg.withdrawal_id, msg.state, msg.offer_id);
+        } else if (msg.code == "17") {
+            $("#jackpot-status").text(msg.status == "ok" ? "" : msg.error);
+        } else if (msg.code == "18") {
+            showJackpot(msg);
+        } else if (msg.code == "19") {
+            $("#jackpot-winner").empty().append(
+                $("<span>").text("Round " + msg.round_id + " won by " + (msg.nickname || msg.winner) +
+                    " with ticket " + msg.ticket + ", $" + (parseInt(msg.payout, 10) / 100).toFixed(2) + " "),
+                $("<a>").attr("href", msg.verify_url).text("verify"));
+        } else if (msg.code == "20" || msg.code == "21" || msg.code == "22") {
+            $("#coinflip-status").text(msg.status == "ok" ? "" : msg.error);
+        } else if (msg.code == "23") {
+            if (msg.status == "ok") {
+                $("#coinflip-lobbies").empty();
+                $.each(msg.lobbies, function(i, lobby) { showCoinflip(lobby); });
+            }
+        } else if (msg.code == "24") {
+            showCoinflip(msg);
+        } else if (msg.code == "25") {
+            $("#roulette-status").text(msg.status == "ok" ? "Bet placed on " + msg.color : msg.error);
+        } else if (msg.code == "26") {
+            showRoulette(msg);
+        } else if (msg.code == "27") {
+            if (msg.status == "ok") {
+                $("#limit-status").text("");
+                showLimits(msg.limits);
+            } else {
+                $("#limit-status").text(msg.error);
+            }
+        } else if (msg.code == "28") {
+            if (msg.status == "ok") {
+                window.location.href = "/";
+            } else {
+                $("#exclude-status").text(msg.error);
+            }
+        } else if (msg.code == "31") {
+            alert("You were disconnected by a moderator");
+        } else if (msg.code == "16") {
+            if (msg.status == "ok") {
+                $("#client-seed-form input[name='client_seed']").val(msg.client_seed);
+                $("#client-seed-status").text("Your client seed is " + msg.client_seed);
+            } else {
+                $("#client-seed-status").text(msg.error);
+            }
+        }
+    }
+
+    //Sorting, filtering and paging happen on the server
+    function loadInventory(refresh)
+    {
+        var filters = $("#inventory-filters");
+        socket.send(JSON.stringify({
+            code: "11",
+            page: String(inventoryPage),
+            search: filters.find("input[name='search']").val(),
+            exterior: filters.find("select[name='exterior']").val(),
+            sort: filters.find("select[name='sort']").val(),
+            tradable: String(filters.find("input[name='tradable']").is(":checked")),
+            refresh: String(refresh)
+        }));
+    }
+
+    function showInventory(msg)
+    {
+        if (msg.status != "ok") {
+            $("#inventory-status").text(msg.error);
+            return;
+        }
+        inventoryPage = parseInt(msg.page, 10);
+        inventoryPages = parseInt(msg.pages, 10);
+        $("#inventory-status").text(msg.total + " items");
+        $("#inventory-page").text((inventoryPage + 1) + " / " + Math.max(inventoryPages, 1));
+
+        var container = $("#inventory-items").empty();
+        $.each(msg.items, function(i, item) {
+            var cell = $("<div>").addClass("col-xs-6 col-sm-3 inventory-item");
+            cell.append($("<img>").attr("src", item.icon).addClass("img-responsive"));
+            cell.append($("<div>").text(item.name));
+            if (item.exterior_short) {
+                cell.append($("<small>").text(item.exterior_short));
+            }
+            $.each(item.stickers, function(j, sticker) {
+                cell.append($("<img>").attr({ src: sticker.image, title: sticker.name, width: 24 }));
+            });
+            if (!item.tradable && item.tradable_after > 0) {
+                cell.append($("<div>").text("Tradable after " + new Date(item.tradable_after * 1000).toLocaleString()));
+            }
+            if (item.priced) {
+                cell.append($("<div>").text("$" + (item.price / 100).toFixed(2)));
+            } else {
+                cell.append($("<div>").text("No price"));
+            }
+            if (item.tradable && item.priced) {
+                cell.toggleClass("active", !!selected[item.asset_id]);
+                cell.click(function() {
+                    if (selected[item.asset_id]) {
+                        delete selected[item.asset_id];
+                    } else {
+                        selected[item.asset_id] = true;
+                    }
+                    cell.toggleClass("active", !!selected[item.asset_id]);
+                });
+            }
+            container.append(cell);
+        });
+    }
+
+    //assetIds is a list of CS:GO asset ids picked from the user's inventory
+    function deposit(assetIds)
+    {
+        socket.send(JSON.stringify({ code: "9", items: assetIds }));
+    }
+    window.deposit = deposit;
+
+    //assetIds come from the bot items listed with code 13
+    function withdraw(assetIds)
+    {
+        socket.send(JSON.stringify({ code: "14", items: assetIds }));
+    }
+    window.withdraw = withdraw;
+
+    //The countdown runs locally from the end time in the last state message
+    var jackpotEnds = 0;
+    setInterval(function() {
+        if (jackpotEnds > 0) {
+            var left = Math.max(0, Math.round(jackpotEnds - Date.now() / 1000));
+            $("#jackpot-timer").text(left + "s left");
+        }
+    }, 1000);
+
+    function showJackpot(msg)
+    {
+        if (msg.state == "unavailable") {
+            $("#jackpot-round").text("unavailable");
+            return;
+        }
+        $("#jackpot-round").text(msg.round_id);
+        $("#jackpot-pot").text("$" + (parseInt(msg.pot, 10) / 100).toFixed(2));
+        $("#jackpot-hash").text(msg.fair_hash);
+        jackpotEnds = parseInt(msg.ends, 10);
+        if (jackpotEnds == 0) {
+            $("#jackpot-timer").text("waiting for players");
+        }
+        var list = $("#jackpot-players").empty();
+        $.each(msg.players, function(i, player) {
+            list.append($("<li>").text((player.nickname || player.sid) + ": $" +
+                (parseInt(player.amount, 10) / 100).toFixed(2) + " (" + player.chance + "%)"));
+        });
+    }
+
+    //Open lobbies get join and cancel buttons, finished ones show the result
+    function showCoinflip(lobby)
+    {
+        var row = $("#coinflip-" + lobby.lobby_id);
+        if (row.length == 0) {
+            row = $("<li>").attr("id", "coinflip-" + lobby.lobby_id);
+            $("#coinflip-lobbies").prepend(row);
+        }
+        var amount = "$" + (parseInt(lobby.amount, 10) / 100).toFixed(2);
+        row.empty().append($("<span>").text("Lobby " + lobby.lobby_id + ": " + amount + " on " + lobby.side + " "));
+        if (lobby.state == "open") {
+            row.append($("<button>").addClass("btn btn-default btn-xs").text("Join").click(function() {
+                socket.send(JSON.stringify({ code: "21", lobby_id: lobby.lobby_id, amount: lobby.amount }));
+            }));
+            row.append($("<button>").addClass("btn btn-default btn-xs").text("Cancel").click(function() {
+                socket.send(JSON.stringify({ code: "22", lobby_id: lobby.lobby_id }));
+            }));
+        } else if (lobby.state == "finished") {
+            row.append($("<span>").text("landed " + lobby.result + ", won by " + lobby.winner + " "));
+            row.append($("<a>").attr("href", lobby.verify_url).text("verify"));
+        } else {
+            row.remove();
+        }
+    }
+
+    function showLimits(limits)
+    {
+        var list = $("#limits").empty();
+        $.each(limits, function(i, limit) {
+            var text = limit.period + " " + limit.kind + ": ";
+            text += limit.amount ? "$" + (limit.used / 100).toFixed(2) + " of $" + (limit.amount / 100).toFixed(2) : "no limit";
+            if (limit.pending >= 0) {
+                text += ", " + (limit.pending ? "$" + (limit.pending / 100).toFixed(2) : "no limit") +
+                    " from " + new Date(limit.pending_from * 1000).toLocaleString();
+            }
+            list.append($("<li>").text(text));
+        });
+    }
+
+    //Pushed every second by the server
+    function showRoulette(msg)
+    {
+        $("#roulette-round").text(msg.round_id);
+        var phase = msg.phase;
+        if (msg.slot) {
+            phase += ", landed on " + msg.slot + " " + msg.color;
+        }
+        $("#roulette-phase").text(phase);
+        $("#roulette-timer").text(Math.ceil(parseInt(msg.time_left, 10) / 1000) + "s");
+        $("#roulette-history").text(msg.history.join(" "));
+    }
+
+    function showWithdrawalState(withdrawalId, state, offerId)
+    {
+        var row = $("#withdrawal-" + withdrawalId);
+        if (row.length == 0) {
+            row = $("<li>").attr("id", "withdrawal-" + withdrawalId);
+            $("#withdrawals").prepend(row);
+        }
+        row.text("Withdrawal" + (offerId ? " offer #" + offerId : "") + ": " + state);
+    }
+
+    function showDepositState(offerId, state)
+    {
+        var row = $("#deposit-" + offerId);
+        if (row.length == 0) {
+            row = $("<li>").attr("id", "deposit-" + offerId);
+            $("#deposit-offers").prepend(row);
+        }
+        row.text("Offer #" + offerId + ": " + state);
+        if (state == "accepted") {
+            selected = {};
+            loadInventory(false);
+        }
     }
 
     function onError(evt)
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	jason "github.com/antonholmquist/jason"
+	"io/ioutil"
+	"net/url"
+	"sync"
+	"time"
+)
+
+//Seconds a fetched profile is served from cache
+const PROFILE_CACHE_TIME = 600
+
+var errProfileNotFound = errors.New("Steam profile not found")
+
+type SteamProfile struct {
+	Sid      string
+	Nickname string
+	Avatar   string
+	//False if the community profile is private or not setup
+	Public  bool
+	Fetched time.Time
+}
+
+func fetchSteamProfile(steam64id string) (*SteamProfile, error) {
+	params := url.Values{}
+	params.Add("key", STEAM_API_KEY)
+	params.Add("steamids", steam64id)
+	resp, respErr := steamClient.Get(steamApiUrl + params.Encode())
+	if respErr != nil {
+		return nil, respErr
+	}
+	defer resp.Body.Close()
+
+	apiData, readErr := ioutil.ReadAll(resp.Body)
+	if readErr != nil {
+		return nil, readErr
+	}
+
+	payload, parseErr := jason.NewObjectFromBytes(apiData)
+	if parseErr != nil {
+		return nil, parseErr
+	}
+	allUserData, _ := payload.GetObjectArray("response", "players")
+	for _, key := range allUserData {
+		if sid, _ := key.GetString("steamid"); sid != steam64id {
+			continue
+		}
+		communityState, _ := key.GetInt64("communityvisibilitystate")
+		profileState, _ := key.GetInt64("profilestate")
+		nickname, _ := key.GetString("personaname")
+		avatar, _ := key.GetString("avatarfull")
+		return &SteamProfile{
+			Sid:      steam64id,
+			Nickname: nickname,
+			Avatar:   avatar,
+			Public:   communityState == 3 && profileState == 1,
+			Fetched:  time.Now(),
+		}, nil
+	}
+	return nil, errProfileNotFound
+}
+
+//Profiles fetched during socket auth, used to personalize pages
+type profileCache struct {
+	lock     sync.RWMutex
+	profiles map[string]*SteamProfile
+}
+
+var profiles = &profileCache{profiles: make(map[string]*SteamProfile)}
+
+//Returns nil if the profile was never fetched or is stale
+func (c *profileCache) Get(steam64id string) *SteamProfile {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	profile, ok := c.profiles[steam64id]
+	if !ok || time.Since(profile.Fetched) > time.Second*PROFILE_CACHE_TIME {
+		return nil
+	}
+	return profile
+}
+
+func (c *profileCache) Put(profile *SteamProfile) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.profiles[profile.Sid] = profile
+}
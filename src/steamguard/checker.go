@@ -0,0 +1,100 @@
+package steamguard
+
+import (
+	"time"
+)
+
+const CHECK_INTERVAL = time.Millisecond * 2500
+const MAX_BACKOFF = time.Minute * 5
+
+//Implemented by Confirmations, lets the checker run against anything
+type ConfirmationSource interface {
+	List() ([]*Confirmation, error)
+	Respond(conf *Confirmation, accept bool) error
+}
+
+//Polls for confirmations and answers them, like startConfirmationChecker in
+//steamcommunity. Errors double the delay up to MaxBackoff, a clean check resets it
+type Checker struct {
+	Source     ConfirmationSource
+	Interval   time.Duration
+	MaxBackoff time.Duration
+	//Decides each confirmation, nil accepts trade offers and leaves everything else alone
+	Decide func(conf *Confirmation) (accept bool, answer bool)
+	//Called after a confirmation is answered
+	OnConfirmed func(conf *Confirmation, accepted bool)
+	OnError     func(err error)
+	delay       time.Duration
+}
+
+func NewChecker(source ConfirmationSource) *Checker {
+	return &Checker{
+		Source:     source,
+		Interval:   CHECK_INTERVAL,
+		MaxBackoff: MAX_BACKOFF,
+	}
+}
+
+func acceptTrades(conf *Confirmation) (bool, bool) {
+	if conf.Type == ConfirmationTrade {
+		return true, true
+	}
+	return false, false
+}
+
+//Lists and answers confirmations once, stops at the first error
+func (c *Checker) Check() error {
+	confs, listErr := c.Source.List()
+	if listErr != nil {
+		return listErr
+	}
+	decide := c.Decide
+	if decide == nil {
+		decide = acceptTrades
+	}
+	for _, conf := range confs {
+		accept, answer := decide(conf)
+		if !answer {
+			continue
+		}
+		if err := c.Source.Respond(conf, accept); err != nil {
+			return err
+		}
+		if c.OnConfirmed != nil {
+			c.OnConfirmed(conf, accept)
+		}
+	}
+	return nil
+}
+
+//Delay before the next check given the result of the last one
+func (c *Checker) nextDelay(err error) time.Duration {
+	if err == nil || c.delay == 0 {
+		c.delay = c.Interval
+		if err == nil {
+			return c.delay
+		}
+	}
+	c.delay *= 2
+	if c.delay > c.MaxBackoff {
+		c.delay = c.MaxBackoff
+	}
+	return c.delay
+}
+
+//Checks until quit is closed
+func (c *Checker) Run(quit chan bool) {
+	for {
+		err := c.Check()
+		if err != nil && c.OnError != nil {
+			c.OnError(err)
+		}
+		timer := time.NewTimer(c.nextDelay(err))
+		select {
+		case <-timer.C:
+		case <-quit:
+			timer.Stop()
+			return
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package steamguard
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+const testSteamId = "76561198000000001"
+
+//Confirmations signed with testSecret, talking to a StandIn served by httptest
+func newTestChecker(t *testing.T) (*Checker, *StandIn) {
+	standIn := NewStandIn(testSteamId, testSecret)
+	server := httptest.NewServer(standIn)
+	t.Cleanup(server.Close)
+
+	confirmations := NewConfirmations(testSteamId, testSecret, "sessionid", "login")
+	confirmations.BaseUrl = server.URL
+	confirmations.Client = server.Client()
+	return NewChecker(confirmations), standIn
+}
+
+func TestCheckerAcceptsTradesByDefault(t *testing.T) {
+	checker, standIn := newTestChecker(t)
+	trade := standIn.Add(Confirmation{Type: ConfirmationTrade, Creator: "4001"})
+	listing := standIn.Add(Confirmation{Type: ConfirmationMarketListing, Creator: "5001"})
+
+	var confirmed []string
+	checker.OnConfirmed = func(conf *Confirmation, accepted bool) {
+		confirmed = append(confirmed, conf.Id)
+	}
+	if err := checker.Check(); err != nil {
+		t.Fatal(err)
+	}
+
+	if accepted, answered := standIn.Answer(trade.Id); !answered || !accepted {
+		t.Fatal("trade confirmation was not accepted")
+	}
+	if _, answered := standIn.Answer(listing.Id); answered {
+		t.Fatal("market listing confirmation should be left alone")
+	}
+	if len(confirmed) != 1 || confirmed[0] != trade.Id {
+		t.Fatalf("OnConfirmed should only see the trade, got %v", confirmed)
+	}
+	if standIn.Pending() != 1 {
+		t.Fatalf("expected the listing to stay pending, %d pending", standIn.Pending())
+	}
+}
+
+func TestCheckerDecide(t *testing.T) {
+	checker, standIn := newTestChecker(t)
+	known := standIn.Add(Confirmation{Type: ConfirmationTrade, Creator: "4001"})
+	unknown := standIn.Add(Confirmation{Type: ConfirmationTrade, Creator: "4002"})
+	rejected := standIn.Add(Confirmation{Type: ConfirmationTrade, Creator: "4003"})
+	checker.Decide = func(conf *Confirmation) (bool, bool) {
+		switch conf.Creator {
+		case "4001":
+			return true, true
+		case "4003":
+			return false, true
+		}
+		return false, false
+	}
+	if err := checker.Check(); err != nil {
+		t.Fatal(err)
+	}
+
+	if accepted, answered := standIn.Answer(known.Id); !answered || !accepted {
+		t.Fatal("known offer was not accepted")
+	}
+	if _, answered := standIn.Answer(unknown.Id); answered {
+		t.Fatal("unknown offer should be left unanswered")
+	}
+	if accepted, answered := standIn.Answer(rejected.Id); !answered || accepted {
+		t.Fatal("rejected offer was not canceled")
+	}
+}
+
+func TestCheckerErrors(t *testing.T) {
+	checker, standIn := newTestChecker(t)
+	standIn.Add(Confirmation{Type: ConfirmationTrade, Creator: "4001"})
+
+	standIn.FailNext(http.StatusServiceUnavailable)
+	err := checker.Check()
+	if reqErr, ok := err.(*RequestError); !ok || !reqErr.Transient || reqErr.Status != http.StatusServiceUnavailable {
+		t.Fatalf("expected a transient 503, got %v", err)
+	}
+
+	standIn.LoggedOut = true
+	if err := checker.Check(); err != ErrNeedAuth {
+		t.Fatalf("expected ErrNeedAuth, got %v", err)
+	}
+	standIn.LoggedOut = false
+
+	//Keys signed with the wrong identity secret are refused
+	standIn.IdentitySecret = rfcSecretBase64
+	if err := checker.Check(); err == nil {
+		t.Fatal("expected keys signed with another secret to be refused")
+	}
+	if standIn.Pending() != 1 {
+		t.Fatal("nothing should be answered after a failed check")
+	}
+}
+
+//Keys more than STANDIN_CLOCK_SKEW off are refused, TimeOffset corrects the clock
+func TestCheckerTimeOffset(t *testing.T) {
+	checker, standIn := newTestChecker(t)
+	standIn.Add(Confirmation{Type: ConfirmationTrade, Creator: "4001"})
+	standIn.Now = func() time.Time { return time.Now().Add(time.Hour) }
+	if err := checker.Check(); err == nil {
+		t.Fatal("expected a key from a clock an hour behind to be refused")
+	}
+	checker.Source.(*Confirmations).TimeOffset = 3600
+	if err := checker.Check(); err != nil {
+		t.Fatal(err)
+	}
+	if standIn.Pending() != 0 {
+		t.Fatal("confirmation was not answered after fixing the offset")
+	}
+}
+
+func TestCheckerBackoff(t *testing.T) {
+	checker := &Checker{Interval: time.Second, MaxBackoff: time.Second * 5}
+	failed := &RequestError{Message: "down", Transient: true}
+	steps := []struct {
+		err      error
+		expected time.Duration
+	}{
+		{nil, time.Second},
+		{failed, time.Second * 2},
+		{failed, time.Second * 4},
+		{failed, time.Second * 5},
+		{failed, time.Second * 5},
+		{nil, time.Second},
+		{failed, time.Second * 2},
+	}
+	for n, step := range steps {
+		if delay := checker.nextDelay(step.err); delay != step.expected {
+			t.Fatalf("step %d: expected %v, got %v", n, step.expected, delay)
+		}
+	}
+
+	//An error on the very first check still backs off
+	checker = &Checker{Interval: time.Second, MaxBackoff: time.Second * 5}
+	if delay := checker.nextDelay(failed); delay != time.Second*2 {
+		t.Fatalf("expected 2s after a first failure, got %v", delay)
+	}
+}
+
+//Run keeps checking through errors and stops once quit is closed
+func TestCheckerRun(t *testing.T) {
+	checker, standIn := newTestChecker(t)
+	checker.Interval = time.Millisecond * 5
+	checker.MaxBackoff = time.Millisecond * 20
+	errs := make(chan error, 10)
+	checker.OnError = func(err error) {
+		errs <- err
+	}
+
+	standIn.FailNext(http.StatusInternalServerError)
+	trade := standIn.Add(Confirmation{Type: ConfirmationTrade, Creator: "4001"})
+	quit := make(chan bool)
+	done := make(chan bool)
+	go func() {
+		checker.Run(quit)
+		close(done)
+	}()
+
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		if _, answered := standIn.Answer(trade.Id); answered {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("confirmation was not answered after the failed check")
+		}
+		time.Sleep(time.Millisecond * 5)
+	}
+	close(quit)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Run did not stop after quit was closed")
+	}
+	if len(errs) != 1 {
+		t.Fatalf("expected OnError once, got %d", len(errs))
+	}
+}
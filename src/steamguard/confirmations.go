@@ -0,0 +1,216 @@
+package steamguard
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const COMMUNITY_URL = "https://steamcommunity.com"
+const QUERY_TIME_URL = "https://api.steampowered.com/ITwoFactorService/QueryTime/v1/"
+
+//Mirrors Steam's EMobileConfirmationType
+type ConfirmationType int
+
+const (
+	ConfirmationTrade         ConfirmationType = 2
+	ConfirmationMarketListing ConfirmationType = 3
+	ConfirmationAccount       ConfirmationType = 6
+)
+
+//Steam answers needauth when the web session cookies expired
+var ErrNeedAuth = errors.New("steamguard: web session is no longer logged in")
+var ErrRejected = errors.New("steamguard: steam did not accept the confirmation request")
+
+type Confirmation struct {
+	Id   string           `json:"id"`
+	Type ConfirmationType `json:"type"`
+	//Trade offer id for trade confirmations, listing id for market listings
+	Creator  string   `json:"creator_id"`
+	Nonce    string   `json:"nonce"`
+	Created  int64    `json:"creation_time"`
+	Headline string   `json:"headline"`
+	Summary  []string `json:"summary"`
+}
+
+//Confirmation requests fail with this, network and 5xx errors are worth retrying
+type RequestError struct {
+	Status    int
+	Message   string
+	Transient bool
+}
+
+func (e *RequestError) Error() string {
+	return e.Message
+}
+
+//Talks to the mobileconf endpoints as the mobile app would
+type Confirmations struct {
+	SteamId        string
+	IdentitySecret string
+	DeviceId       string
+	//Web session cookies for the account
+	SessionId        string
+	SteamLoginSecure string
+	//Seconds to add to the local clock, see QueryTimeOffset
+	TimeOffset int64
+	//Defaults to COMMUNITY_URL, pointed at a StandIn when running offline
+	BaseUrl string
+	Client  *http.Client
+	Now     func() time.Time
+}
+
+func NewConfirmations(steam64id string, identitySecret string, sessionId string, steamLoginSecure string) *Confirmations {
+	return &Confirmations{
+		SteamId:          steam64id,
+		IdentitySecret:   identitySecret,
+		DeviceId:         DeviceId(steam64id),
+		SessionId:        sessionId,
+		SteamLoginSecure: steamLoginSecure,
+		BaseUrl:          COMMUNITY_URL,
+		Client:           &http.Client{Timeout: time.Second * 15},
+		Now:              time.Now,
+	}
+}
+
+func (c *Confirmations) now() time.Time {
+	return c.Now().Add(time.Second * time.Duration(c.TimeOffset))
+}
+
+//Signed query parameters shared by every mobileconf request
+func (c *Confirmations) params(tag string) (url.Values, error) {
+	t := c.now()
+	key, keyErr := ConfirmationKey(c.IdentitySecret, t, tag)
+	if keyErr != nil {
+		return nil, keyErr
+	}
+	params := url.Values{}
+	params.Set("p", c.DeviceId)
+	params.Set("a", c.SteamId)
+	params.Set("k", key)
+	params.Set("t", strconv.FormatInt(t.Unix(), 10))
+	params.Set("m", "react")
+	params.Set("tag", tag)
+	return params, nil
+}
+
+func (c *Confirmations) get(path string, params url.Values, out interface{}) error {
+	req, reqErr := http.NewRequest("GET", c.BaseUrl+path+"?"+params.Encode(), nil)
+	if reqErr != nil {
+		return reqErr
+	}
+	req.AddCookie(&http.Cookie{Name: "sessionid", Value: c.SessionId})
+	req.AddCookie(&http.Cookie{Name: "steamLoginSecure", Value: c.SteamLoginSecure})
+	req.AddCookie(&http.Cookie{Name: "mobileClient", Value: "android"})
+	req.AddCookie(&http.Cookie{Name: "mobileClientVersion", Value: "777777 3.6.4"})
+
+	resp, respErr := c.Client.Do(req)
+	if respErr != nil {
+		return &RequestError{Message: respErr.Error(), Transient: true}
+	}
+	defer resp.Body.Close()
+	body, readErr := ioutil.ReadAll(resp.Body)
+	if readErr != nil {
+		return &RequestError{Message: readErr.Error(), Transient: true}
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		msg := strings.TrimSpace(string(body))
+		if len(msg) > 200 {
+			msg = msg[:200]
+		}
+		return &RequestError{
+			Status:    resp.StatusCode,
+			Message:   fmt.Sprintf("Steam returned %d: %s", resp.StatusCode, msg),
+			Transient: resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500,
+		}
+	}
+	if err := json.Unmarshal(body, out); err != nil {
+		return &RequestError{Status: resp.StatusCode, Message: "Invalid response from Steam: " + err.Error(), Transient: true}
+	}
+	return nil
+}
+
+//Returns the confirmations waiting on the account
+func (c *Confirmations) List() ([]*Confirmation, error) {
+	params, paramsErr := c.params("list")
+	if paramsErr != nil {
+		return nil, paramsErr
+	}
+	var resp struct {
+		Success  bool            `json:"success"`
+		NeedAuth bool            `json:"needauth"`
+		Message  string          `json:"message"`
+		Conf     []*Confirmation `json:"conf"`
+	}
+	if err := c.get("/mobileconf/getlist", params, &resp); err != nil {
+		return nil, err
+	}
+	if resp.NeedAuth {
+		return nil, ErrNeedAuth
+	}
+	if !resp.Success {
+		if resp.Message != "" {
+			return nil, &RequestError{Message: "steamguard: " + resp.Message}
+		}
+		return nil, ErrRejected
+	}
+	if resp.Conf == nil {
+		return []*Confirmation{}, nil
+	}
+	return resp.Conf, nil
+}
+
+//Accepts or cancels a confirmation
+func (c *Confirmations) Respond(conf *Confirmation, accept bool) error {
+	op, tag := "cancel", "reject"
+	if accept {
+		op, tag = "allow", "accept"
+	}
+	params, paramsErr := c.params(tag)
+	if paramsErr != nil {
+		return paramsErr
+	}
+	params.Set("op", op)
+	params.Set("cid", conf.Id)
+	params.Set("ck", conf.Nonce)
+
+	var resp struct {
+		Success bool `json:"success"`
+	}
+	if err := c.get("/mobileconf/ajaxop", params, &resp); err != nil {
+		return err
+	}
+	if !resp.Success {
+		return ErrRejected
+	}
+	return nil
+}
+
+//Seconds the local clock is behind Steam's, codes are rejected when it drifts
+//by more than a period
+func QueryTimeOffset(client *http.Client) (int64, error) {
+	resp, respErr := client.Post(QUERY_TIME_URL, "application/x-www-form-urlencoded", strings.NewReader(""))
+	if respErr != nil {
+		return 0, respErr
+	}
+	defer resp.Body.Close()
+	var body struct {
+		Response struct {
+			ServerTime string `json:"server_time"`
+		} `json:"response"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return 0, err
+	}
+	serverTime, parseErr := strconv.ParseInt(body.Response.ServerTime, 10, 64)
+	if parseErr != nil {
+		return 0, parseErr
+	}
+	return serverTime - time.Now().Unix(), nil
+}
@@ -0,0 +1,146 @@
+package steamguard
+
+import (
+	"crypto/hmac"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//Requests signed further than this from the stand-in's clock are refused
+const STANDIN_CLOCK_SKEW = 60
+
+//Local stand-in for steamcommunity.com's mobileconf endpoints. It checks
+//confirmation keys the way Steam does so Confirmations can run against it
+//offline, serve it with httptest or any http.Server and set BaseUrl
+type StandIn struct {
+	lock           sync.Mutex
+	SteamId        string
+	IdentitySecret string
+	//Answers needauth like an expired session when set
+	LoggedOut bool
+	pending   []*Confirmation
+	answered  map[string]bool
+	failures  []int
+	nextId    int64
+	Now       func() time.Time
+}
+
+func NewStandIn(steam64id string, identitySecret string) *StandIn {
+	return &StandIn{
+		SteamId:        steam64id,
+		IdentitySecret: identitySecret,
+		answered:       make(map[string]bool),
+		nextId:         1000,
+		Now:            time.Now,
+	}
+}
+
+//Queues a confirmation, Id and Nonce are filled in when empty
+func (s *StandIn) Add(conf Confirmation) *Confirmation {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.nextId++
+	if conf.Id == "" {
+		conf.Id = strconv.FormatInt(s.nextId, 10)
+	}
+	if conf.Nonce == "" {
+		conf.Nonce = strconv.FormatInt(s.nextId*7919, 10)
+	}
+	if conf.Created == 0 {
+		conf.Created = s.Now().Unix()
+	}
+	s.pending = append(s.pending, &conf)
+	dup := conf
+	return &dup
+}
+
+//Fails the next request with the given http status
+func (s *StandIn) FailNext(status int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.failures = append(s.failures, status)
+}
+
+//Whether the confirmation was answered and if it was accepted
+func (s *StandIn) Answer(id string) (accepted bool, answered bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	accepted, answered = s.answered[id]
+	return accepted, answered
+}
+
+func (s *StandIn) Pending() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.pending)
+}
+
+//Caller must hold lock
+func (s *StandIn) validKey(r *http.Request) bool {
+	q := r.URL.Query()
+	if q.Get("a") != s.SteamId || q.Get("p") != DeviceId(s.SteamId) {
+		return false
+	}
+	t, parseErr := strconv.ParseInt(q.Get("t"), 10, 64)
+	if parseErr != nil {
+		return false
+	}
+	skew := s.Now().Unix() - t
+	if skew > STANDIN_CLOCK_SKEW || skew < -STANDIN_CLOCK_SKEW {
+		return false
+	}
+	expected, keyErr := ConfirmationKey(s.IdentitySecret, time.Unix(t, 0), q.Get("tag"))
+	if keyErr != nil {
+		return false
+	}
+	return hmac.Equal([]byte(expected), []byte(q.Get("k")))
+}
+
+func (s *StandIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if len(s.failures) > 0 {
+		status := s.failures[0]
+		s.failures = s.failures[1:]
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if s.LoggedOut {
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": false, "needauth": true})
+		return
+	}
+	//Steam answers bad keys with success false rather than an error status
+	if !s.validKey(r) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": false, "message": "Invalid authenticator"})
+		return
+	}
+
+	switch r.URL.Path {
+	case "/mobileconf/getlist":
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "conf": s.pending})
+	case "/mobileconf/ajaxop":
+		q := r.URL.Query()
+		op := q.Get("op")
+		if op != "allow" && op != "cancel" {
+			json.NewEncoder(w).Encode(map[string]interface{}{"success": false})
+			return
+		}
+		for n, conf := range s.pending {
+			if conf.Id == q.Get("cid") && conf.Nonce == q.Get("ck") {
+				s.pending = append(s.pending[:n], s.pending[n+1:]...)
+				s.answered[conf.Id] = op == "allow"
+				json.NewEncoder(w).Encode(map[string]interface{}{"success": true})
+				return
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": false})
+	default:
+		http.NotFound(w, r)
+	}
+}
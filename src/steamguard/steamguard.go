@@ -0,0 +1,89 @@
+//Package steamguard implements the Steam Guard mobile authenticator, login
+//codes from the shared secret and trade confirmations signed with the
+//identity secret. Port of steam-totp and the steamcommunity confirmation checker
+package steamguard
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"time"
+)
+
+//Steam codes use this alphabet instead of digits
+const CODE_CHARS = "23456789BCDFGHJKMNPQRTVWXY"
+const CODE_LENGTH = 5
+const CODE_PERIOD = 30
+
+//Steam truncates confirmation tags to this many bytes
+const MAX_TAG_LEN = 32
+
+var ErrInvalidSecret = errors.New("steamguard: secret is not valid base64")
+
+//Secrets come from the maFile, base64 or hex encoded
+func decodeSecret(secret string) ([]byte, error) {
+	if len(secret) == 40 {
+		if raw, err := hex.DecodeString(secret); err == nil {
+			return raw, nil
+		}
+	}
+	raw, err := base64.StdEncoding.DecodeString(secret)
+	if err != nil {
+		return nil, ErrInvalidSecret
+	}
+	return raw, nil
+}
+
+//Login code for t, which should already include the offset from Steam's clock
+func GenerateAuthCode(sharedSecret string, t time.Time) (string, error) {
+	key, keyErr := decodeSecret(sharedSecret)
+	if keyErr != nil {
+		return "", keyErr
+	}
+
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(t.Unix()/CODE_PERIOD))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+
+	//Dynamic truncation from RFC 4226
+	start := sum[19] & 0x0f
+	full := binary.BigEndian.Uint32(sum[start:start+4]) & 0x7fffffff
+
+	code := make([]byte, CODE_LENGTH)
+	for n := range code {
+		code[n] = CODE_CHARS[full%uint32(len(CODE_CHARS))]
+		full /= uint32(len(CODE_CHARS))
+	}
+	return string(code), nil
+}
+
+//Key for a confirmation request, tag is the action ex. "list", "accept", "reject"
+func ConfirmationKey(identitySecret string, t time.Time, tag string) (string, error) {
+	key, keyErr := decodeSecret(identitySecret)
+	if keyErr != nil {
+		return "", keyErr
+	}
+	if len(tag) > MAX_TAG_LEN {
+		tag = tag[:MAX_TAG_LEN]
+	}
+
+	buf := make([]byte, 8, 8+len(tag))
+	binary.BigEndian.PutUint64(buf, uint64(t.Unix()))
+	buf = append(buf, tag...)
+	mac := hmac.New(sha1.New, key)
+	mac.Write(buf)
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+//Device id Steam expects for a mobile authenticator, derived from the steam64 id
+//the same way the official app does
+func DeviceId(steam64id string) string {
+	sum := sha1.Sum([]byte(steam64id))
+	h := hex.EncodeToString(sum[:])
+	return "android:" + h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:32]
+}
@@ -0,0 +1,83 @@
+package steamguard
+
+import (
+	"testing"
+	"time"
+)
+
+//RFC 4226 appendix D secret, "12345678901234567890"
+const rfcSecretBase64 = "MTIzNDU2Nzg5MDEyMzQ1Njc4OTA="
+const rfcSecretHex = "3132333435363738393031323334353637383930"
+
+//Steam codes are the RFC 4226 truncated values of appendix D written in
+//CODE_CHARS instead of decimal, ex. counter 0 truncates to 1284755224
+var rfcCodes = []string{"GG5F5", "PV9M4", "B26KJ", "5H85C", "6Y9J3", "MD224", "P2GRF", "C9PRW", "3NKKN", "5YCKB"}
+
+//"1234567890abcdefghij", the keys below were computed separately with python's hmac
+const testSecret = "MTIzNDU2Nzg5MGFiY2RlZmdoaWo="
+
+func TestGenerateAuthCode(t *testing.T) {
+	for counter, expected := range rfcCodes {
+		for _, offset := range []int64{0, CODE_PERIOD - 1} {
+			code, err := GenerateAuthCode(rfcSecretBase64, time.Unix(int64(counter)*CODE_PERIOD+offset, 0))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if code != expected {
+				t.Errorf("counter %d offset %d: expected %s, got %s", counter, offset, expected, code)
+			}
+		}
+	}
+}
+
+func TestGenerateAuthCodeHexSecret(t *testing.T) {
+	code, err := GenerateAuthCode(rfcSecretHex, time.Unix(CODE_PERIOD*4, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != rfcCodes[4] {
+		t.Fatalf("expected %s from the hex secret, got %s", rfcCodes[4], code)
+	}
+}
+
+func TestGenerateAuthCodeInvalidSecret(t *testing.T) {
+	if _, err := GenerateAuthCode("not base64!", time.Now()); err != ErrInvalidSecret {
+		t.Fatalf("expected ErrInvalidSecret, got %v", err)
+	}
+}
+
+func TestConfirmationKey(t *testing.T) {
+	vectors := []struct {
+		tag      string
+		time     int64
+		expected string
+	}{
+		{"conf", 1600000000, "jpWFEgNCX5EFMPnH3GY6NST9/dU="},
+		{"list", 1600000000, "Fc793GPTeeW7msf7NfZ+oq0xHjY="},
+		{"accept", 1600000030, "x0HOt6Ab+kZoeXc4VJYfIggFX6A="},
+		{"", 100000, "O18zXOecHhkkI5f5vEIPN98jT7E="},
+		//Tags past MAX_TAG_LEN are cut, so this is the key for 32 x's
+		{"xxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxx", 1600000000, "qBgaRctiBnswrz9BqLgWcJw61rs="},
+	}
+	for _, v := range vectors {
+		key, err := ConfirmationKey(testSecret, time.Unix(v.time, 0), v.tag)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if key != v.expected {
+			t.Errorf("tag %q time %d: expected %s, got %s", v.tag, v.time, v.expected, key)
+		}
+	}
+}
+
+func TestDeviceId(t *testing.T) {
+	vectors := map[string]string{
+		"76561197960265728": "android:63e01aa8-e99c-42c4-ef4c-e78bd041f129",
+		"76561198000000001": "android:ca748b58-133d-73d0-adcd-109baa02c0fa",
+	}
+	for steam64id, expected := range vectors {
+		if id := DeviceId(steam64id); id != expected {
+			t.Errorf("%s: expected %s, got %s", steam64id, expected, id)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"errors"
+	redigo "github.com/garyburd/redigo/redis"
+	"strconv"
+	"sync"
+)
+
+//Backend for everything that used to live directly in redis:
+//single use websocket tokens, online presence, sessions and rate limits
+type Store interface {
+	//Records a websocket token id (jti), returns false if it has already been used
+	ClaimToken(token string, sid string, ttl int) (bool, error)
+	//Marks a steamid as online, returns false if it already was
+	SetOnline(sid string) (bool, error)
+	SetOffline(sid string) error
+	PutSession(id string, values map[string]string, ttl int) error
+	//Returns nil if the session does not exist or has expired
+	GetSession(id string) (map[string]string, error)
+	DeleteSession(id string) error
+	//Increments the counter for key and returns the number of hits in the current window
+	Hit(key string, window int) (int64, error)
+	//Removes tokens and presence left over from a previous run
+	Reset() error
+	Close() error
+}
+
+var errUnknownStore = errors.New("Unknown store type")
+
+func openStore(conf *Config, redisKey string) (Store, error) {
+	switch conf.Store {
+	case "redis":
+		return newRedisStore(conf.RedisAddr, redisKey)
+	case "memory":
+		return newMemoryStore(conf.SnapshotFile, conf.SnapshotInterval)
+	}
+	return nil, errUnknownStore
+}
+
+//db 0 for tokens, 1 for steamids, 2 for sessions, 3 for rate limits
+const (
+	REDIS_DB_TOKENS   = "0"
+	REDIS_DB_ONLINE   = "1"
+	REDIS_DB_SESSIONS = "2"
+	REDIS_DB_RATE     = "3"
+)
+
+type redisStore struct {
+	conn redigo.Conn
+	lock sync.Mutex
+}
+
+func newRedisStore(addr string, password string) (*redisStore, error) {
+	conn, connErr := redigo.Dial("tcp", addr)
+	if connErr != nil {
+		return nil, connErr
+	}
+	if _, err := conn.Do("AUTH", password); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &redisStore{conn: &timedRedisConn{Conn: conn}}, nil
+}
+
+//Caller must hold lock
+func (s *redisStore) do(db string, cmd string, args ...interface{}) (interface{}, error) {
+	if _, err := s.conn.Do("SELECT", db); err != nil {
+		return nil, err
+	}
+	return s.conn.Do(cmd, args...)
+}
+
+func (s *redisStore) ClaimToken(token string, sid string, ttl int) (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	val, err := s.do(REDIS_DB_TOKENS, "SET", token, sid, "NX", "EX", strconv.Itoa(ttl))
+	if err != nil {
+		return false, err
+	}
+	return val != nil, nil
+}
+
+func (s *redisStore) SetOnline(sid string) (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	val, err := s.do(REDIS_DB_ONLINE, "SET", "online."+sid, sid, "NX")
+	if err != nil {
+		return false, err
+	}
+	return val != nil, nil
+}
+
+func (s *redisStore) SetOffline(sid string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	_, err := s.do(REDIS_DB_ONLINE, "DEL", "online."+sid)
+	return err
+}
+
+func (s *redisStore) PutSession(id string, values map[string]string, ttl int) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	args := redigo.Args{}.Add("sess." + id).AddFlat(values)
+	if _, err := s.do(REDIS_DB_SESSIONS, "HMSET", args...); err != nil {
+		return err
+	}
+	_, err := s.conn.Do("EXPIRE", "sess."+id, strconv.Itoa(ttl))
+	return err
+}
+
+func (s *redisStore) GetSession(id string) (map[string]string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	values, err := redigo.StringMap(s.do(REDIS_DB_SESSIONS, "HGETALL", "sess."+id))
+	if err != nil {
+		return nil, err
+	}
+	if len(values) == 0 {
+		return nil, nil
+	}
+	return values, nil
+}
+
+func (s *redisStore) DeleteSession(id string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	_, err := s.do(REDIS_DB_SESSIONS, "DEL", "sess."+id)
+	return err
+}
+
+func (s *redisStore) Hit(key string, window int) (int64, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	count, err := redigo.Int64(s.do(REDIS_DB_RATE, "INCR", "rate."+key))
+	if err != nil {
+		return 0, err
+	}
+	if count == 1 {
+		if _, err := s.conn.Do("EXPIRE", "rate."+key, strconv.Itoa(window)); err != nil {
+			return count, err
+		}
+	}
+	return count, nil
+}
+
+func (s *redisStore) Reset() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, db := range []string{REDIS_DB_TOKENS, REDIS_DB_ONLINE, REDIS_DB_RATE} {
+		if _, err := s.do(db, "FLUSHDB"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *redisStore) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.conn.Close()
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	csrf "github.com/gorilla/csrf"
+	"html/template"
+	log "github.com/Sirupsen/logrus"
+	"net/http"
+	"path/filepath"
+	"sync"
+)
+
+const TEMPLATE_DIR = "templates"
+
+//Every page is parsed together with layout.html and everything in partials/
+var pageTemplates = []string{"index.html", "home.html", "404.html", "verify.html", "excluded.html", "terms.html", "blocked.html", "banned.html", "admin.html"}
+
+//Data available to every page template
+type PageData struct {
+	Nonce     string
+	CsrfToken string
+	CsrfField template.HTML
+	//Empty when not logged in
+	Sid     string
+	Profile *SteamProfile
+	//Only set on /verify
+	Verify      *FairVerification
+	VerifyError string
+	//Only set on the self-exclusion page
+	ExcludedUntil string
+	//Only set on /terms
+	TosVersion string
+	MinAge     int
+	TermsError string
+	//Hides the form once an underage date of birth was given
+	TosRefused bool
+	//Shows the admin link in the navbar
+	Staff bool
+	//Only set on the banned page
+	Ban *Ban
+	//Only set on /admin
+	Admin *AdminView
+}
+
+func newPageData(r *http.Request, steam64id string) *PageData {
+	data := &PageData{
+		Nonce:     cspNonce(r),
+		CsrfToken: csrf.Token(r),
+		CsrfField: csrf.TemplateField(r),
+		Sid:       steam64id,
+	}
+	if steam64id != "" {
+		data.Profile = profiles.Get(steam64id)
+		staff, err := hasPermission(steam64id, PERM_ADMIN_VIEW)
+		if err != nil {
+			requestLog(r).WithError(err).Error("Error checking role")
+		}
+		data.Staff = staff
+	}
+	return data
+}
+
+func templateFuncs() template.FuncMap {
+	return template.FuncMap{
+		"asset": func(name string) string {
+			return assets.URL(name)
+		},
+	}
+}
+
+type templateSet struct {
+	lock  sync.RWMutex
+	pages map[string]*template.Template
+}
+
+var templates = &templateSet{}
+
+func parseTemplates() (map[string]*template.Template, error) {
+	partials, globErr := filepath.Glob(filepath.Join(TEMPLATE_DIR, "partials", "*.html"))
+	if globErr != nil {
+		return nil, globErr
+	}
+
+	pages := make(map[string]*template.Template, len(pageTemplates))
+	for _, name := range pageTemplates {
+		files := []string{filepath.Join(TEMPLATE_DIR, "layout.html")}
+		files = append(files, partials...)
+		files = append(files, filepath.Join(TEMPLATE_DIR, name))
+		page, parseErr := template.New("layout.html").Funcs(templateFuncs()).ParseFiles(files...)
+		if parseErr != nil {
+			return nil, parseErr
+		}
+		pages[name] = page
+	}
+	return pages, nil
+}
+
+func (t *templateSet) Load() error {
+	pages, err := parseTemplates()
+	if err != nil {
+		return err
+	}
+	t.lock.Lock()
+	t.pages = pages
+	t.lock.Unlock()
+	return nil
+}
+
+//In dev mode templates are re-parsed on every request so edits show up without a restart
+func (t *templateSet) get(name string) (*template.Template, error) {
+	if config.DevMode {
+		if err := t.Load(); err != nil {
+			return nil, err
+		}
+	}
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	return t.pages[name], nil
+}
+
+//Renders into a buffer first so a failed template never sends half a page
+func renderPage(w http.ResponseWriter, r *http.Request, name string, status int, data *PageData) {
+	page, loadErr := templates.get(name)
+	if loadErr != nil || page == nil {
+		if loadErr != nil {
+			log.WithError(loadErr).WithField("template", name).Error("Error loading template")
+		} else {
+			log.WithField("template", name).Error("Missing template")
+		}
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := page.ExecuteTemplate(&buf, "layout", data); err != nil {
+		requestLog(r).WithError(err).WithField("template", name).Error("Error rendering template")
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-type", "text/html")
+	w.WriteHeader(status)
+	buf.WriteTo(w)
+}
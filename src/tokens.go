@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	jwt "github.com/dgrijalva/jwt-go"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const TOKEN_PURPOSE_WEBSOCKET = "websocket"
+
+//Allowed clock skew in seconds when checking exp, nbf and iat
+const TOKEN_LEEWAY = 5
+
+var errNoSigningKey = errors.New("Key ring has no signing key")
+
+//Claims carried by the websocket ticket, sub holds the steam64 id
+type SockClaims struct {
+	jwt.StandardClaims
+	Ip      string `json:"ip"`
+	Purpose string `json:"purpose"`
+}
+
+func tokenAudience() string {
+	return "https://" + HOST_ADDR + "/sock"
+}
+
+func (c *SockClaims) Valid() error {
+	now := time.Now().Unix()
+	if !c.VerifyExpiresAt(now-TOKEN_LEEWAY, true) {
+		return fmt.Errorf("Token expired at %d", c.ExpiresAt)
+	}
+	if !c.VerifyNotBefore(now+TOKEN_LEEWAY, true) {
+		return fmt.Errorf("Token not valid before %d", c.NotBefore)
+	}
+	if !c.VerifyIssuedAt(now+TOKEN_LEEWAY, true) {
+		return fmt.Errorf("Token issued in the future at %d", c.IssuedAt)
+	}
+	if !c.VerifyAudience(tokenAudience(), true) {
+		return fmt.Errorf("Invalid audience %q", c.Audience)
+	}
+	if c.Purpose != TOKEN_PURPOSE_WEBSOCKET {
+		return fmt.Errorf("Invalid purpose %q", c.Purpose)
+	}
+	if c.Id == "" || c.Subject == "" {
+		return errors.New("Missing jti or sub")
+	}
+	return nil
+}
+
+//Set of HMAC secrets indexed by kid. New tokens are signed with the current
+//key while older keys stay valid for verification until they are removed
+type KeyRing struct {
+	lock    sync.RWMutex
+	keys    map[string][]byte
+	current string
+}
+
+func NewKeyRing() *KeyRing {
+	return &KeyRing{keys: make(map[string][]byte)}
+}
+
+//Adds a key, the most recently added key becomes the signing key
+func (k *KeyRing) Add(kid string, secret []byte) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	k.keys[kid] = secret
+	k.current = kid
+}
+
+func (k *KeyRing) Remove(kid string) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	delete(k.keys, kid)
+	if k.current == kid {
+		k.current = ""
+	}
+}
+
+func (k *KeyRing) signingKey() (string, []byte, error) {
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+	if k.current == "" {
+		return "", nil, errNoSigningKey
+	}
+	return k.current, k.keys[k.current], nil
+}
+
+func (k *KeyRing) lookup(token *jwt.Token) (interface{}, error) {
+	if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+		return nil, fmt.Errorf("Invalid signing method: %v", token.Header["alg"])
+	}
+	kid, _ := token.Header["kid"].(string)
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+	secret, ok := k.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("Unknown key id %q", kid)
+	}
+	return secret, nil
+}
+
+func (k *KeyRing) Sign(claims jwt.Claims) (string, error) {
+	kid, secret, keyErr := k.signingKey()
+	if keyErr != nil {
+		return "", keyErr
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	token.Header["kid"] = kid
+	return token.SignedString(secret)
+}
+
+func (k *KeyRing) ParseSockToken(tokenStr string) (*SockClaims, error) {
+	claims := &SockClaims{}
+	token, tokenErr := jwt.ParseWithClaims(tokenStr, claims, k.lookup)
+	if tokenErr != nil {
+		return nil, tokenErr
+	}
+	if !token.Valid {
+		return nil, errors.New("Invalid token")
+	}
+	return claims, nil
+}
+
+//Loads "kid:secret" lines, the last line is the signing key so rotating is
+//done by appending a new key and removing the oldest once its tokens expire
+func loadKeyRing(path string) (*KeyRing, error) {
+	file, openErr := os.Open(path)
+	if openErr != nil {
+		return nil, openErr
+	}
+	defer file.Close()
+
+	ring := NewKeyRing()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("Malformed key line in %s", path)
+		}
+		ring.Add(parts[0], []byte(parts[1]))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if _, _, err := ring.signingKey(); err != nil {
+		return nil, err
+	}
+	return ring, nil
+}
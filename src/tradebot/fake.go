@@ -0,0 +1,406 @@
+package tradebot
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+//In-memory TradeOfferService for development and offline tests. Partner
+//behaviour is driven by calling the Partner* methods and Expire
+type FakeSteam struct {
+	lock sync.Mutex
+	//steam64 id of the bot account
+	BotId       string
+	inventories map[string][]Item
+	offers      map[string]*Offer
+	nextId      int64
+	nextAssetId int64
+	failures    []error
+	now         func() time.Time
+}
+
+func NewFakeSteam(botId string) *FakeSteam {
+	return &FakeSteam{
+		BotId:       botId,
+		inventories: make(map[string][]Item),
+		offers:      make(map[string]*Offer),
+		nextId:      1000,
+		nextAssetId: 1000000,
+		now:         time.Now,
+	}
+}
+
+//Queues an error returned by the next call, used to simulate Steam outages
+func (f *FakeSteam) FailNext(err error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.failures = append(f.failures, err)
+}
+
+//Caller must hold lock
+func (f *FakeSteam) popFailure() error {
+	if len(f.failures) == 0 {
+		return nil
+	}
+	err := f.failures[0]
+	f.failures = f.failures[1:]
+	return err
+}
+
+//Adds an item to an inventory, a new asset id is assigned if AssetId is empty
+func (f *FakeSteam) AddItem(steam64id string, item Item) Item {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if item.AssetId == "" {
+		item.AssetId = f.assetId()
+	}
+	if item.AppId == 0 {
+		item.AppId = APPID_CSGO
+	}
+	if item.ContextId == "" {
+		item.ContextId = CONTEXTID_CSGO
+	}
+	if item.Amount == 0 {
+		item.Amount = 1
+	}
+	f.inventories[steam64id] = append(f.inventories[steam64id], item)
+	return item
+}
+
+//Caller must hold lock
+func (f *FakeSteam) assetId() string {
+	f.nextAssetId++
+	return strconv.FormatInt(f.nextAssetId, 10)
+}
+
+//Caller must hold lock
+func (f *FakeSteam) findItem(steam64id string, assetId string) (int, bool) {
+	for n, item := range f.inventories[steam64id] {
+		if item.AssetId == assetId {
+			return n, true
+		}
+	}
+	return 0, false
+}
+
+//Caller must hold lock
+func (f *FakeSteam) touch(offer *Offer, state OfferState) {
+	offer.State = state
+	offer.Updated = f.now()
+}
+
+func copyOffer(offer *Offer) *Offer {
+	dup := *offer
+	dup.ItemsToGive = append([]Item(nil), offer.ItemsToGive...)
+	dup.ItemsToReceive = append([]Item(nil), offer.ItemsToReceive...)
+	return &dup
+}
+
+//Moves items between inventories. Assets get new ids like they do on Steam
+//Caller must hold lock
+func (f *FakeSteam) exchange(offer *Offer) bool {
+	botSideGives, botSideReceives := offer.ItemsToGive, offer.ItemsToReceive
+	for _, item := range botSideGives {
+		if _, ok := f.findItem(f.BotId, item.AssetId); !ok {
+			return false
+		}
+	}
+	for _, item := range botSideReceives {
+		if _, ok := f.findItem(offer.Partner, item.AssetId); !ok {
+			return false
+		}
+	}
+	f.move(f.BotId, offer.Partner, botSideGives)
+	f.move(offer.Partner, f.BotId, botSideReceives)
+	offer.TradeId = strconv.FormatInt(f.nextId, 10)
+	return true
+}
+
+//Caller must hold lock
+func (f *FakeSteam) move(from string, to string, items []Item) {
+	for _, item := range items {
+		n, _ := f.findItem(from, item.AssetId)
+		moved := f.inventories[from][n]
+		f.inventories[from] = append(f.inventories[from][:n], f.inventories[from][n+1:]...)
+		moved.AssetId = f.assetId()
+		f.inventories[to] = append(f.inventories[to], moved)
+	}
+}
+
+func (f *FakeSteam) CreateOffer(offer *NewOffer) (*Offer, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if err := f.popFailure(); err != nil {
+		return nil, err
+	}
+	if len(offer.ItemsToGive) == 0 && len(offer.ItemsToReceive) == 0 {
+		return nil, ErrEmptyOffer
+	}
+	for _, item := range offer.ItemsToGive {
+		if _, ok := f.findItem(f.BotId, item.AssetId); !ok {
+			return nil, ErrItemNotFound
+		}
+	}
+	for _, item := range offer.ItemsToReceive {
+		if _, ok := f.findItem(offer.Partner, item.AssetId); !ok {
+			return nil, ErrItemNotFound
+		}
+	}
+
+	f.nextId++
+	now := f.now()
+	created := &Offer{
+		Id:             strconv.FormatInt(f.nextId, 10),
+		Partner:        offer.Partner,
+		Message:        offer.Message,
+		State:          StateActive,
+		IsOurs:         true,
+		ItemsToGive:    append([]Item(nil), offer.ItemsToGive...),
+		ItemsToReceive: append([]Item(nil), offer.ItemsToReceive...),
+		Created:        now,
+		Updated:        now,
+		Expires:        now.Add(time.Hour * 24 * 14),
+	}
+	f.offers[created.Id] = created
+	return copyOffer(created), nil
+}
+
+//Creates an offer from a user to the bot, like newOffer in steam-tradeoffer-manager.
+//give and receive are from the bot's side like every other Offer
+func (f *FakeSteam) ReceiveOffer(partner string, give []Item, receive []Item) *Offer {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.nextId++
+	now := f.now()
+	offer := &Offer{
+		Id:             strconv.FormatInt(f.nextId, 10),
+		Partner:        partner,
+		State:          StateActive,
+		IsOurs:         false,
+		ItemsToGive:    append([]Item(nil), give...),
+		ItemsToReceive: append([]Item(nil), receive...),
+		Created:        now,
+		Updated:        now,
+		Expires:        now.Add(time.Hour * 24 * 14),
+	}
+	f.offers[offer.Id] = offer
+	return copyOffer(offer)
+}
+
+//Caller must hold lock
+func (f *FakeSteam) activeOffer(id string) (*Offer, error) {
+	offer, ok := f.offers[id]
+	if !ok {
+		return nil, ErrOfferNotFound
+	}
+	if offer.State != StateActive {
+		return nil, ErrOfferNotActive
+	}
+	return offer, nil
+}
+
+func (f *FakeSteam) AcceptOffer(id string) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if err := f.popFailure(); err != nil {
+		return err
+	}
+	offer, err := f.activeOffer(id)
+	if err != nil {
+		return err
+	}
+	if offer.IsOurs {
+		return ErrNotTheirOffer
+	}
+	if !f.exchange(offer) {
+		f.touch(offer, StateInvalidItems)
+		return nil
+	}
+	f.touch(offer, StateAccepted)
+	return nil
+}
+
+func (f *FakeSteam) DeclineOffer(id string) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if err := f.popFailure(); err != nil {
+		return err
+	}
+	offer, err := f.activeOffer(id)
+	if err != nil {
+		return err
+	}
+	if offer.IsOurs {
+		return ErrNotTheirOffer
+	}
+	f.touch(offer, StateDeclined)
+	return nil
+}
+
+func (f *FakeSteam) CancelOffer(id string) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if err := f.popFailure(); err != nil {
+		return err
+	}
+	offer, ok := f.offers[id]
+	if !ok {
+		return ErrOfferNotFound
+	}
+	if !offer.IsOurs {
+		return ErrNotOurOffer
+	}
+	if offer.State != StateActive && offer.State != StateCreatedNeedsConfirmation {
+		return ErrOfferNotActive
+	}
+	f.touch(offer, StateCanceled)
+	return nil
+}
+
+func (f *FakeSteam) GetOffer(id string) (*Offer, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if err := f.popFailure(); err != nil {
+		return nil, err
+	}
+	offer, ok := f.offers[id]
+	if !ok {
+		return nil, ErrOfferNotFound
+	}
+	return copyOffer(offer), nil
+}
+
+func (f *FakeSteam) GetOffersSince(since time.Time) ([]*Offer, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if err := f.popFailure(); err != nil {
+		return nil, err
+	}
+	offers := make([]*Offer, 0)
+	for _, offer := range f.offers {
+		if !offer.Updated.Before(since) {
+			offers = append(offers, copyOffer(offer))
+		}
+	}
+	return offers, nil
+}
+
+func (f *FakeSteam) LoadInventory(steam64id string, appId int, contextId string, tradableOnly bool) ([]Item, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if err := f.popFailure(); err != nil {
+		return nil, err
+	}
+	items := make([]Item, 0)
+	for _, item := range f.inventories[steam64id] {
+		if item.AppId != appId || item.ContextId != contextId {
+			continue
+		}
+		if tradableOnly && !item.Tradable {
+			continue
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+//Partner side actions on offers sent by the bot
+
+func (f *FakeSteam) partnerAction(id string, fn func(offer *Offer)) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	offer, ok := f.offers[id]
+	if !ok {
+		return ErrOfferNotFound
+	}
+	if !offer.IsOurs {
+		return ErrNotOurOffer
+	}
+	if offer.State != StateActive {
+		return ErrOfferNotActive
+	}
+	fn(offer)
+	return nil
+}
+
+func (f *FakeSteam) PartnerAccept(id string) error {
+	return f.partnerAction(id, func(offer *Offer) {
+		if !f.exchange(offer) {
+			f.touch(offer, StateInvalidItems)
+			return
+		}
+		f.touch(offer, StateAccepted)
+	})
+}
+
+//Accepts into escrow, items move once ReleaseEscrow is called
+func (f *FakeSteam) PartnerAcceptEscrow(id string, holdFor time.Duration) error {
+	return f.partnerAction(id, func(offer *Offer) {
+		offer.EscrowEnds = f.now().Add(holdFor)
+		f.touch(offer, StateInEscrow)
+	})
+}
+
+func (f *FakeSteam) ReleaseEscrow(id string) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	offer, ok := f.offers[id]
+	if !ok {
+		return ErrOfferNotFound
+	}
+	if offer.State != StateInEscrow {
+		return ErrOfferNotActive
+	}
+	if !f.exchange(offer) {
+		f.touch(offer, StateInvalidItems)
+		return nil
+	}
+	f.touch(offer, StateAccepted)
+	return nil
+}
+
+func (f *FakeSteam) PartnerDecline(id string) error {
+	return f.partnerAction(id, func(offer *Offer) {
+		f.touch(offer, StateDeclined)
+	})
+}
+
+//Marks the offer countered and creates the counter offer, which is returned
+func (f *FakeSteam) PartnerCounter(id string, give []Item, receive []Item) (*Offer, error) {
+	var counter *Offer
+	err := f.partnerAction(id, func(offer *Offer) {
+		f.touch(offer, StateCountered)
+		f.nextId++
+		now := f.now()
+		counter = &Offer{
+			Id:             strconv.FormatInt(f.nextId, 10),
+			Partner:        offer.Partner,
+			State:          StateActive,
+			ItemsToGive:    append([]Item(nil), give...),
+			ItemsToReceive: append([]Item(nil), receive...),
+			Created:        now,
+			Updated:        now,
+			Expires:        now.Add(time.Hour * 24 * 14),
+		}
+		f.offers[counter.Id] = counter
+	})
+	if err != nil {
+		return nil, err
+	}
+	return copyOffer(counter), nil
+}
+
+func (f *FakeSteam) Expire(id string) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	offer, ok := f.offers[id]
+	if !ok {
+		return ErrOfferNotFound
+	}
+	if offer.State.Final() {
+		return ErrOfferNotActive
+	}
+	f.touch(offer, StateExpired)
+	return nil
+}
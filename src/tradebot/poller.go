@@ -0,0 +1,119 @@
+package tradebot
+
+import (
+	"time"
+)
+
+//Offers are re-fetched this far back so updates that land while a poll is
+//running are not missed, the state map filters out anything already seen
+const POLL_OVERLAP = time.Minute * 30
+
+//Last seen state of every offer, persisted between restarts (was polldata.json)
+type PollData struct {
+	Since  time.Time             `json:"since"`
+	States map[string]OfferState `json:"states"`
+}
+
+type PollStore interface {
+	//Returns empty poll data on first run
+	LoadPollData() (*PollData, error)
+	SavePollData(data *PollData) error
+}
+
+//OldState is 0 for offers seen for the first time
+type OfferEvent struct {
+	Offer    *Offer
+	OldState OfferState
+}
+
+func (e *OfferEvent) IsNew() bool {
+	return e.OldState == 0
+}
+
+type Poller struct {
+	Service  TradeOfferService
+	Store    PollStore
+	Interval time.Duration
+	//Called for new offers and state changes, in order, on the poll goroutine
+	OnEvent func(event *OfferEvent)
+	//Called when a poll fails, polling continues at the next interval
+	OnError func(err error)
+	data    *PollData
+}
+
+func (p *Poller) load() error {
+	data, loadErr := p.Store.LoadPollData()
+	if loadErr != nil {
+		return loadErr
+	}
+	if data.States == nil {
+		data.States = make(map[string]OfferState)
+	}
+	p.data = data
+	return nil
+}
+
+//Fetches changes once, emits events and saves the poll data
+func (p *Poller) Poll() error {
+	if p.data == nil {
+		if err := p.load(); err != nil {
+			return err
+		}
+	}
+
+	since := p.data.Since.Add(-POLL_OVERLAP)
+	if p.data.Since.IsZero() {
+		since = time.Time{}
+	}
+	offers, fetchErr := p.Service.GetOffersSince(since)
+	if fetchErr != nil {
+		return fetchErr
+	}
+
+	latest := p.data.Since
+	for _, offer := range offers {
+		oldState, seen := p.data.States[offer.Id]
+		if !seen || oldState != offer.State {
+			p.data.States[offer.Id] = offer.State
+			if p.OnEvent != nil {
+				p.OnEvent(&OfferEvent{Offer: offer, OldState: oldState})
+			}
+		}
+		if offer.Updated.After(latest) {
+			latest = offer.Updated
+		}
+	}
+	p.data.Since = latest
+	p.prune(offers)
+	return p.Store.SavePollData(p.data)
+}
+
+//Drops finished offers that fell out of the poll window, they can no
+//longer change so there is no point remembering them
+func (p *Poller) prune(offers []*Offer) {
+	seen := make(map[string]bool, len(offers))
+	for _, offer := range offers {
+		seen[offer.Id] = true
+	}
+	for id, state := range p.data.States {
+		if state.Final() && !seen[id] {
+			delete(p.data.States, id)
+		}
+	}
+}
+
+//Polls every Interval until quit is closed
+func (p *Poller) Run(quit chan bool) {
+	ticker := time.NewTicker(p.Interval)
+	defer ticker.Stop()
+	for {
+		if err := p.Poll(); err != nil && p.OnError != nil {
+			p.OnError(err)
+		}
+		select {
+		case <-ticker.C:
+		case <-quit:
+			return
+		}
+	}
+}
@@ -0,0 +1,275 @@
+package tradebot
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+const testBotId = "76561198000000001"
+const testPartnerId = "76561198000000002"
+
+//Keeps poll data as json like the database store, so nothing is shared with
+//the poller between saves
+type memPollStore struct {
+	raw   []byte
+	saves int
+}
+
+func (s *memPollStore) LoadPollData() (*PollData, error) {
+	data := &PollData{}
+	if s.raw == nil {
+		return data, nil
+	}
+	if err := json.Unmarshal(s.raw, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (s *memPollStore) SavePollData(data *PollData) error {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	s.raw = raw
+	s.saves++
+	return nil
+}
+
+//Fake Steam with a clock that only moves when advance is called
+type pollerFixture struct {
+	t      *testing.T
+	steam  *FakeSteam
+	store  *memPollStore
+	poller *Poller
+	clock  time.Time
+	events []*OfferEvent
+}
+
+func newPollerFixture(t *testing.T) *pollerFixture {
+	fx := &pollerFixture{
+		t:     t,
+		steam: NewFakeSteam(testBotId),
+		store: &memPollStore{},
+		clock: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+	fx.steam.now = func() time.Time { return fx.clock }
+	fx.restart()
+	return fx
+}
+
+//Replaces the poller with a fresh one on the same store, like a process restart
+func (fx *pollerFixture) restart() {
+	fx.poller = &Poller{
+		Service: fx.steam,
+		Store:   fx.store,
+		OnEvent: func(event *OfferEvent) {
+			fx.events = append(fx.events, event)
+		},
+	}
+}
+
+func (fx *pollerFixture) advance() {
+	fx.clock = fx.clock.Add(time.Second * 10)
+}
+
+//Polls once and returns the events it produced
+func (fx *pollerFixture) poll() []*OfferEvent {
+	fx.t.Helper()
+	fx.events = nil
+	if err := fx.poller.Poll(); err != nil {
+		fx.t.Fatalf("poll failed: %v", err)
+	}
+	return fx.events
+}
+
+func (fx *pollerFixture) expect(events []*OfferEvent, id string, oldState OfferState, newState OfferState) {
+	fx.t.Helper()
+	if len(events) != 1 {
+		fx.t.Fatalf("expected 1 event for offer %s, got %d", id, len(events))
+	}
+	event := events[0]
+	if event.Offer.Id != id || event.OldState != oldState || event.Offer.State != newState {
+		fx.t.Fatalf("expected offer %s %v -> %v, got offer %s %v -> %v",
+			id, oldState, newState, event.Offer.Id, event.OldState, event.Offer.State)
+	}
+}
+
+func (fx *pollerFixture) item(owner string) Item {
+	return fx.steam.AddItem(owner, Item{Tradable: true})
+}
+
+func TestPollerCreateAndPartnerAccept(t *testing.T) {
+	fx := newPollerFixture(t)
+	item := fx.item(testBotId)
+	offer, err := fx.steam.CreateOffer(&NewOffer{Partner: testPartnerId, ItemsToGive: []Item{item}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events := fx.poll()
+	fx.expect(events, offer.Id, 0, StateActive)
+	if !events[0].IsNew() {
+		t.Fatal("first event for an offer should be new")
+	}
+
+	fx.advance()
+	if err := fx.steam.PartnerAccept(offer.Id); err != nil {
+		t.Fatal(err)
+	}
+	fx.expect(fx.poll(), offer.Id, StateActive, StateAccepted)
+
+	items, _ := fx.steam.LoadInventory(testPartnerId, APPID_CSGO, CONTEXTID_CSGO, false)
+	if len(items) != 1 {
+		t.Fatalf("partner should own the item after accepting, has %d items", len(items))
+	}
+}
+
+func TestPollerAcceptAndDeclineReceived(t *testing.T) {
+	fx := newPollerFixture(t)
+	accepted := fx.steam.ReceiveOffer(testPartnerId, nil, []Item{fx.item(testPartnerId)})
+	declined := fx.steam.ReceiveOffer(testPartnerId, nil, []Item{fx.item(testPartnerId)})
+	if events := fx.poll(); len(events) != 2 {
+		t.Fatalf("expected 2 new offers, got %d events", len(events))
+	}
+
+	fx.advance()
+	if err := fx.steam.AcceptOffer(accepted.Id); err != nil {
+		t.Fatal(err)
+	}
+	fx.expect(fx.poll(), accepted.Id, StateActive, StateAccepted)
+
+	fx.advance()
+	if err := fx.steam.DeclineOffer(declined.Id); err != nil {
+		t.Fatal(err)
+	}
+	fx.expect(fx.poll(), declined.Id, StateActive, StateDeclined)
+
+	if err := fx.steam.AcceptOffer(declined.Id); err != ErrOfferNotActive {
+		t.Fatalf("accepting a declined offer should fail with ErrOfferNotActive, got %v", err)
+	}
+}
+
+func TestPollerCancel(t *testing.T) {
+	fx := newPollerFixture(t)
+	offer, err := fx.steam.CreateOffer(&NewOffer{Partner: testPartnerId, ItemsToGive: []Item{fx.item(testBotId)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fx.poll()
+
+	fx.advance()
+	if err := fx.steam.CancelOffer(offer.Id); err != nil {
+		t.Fatal(err)
+	}
+	fx.expect(fx.poll(), offer.Id, StateActive, StateCanceled)
+
+	if err := fx.steam.CancelOffer(offer.Id); err != ErrOfferNotActive {
+		t.Fatalf("canceling twice should fail with ErrOfferNotActive, got %v", err)
+	}
+}
+
+//The overlap window re-fetches offers every poll, they must not be re-emitted
+func TestPollerEventsOnce(t *testing.T) {
+	fx := newPollerFixture(t)
+	offer, err := fx.steam.CreateOffer(&NewOffer{Partner: testPartnerId, ItemsToGive: []Item{fx.item(testBotId)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fx.expect(fx.poll(), offer.Id, 0, StateActive)
+	for n := 0; n < 3; n++ {
+		fx.advance()
+		if events := fx.poll(); len(events) != 0 {
+			t.Fatalf("unchanged offer emitted %d events on poll %d", len(events), n)
+		}
+	}
+
+	fx.advance()
+	fx.steam.PartnerDecline(offer.Id)
+	fx.expect(fx.poll(), offer.Id, StateActive, StateDeclined)
+	if events := fx.poll(); len(events) != 0 {
+		t.Fatalf("declined offer emitted %d events on the next poll", len(events))
+	}
+}
+
+func TestPollerPersistsAcrossRestart(t *testing.T) {
+	fx := newPollerFixture(t)
+	first, _ := fx.steam.CreateOffer(&NewOffer{Partner: testPartnerId, ItemsToGive: []Item{fx.item(testBotId)}})
+	fx.advance()
+	second, _ := fx.steam.CreateOffer(&NewOffer{Partner: testPartnerId, ItemsToGive: []Item{fx.item(testBotId)}})
+	if events := fx.poll(); len(events) != 2 {
+		t.Fatalf("expected 2 new offers, got %d events", len(events))
+	}
+
+	saved, err := fx.store.LoadPollData()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !saved.Since.Equal(fx.clock) {
+		t.Fatalf("since should be the latest update %v, got %v", fx.clock, saved.Since)
+	}
+	if saved.States[first.Id] != StateActive || saved.States[second.Id] != StateActive {
+		t.Fatalf("states not saved: %v", saved.States)
+	}
+
+	fx.restart()
+	if events := fx.poll(); len(events) != 0 {
+		t.Fatalf("restarted poller re-emitted %d events", len(events))
+	}
+
+	//Changes made while the poller was down are picked up once
+	fx.restart()
+	fx.advance()
+	fx.steam.PartnerAccept(first.Id)
+	fx.expect(fx.poll(), first.Id, StateActive, StateAccepted)
+	fx.restart()
+	if events := fx.poll(); len(events) != 0 {
+		t.Fatalf("restarted poller re-emitted %d events", len(events))
+	}
+}
+
+//A failed fetch leaves the poll data alone so the next poll picks up the change
+func TestPollerFetchError(t *testing.T) {
+	fx := newPollerFixture(t)
+	offer, _ := fx.steam.CreateOffer(&NewOffer{Partner: testPartnerId, ItemsToGive: []Item{fx.item(testBotId)}})
+	fx.poll()
+	saves := fx.store.saves
+
+	fx.advance()
+	fx.steam.PartnerAccept(offer.Id)
+	outage := errors.New("steam is down")
+	fx.steam.FailNext(outage)
+	if err := fx.poller.Poll(); err != outage {
+		t.Fatalf("expected the fetch error, got %v", err)
+	}
+	if fx.store.saves != saves {
+		t.Fatal("poll data saved after a failed fetch")
+	}
+	fx.expect(fx.poll(), offer.Id, StateActive, StateAccepted)
+}
+
+//Finished offers are forgotten once they leave the overlap window
+func TestPollerPrunesFinishedOffers(t *testing.T) {
+	fx := newPollerFixture(t)
+	offer, _ := fx.steam.CreateOffer(&NewOffer{Partner: testPartnerId, ItemsToGive: []Item{fx.item(testBotId)}})
+	fx.poll()
+	fx.advance()
+	fx.steam.CancelOffer(offer.Id)
+	fx.poll()
+
+	fx.clock = fx.clock.Add(POLL_OVERLAP * 2)
+	fx.steam.CreateOffer(&NewOffer{Partner: testPartnerId, ItemsToGive: []Item{fx.item(testBotId)}})
+	//The first poll after the newer offer still overlaps the cancel, the second does not
+	fx.poll()
+	saved, _ := fx.store.LoadPollData()
+	if _, ok := saved.States[offer.Id]; !ok {
+		t.Fatal("canceled offer inside the poll window was pruned")
+	}
+	fx.poll()
+	saved, _ = fx.store.LoadPollData()
+	if _, ok := saved.States[offer.Id]; ok {
+		t.Fatal("canceled offer outside the poll window was not pruned")
+	}
+}
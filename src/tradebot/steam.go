@@ -0,0 +1,469 @@
+package tradebot
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const API_URL = "https://api.steampowered.com/IEconService/"
+const COMMUNITY_URL = "https://steamcommunity.com"
+
+//Web session cookies for the bot account, obtained when the bot logs in
+type WebSession struct {
+	SessionId        string
+	SteamLoginSecure string
+}
+
+//TradeOfferService backed by the Steam web API and steamcommunity.com
+type SteamService struct {
+	ApiKey  string
+	Session WebSession
+	Client  *http.Client
+}
+
+func NewSteamService(apiKey string, session WebSession) *SteamService {
+	return &SteamService{
+		ApiKey:  apiKey,
+		Session: session,
+		Client:  &http.Client{Timeout: time.Second * 15},
+	}
+}
+
+type apiAsset struct {
+	AppId      int    `json:"appid"`
+	ContextId  string `json:"contextid"`
+	AssetId    string `json:"assetid"`
+	ClassId    string `json:"classid"`
+	InstanceId string `json:"instanceid"`
+	Amount     string `json:"amount"`
+}
+
+type apiTag struct {
+	Category              string `json:"category"`
+	InternalName          string `json:"internal_name"`
+	LocalizedTagName      string `json:"localized_tag_name"`
+	LocalizedCategoryName string `json:"localized_category_name"`
+}
+
+type apiDescriptionLine struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type apiDescription struct {
+	AppId             int                  `json:"appid"`
+	ClassId           string               `json:"classid"`
+	InstanceId        string               `json:"instanceid"`
+	Name              string               `json:"name"`
+	MarketHashName    string               `json:"market_hash_name"`
+	Type              string               `json:"type"`
+	IconUrl           string               `json:"icon_url"`
+	Tradable          int                  `json:"tradable"`
+	Marketable        int                  `json:"marketable"`
+	Tags              []apiTag             `json:"tags"`
+	Descriptions      []apiDescriptionLine `json:"descriptions"`
+	OwnerDescriptions []apiDescriptionLine `json:"owner_descriptions"`
+	CacheExpiration   string               `json:"cache_expiration"`
+}
+
+type apiOffer struct {
+	TradeOfferId   string     `json:"tradeofferid"`
+	AccountIdOther uint32     `json:"accountid_other"`
+	Message        string     `json:"message"`
+	ExpirationTime int64      `json:"expiration_time"`
+	State          OfferState `json:"trade_offer_state"`
+	ItemsToGive    []apiAsset `json:"items_to_give"`
+	ItemsToReceive []apiAsset `json:"items_to_receive"`
+	IsOurOffer     bool       `json:"is_our_offer"`
+	TimeCreated    int64      `json:"time_created"`
+	TimeUpdated    int64      `json:"time_updated"`
+	EscrowEndDate  int64      `json:"escrow_end_date"`
+	TradeId        string     `json:"tradeid"`
+}
+
+type descriptionKey struct {
+	ClassId    string
+	InstanceId string
+}
+
+func indexDescriptions(descriptions []apiDescription) map[descriptionKey]*apiDescription {
+	index := make(map[descriptionKey]*apiDescription, len(descriptions))
+	for n := range descriptions {
+		d := &descriptions[n]
+		index[descriptionKey{d.ClassId, d.InstanceId}] = d
+	}
+	return index
+}
+
+func toItem(asset apiAsset, descriptions map[descriptionKey]*apiDescription) Item {
+	amount, _ := strconv.Atoi(asset.Amount)
+	item := Item{
+		AppId:      asset.AppId,
+		ContextId:  asset.ContextId,
+		AssetId:    asset.AssetId,
+		ClassId:    asset.ClassId,
+		InstanceId: asset.InstanceId,
+		Amount:     amount,
+	}
+	if item.InstanceId == "" {
+		item.InstanceId = "0"
+	}
+	d, ok := descriptions[descriptionKey{item.ClassId, item.InstanceId}]
+	if !ok {
+		return item
+	}
+	item.Name = d.Name
+	item.MarketHashName = d.MarketHashName
+	item.Type = d.Type
+	item.IconUrl = d.IconUrl
+	item.Tradable = d.Tradable == 1
+	item.Marketable = d.Marketable == 1
+	for _, tag := range d.Tags {
+		item.Tags = append(item.Tags, Tag{
+			Category:     tag.Category,
+			InternalName: tag.InternalName,
+			Name:         tag.LocalizedTagName,
+			CategoryName: tag.LocalizedCategoryName,
+		})
+	}
+	for _, line := range d.Descriptions {
+		item.Descriptions = append(item.Descriptions, line.Value)
+	}
+	for _, line := range d.OwnerDescriptions {
+		item.OwnerDescriptions = append(item.OwnerDescriptions, line.Value)
+	}
+	if !item.Tradable && d.CacheExpiration != "" {
+		if until, err := time.Parse(time.RFC3339, d.CacheExpiration); err == nil {
+			item.TradableAfter = until
+		}
+	}
+	return item
+}
+
+func toOffer(o *apiOffer, descriptions map[descriptionKey]*apiDescription) *Offer {
+	offer := &Offer{
+		Id:      o.TradeOfferId,
+		Partner: strconv.FormatUint(Steam64Id(o.AccountIdOther), 10),
+		Message: o.Message,
+		State:   o.State,
+		IsOurs:  o.IsOurOffer,
+		Created: time.Unix(o.TimeCreated, 0),
+		Updated: time.Unix(o.TimeUpdated, 0),
+		Expires: time.Unix(o.ExpirationTime, 0),
+		TradeId: o.TradeId,
+	}
+	if o.EscrowEndDate != 0 {
+		offer.EscrowEnds = time.Unix(o.EscrowEndDate, 0)
+	}
+	for _, asset := range o.ItemsToGive {
+		offer.ItemsToGive = append(offer.ItemsToGive, toItem(asset, descriptions))
+	}
+	for _, asset := range o.ItemsToReceive {
+		offer.ItemsToReceive = append(offer.ItemsToReceive, toItem(asset, descriptions))
+	}
+	return offer
+}
+
+//Maps a response status to a SteamError, nil for 2xx
+func statusError(resp *http.Response, body []byte) error {
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	transient := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+	msg := strings.TrimSpace(string(body))
+	if len(msg) > 200 {
+		msg = msg[:200]
+	}
+	return &SteamError{
+		Status:    resp.StatusCode,
+		Message:   fmt.Sprintf("Steam returned %d: %s", resp.StatusCode, msg),
+		Transient: transient,
+	}
+}
+
+//Runs a request and decodes the json body into out, network errors are transient
+func (s *SteamService) do(req *http.Request, out interface{}) error {
+	resp, respErr := s.Client.Do(req)
+	if respErr != nil {
+		return &SteamError{Message: respErr.Error(), Transient: true}
+	}
+	defer resp.Body.Close()
+	body, readErr := ioutil.ReadAll(resp.Body)
+	if readErr != nil {
+		return &SteamError{Message: readErr.Error(), Transient: true}
+	}
+	if err := statusError(resp, body); err != nil {
+		return err
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.Unmarshal(body, out); err != nil {
+		//Steam serves html error pages with 200 when it is struggling
+		return &SteamError{Status: resp.StatusCode, Message: "Invalid response from Steam: " + err.Error(), Transient: true}
+	}
+	return nil
+}
+
+func (s *SteamService) apiGet(method string, params url.Values, out interface{}) error {
+	params.Set("key", s.ApiKey)
+	req, reqErr := http.NewRequest("GET", API_URL+method+"/v1/?"+params.Encode(), nil)
+	if reqErr != nil {
+		return reqErr
+	}
+	return s.do(req, out)
+}
+
+func (s *SteamService) apiPost(method string, params url.Values) error {
+	params.Set("key", s.ApiKey)
+	req, reqErr := http.NewRequest("POST", API_URL+method+"/v1/", strings.NewReader(params.Encode()))
+	if reqErr != nil {
+		return reqErr
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return s.do(req, nil)
+}
+
+//steamcommunity.com endpoints need the web session cookies and a matching referer
+func (s *SteamService) communityPost(path string, referer string, form url.Values, out interface{}) error {
+	form.Set("sessionid", s.Session.SessionId)
+	req, reqErr := http.NewRequest("POST", COMMUNITY_URL+path, strings.NewReader(form.Encode()))
+	if reqErr != nil {
+		return reqErr
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Referer", referer)
+	req.AddCookie(&http.Cookie{Name: "sessionid", Value: s.Session.SessionId})
+	req.AddCookie(&http.Cookie{Name: "steamLoginSecure", Value: s.Session.SteamLoginSecure})
+	return s.do(req, out)
+}
+
+type jsonAsset struct {
+	AppId     int    `json:"appid"`
+	ContextId string `json:"contextid"`
+	Amount    int    `json:"amount"`
+	AssetId   string `json:"assetid"`
+}
+
+type jsonSide struct {
+	Assets   []jsonAsset   `json:"assets"`
+	Currency []interface{} `json:"currency"`
+	Ready    bool          `json:"ready"`
+}
+
+func toJsonSide(items []Item) jsonSide {
+	side := jsonSide{Assets: []jsonAsset{}, Currency: []interface{}{}}
+	for _, item := range items {
+		amount := item.Amount
+		if amount < 1 {
+			amount = 1
+		}
+		side.Assets = append(side.Assets, jsonAsset{
+			AppId:     item.AppId,
+			ContextId: item.ContextId,
+			Amount:    amount,
+			AssetId:   item.AssetId,
+		})
+	}
+	return side
+}
+
+func (s *SteamService) CreateOffer(offer *NewOffer) (*Offer, error) {
+	if len(offer.ItemsToGive) == 0 && len(offer.ItemsToReceive) == 0 {
+		return nil, ErrEmptyOffer
+	}
+	partner, parseErr := strconv.ParseUint(offer.Partner, 10, 64)
+	if parseErr != nil {
+		return nil, parseErr
+	}
+
+	tradeJson, _ := json.Marshal(map[string]interface{}{
+		"newversion": true,
+		"version":    len(offer.ItemsToGive) + len(offer.ItemsToReceive) + 1,
+		"me":         toJsonSide(offer.ItemsToGive),
+		"them":       toJsonSide(offer.ItemsToReceive),
+	})
+	createParams, _ := json.Marshal(map[string]string{"trade_offer_access_token": offer.Token})
+	message := offer.Message
+	if len(message) > MAX_MESSAGE_LEN {
+		message = message[:MAX_MESSAGE_LEN]
+	}
+
+	form := url.Values{}
+	form.Set("serverid", "1")
+	form.Set("partner", offer.Partner)
+	form.Set("tradeoffermessage", message)
+	form.Set("json_tradeoffer", string(tradeJson))
+	form.Set("captcha", "")
+	form.Set("trade_offer_create_params", string(createParams))
+
+	referer := fmt.Sprintf("%s/tradeoffer/new/?partner=%d&token=%s", COMMUNITY_URL, AccountId(partner), url.QueryEscape(offer.Token))
+	var resp struct {
+		TradeOfferId            string `json:"tradeofferid"`
+		NeedsMobileConfirmation bool   `json:"needs_mobile_confirmation"`
+		NeedsEmailConfirmation  bool   `json:"needs_email_confirmation"`
+		StrError                string `json:"strError"`
+	}
+	if err := s.communityPost("/tradeoffer/new/send", referer, form, &resp); err != nil {
+		return nil, err
+	}
+	if resp.TradeOfferId == "" {
+		return nil, &SteamError{Message: "Offer not created: " + resp.StrError}
+	}
+
+	now := time.Now()
+	state := StateActive
+	if resp.NeedsMobileConfirmation || resp.NeedsEmailConfirmation {
+		state = StateCreatedNeedsConfirmation
+	}
+	return &Offer{
+		Id:                resp.TradeOfferId,
+		Partner:           offer.Partner,
+		Message:           message,
+		State:             state,
+		IsOurs:            true,
+		ItemsToGive:       offer.ItemsToGive,
+		ItemsToReceive:    offer.ItemsToReceive,
+		Created:           now,
+		Updated:           now,
+		NeedsConfirmation: state == StateCreatedNeedsConfirmation,
+	}, nil
+}
+
+func (s *SteamService) AcceptOffer(id string) error {
+	offer, getErr := s.GetOffer(id)
+	if getErr != nil {
+		return getErr
+	}
+	if offer.IsOurs {
+		return ErrNotTheirOffer
+	}
+	if offer.State != StateActive {
+		return ErrOfferNotActive
+	}
+
+	form := url.Values{}
+	form.Set("serverid", "1")
+	form.Set("tradeofferid", id)
+	form.Set("partner", offer.Partner)
+	form.Set("captcha", "")
+	return s.communityPost("/tradeoffer/"+id+"/accept", COMMUNITY_URL+"/tradeoffer/"+id+"/", form, nil)
+}
+
+func (s *SteamService) DeclineOffer(id string) error {
+	params := url.Values{}
+	params.Set("tradeofferid", id)
+	return s.apiPost("DeclineTradeOffer", params)
+}
+
+func (s *SteamService) CancelOffer(id string) error {
+	params := url.Values{}
+	params.Set("tradeofferid", id)
+	return s.apiPost("CancelTradeOffer", params)
+}
+
+func (s *SteamService) GetOffer(id string) (*Offer, error) {
+	params := url.Values{}
+	params.Set("tradeofferid", id)
+	params.Set("get_descriptions", "1")
+	params.Set("language", "english")
+	var resp struct {
+		Response struct {
+			Offer        *apiOffer        `json:"offer"`
+			Descriptions []apiDescription `json:"descriptions"`
+		} `json:"response"`
+	}
+	if err := s.apiGet("GetTradeOffer", params, &resp); err != nil {
+		return nil, err
+	}
+	if resp.Response.Offer == nil {
+		return nil, ErrOfferNotFound
+	}
+	return toOffer(resp.Response.Offer, indexDescriptions(resp.Response.Descriptions)), nil
+}
+
+func (s *SteamService) GetOffersSince(since time.Time) ([]*Offer, error) {
+	params := url.Values{}
+	params.Set("get_sent_offers", "1")
+	params.Set("get_received_offers", "1")
+	params.Set("get_descriptions", "1")
+	params.Set("language", "english")
+	params.Set("time_historical_cutoff", strconv.FormatInt(since.Unix(), 10))
+	var resp struct {
+		Response struct {
+			Sent         []apiOffer       `json:"trade_offers_sent"`
+			Received     []apiOffer       `json:"trade_offers_received"`
+			Descriptions []apiDescription `json:"descriptions"`
+		} `json:"response"`
+	}
+	if err := s.apiGet("GetTradeOffers", params, &resp); err != nil {
+		return nil, err
+	}
+
+	descriptions := indexDescriptions(resp.Response.Descriptions)
+	offers := make([]*Offer, 0, len(resp.Response.Sent)+len(resp.Response.Received))
+	for n := range resp.Response.Sent {
+		if resp.Response.Sent[n].TimeUpdated >= since.Unix() {
+			offers = append(offers, toOffer(&resp.Response.Sent[n], descriptions))
+		}
+	}
+	for n := range resp.Response.Received {
+		if resp.Response.Received[n].TimeUpdated >= since.Unix() {
+			offers = append(offers, toOffer(&resp.Response.Received[n], descriptions))
+		}
+	}
+	return offers, nil
+}
+
+//Pages through the community inventory endpoint
+func (s *SteamService) LoadInventory(steam64id string, appId int, contextId string, tradableOnly bool) ([]Item, error) {
+	items := make([]Item, 0)
+	startAssetId := ""
+	for {
+		params := url.Values{}
+		params.Set("l", "english")
+		params.Set("count", "2000")
+		if startAssetId != "" {
+			params.Set("start_assetid", startAssetId)
+		}
+		req, reqErr := http.NewRequest("GET", fmt.Sprintf("%s/inventory/%s/%d/%s?%s", COMMUNITY_URL, steam64id, appId, contextId, params.Encode()), nil)
+		if reqErr != nil {
+			return nil, reqErr
+		}
+
+		var resp struct {
+			Assets       []apiAsset       `json:"assets"`
+			Descriptions []apiDescription `json:"descriptions"`
+			MoreItems    int              `json:"more_items"`
+			LastAssetId  string           `json:"last_assetid"`
+			Success      int              `json:"success"`
+		}
+		if err := s.do(req, &resp); err != nil {
+			return nil, err
+		}
+		if resp.Success != 1 {
+			return nil, &SteamError{Message: "Inventory request for " + steam64id + " failed"}
+		}
+
+		descriptions := indexDescriptions(resp.Descriptions)
+		for _, asset := range resp.Assets {
+			item := toItem(asset, descriptions)
+			if tradableOnly && !item.Tradable {
+				continue
+			}
+			items = append(items, item)
+		}
+
+		if resp.MoreItems != 1 || resp.LastAssetId == "" {
+			break
+		}
+		startAssetId = resp.LastAssetId
+	}
+	return items, nil
+}
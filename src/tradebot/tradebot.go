@@ -0,0 +1,175 @@
+//Package tradebot manages a Steam bot account's trade offers and inventory.
+//TradeOfferService is implemented against the Steam web API (SteamService)
+//and by an in-memory fake (FakeSteam) for running offline
+package tradebot
+
+import (
+	"errors"
+	"time"
+)
+
+const (
+	APPID_CSGO      = 730
+	CONTEXTID_CSGO  = "2"
+	STEAM64_BASE    = 76561197960265728
+	MAX_MESSAGE_LEN = 128
+)
+
+//Mirrors Steam's ETradeOfferState
+type OfferState int
+
+const (
+	StateInvalid                  OfferState = 1
+	StateActive                   OfferState = 2
+	StateAccepted                 OfferState = 3
+	StateCountered                OfferState = 4
+	StateExpired                  OfferState = 5
+	StateCanceled                 OfferState = 6
+	StateDeclined                 OfferState = 7
+	StateInvalidItems             OfferState = 8
+	StateCreatedNeedsConfirmation OfferState = 9
+	StateCanceledBySecondFactor   OfferState = 10
+	StateInEscrow                 OfferState = 11
+)
+
+var stateNames = map[OfferState]string{
+	StateInvalid:                  "invalid",
+	StateActive:                   "active",
+	StateAccepted:                 "accepted",
+	StateCountered:                "countered",
+	StateExpired:                  "expired",
+	StateCanceled:                 "canceled",
+	StateDeclined:                 "declined",
+	StateInvalidItems:             "invalid_items",
+	StateCreatedNeedsConfirmation: "needs_confirmation",
+	StateCanceledBySecondFactor:   "canceled_by_second_factor",
+	StateInEscrow:                 "escrow",
+}
+
+func (s OfferState) String() string {
+	if name, ok := stateNames[s]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+//True once the offer can no longer change
+func (s OfferState) Final() bool {
+	switch s {
+	case StateActive, StateCreatedNeedsConfirmation, StateInEscrow:
+		return false
+	}
+	return true
+}
+
+var ErrOfferNotFound = errors.New("Trade offer not found")
+var ErrOfferNotActive = errors.New("Trade offer is not active")
+var ErrNotOurOffer = errors.New("Trade offer was not sent by us")
+var ErrNotTheirOffer = errors.New("Trade offer was not sent to us")
+var ErrEmptyOffer = errors.New("Trade offer has no items")
+var ErrItemNotFound = errors.New("Item not in inventory")
+
+//Error returned by Steam. Transient errors (rate limits, 5xx, timeouts) are safe to retry
+type SteamError struct {
+	Status    int
+	Message   string
+	Transient bool
+}
+
+func (e *SteamError) Error() string {
+	return e.Message
+}
+
+func IsTransient(err error) bool {
+	var steamErr *SteamError
+	return errors.As(err, &steamErr) && steamErr.Transient
+}
+
+type Tag struct {
+	Category     string
+	InternalName string
+	Name         string
+	CategoryName string
+}
+
+type Item struct {
+	AppId      int
+	ContextId  string
+	AssetId    string
+	ClassId    string
+	InstanceId string
+	Amount     int
+	//Filled from the item description when loaded from an inventory
+	Name           string
+	MarketHashName string
+	Type           string
+	IconUrl        string
+	Tradable       bool
+	Marketable     bool
+	Tags           []Tag
+	//Plain text and html lines from the description, stickers live here
+	Descriptions []string
+	//Owner descriptions, the trade hold date lives here
+	OwnerDescriptions []string
+	//Set when the item is on trade hold
+	TradableAfter time.Time
+}
+
+//Returns the tag with the given category, ex. "Exterior", or nil
+func (i *Item) Tag(category string) *Tag {
+	for n := range i.Tags {
+		if i.Tags[n].Category == category {
+			return &i.Tags[n]
+		}
+	}
+	return nil
+}
+
+//Items are always from the bot's side, ItemsToGive leave the bot's inventory
+//whether or not the bot created the offer
+type Offer struct {
+	Id string
+	//steam64 id of the other party
+	Partner        string
+	Message        string
+	State          OfferState
+	IsOurs         bool
+	ItemsToGive    []Item
+	ItemsToReceive []Item
+	Created        time.Time
+	Updated        time.Time
+	Expires        time.Time
+	//Zero unless the offer is held in escrow
+	EscrowEnds time.Time
+	TradeId    string
+	//Set on offers we create that still need a mobile confirmation
+	NeedsConfirmation bool
+}
+
+type NewOffer struct {
+	Partner string
+	//Trade url token, required unless the partner is a friend
+	Token          string
+	Message        string
+	ItemsToGive    []Item
+	ItemsToReceive []Item
+}
+
+type TradeOfferService interface {
+	CreateOffer(offer *NewOffer) (*Offer, error)
+	AcceptOffer(id string) error
+	DeclineOffer(id string) error
+	CancelOffer(id string) error
+	GetOffer(id string) (*Offer, error)
+	//Sent and received offers updated at or after since
+	GetOffersSince(since time.Time) ([]*Offer, error)
+	LoadInventory(steam64id string, appId int, contextId string, tradableOnly bool) ([]Item, error)
+}
+
+func AccountId(steam64id uint64) uint32 {
+	return uint32(steam64id - STEAM64_BASE)
+}
+
+func Steam64Id(accountId uint32) uint64 {
+	return uint64(accountId) + STEAM64_BASE
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	audit "github.com/skyguy126/website/src/audit"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//steam64 id = STEAM64_BASE + 32 bit account id, the trade url "partner"
+const STEAM64_BASE uint64 = 76561197960265728
+
+//Seconds a user has to wait between trade url changes
+const TRADE_URL_COOLDOWN = 86400
+
+var tokenRegex = regexp.MustCompile(`^[\w-]{8}$`)
+
+var errTradeUrlInvalid = errors.New("Invalid trade url")
+var errTradeUrlPartner = errors.New("Trade url belongs to another account")
+var errTradeUrlCooldown = errors.New("Trade url was changed recently")
+
+type TradeUrl struct {
+	Sid     string
+	Url     string
+	Partner string
+	Token   string
+	Updated time.Time
+}
+
+func accountId(steam64id string) (string, error) {
+	id, parseErr := strconv.ParseUint(steam64id, 10, 64)
+	if parseErr != nil || id <= STEAM64_BASE {
+		return "", errTradeUrlInvalid
+	}
+	return strconv.FormatUint(id-STEAM64_BASE, 10), nil
+}
+
+//Checks a url looks like https://steamcommunity.com/tradeoffer/new/?partner=X&token=Y
+//and that partner is the account id of steam64id
+func parseTradeUrl(steam64id string, raw string) (*TradeUrl, error) {
+	parsed, parseErr := url.Parse(strings.TrimSpace(trimNullBytes(raw)))
+	if parseErr != nil {
+		return nil, errTradeUrlInvalid
+	}
+	if parsed.Scheme != "https" || parsed.Host != "steamcommunity.com" || strings.TrimSuffix(parsed.Path, "/") != "/tradeoffer/new" {
+		return nil, errTradeUrlInvalid
+	}
+
+	query := parsed.Query()
+	partner := query.Get("partner")
+	token := query.Get("token")
+	if len(query["partner"]) != 1 || len(query["token"]) != 1 || !tokenRegex.MatchString(token) {
+		return nil, errTradeUrlInvalid
+	}
+
+	expected, idErr := accountId(steam64id)
+	if idErr != nil {
+		return nil, idErr
+	}
+	if partner != expected {
+		return nil, errTradeUrlPartner
+	}
+
+	return &TradeUrl{
+		Sid:     steam64id,
+		Url:     "https://steamcommunity.com/tradeoffer/new/?partner=" + partner + "&token=" + token,
+		Partner: partner,
+		Token:   token,
+	}, nil
+}
+
+//Returns nil if the user has not set a trade url
+func getTradeUrl(steam64id string) (*TradeUrl, error) {
+	tradeUrl := &TradeUrl{Sid: steam64id}
+	var updated int64
+	err := db.QueryRow(`SELECT url, partner, token, updated FROM trade_urls WHERE sid = ?`, steam64id).
+		Scan(&tradeUrl.Url, &tradeUrl.Partner, &tradeUrl.Token, &updated)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	tradeUrl.Updated = time.Unix(updated, 0)
+	return tradeUrl, nil
+}
+
+func setTradeUrl(steam64id string, raw string, ip string) (*TradeUrl, error) {
+	tradeUrl, parseErr := parseTradeUrl(steam64id, raw)
+	if parseErr != nil {
+		return nil, parseErr
+	}
+
+	current, getErr := getTradeUrl(steam64id)
+	if getErr != nil {
+		return nil, getErr
+	}
+	if current != nil {
+		if current.Url == tradeUrl.Url {
+			return current, nil
+		}
+		if time.Since(current.Updated) < time.Second*TRADE_URL_COOLDOWN {
+			return nil, errTradeUrlCooldown
+		}
+	}
+
+	//The cooldown is checked again by the upsert so two concurrent changes
+	//cannot both pass the check above
+	tradeUrl.Updated = time.Now()
+	res, execErr := db.Exec(`INSERT INTO trade_urls (sid, url, partner, token, updated) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(sid) DO UPDATE SET url = excluded.url, partner = excluded.partner, token = excluded.token, updated = excluded.updated
+		WHERE trade_urls.updated <= ?`,
+		steam64id, tradeUrl.Url, tradeUrl.Partner, tradeUrl.Token, tradeUrl.Updated.Unix(),
+		tradeUrl.Updated.Unix()-TRADE_URL_COOLDOWN)
+	if execErr != nil {
+		return nil, execErr
+	}
+	if affected, err := res.RowsAffected(); err != nil {
+		return nil, err
+	} else if affected == 0 {
+		return nil, errTradeUrlCooldown
+	}
+
+	detail := "set token " + tradeUrl.Token
+	if current != nil {
+		detail = fmt.Sprintf("changed token %s to %s", current.Token, tradeUrl.Token)
+	}
+	if err := recordAudit(steam64id, ip, audit.EVENT_TRADE_URL, detail); err != nil {
+		log.WithError(err).WithField("sid", steam64id).Error("Error writing trade url audit entry")
+	}
+	log.WithField("sid", steam64id).Info("Trade url updated")
+	return tradeUrl, nil
+}
+
+//Message shown to the user for a failed update
+func tradeUrlErrorText(err error) string {
+	switch err {
+	case errTradeUrlInvalid, errTradeUrlPartner, errTradeUrlCooldown:
+		return err.Error()
+	}
+	return "Internal server error"
+}
+
+//GET returns the stored trade url, POST {"trade_url": "..."} updates it
+func TradeUrlHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+
+	steam64id, sessionErr := checkSession(w, r)
+	if sessionErr == errSessionLookup {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, `{"error":"internal"}`)
+		return
+	}
+	if sessionErr != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, `{"error":"unauthorized"}`)
+		return
+	}
+
+	var tradeUrl *TradeUrl
+	var err error
+	if r.Method == "POST" {
+		var body struct {
+			TradeUrl string `json:"trade_url"`
+		}
+		if decodeErr := json.NewDecoder(http.MaxBytesReader(w, r.Body, 2048)).Decode(&body); decodeErr != nil {
+			err = errTradeUrlInvalid
+		} else {
+			tradeUrl, err = setTradeUrl(steam64id, body.TradeUrl, remoteIp(r.RemoteAddr))
+		}
+	} else {
+		tradeUrl, err = getTradeUrl(steam64id)
+	}
+
+	if err != nil {
+		if err == errTradeUrlInvalid || err == errTradeUrlPartner {
+			w.WriteHeader(http.StatusBadRequest)
+		} else if err == errTradeUrlCooldown {
+			w.WriteHeader(http.StatusTooManyRequests)
+		} else {
+			requestLog(r).WithError(err).Error("Error handling trade url")
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		data, _ := json.Marshal(map[string]string{"error": tradeUrlErrorText(err)})
+		w.Write(data)
+		return
+	}
+
+	resp := map[string]string{"trade_url": ""}
+	if tradeUrl != nil {
+		resp["trade_url"] = tradeUrl.Url
+	}
+	data, _ := json.Marshal(resp)
+	w.Write(data)
+}
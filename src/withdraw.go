@@ -0,0 +1,563 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	log "github.com/Sirupsen/logrus"
+	audit "github.com/skyguy126/website/src/audit"
+	ledger "github.com/skyguy126/website/src/ledger"
+	tradebot "github.com/skyguy126/website/src/tradebot"
+	"strings"
+	"time"
+)
+
+const MAX_WITHDRAW_ITEMS = 20
+
+//Transient steam errors are retried this many times before the withdrawal is refunded
+const MAX_WITHDRAW_ATTEMPTS = 5
+
+//Seconds before the first retry, doubled on every attempt
+const WITHDRAW_RETRY_DELAY = 30
+
+//Seconds a withdrawal offer stays open before the bot cancels it
+const WITHDRAW_TIMEOUT = 600
+const WITHDRAW_LOOP_INTERVAL = 5
+
+//Withdrawal states pushed to the client with code 15
+const (
+	WITHDRAW_QUEUED   = "queued"
+	WITHDRAW_SENT     = "sent"
+	WITHDRAW_ESCROW   = "escrow"
+	WITHDRAW_ACCEPTED = "accepted"
+	WITHDRAW_DECLINED = "declined"
+	WITHDRAW_EXPIRED  = "expired"
+	WITHDRAW_CANCELED = "canceled"
+	WITHDRAW_FAILED   = "failed"
+)
+
+var errWithdrawUnavailable = errors.New("Withdrawals are unavailable right now")
+var errWithdrawNoTradeUrl = errors.New("Set your trade url before withdrawing")
+var errWithdrawItems = errors.New("Select between 1 and 20 items")
+var errWithdrawItemNotFound = errors.New("An item is no longer available")
+var errWithdrawReserved = errors.New("An item is already being withdrawn by someone else")
+var errWithdrawUnpriced = errors.New("An item has no current price and cannot be withdrawn")
+var errWithdrawFunds = errors.New("Your balance is too low for these items")
+
+//Wakes the withdrawal loop when a new withdrawal is queued
+var withdrawalWake = make(chan bool, 1)
+
+type Withdrawal struct {
+	Id    string
+	Sid   string
+	State string
+	Total int64
+	Items []tradebot.Item
+	//Cents per item, same order as Items
+	Prices []int64
+}
+
+//States that give the items and balance back
+func withdrawalRefunded(state string) bool {
+	return state == WITHDRAW_DECLINED || state == WITHDRAW_EXPIRED || state == WITHDRAW_CANCELED || state == WITHDRAW_FAILED
+}
+
+func withdrawalFinal(state string) bool {
+	return state == WITHDRAW_ACCEPTED || withdrawalRefunded(state)
+}
+
+func withdrawalState(state tradebot.OfferState) string {
+	switch state {
+	case tradebot.StateActive, tradebot.StateCreatedNeedsConfirmation:
+		return WITHDRAW_SENT
+	case tradebot.StateInEscrow:
+		return WITHDRAW_ESCROW
+	case tradebot.StateAccepted:
+		return WITHDRAW_ACCEPTED
+	case tradebot.StateDeclined, tradebot.StateCountered:
+		return WITHDRAW_DECLINED
+	case tradebot.StateExpired:
+		return WITHDRAW_EXPIRED
+	case tradebot.StateCanceled, tradebot.StateCanceledBySecondFactor:
+		return WITHDRAW_CANCELED
+	}
+	return WITHDRAW_FAILED
+}
+
+func sendWithdrawalState(steam64id string, id string, state string, offerId string) {
+	sendToSid(steam64id, map[string]string{"code": "15", "withdrawal_id": id, "state": state, "offer_id": offerId})
+}
+
+//Picks the requested assets out of the bot's inventory and prices them
+func selectWithdrawItems(assetIds []string) ([]tradebot.Item, []int64, error) {
+	if len(assetIds) < 1 || len(assetIds) > MAX_WITHDRAW_ITEMS {
+		return nil, nil, errWithdrawItems
+	}
+	inventory, invErr := tradeBot.LoadInventory(config.Bot.SteamId, tradebot.APPID_CSGO, tradebot.CONTEXTID_CSGO, true)
+	if invErr != nil {
+		return nil, nil, invErr
+	}
+	byAsset := make(map[string]tradebot.Item, len(inventory))
+	for _, item := range inventory {
+		byAsset[item.AssetId] = item
+	}
+
+	items := make([]tradebot.Item, 0, len(assetIds))
+	prices := make([]int64, 0, len(assetIds))
+	seen := make(map[string]bool, len(assetIds))
+	for _, assetId := range assetIds {
+		item, ok := byAsset[assetId]
+		if !ok {
+			return nil, nil, errWithdrawItemNotFound
+		}
+		if seen[assetId] {
+			return nil, nil, errWithdrawItems
+		}
+		price, priced := itemPrice(item.MarketHashName)
+		if !priced {
+			return nil, nil, errWithdrawUnpriced
+		}
+		seen[assetId] = true
+		items = append(items, item)
+		prices = append(prices, price)
+	}
+	return items, prices, nil
+}
+
+//Reserves the items, debits the balance and queues the trade offer. Nothing
+//is reserved or debited unless all of it succeeds
+func createWithdrawal(steam64id string, ip string, assetIds []string) (*Withdrawal, error) {
+	if tradeBot == nil {
+		return nil, errWithdrawUnavailable
+	}
+	tradeUrl, urlErr := getTradeUrl(steam64id)
+	if urlErr != nil {
+		return nil, urlErr
+	}
+	if tradeUrl == nil {
+		return nil, errWithdrawNoTradeUrl
+	}
+
+	items, prices, itemsErr := selectWithdrawItems(assetIds)
+	if itemsErr != nil {
+		return nil, itemsErr
+	}
+	id, idErr := genRandomId()
+	if idErr != nil {
+		return nil, idErr
+	}
+	withdrawal := &Withdrawal{
+		Id:     id,
+		Sid:    steam64id,
+		State:  WITHDRAW_QUEUED,
+		Items:  items,
+		Prices: prices,
+	}
+	for _, price := range prices {
+		withdrawal.Total += price
+	}
+
+	if err := insertWithdrawal(withdrawal); err != nil {
+		return nil, err
+	}
+	if err := recordAudit(steam64id, ip, audit.EVENT_WITHDRAWAL, "withdrawal "+id+" queued"); err != nil {
+		log.WithError(err).WithField("sid", steam64id).Error("Error writing withdrawal audit entry")
+	}
+	log.WithFields(log.Fields{"withdrawal_id": id, "sid": steam64id, "items": len(items)}).Info("Withdrawal queued")
+
+	select {
+	case withdrawalWake <- true:
+	default:
+	}
+	return withdrawal, nil
+}
+
+func insertWithdrawal(withdrawal *Withdrawal) error {
+	tx, txErr := db.Begin()
+	if txErr != nil {
+		return txErr
+	}
+	defer tx.Rollback()
+
+	now := time.Now().Unix()
+	_, execErr := tx.Exec(`INSERT INTO withdrawals (id, sid, state, offer_id, total, attempts, next_attempt, created, updated)
+		VALUES (?, ?, ?, '', ?, 0, ?, ?, ?)`, withdrawal.Id, withdrawal.Sid, withdrawal.State, withdrawal.Total, now, now, now)
+	if execErr != nil {
+		return execErr
+	}
+	for n, item := range withdrawal.Items {
+		_, execErr = tx.Exec(`INSERT INTO withdrawal_items (withdrawal_id, asset_id, market_hash_name, price) VALUES (?, ?, ?, ?)`,
+			withdrawal.Id, item.AssetId, item.MarketHashName, withdrawal.Prices[n])
+		if execErr != nil {
+			return execErr
+		}
+		//The primary key on asset_id is what stops two withdrawals claiming one item
+		result, reserveErr := tx.Exec(`INSERT INTO bot_reservations (asset_id, withdrawal_id) VALUES (?, ?)
+			ON CONFLICT(asset_id) DO NOTHING`, item.AssetId, withdrawal.Id)
+		if reserveErr != nil {
+			return reserveErr
+		}
+		if reserved, _ := result.RowsAffected(); reserved != 1 {
+			return errWithdrawReserved
+		}
+	}
+
+	_, postErr := books.PostTx(tx, &ledger.Entry{
+		Key:  "withdraw:" + withdrawal.Id,
+		Kind: "withdraw",
+		Ref:  withdrawal.Id,
+		Postings: []ledger.Posting{
+			{Account: ledger.UserAccount(withdrawal.Sid), Amount: -withdrawal.Total},
+			{Account: ledger.ACCOUNT_WITHDRAWALS, Amount: withdrawal.Total},
+		},
+	})
+	if postErr == ledger.ErrInsufficientFunds {
+		return errWithdrawFunds
+	}
+	if postErr != nil {
+		return postErr
+	}
+	return tx.Commit()
+}
+
+//Moves a withdrawal to state. Refunding states release the reservations and
+//give the balance back in the same transaction. Returns the owner and false
+//if nothing changed
+func setWithdrawalState(id string, state string, offerId string) (string, bool, error) {
+	tx, txErr := db.Begin()
+	if txErr != nil {
+		return "", false, txErr
+	}
+	defer tx.Rollback()
+
+	var steam64id, current string
+	var total int64
+	err := tx.QueryRow(`SELECT sid, state, total FROM withdrawals WHERE id = ?`, id).Scan(&steam64id, &current, &total)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	if current == state || withdrawalFinal(current) {
+		return steam64id, false, nil
+	}
+
+	now := time.Now().Unix()
+	if offerId != "" {
+		_, err = tx.Exec(`UPDATE withdrawals SET state = ?, offer_id = ?, updated = ? WHERE id = ?`, state, offerId, now, id)
+	} else {
+		_, err = tx.Exec(`UPDATE withdrawals SET state = ?, updated = ? WHERE id = ?`, state, now, id)
+	}
+	if err != nil {
+		return "", false, err
+	}
+
+	if withdrawalFinal(state) {
+		if _, err := tx.Exec(`DELETE FROM bot_reservations WHERE withdrawal_id = ?`, id); err != nil {
+			return "", false, err
+		}
+	}
+	if state == WITHDRAW_ACCEPTED {
+		_, err = tx.Exec(`INSERT INTO item_ledger (time, sid, kind, ref, asset_id, market_hash_name, amount)
+			SELECT ?, ?, 'withdraw', withdrawal_id, asset_id, market_hash_name, -1 FROM withdrawal_items WHERE withdrawal_id = ?
+			ON CONFLICT (kind, ref, asset_id) DO NOTHING`, now, steam64id, id)
+		if err != nil {
+			return "", false, err
+		}
+	}
+	if withdrawalRefunded(state) {
+		_, err = books.PostTx(tx, &ledger.Entry{
+			Key:  "withdraw-refund:" + id,
+			Kind: "withdraw_refund",
+			Ref:  id,
+			Memo: state,
+			Postings: []ledger.Posting{
+				{Account: ledger.UserAccount(steam64id), Amount: total},
+				{Account: ledger.ACCOUNT_WITHDRAWALS, Amount: -total},
+			},
+		})
+		if err != nil {
+			return "", false, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return "", false, err
+	}
+	return steam64id, true, nil
+}
+
+//Applies a state change and tells the user about it
+func updateWithdrawal(id string, state string, offerId string) {
+	steam64id, changed, err := setWithdrawalState(id, state, offerId)
+	if err != nil {
+		log.WithError(err).WithField("withdrawal_id", id).Error("Error updating withdrawal")
+		return
+	}
+	if !changed {
+		return
+	}
+	if err := recordAudit(steam64id, "", audit.EVENT_WITHDRAWAL, "withdrawal "+id+" "+state); err != nil {
+		log.WithError(err).WithField("sid", steam64id).Error("Error writing withdrawal audit entry")
+	}
+	log.WithFields(log.Fields{"withdrawal_id": id, "sid": steam64id, "state": state}).Info("Withdrawal changed state")
+	sendWithdrawalState(steam64id, id, state, offerId)
+	if withdrawalFinal(state) {
+		inventories.Forget(config.Bot.SteamId)
+	}
+	if withdrawalRefunded(state) {
+		sendBalance(steam64id)
+	}
+}
+
+//Called by the trade bot for every change to an offer it sent
+func handleWithdrawalEvent(offer *tradebot.Offer) {
+	var id string
+	err := db.QueryRow(`SELECT id FROM withdrawals WHERE offer_id = ?`, offer.Id).Scan(&id)
+	if err == sql.ErrNoRows {
+		return
+	}
+	if err != nil {
+		log.WithError(err).WithField("offer_id", offer.Id).Error("Error finding withdrawal for offer")
+		return
+	}
+	updateWithdrawal(id, withdrawalState(offer.State), offer.Id)
+}
+
+//Message on a withdrawal's offer, also how the offer is found again when
+//CreateOffer fails after Steam already made it
+func withdrawalMessage(id string) string {
+	return "EnemyPC withdrawal " + strings.ToUpper(id[:8])
+}
+
+//Offer Steam already has for a withdrawal, nil when there is none
+func findWithdrawalOffer(id string, steam64id string, created int64) (*tradebot.Offer, error) {
+	//An hour of slack in case Steam's clock is behind ours
+	offers, err := tradeBot.GetOffersSince(time.Unix(created, 0).Add(-time.Hour))
+	if err != nil {
+		return nil, err
+	}
+	message := withdrawalMessage(id)
+	for _, offer := range offers {
+		if offer.IsOurs && offer.Partner == steam64id && offer.Message == message {
+			return offer, nil
+		}
+	}
+	return nil, nil
+}
+
+func rescheduleWithdrawal(id string, attempts int) {
+	retries := attempts
+	if retries > MAX_WITHDRAW_ATTEMPTS {
+		retries = MAX_WITHDRAW_ATTEMPTS
+	}
+	delay := int64(WITHDRAW_RETRY_DELAY) << uint(retries-1)
+	_, err := db.Exec(`UPDATE withdrawals SET attempts = ?, next_attempt = ?, updated = ? WHERE id = ?`,
+		attempts, time.Now().Unix()+delay, time.Now().Unix(), id)
+	if err != nil {
+		log.WithError(err).WithField("withdrawal_id", id).Error("Error rescheduling withdrawal")
+	}
+}
+
+//Sends the trade offer for a queued withdrawal. Failed attempts are retried
+//with backoff. CreateOffer can fail after Steam made the offer, so every retry
+//first looks for one and the withdrawal is only refunded once Steam has none
+func sendWithdrawal(id string, steam64id string, attempts int, created int64) {
+	if attempts > 0 {
+		offer, findErr := findWithdrawalOffer(id, steam64id, created)
+		if findErr != nil {
+			log.WithError(findErr).WithField("withdrawal_id", id).Warn("Unable to look for an earlier withdrawal offer, retrying")
+			rescheduleWithdrawal(id, attempts)
+			return
+		}
+		if offer != nil {
+			log.WithFields(log.Fields{"withdrawal_id": id, "offer_id": offer.Id}).Info("Found the offer of an earlier withdrawal attempt")
+			updateWithdrawal(id, withdrawalState(offer.State), offer.Id)
+			return
+		}
+		if attempts >= MAX_WITHDRAW_ATTEMPTS {
+			log.WithFields(log.Fields{"withdrawal_id": id, "attempts": attempts}).Error("Withdrawal failed")
+			updateWithdrawal(id, WITHDRAW_FAILED, "")
+			return
+		}
+	}
+
+	tradeUrl, urlErr := getTradeUrl(steam64id)
+	if urlErr != nil {
+		log.WithError(urlErr).WithField("withdrawal_id", id).Error("Error loading withdrawal trade url")
+		return
+	}
+	if tradeUrl == nil {
+		log.WithField("withdrawal_id", id).Error("Withdrawal has no trade url")
+		updateWithdrawal(id, WITHDRAW_FAILED, "")
+		return
+	}
+
+	rows, queryErr := db.Query(`SELECT asset_id FROM withdrawal_items WHERE withdrawal_id = ?`, id)
+	if queryErr != nil {
+		log.WithError(queryErr).WithField("withdrawal_id", id).Error("Error loading withdrawal items")
+		return
+	}
+	items := make([]tradebot.Item, 0)
+	for rows.Next() {
+		item := tradebot.Item{AppId: tradebot.APPID_CSGO, ContextId: tradebot.CONTEXTID_CSGO, Amount: 1}
+		if err := rows.Scan(&item.AssetId); err != nil {
+			rows.Close()
+			log.WithError(err).WithField("withdrawal_id", id).Error("Error loading withdrawal items")
+			return
+		}
+		items = append(items, item)
+	}
+	rowsErr := rows.Err()
+	rows.Close()
+	if rowsErr != nil {
+		log.WithError(rowsErr).WithField("withdrawal_id", id).Error("Error loading withdrawal items")
+		return
+	}
+	if len(items) == 0 {
+		log.WithField("withdrawal_id", id).Error("Withdrawal has no items")
+		updateWithdrawal(id, WITHDRAW_FAILED, "")
+		return
+	}
+
+	offer, offerErr := tradeBot.CreateOffer(&tradebot.NewOffer{
+		Partner:     steam64id,
+		Token:       tradeUrl.Token,
+		Message:     withdrawalMessage(id),
+		ItemsToGive: items,
+	})
+	if offerErr == nil {
+		updateWithdrawal(id, WITHDRAW_SENT, offer.Id)
+		return
+	}
+
+	//Permanent errors skip straight to the last attempt, which only checks
+	//Steam for an offer before refunding
+	attempts++
+	if !tradebot.IsTransient(offerErr) {
+		attempts = MAX_WITHDRAW_ATTEMPTS
+	}
+	log.WithError(offerErr).WithFields(log.Fields{"withdrawal_id": id, "attempt": attempts}).Warn("Withdrawal attempt failed")
+	rescheduleWithdrawal(id, attempts)
+}
+
+//Sends queued withdrawals that are due, one at a time so the bot is not rate limited
+func processWithdrawals() {
+	type due struct {
+		id       string
+		sid      string
+		attempts int
+		created  int64
+	}
+	rows, queryErr := db.Query(`SELECT id, sid, attempts, created FROM withdrawals WHERE state = ? AND next_attempt <= ? ORDER BY created`,
+		WITHDRAW_QUEUED, time.Now().Unix())
+	if queryErr != nil {
+		log.WithError(queryErr).Error("Error finding queued withdrawals")
+		return
+	}
+	queued := make([]due, 0)
+	for rows.Next() {
+		var d due
+		if err := rows.Scan(&d.id, &d.sid, &d.attempts, &d.created); err == nil {
+			queued = append(queued, d)
+		}
+	}
+	rows.Close()
+
+	for _, d := range queued {
+		sendWithdrawal(d.id, d.sid, d.attempts, d.created)
+	}
+}
+
+//Cancels withdrawal offers nobody answered within WITHDRAW_TIMEOUT
+func expireWithdrawals() {
+	rows, queryErr := db.Query(`SELECT id, offer_id FROM withdrawals WHERE state = ? AND updated < ?`,
+		WITHDRAW_SENT, time.Now().Unix()-WITHDRAW_TIMEOUT)
+	if queryErr != nil {
+		log.WithError(queryErr).Error("Error finding stale withdrawals")
+		return
+	}
+	stale := make(map[string]string)
+	for rows.Next() {
+		var id, offerId string
+		if err := rows.Scan(&id, &offerId); err == nil {
+			stale[id] = offerId
+		}
+	}
+	rows.Close()
+
+	for id, offerId := range stale {
+		cancelErr := tradeBot.CancelOffer(offerId)
+		if cancelErr == tradebot.ErrOfferNotActive {
+			//Answered before the cancel got there. Expiring it would refund items
+			//the user may already have, so take whatever state Steam has
+			offer, getErr := tradeBot.GetOffer(offerId)
+			if getErr != nil {
+				log.WithError(getErr).WithField("withdrawal_id", id).Error("Error loading stale withdrawal offer")
+				continue
+			}
+			updateWithdrawal(id, withdrawalState(offer.State), offerId)
+			continue
+		}
+		if cancelErr != nil {
+			log.WithError(cancelErr).WithField("withdrawal_id", id).Error("Error canceling stale withdrawal")
+			continue
+		}
+		updateWithdrawal(id, WITHDRAW_EXPIRED, offerId)
+	}
+}
+
+func withdrawalLoop(quit chan bool) {
+	ticker := time.NewTicker(time.Second * WITHDRAW_LOOP_INTERVAL)
+	defer ticker.Stop()
+	for {
+		processWithdrawals()
+		expireWithdrawals()
+		select {
+		case <-ticker.C:
+		case <-withdrawalWake:
+		case <-quit:
+			return
+		}
+	}
+}
+
+//Bot items that are not reserved by a pending withdrawal
+func availableBotItems() ([]InventoryItem, error) {
+	items, loadErr := inventories.Load(config.Bot.SteamId, false)
+	if loadErr != nil {
+		return nil, loadErr
+	}
+	reserved := make(map[string]bool)
+	rows, queryErr := db.Query(`SELECT asset_id FROM bot_reservations`)
+	if queryErr != nil {
+		return nil, queryErr
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var assetId string
+		if err := rows.Scan(&assetId); err == nil {
+			reserved[assetId] = true
+		}
+	}
+
+	available := make([]InventoryItem, 0, len(items))
+	for _, item := range items {
+		if !reserved[item.AssetId] && item.Tradable {
+			available = append(available, item)
+		}
+	}
+	return available, nil
+}
+
+//Message shown to the user for a failed withdrawal
+func withdrawErrorText(err error) string {
+	switch err {
+	case errWithdrawUnavailable, errWithdrawNoTradeUrl, errWithdrawItems, errWithdrawItemNotFound,
+		errWithdrawReserved, errWithdrawUnpriced, errWithdrawFunds:
+		return err.Error()
+	}
+	if tradebot.IsTransient(err) {
+		return "Steam is not responding, try again in a few minutes"
+	}
+	return "Internal server error"
+}
@@ -2,9 +2,12 @@ package main
 
 import (
 	"bytes"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
-	redigo "github.com/garyburd/redigo/redis"
 	log "github.com/Sirupsen/logrus"
 	jason "github.com/antonholmquist/jason"
 	jwt "github.com/dgrijalva/jwt-go"
@@ -12,6 +15,9 @@ import (
 	sessions "github.com/gorilla/sessions"
 	websocket "github.com/gorilla/websocket"
 	alice "github.com/justinas/alice"
+	audit "github.com/skyguy126/website/src/audit"
+	ledger "github.com/skyguy126/website/src/ledger"
+	tradebot "github.com/skyguy126/website/src/tradebot"
 	"io/ioutil"
 	"net/http"
 	"net/url"
@@ -26,7 +32,6 @@ import (
 )
 
 //TODO
-//verify trade url if(url.match(/token=([\w-]+)/)) with regex
 //prevent directory listing
 //https://gyazo.com/440cd2eaae0ad7a48e84604d356d73c4
 //implement routers http://www.gorillatoolkit.org/pkg/mux
@@ -53,13 +58,10 @@ const TOKEN_VALID_TIME = 30
 const SESS_VALID_TIME = 86400 * 3
 const CLEANUP_DELAY = 5
 
-var COOKIE_SECRET string
+var keyRing *KeyRing
 var STEAM_API_KEY string
-var INDEX_HTML string
-var HOME_HTML string
-var NOT_FOUND_HTML string
 
-var redis redigo.Conn
+var store Store
 var redisChan chan *RedisToken = make(chan *RedisToken, 100)
 var broadcastChan chan *Broadcast = make(chan *Broadcast, 100)
 var steamApiUrl string = "https://api.steampowered.com/ISteamUser/GetPlayerSummaries/v0002/?"
@@ -68,6 +70,7 @@ var upgrader = websocket.Upgrader{
 	HandshakeTimeout: time.Second * 10,
 	ReadBufferSize:   1024,
 	WriteBufferSize:  1024,
+	CheckOrigin:      checkOrigin,
 }
 
 type WebsocketMessage struct {
@@ -86,69 +89,196 @@ type RedisToken struct {
 
 type SocketConn struct {
 	Sid string
+	Ip string
 	Conn *websocket.Conn
 	Callback chan int
 	ConnAlive bool
 	Sync *sync.Mutex
 	KeepInDb bool
+	Connected time.Time
+	//Carries conn_id, ip and once authenticated the sid
+	Log *log.Entry
 }
 
 type Broadcast struct {
-	Msg map[string]string
+	Msg interface{}
 	Conn *SocketConn
 	Code int
 	Callback chan *SocketConn
+	List chan []*SocketConn
 	//0 add to array of active clients
 	//1 perform cleanup operation
 	//2 disable client with specified steamid
-	//3 broadcast chat message to all clients
+	//3 send Msg to every client, ex. chat messages and game state
+	//4 send Msg to every connection of the steamid in Conn
+	//5 send the active clients to List
 }
 
 func MainHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-type", "text/html")
-	fmt.Fprint(w, INDEX_HTML)
+	renderPage(w, r, "index.html", http.StatusOK, newPageData(r, ""))
 }
 
 func HomeHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-type", "text/html")
+	steam64id, sessionErr := checkSession(w, r)
+	if sessionErr == errSessionLookup {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if sessionErr == errInvalidSession {
+		http.Redirect(w, r, "https://"+HOST_ADDR+"/oid/login", http.StatusMovedPermanently)
+		return
+	}
+	if sessionErr == nil {
+		switch err := checkCompliance(steam64id, remoteIp(r.RemoteAddr)); err {
+		case nil:
+		case errRegionBlocked:
+			renderRegionBlocked(w, r)
+			return
+		case errTosRequired, errUnderage:
+			http.Redirect(w, r, "https://"+HOST_ADDR+"/terms", http.StatusFound)
+			return
+		default:
+			requestLog(r).WithError(err).Error("Error checking terms")
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+	}
+	renderPage(w, r, "home.html", http.StatusOK, newPageData(r, steam64id))
+}
+
+var errNoSession = errors.New("No session")
+var errInvalidSession = errors.New("Invalid session")
+var errSessionLookup = errors.New("Session lookup failed")
 
+//Returns the steam64 id of a valid session. Expired, revoked or
+//mismatched sessions get their cookie removed and return errInvalidSession.
+//If the store cannot be reached the cookie is kept and errSessionLookup returned
+func checkSession(w http.ResponseWriter, r *http.Request) (string, error) {
 	session, sessionErr := sessionStore.Get(r, "session")
 	if sessionErr != nil {
-		log.Error("Error getting session for ", r.RemoteAddr, ": ", sessionErr.Error())
+		requestLog(r).WithError(sessionErr).Error("Error getting session")
 		removeSessionCookie(session, w, r)
+		return "", errInvalidSession
 	}
 
-	if !session.IsNew {
-		expTime, _ := strconv.ParseInt(session.Values["exp"].(string), 10, 64)
-		remAddr, _ := session.Values["ip"].(string)
-		isExpired := expTime <= time.Now().Unix()
-		isDifferentIp := strings.Compare(remAddr, strings.Split(r.RemoteAddr, ":")[0]) != 0
-		//TODO make code better
-		if isExpired || isDifferentIp {
-			if isDifferentIp {
-				log.Warn("Session ip addr mismatch: ", r.RemoteAddr, ", ", remAddr)
-			} else if isExpired {
-				log.Warn("Expired session from ", r.RemoteAddr)
+	if session.IsNew {
+		return "", errNoSession
+	}
+
+	expTime, _ := strconv.ParseInt(session.Values["exp"].(string), 10, 64)
+	remAddr, _ := session.Values["ip"].(string)
+	sessionId, _ := session.Values["id"].(string)
+	stored, storeErr := store.GetSession(sessionId)
+	if storeErr != nil {
+		requestLog(r).WithError(storeErr).Error("Error looking up session")
+		return "", errSessionLookup
+	}
+	isExpired := expTime <= time.Now().Unix()
+	isDifferentIp := strings.Compare(remAddr, remoteIp(r.RemoteAddr)) != 0
+	isRevoked := stored == nil
+	if isExpired || isDifferentIp || isRevoked {
+		if isDifferentIp {
+			requestLog(r).WithField("session_ip", remAddr).Warn("Session ip addr mismatch")
+			authFailures.WithLabelValues("session", "ip_mismatch").Inc()
+			sid, _ := session.Values["sid"].(string)
+			if err := recordAudit(sid, remoteIp(r.RemoteAddr), audit.EVENT_IP_MISMATCH, "session issued to "+remAddr); err != nil {
+				requestLog(r).WithError(err).Error("Error writing ip mismatch audit entry")
 			}
-			removeSessionCookie(session, w, r)
-			http.Redirect(w, r, "https://"+HOST_ADDR+"/oid/login", http.StatusMovedPermanently)
-			return
+		} else if isExpired {
+			requestLog(r).Warn("Expired session")
+			authFailures.WithLabelValues("session", "expired").Inc()
+		} else if isRevoked {
+			requestLog(r).Warn("Revoked session")
+			authFailures.WithLabelValues("session", "revoked").Inc()
 		}
+		removeSessionCookie(session, w, r)
+		return "", errInvalidSession
+	}
 
-		log.Info("Logged in with session for ", r.RemoteAddr)
+	steam64id := session.Values["sid"].(string)
+	setRequestSid(r, steam64id)
+	requestLog(r).Debug("Logged in with session")
+	return steam64id, nil
+}
 
-		if genSockAuthCookie(w, r, session.Values["sid"].(string)) != nil {
-			http.Redirect(w, r, "https://"+HOST_ADDR, http.StatusMovedPermanently)
-			return
-		}
+//Issues a short lived websocket ticket to the holder of a valid session,
+//the ticket is sent as the first message on /sock
+func SockTicketHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+
+	steam64id, sessionErr := checkSession(w, r)
+	if sessionErr == errSessionLookup {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, `{"error":"internal"}`)
+		return
 	}
-	fmt.Fprint(w, HOME_HTML)
+	if sessionErr != nil {
+		requestLog(r).Warn("Sock ticket requested without valid session")
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, `{"error":"unauthorized"}`)
+		return
+	}
+
+	until, exclusionErr := exclusionUntil(steam64id)
+	if exclusionErr != nil {
+		requestLog(r).WithError(exclusionErr).Error("Error checking self-exclusion")
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, `{"error":"internal"}`)
+		return
+	}
+	if !until.IsZero() {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, `{"error":"excluded"}`)
+		return
+	}
+	ban, banErr := activeBan(steam64id)
+	if banErr != nil {
+		requestLog(r).WithError(banErr).Error("Error checking bans")
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, `{"error":"internal"}`)
+		return
+	}
+	if ban != nil {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, `{"error":"banned"}`)
+		return
+	}
+
+	//Tickets are only issued once the current terms are accepted
+	switch err := checkCompliance(steam64id, remoteIp(r.RemoteAddr)); err {
+	case nil:
+	case errRegionBlocked:
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, `{"error":"region"}`)
+		return
+	case errTosRequired, errUnderage:
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, `{"error":"terms"}`)
+		return
+	default:
+		requestLog(r).WithError(err).Error("Error checking terms")
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, `{"error":"internal"}`)
+		return
+	}
+
+	ticket, ticketErr := genSockTicket(r, steam64id)
+	if ticketErr != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, `{"error":"internal"}`)
+		return
+	}
+
+	data, _ := json.Marshal(map[string]string{"ticket": ticket})
+	w.Write(data)
 }
 
-func marshalAndSend(data map[string]string, socketConn *SocketConn, needLock bool) error {
+//data is usually a map[string]string, replies with lists use map[string]interface{}
+func marshalAndSend(data interface{}, socketConn *SocketConn, needLock bool) error {
 	json, jsonErr := json.Marshal(data)
 	if jsonErr != nil {
-		log.Error("Json marshal error for ", socketConn.Conn.RemoteAddr().String(), ": ", jsonErr.Error())
+		socketConn.Log.WithError(jsonErr).Error("Json marshal error")
 		return jsonErr
 	}
 
@@ -156,19 +286,20 @@ func marshalAndSend(data map[string]string, socketConn *SocketConn, needLock boo
 	if needLock {
 		socketConn.Sync.Lock()
 	}
-	if socketConn.ConnAlive {
-		//TODO catch error
-		socketConn.Conn.WriteMessage(1, json)
-	} else {
+	if !socketConn.ConnAlive {
+		if needLock {
+			socketConn.Sync.Unlock()
+		}
 		return nil
 	}
+	sendErr = socketConn.Conn.WriteMessage(1, json)
 	if needLock {
 		socketConn.Sync.Unlock()
 	}
 
 	if sendErr != nil {
 		//TODO add retry mechanism
-		log.Error("Error sending message to ", socketConn.Conn.RemoteAddr().String(), ": ", sendErr.Error())
+		socketConn.Log.WithError(sendErr).Error("Error sending message")
 		if needLock {
 			socketConn.Sync.Lock()
 		}
@@ -184,74 +315,90 @@ func marshalAndSend(data map[string]string, socketConn *SocketConn, needLock boo
 func SockHandler(w http.ResponseWriter, r *http.Request) {
 
 	if !websocket.IsWebSocketUpgrade(r) {
-		log.Warn("Invalid request to /sock from ", r.RemoteAddr, ", redirecting to /")
+		requestLog(r).Warn("Invalid request to /sock, redirecting to /")
 		http.Redirect(w, r, "https://"+HOST_ADDR, http.StatusMovedPermanently)
 		return
 	}
 
 	conn, connErr := upgrader.Upgrade(w, r, nil)
 	if connErr != nil {
-		log.Error("Websocket upgrade error for ", r.RemoteAddr, ": ", connErr.Error())
+		requestLog(r).WithError(connErr).Error("Websocket upgrade error")
 		http.Redirect(w, r, "https://"+HOST_ADDR, http.StatusMovedPermanently)
 		return
 	}
-	log.Info("Websocket connected from ", conn.RemoteAddr().String())
-
 	socketConn := &SocketConn{
+		Ip: remoteIp(conn.RemoteAddr().String()),
 		Conn: conn,
 		ConnAlive : true,
 		Sync : new(sync.Mutex),
+		Log : requestLog(r).WithField("conn_id", genLogId()),
 	}
+	socketConn.Log.Info("Websocket connected")
+	wsConnects.Inc()
+	wsOpen.Inc()
+	defer wsOpen.Dec()
 
 	conn.SetReadLimit(2048)
 	_, data, readErr := conn.ReadMessage()
-	if readErr != nil || len(data) < 1 || strings.Contains(string(data), "=") == false {
+	if readErr != nil || len(data) < 1 {
 		if readErr != nil {
-			log.Error("Socket read (auth token) error from, ", conn.RemoteAddr().String(), ": ", readErr.Error())
+			socketConn.Log.WithError(readErr).Error("Socket read (auth token) error")
 		} else {
-			log.Warn("Invalid token received from ", conn.RemoteAddr().String())
+			socketConn.Log.Warn("Invalid token received")
 		}
+		authFailures.WithLabelValues("socket", "invalid_token").Inc()
 		conn.Close()
 		return
 	}
 
-	cookieStr := strings.Split(string(bytes.Trim(data, "\x00")), "=")[1]
-
-	token, tokenErr := jwt.Parse(cookieStr, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("Invalid signing method: ", token.Header["alg"])
-		}
-		return []byte(COOKIE_SECRET), nil
-	})
+	ticketStr := string(bytes.Trim(data, "\x00 \n"))
 
+	//exp, nbf, iat, aud and purpose are checked by SockClaims.Valid
+	claims, tokenErr := keyRing.ParseSockToken(ticketStr)
 	if tokenErr != nil {
-		log.Error("Error validating token from, ", conn.RemoteAddr().String(), ": ", tokenErr.Error())
+		socketConn.Log.WithError(tokenErr).Error("Error validating token")
+		authFailures.WithLabelValues("socket", "invalid_token").Inc()
 		marshalAndSend(map[string]string{"is_valid": "false", "code":"0"}, socketConn, true)
 		conn.Close()
 		return
 	}
 
-	claims, ok := token.Claims.(jwt.MapClaims)
-	if !ok || !token.Valid {
-		log.Error("Error asserting types or invalid token from ", conn.RemoteAddr().String())
+	remAddr := claims.Ip
+	steam64id := claims.Subject
+	socketConn.Log = socketConn.Log.WithField("sid", steam64id)
+
+	if strings.Compare(remAddr, remoteIp(conn.RemoteAddr().String())) != 0 {
+		socketConn.Log.WithField("token_ip", remAddr).Warn("Token ip addr mismatch")
+		authFailures.WithLabelValues("socket", "ip_mismatch").Inc()
+		if err := recordAudit(steam64id, remoteIp(conn.RemoteAddr().String()), audit.EVENT_IP_MISMATCH, "socket token issued to "+remAddr); err != nil {
+			socketConn.Log.WithError(err).Error("Error writing ip mismatch audit entry")
+		}
 		marshalAndSend(map[string]string{"is_valid": "false", "code":"0"}, socketConn, true)
 		conn.Close()
 		return
 	}
 
-	expTime, _ := strconv.ParseInt(claims["exp"].(string), 10, 64)
-	remAddr, _ := claims["ip"].(string)
-	steam64id, _ := claims["sid"].(string)
-
-	isExpired := expTime <= time.Now().Unix()
-	isDifferentIp := strings.Compare(remAddr, strings.Split(conn.RemoteAddr().String(), ":")[0]) != 0
-	if isExpired || isDifferentIp {
-		if isExpired {
-			log.Warn("Expired token from ", conn.RemoteAddr().String())
-		} else if isDifferentIp {
-			log.Warn("Token ip addr mismatch: ", conn.RemoteAddr().String(), ", ", remAddr)
+	//Sessions from before the exclusion started are still around. Checked before
+	//the token is claimed, refusing after that would leave the sid online
+	if until, err := exclusionUntil(steam64id); err != nil || !until.IsZero() {
+		if err != nil {
+			socketConn.Log.WithError(err).Error("Error checking self-exclusion")
+		} else {
+			socketConn.Log.Info("Refusing socket for self-excluded user")
 		}
-		marshalAndSend(map[string]string{"is_valid": "false", "code":"0"}, socketConn, true)
+		authFailures.WithLabelValues("socket", "excluded").Inc()
+		marshalAndSend(map[string]string{"is_valid": "false", "code":"0", "reason":"excluded"}, socketConn, true)
+		conn.Close()
+		return
+	}
+	if ban, err := activeBan(steam64id); err != nil || ban != nil {
+		if err != nil {
+			socketConn.Log.WithError(err).Error("Error checking bans")
+		} else {
+			socketConn.Log.Info("Refusing socket for banned user")
+		}
+		authFailures.WithLabelValues("socket", "banned").Inc()
+		marshalAndSend(map[string]string{"is_valid": "false", "code":"0", "reason":"banned"}, socketConn, true)
 		conn.Close()
 		return
 	}
@@ -259,13 +406,17 @@ func SockHandler(w http.ResponseWriter, r *http.Request) {
 	callbackChan := make(chan int)
 	redisChan <- &RedisToken{
 		Code : 0,
-		Token : cookieStr,
+		Token : claims.Id,
 		Sid : steam64id,
 		Callback : callbackChan,
 	}
 
 	if <-callbackChan == 1 {
-		log.Warn("Token from ", conn.RemoteAddr().String(), " has already been used")
+		socketConn.Log.Warn("Token has already been used")
+		authFailures.WithLabelValues("socket", "token_reuse").Inc()
+		if err := recordAudit(steam64id, remoteIp(conn.RemoteAddr().String()), audit.EVENT_TOKEN_REUSE, "token "+claims.Id); err != nil {
+			socketConn.Log.WithError(err).Error("Error writing token reuse audit entry")
+		}
 		marshalAndSend(map[string]string{"is_valid": "false", "code":"0"}, socketConn, true)
 		conn.Close()
 		return
@@ -276,51 +427,34 @@ func SockHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	log.Info("Token validated for ", conn.RemoteAddr().String())
+	socketConn.Log.Info("Token validated")
 
 	socketConn.Sid = steam64id
 	socketConn.Callback = callbackChan
 	socketConn.KeepInDb = false
+	socketConn.Connected = time.Now()
 
-	params := url.Values{}
-	params.Add("key", STEAM_API_KEY)
-	params.Add("steamids", steam64id)
-	resp, respErr := http.Get(steamApiUrl + params.Encode())
-	if readErr != nil {
-		log.Error("Error fetching userinfo with steam api ", conn.RemoteAddr().String(), ": ", respErr.Error())
+	profile, profileErr := fetchSteamProfile(steam64id)
+	if profileErr != nil {
+		socketConn.Log.WithError(profileErr).Error("Error fetching userinfo with steam api")
 		marshalAndSend(map[string]string{"code":"4"}, socketConn, true)
 		conn.Close()
 		return
 	}
 
-	apiData, readErr := ioutil.ReadAll(resp.Body)
-	if readErr != nil {
-		log.Error("Error reading response from steamapi for ", conn.RemoteAddr().String(), ": ", readErr.Error())
-		marshalAndSend(map[string]string{"code":"4"}, socketConn, true)
+	if !profile.Public {
+		socketConn.Log.Warn("Steam profile is private or not setup")
+		marshalAndSend(map[string]string{"code":"6"}, socketConn, true)
 		conn.Close()
 		return
 	}
+	profiles.Put(profile)
 
-	payload, _ := jason.NewObjectFromBytes(apiData)
-	allUserData, _ := payload.GetObjectArray("response", "players")
-	for _, key := range allUserData {
-		communityState, _ := key.GetInt64("communityvisibilitystate")
-		profileState, _ := key.GetInt64("profilestate")
-		if communityState == 3 && profileState == 1 {
-			userNickname, _ := key.GetString("personaname")
-			userAvatar, _ := key.GetString("avatarfull")
-			userInfo := map[string]string{"nickname": userNickname, "avatar": userAvatar, "code": "1"}
-			if marshalAndSend(userInfo, socketConn, true) != nil {
-				log.Error("Error sending userinfo to ", conn.RemoteAddr().String())
-				conn.Close()
-				return
-			}
-		} else {
-			log.Warn(conn.RemoteAddr().String(), " ", steam64id, " steam profile is private or not setup")
-			marshalAndSend(map[string]string{"code":"6"}, socketConn, true)
-			conn.Close()
-			return
-		}
+	userInfo := map[string]string{"nickname": profile.Nickname, "avatar": profile.Avatar, "code": "1"}
+	if marshalAndSend(userInfo, socketConn, true) != nil {
+		socketConn.Log.Error("Error sending userinfo")
+		conn.Close()
+		return
 	}
 
 	//Add connection to broadcast loop
@@ -331,7 +465,7 @@ func SockHandler(w http.ResponseWriter, r *http.Request) {
 
 	//status 0 = ok
 	//status 1 = quit
-	defer fmt.Println("main exit")
+	defer socketConn.Log.Debug("Socket handler exited")
 	msgChan := make(chan *WebsocketMessage)
 	go socketReadLoop(socketConn, msgChan)
 	for {
@@ -345,8 +479,10 @@ func SockHandler(w http.ResponseWriter, r *http.Request) {
 				//1 token invalid
 				//2 another user signed in as
 				//3 too many errors
+				//4 kicked by staff
 				if state == 2 {
-					log.Warn("Another user signed in as ", conn.RemoteAddr().String())
+					socketConn.Log.Warn("Another user signed in, closing socket")
+					wsDisconnects.WithLabelValues("other_login").Inc()
 					marshalAndSend(map[string]string{"code": "2"}, socketConn, false)
 					socketConn.ConnAlive = false
 					socketConn.KeepInDb = true
@@ -354,22 +490,32 @@ func SockHandler(w http.ResponseWriter, r *http.Request) {
 					socketConn.Callback <- 2
 					return
 				} else if state == 3 {
-					log.Warn("Too many errors for ", conn.RemoteAddr().String())
+					socketConn.Log.Warn("Too many errors, closing socket")
+					wsDisconnects.WithLabelValues("too_many_errors").Inc()
 					marshalAndSend(map[string]string{"code": "5"}, socketConn, false)
 					socketConn.ConnAlive = false
 					conn.Close()
 					socketConn.Callback <- 3
 					return
+				} else if state == 4 {
+					socketConn.Log.Warn("Kicked by staff, closing socket")
+					wsDisconnects.WithLabelValues("kicked").Inc()
+					marshalAndSend(map[string]string{"code": "31"}, socketConn, false)
+					socketConn.ConnAlive = false
+					conn.Close()
+					socketConn.Callback <- 4
+					return
 				}
 			case data := <-msgChan:
 				if data.ReadError != nil || data.Code == -1 {
+					wsDisconnects.WithLabelValues("closed").Inc()
 					socketConn.Sync.Lock()
 					socketConn.ConnAlive = false
 					socketConn.Sync.Unlock()
 					conn.Close()
 					return
 				} else {
-					fmt.Println(data.Msg)
+					handleSocketMessage(socketConn, data)
 				}
 		}
 	}
@@ -378,8 +524,7 @@ func SockHandler(w http.ResponseWriter, r *http.Request) {
 //Add max number of messages read
 //something like 60 messages per min
 func socketReadLoop(socketConn *SocketConn, msgChan chan *WebsocketMessage) {
-	defer fmt.Println("Readloop exited")
-	remoteAddr := socketConn.Conn.RemoteAddr().String()
+	defer socketConn.Log.Debug("Read loop exited")
 	errCount := 0
 	for {
 		if errCount > 3 {
@@ -398,12 +543,13 @@ func socketReadLoop(socketConn *SocketConn, msgChan chan *WebsocketMessage) {
 
 		mType, data, err := socketConn.Conn.ReadMessage()
 		if err != nil {
+			wsCloseCodes.WithLabelValues(closeCodeLabel(err)).Inc()
 			if websocket.IsCloseError(err, 1001) == true {
-				log.Info("Client ", remoteAddr, " went away")
+				socketConn.Log.Info("Client went away")
 			} else if !socketConn.ConnAlive {
-				log.Warn(remoteAddr, " socket connection forcibly closed")
+				socketConn.Log.Warn("Socket connection forcibly closed")
 			} else {
-				log.Error("Read message error for ", remoteAddr, ": ", err.Error())
+				socketConn.Log.WithError(err).Error("Read message error")
 			}
 			if !socketConn.KeepInDb {
 				redisChan <- &RedisToken{
@@ -421,7 +567,8 @@ func socketReadLoop(socketConn *SocketConn, msgChan chan *WebsocketMessage) {
 
 		payload, parseErr := jason.NewObjectFromBytes(data)
 		if parseErr != nil {
-			log.Error("Message parse error for ", remoteAddr, ": ", parseErr.Error())
+			socketConn.Log.WithError(parseErr).Error("Message parse error")
+			wsRejected.WithLabelValues("invalid").Inc()
 			errCount++
 			marshalAndSend(map[string]string{"code":"4"}, socketConn, true)
 			continue
@@ -430,7 +577,8 @@ func socketReadLoop(socketConn *SocketConn, msgChan chan *WebsocketMessage) {
 
 		msgCode, msgCodeErr := payload.GetString("code")
 		if msgCodeErr != nil {
-			log.Warn("No field code in received message ", remoteAddr)
+			socketConn.Log.Warn("No field code in received message")
+			wsRejected.WithLabelValues("invalid").Inc()
 			errCount++
 			marshalAndSend(map[string]string{"code":"4"}, socketConn, true)
 			continue
@@ -438,7 +586,8 @@ func socketReadLoop(socketConn *SocketConn, msgChan chan *WebsocketMessage) {
 
 		code, convErr := strconv.Atoi(msgCode)
 		if convErr != nil {
-			log.Error("Error converting code to int for ", remoteAddr, ": ", convErr.Error())
+			socketConn.Log.WithError(convErr).Error("Error converting code to int")
+			wsRejected.WithLabelValues("invalid").Inc()
 			errCount++
 			marshalAndSend(map[string]string{"code":"4"}, socketConn, true)
 			continue
@@ -457,27 +606,23 @@ func redisLoop(rChan chan *RedisToken) {
 	callback := make(chan *SocketConn)
 	for {
 		input := <-rChan
-		//db 0 for tokens 1 for steamids
 		//code 0 add sid, 1 remove sid
 		if input.Code == 0 {
-			if _, err := redis.Do("SELECT", "0"); err != nil {
-				log.Error("Error changing redis database: ", err.Error())
-			}
 			//Check if token has only been used once
-			tVal, redisTErr := redis.Do("SET", input.Token, input.Sid, "NX", "EX", strconv.Itoa(TOKEN_VALID_TIME))
-			if redisTErr != nil {
-				log.Error("Error setting token in redis: ", redisTErr.Error())
+			isNewToken, tokenErr := store.ClaimToken(input.Token, input.Sid, TOKEN_VALID_TIME+TOKEN_LEEWAY)
+			if tokenErr != nil {
+				log.WithError(tokenErr).WithField("sid", input.Sid).Error("Error setting token in store")
 				input.Callback <- 1
 				continue
 			}
 			//If new token, check if another user is logged in already with same sid
-			if tVal != nil {
-				if _, err := redis.Do("SELECT", "1"); err != nil {
-					log.Error("Error changing redis database: ", err.Error())
+			if isNewToken {
+				isNewSid, onlineErr := store.SetOnline(input.Sid)
+				if onlineErr != nil {
+					log.WithError(onlineErr).WithField("sid", input.Sid).Error("Error setting sid online in store")
 				}
-				gVal, _ := redis.Do("SET", "online."+input.Sid, input.Sid, "NX")
 				//if no duplicate sid is found send 0 to callback asking socket to proceed
-				if gVal != nil {
+				if isNewSid {
 					input.Callback <- 0
 					continue
 				} else {
@@ -490,6 +635,11 @@ func redisLoop(rChan chan *RedisToken) {
 						Callback : callback,
 					}
 					closeClient := <-callback
+					//Not in the broadcast loop, the sid was left online by a socket that never joined it
+					if closeClient.Sync == nil {
+						input.Callback <- 0
+						continue
+					}
 					//if client is active, close its connection and proceed with current socket
 					closeClient.Sync.Lock()
 					if closeClient.ConnAlive {
@@ -506,12 +656,11 @@ func redisLoop(rChan chan *RedisToken) {
 				input.Callback <- 1
 			}
 		} else if input.Code == 1 {
-			if _, err := redis.Do("SELECT", "1"); err != nil {
-				log.Error("Error changing redis database: ", err.Error())
+			if err := store.SetOffline(input.Sid); err != nil {
+				log.WithError(err).WithField("sid", input.Sid).Error("Error removing sid from store")
 				continue
 			}
-			redis.Do("DEL", "online."+input.Sid)
-			log.Info("Removed ", input.Sid, " from redis")
+			log.WithField("sid", input.Sid).Info("Removed sid from store")
 		}
 	}
 }
@@ -553,11 +702,24 @@ func broadcastLoop(broadcastChan chan *Broadcast) {
 		} else if input.Code == 3 {
 			for _, key := range activeConns {
 				if key.ConnAlive {
-					go marshalAndSend(map[string]string{"kek":"kek"}, key, true)
+					go marshalAndSend(input.Msg, key, true)
+				}
+			}
+		} else if input.Code == 4 {
+			for _, key := range activeConns {
+				if key.ConnAlive && key.Sid == input.Conn.Sid {
+					go marshalAndSend(input.Msg, key, true)
 				}
 			}
+		} else if input.Code == 5 {
+			list := make([]*SocketConn, 0, len(activeConns))
+			for _, key := range activeConns {
+				if key.ConnAlive {
+					list = append(list, key)
+				}
+			}
+			input.List <- list
 		}
-		fmt.Println(activeConns)
 	}
 }
 
@@ -580,10 +742,8 @@ func OidHandler(w http.ResponseWriter, r *http.Request) {
 		OidAuthHandler(w, r, false)
 	} else if mode == "auth_s" {
 		OidAuthHandler(w, r, true)
-	} else if mode == "logout" {
-		OidLogoutHandler(w, r)
 	} else {
-		log.Warn("Invalid oid mode from ", r.RemoteAddr, ", redirecting to /")
+		requestLog(r).WithField("mode", mode).Warn("Invalid oid mode, redirecting to /")
 		http.Redirect(w, r, "https://"+HOST_ADDR, http.StatusMovedPermanently)
 		return
 	}
@@ -592,15 +752,21 @@ func OidHandler(w http.ResponseWriter, r *http.Request) {
 func OidLogoutHandler(w http.ResponseWriter, r *http.Request) {
 	session, sessionErr := sessionStore.Get(r, "session")
 	if sessionErr != nil {
-		log.Error("Error getting session for ", r.RemoteAddr, ": ", sessionErr.Error())
-		http.Redirect(w, r, "https://"+HOST_ADDR, http.StatusMovedPermanently)
+		requestLog(r).WithError(sessionErr).Error("Error getting session")
+		http.Redirect(w, r, "https://"+HOST_ADDR, http.StatusSeeOther)
+		return
 	}
 	if !session.IsNew {
+		if sid, ok := session.Values["sid"].(string); ok {
+			if err := recordAudit(sid, remoteIp(r.RemoteAddr), audit.EVENT_LOGOUT, ""); err != nil {
+				requestLog(r).WithError(err).Error("Error writing logout audit entry")
+			}
+		}
 		removeSessionCookie(session, w, r)
 	}
 
-	log.Info("Logout sequence finished for ", r.RemoteAddr, " redirecting to /")
-	http.Redirect(w, r, "https://"+HOST_ADDR, http.StatusMovedPermanently)
+	requestLog(r).Info("Logout sequence finished, redirecting to /")
+	http.Redirect(w, r, "https://"+HOST_ADDR, http.StatusSeeOther)
 }
 
 func OidLoginHandler(w http.ResponseWriter, r *http.Request, saveSession bool) {
@@ -634,87 +800,177 @@ func OidAuthHandler(w http.ResponseWriter, r *http.Request, saveSession bool) {
 	params.Add("openid.return_to", r.Form.Get("openid.return_to"))
 	params.Add("openid.response_nonce", r.Form.Get("openid.response_nonce"))
 
-	log.Info("Authenticating login request from ", r.RemoteAddr, " with Steam...")
+	requestLog(r).Info("Authenticating login request with Steam")
 
 	var steam64id string
 	if len(params.Get("openid.identity")) == 53 {
 		steam64id = trimNullBytes(params.Get("openid.identity"))[36:53]
 		match, regErr := regexp.MatchString("[0-9]", steam64id)
 		if match == false {
-			log.Warn("Invalid (non-numeric) steam64 ID returned for ", r.RemoteAddr, ", redirecting to /")
+			requestLog(r).Warn("Invalid (non-numeric) steam64 ID returned, redirecting to /")
 			http.Redirect(w, r, "https://"+HOST_ADDR, http.StatusMovedPermanently)
 			return
 		} else if regErr != nil {
-			log.Error("Regex error on steam64 ID for ", r.RemoteAddr, ", redirecting to /")
+			requestLog(r).WithError(regErr).Error("Regex error on steam64 ID, redirecting to /")
 			http.Redirect(w, r, "https://"+HOST_ADDR, http.StatusMovedPermanently)
 			return
 		}
 	} else {
-		log.Warn("Invalid (invalid length) steam64 ID returned for ", r.RemoteAddr, ", redirecting to /")
+		requestLog(r).Warn("Invalid (invalid length) steam64 ID returned, redirecting to /")
 		http.Redirect(w, r, "https://"+HOST_ADDR, http.StatusMovedPermanently)
 		return
 	}
 
-	resp, err := http.PostForm("https://steamcommunity.com/openid/login", params)
+	resp, err := steamClient.PostForm("https://steamcommunity.com/openid/login", params)
 	if err != nil {
-		log.Error("Auth request for ", r.RemoteAddr, " failed, redirecting to /")
+		requestLog(r).WithError(err).Error("Auth request failed, redirecting to /")
 		http.Redirect(w, r, "https://"+HOST_ADDR, http.StatusMovedPermanently)
 		return
 	}
 	defer resp.Body.Close()
 	data, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		log.Error("Read auth response for ", r.RemoteAddr, " failed, redirecting to /")
+		requestLog(r).WithError(err).Error("Read auth response failed, redirecting to /")
 		http.Redirect(w, r, "https://"+HOST_ADDR, http.StatusMovedPermanently)
 		return
 	}
 
 	is_valid := strings.Split(strings.Split(strings.Trim(string(data), "\n"), "\n")[1], ":")[1]
 	if strings.Compare(is_valid, "true") == 0 {
-		log.Info("Addr ", r.RemoteAddr, " has been authenticated")
+		setRequestSid(r, steam64id)
+		requestLog(r).Info("Authenticated with Steam")
+
+		if region := blockedRegion(remoteIp(r.RemoteAddr)); region != "" {
+			requestLog(r).WithField("region", region).Info("Refusing login from blocked region")
+			authFailures.WithLabelValues("login", "region").Inc()
+			if err := recordAudit(steam64id, remoteIp(r.RemoteAddr), audit.EVENT_LOGIN_REFUSED, "region "+region); err != nil {
+				requestLog(r).WithError(err).Error("Error writing login audit entry")
+			}
+			renderRegionBlocked(w, r)
+			return
+		}
 
-		if saveSession {
-			session, sessionErr := sessionStore.Get(r, "session")
-			if sessionErr != nil {
-				log.Error("Error getting session for ", r.RemoteAddr, ": ", sessionErr.Error())
+		until, exclusionErr := exclusionUntil(steam64id)
+		if exclusionErr != nil {
+			requestLog(r).WithError(exclusionErr).Error("Error checking self-exclusion, redirecting to /")
+			http.Redirect(w, r, "https://"+HOST_ADDR, http.StatusMovedPermanently)
+			return
+		}
+		if !until.IsZero() {
+			requestLog(r).Info("Refusing login for self-excluded user")
+			authFailures.WithLabelValues("login", "excluded").Inc()
+			if err := recordAudit(steam64id, remoteIp(r.RemoteAddr), audit.EVENT_LOGIN_REFUSED, "self-excluded"); err != nil {
+				requestLog(r).WithError(err).Error("Error writing login audit entry")
 			}
+			data := newPageData(r, "")
+			data.ExcludedUntil = until.UTC().Format("2006-01-02 15:04 MST")
+			renderPage(w, r, "excluded.html", http.StatusForbidden, data)
+			return
+		}
 
-			session.Options = &sessions.Options{
-				Path:     "/",
-				HttpOnly: true,
-				MaxAge:   SESS_VALID_TIME,
-				Secure:   true,
+		ban, banErr := activeBan(steam64id)
+		if banErr != nil {
+			requestLog(r).WithError(banErr).Error("Error checking bans, redirecting to /")
+			http.Redirect(w, r, "https://"+HOST_ADDR, http.StatusMovedPermanently)
+			return
+		}
+		if ban != nil {
+			requestLog(r).Info("Refusing login for banned user")
+			authFailures.WithLabelValues("login", "banned").Inc()
+			if err := recordAudit(steam64id, remoteIp(r.RemoteAddr), audit.EVENT_LOGIN_REFUSED, "banned"); err != nil {
+				requestLog(r).WithError(err).Error("Error writing login audit entry")
 			}
+			data := newPageData(r, "")
+			data.Ban = ban
+			renderPage(w, r, "banned.html", http.StatusForbidden, data)
+			return
+		}
 
-			session.Values["sid"] = steam64id
-			session.Values["exp"] = strconv.FormatInt(time.Now().Unix()+SESS_VALID_TIME, 10)
-			session.Values["ip"] = strings.Split(r.RemoteAddr, ":")[0]
+		session, sessionErr := sessionStore.Get(r, "session")
+		if sessionErr != nil {
+			requestLog(r).WithError(sessionErr).Error("Error getting session")
+		}
 
-			if err := session.Save(r, w); err != nil {
-				log.Error("Error saving session for ", r.RemoteAddr, ": ", err.Error(), " redirecting to /")
-				http.Redirect(w, r, "https://"+HOST_ADDR, http.StatusMovedPermanently)
-				return
-			}
+		//Without "remember me" the cookie only lasts until the browser closes
+		maxAge := 0
+		if saveSession {
+			maxAge = SESS_VALID_TIME
+		}
+		session.Options = &sessions.Options{
+			Path:     "/",
+			HttpOnly: true,
+			MaxAge:   maxAge,
+			Secure:   true,
+		}
 
-			log.Info("Generated session cookie for ", r.RemoteAddr)
-		} else {
-			if genSockAuthCookie(w, r, steam64id) != nil {
-				http.Redirect(w, r, "https://"+HOST_ADDR+"/", http.StatusMovedPermanently)
-				return
-			}
+		sessionId, idErr := genRandomId()
+		if idErr != nil {
+			requestLog(r).WithError(idErr).Error("Error generating session id, redirecting to /")
+			http.Redirect(w, r, "https://"+HOST_ADDR, http.StatusMovedPermanently)
+			return
+		}
+
+		session.Values["id"] = sessionId
+		session.Values["sid"] = steam64id
+		session.Values["exp"] = strconv.FormatInt(time.Now().Unix()+SESS_VALID_TIME, 10)
+		session.Values["ip"] = remoteIp(r.RemoteAddr)
+
+		storeErr := store.PutSession(sessionId, map[string]string{
+			"sid": steam64id,
+			"ip":  session.Values["ip"].(string),
+			"exp": session.Values["exp"].(string),
+		}, SESS_VALID_TIME)
+		if storeErr != nil {
+			requestLog(r).WithError(storeErr).Error("Error storing session, redirecting to /")
+			http.Redirect(w, r, "https://"+HOST_ADDR, http.StatusMovedPermanently)
+			return
+		}
+
+		if err := session.Save(r, w); err != nil {
+			requestLog(r).WithError(err).Error("Error saving session, redirecting to /")
+			http.Redirect(w, r, "https://"+HOST_ADDR, http.StatusMovedPermanently)
+			return
+		}
+
+		requestLog(r).Info("Generated session cookie")
+
+		if err := recordLogin(sessionId, steam64id, session.Values["ip"].(string), time.Now().Unix()+SESS_VALID_TIME); err != nil {
+			requestLog(r).WithError(err).Error("Error recording login")
+		}
+		if err := recordAudit(steam64id, session.Values["ip"].(string), audit.EVENT_LOGIN, ""); err != nil {
+			requestLog(r).WithError(err).Error("Error writing login audit entry")
 		}
 
-		log.Info("Redirecting ", r.RemoteAddr, " to /home")
+		accepted, tosErr := hasAcceptedTos(steam64id)
+		if tosErr != nil {
+			requestLog(r).WithError(tosErr).Error("Error checking terms")
+		}
+		if !accepted {
+			requestLog(r).Info("Redirecting to /terms")
+			http.Redirect(w, r, "https://"+HOST_ADDR+"/terms", http.StatusFound)
+			return
+		}
+
+		requestLog(r).Info("Redirecting to /home")
 		http.Redirect(w, r, "https://"+HOST_ADDR+"/home", http.StatusMovedPermanently)
 		return
 	} else {
-		log.Warn("Addr ", r.RemoteAddr, " auth fail, redirecting to /")
+		requestLog(r).Warn("Steam auth failed, redirecting to /")
+		authFailures.WithLabelValues("login", "openid").Inc()
 		http.Redirect(w, r, "https://"+HOST_ADDR, http.StatusMovedPermanently)
 		return
 	}
 }
 
 func removeSessionCookie(session *sessions.Session, w http.ResponseWriter, r *http.Request) {
+	if sessionId, ok := session.Values["id"].(string); ok {
+		if err := store.DeleteSession(sessionId); err != nil {
+			requestLog(r).WithError(err).Error("Error deleting stored session")
+		}
+		if err := endLogin(sessionId); err != nil {
+			requestLog(r).WithError(err).Error("Error ending login")
+		}
+	}
 	session.Options = &sessions.Options{
 		Path:     "/",
 		HttpOnly: true,
@@ -722,40 +978,49 @@ func removeSessionCookie(session *sessions.Session, w http.ResponseWriter, r *ht
 		Secure:   true,
 	}
 	if err := session.Save(r, w); err != nil {
-		log.Error("Error removing session for ", r.RemoteAddr, ": ", err.Error())
+		requestLog(r).WithError(err).Error("Error removing session")
 		return
 	}
-	log.Info("Requested removal of session for ", r.RemoteAddr)
+	requestLog(r).Info("Requested removal of session")
 }
 
-func genSockAuthCookie(w http.ResponseWriter, r *http.Request, steam64id string) error {
-	tokenExp := time.Now().Add(time.Second * TOKEN_VALID_TIME)
+func genSockTicket(r *http.Request, steam64id string) (string, error) {
+	now := time.Now()
+	tokenExp := now.Add(time.Second * TOKEN_VALID_TIME)
 
-	//TODO add mode field "websocket"
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"sid": steam64id,
-		"exp": strconv.FormatInt(tokenExp.Unix(), 10),
-		"ip":  strings.Split(string(r.RemoteAddr), ":")[0],
-	})
+	tokenId, idErr := genRandomId()
+	if idErr != nil {
+		requestLog(r).WithError(idErr).Error("Error generating token id")
+		return "", idErr
+	}
 
-	tokenString, tokenErr := token.SignedString([]byte(COOKIE_SECRET))
+	tokenString, tokenErr := keyRing.Sign(&SockClaims{
+		StandardClaims: jwt.StandardClaims{
+			Id:        tokenId,
+			Subject:   steam64id,
+			Audience:  tokenAudience(),
+			IssuedAt:  now.Unix(),
+			NotBefore: now.Unix(),
+			ExpiresAt: tokenExp.Unix(),
+		},
+		Ip:      remoteIp(r.RemoteAddr),
+		Purpose: TOKEN_PURPOSE_WEBSOCKET,
+	})
 	if tokenErr != nil {
-		log.Error("Error generating token for ", r.RemoteAddr, ": ", tokenErr.Error())
-		return tokenErr
+		requestLog(r).WithError(tokenErr).Error("Error generating token")
+		return "", tokenErr
 	}
 
-	cookie := &http.Cookie{
-		Name:     "sock_auth",
-		Value:    tokenString,
-		Expires:  tokenExp,
-		HttpOnly: false,
-		Secure:   true,
-		Path:     "/home",
-	}
-	http.SetCookie(w, cookie)
-	log.Info("Set jwt sock_auth cookie for ", r.RemoteAddr)
+	requestLog(r).Info("Issued jwt sock ticket")
+	return tokenString, nil
+}
 
-	return nil
+func genRandomId() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
 }
 
 func trimNullBytes(input string) string {
@@ -763,30 +1028,19 @@ func trimNullBytes(input string) string {
 }
 
 func RedirectToHttps(w http.ResponseWriter, r *http.Request) {
-	log.Info("Redirecting ", r.RemoteAddr, " to HTTPS /")
+	requestLog(r).Info("Redirecting to HTTPS /")
 	http.Redirect(w, r, "https://"+HOST_ADDR, http.StatusMovedPermanently)
 }
 
-func NoDirListing(h http.Handler) http.HandlerFunc {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if strings.HasSuffix(r.URL.Path, "/") {
-			http.NotFound(w, r)
-			return
-		}
-		h.ServeHTTP(w, r)
-	})
-}
-
 func NotFound(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-type", "text/html")
-	fmt.Fprint(w, NOT_FOUND_HTML)
+	renderPage(w, r, "404.html", http.StatusNotFound, newPageData(r, ""))
 }
 
 func RecoverHandler(next http.Handler) http.Handler {
 	fn := func(w http.ResponseWriter, r *http.Request) {
 		defer func() {
 			if err := recover(); err != nil {
-				log.Error("Unexpected panic from ", r.RemoteAddr, ": ", err)
+				requestLog(r).WithField("panic", err).Error("Unexpected panic")
 			}
 		}()
 		next.ServeHTTP(w, r)
@@ -796,119 +1050,274 @@ func RecoverHandler(next http.Handler) http.Handler {
 
 func LogHandler(next http.Handler) http.Handler {
 	fn := func(w http.ResponseWriter, r *http.Request) {
-		log.Info(r.RemoteAddr, " ", r.Method, " ", r.URL.Path)
+		requestLog(r).WithFields(log.Fields{"method": r.Method, "path": r.URL.Path}).Debug("Request started")
 		startTime := time.Now()
-		next.ServeHTTP(w, r)
-		log.Info(r.RemoteAddr, " ", r.Method, " ", r.URL.Path, " completed in ", time.Now().Sub(startTime))
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+		elapsed := time.Now().Sub(startTime)
+		route := routeLabel(r)
+		httpRequests.WithLabelValues(route, r.Method, strconv.Itoa(sw.Status())).Inc()
+		httpDuration.WithLabelValues(route, r.Method).Observe(elapsed.Seconds())
+		requestLog(r).WithFields(log.Fields{
+			"method":   r.Method,
+			"path":     r.URL.Path,
+			"status":   sw.Status(),
+			"duration": elapsed.String(),
+		}).Info("Request completed")
 	}
 	return http.HandlerFunc(fn)
 }
 
 func cleanup() {
-	if _, err := redis.Do("SELECT", "0"); err != nil {
-		log.Error("Error changing redis database: ", err.Error())
-	}
-	redis.Do("FLUSHALL")
-	if _, err := redis.Do("SELECT", "1"); err != nil {
-		log.Error("Error changing redis database: ", err.Error())
+	if err := store.Reset(); err != nil {
+		log.WithError(err).Error("Error resetting store")
 	}
-	redis.Do("FLUSHALL")
 }
 
 func main() {
-	log.SetLevel(log.InfoLevel)
 	log.SetOutput(os.Stdout)
 
+	configPath := flag.String("config", "config.json", "path to config file")
+	guardCode := flag.Bool("guard-code", false, "print the bot's steam guard login code and exit")
+	reconcile := flag.Bool("reconcile", false, "check the ledger balances and exit")
+	verifyAudit := flag.Bool("verify-audit", false, "check the audit log hash chain and exit")
+	flag.Parse()
+	if *guardCode {
+		if err := printGuardCode(); err != nil {
+			log.WithError(err).Fatal("Error generating guard code")
+		}
+		return
+	}
+	loadedConfig, configErr := loadConfig(*configPath)
+	if configErr != nil {
+		log.WithError(configErr).Fatal("Error loading config")
+		return
+	}
+	config = loadedConfig
+	if err := setupLogging(config.Log); err != nil {
+		log.WithError(err).Fatal("Error setting up logging")
+		return
+	}
+	log.Info("Loaded config")
+
+	if *reconcile {
+		if !runReconcile() {
+			os.Exit(1)
+		}
+		return
+	}
+	if *verifyAudit {
+		if !runVerifyAudit() {
+			os.Exit(1)
+		}
+		return
+	}
+
 	apiKey, apiKeyFileError := ioutil.ReadFile("secure/apikey.txt")
 	if apiKeyFileError != nil {
-		log.Fatal("Error loading API key:", apiKeyFileError.Error())
+		log.WithError(apiKeyFileError).Fatal("Error loading API key")
 		return
 	}
 	STEAM_API_KEY = strings.Trim(string(apiKey), "\n ")
 	log.Info("Loaded API key")
 
-	cookieSecret, cookieSecretError := ioutil.ReadFile("secure/cookie_secret.txt")
-	if cookieSecretError != nil {
-		log.Fatal("Error loading cookie secret: ", cookieSecretError.Error())
-		return
+	//cookie_secrets.txt holds the rotating key ring, cookie_secret.txt is the old single key
+	if _, err := os.Stat("secure/cookie_secrets.txt"); err == nil {
+		loadedRing, keyRingError := loadKeyRing("secure/cookie_secrets.txt")
+		if keyRingError != nil {
+			log.WithError(keyRingError).Fatal("Error loading cookie secrets")
+			return
+		}
+		keyRing = loadedRing
+	} else {
+		cookieSecret, cookieSecretError := ioutil.ReadFile("secure/cookie_secret.txt")
+		if cookieSecretError != nil {
+			log.WithError(cookieSecretError).Fatal("Error loading cookie secret")
+			return
+		}
+		keyRing = NewKeyRing()
+		keyRing.Add("0", []byte(strings.Trim(string(cookieSecret), "\n ")))
 	}
-	COOKIE_SECRET = strings.Trim(string(cookieSecret), "\n ")
-	log.Info("Loaded jwt cookie secret")
+	log.Info("Loaded jwt key ring")
 
 	sessionSecret, sessionSecretError := ioutil.ReadFile("secure/session_secret.txt")
 	if sessionSecretError != nil {
-		log.Fatal("Error loading session secret: ", sessionSecretError.Error())
+		log.WithError(sessionSecretError).Fatal("Error loading session secret")
 		return
 	}
 	sessionStore = sessions.NewCookieStore(sessionSecret)
 	sessionStore.MaxAge(SESS_VALID_TIME)
 	log.Info("Loaded session store")
 
-	indexHtmlFile, indexHtmlFileError := ioutil.ReadFile("index.html")
-	if indexHtmlFileError != nil {
-		log.Fatal("Error loading index.html: ", indexHtmlFileError.Error())
+	csrfSecret, csrfSecretError := ioutil.ReadFile("secure/csrf_secret.txt")
+	if csrfSecretError != nil {
+		log.WithError(csrfSecretError).Fatal("Error loading csrf secret")
 		return
 	}
-	INDEX_HTML = strings.Trim(string(indexHtmlFile), "\n ")
-	log.Info("Loaded index.html")
+	csrfHandler := newCsrfHandler(csrfSecret)
+	log.Info("Loaded csrf secret")
 
-	homeHtmlFile, homeHtmlFileError := ioutil.ReadFile("home.html")
-	if homeHtmlFileError != nil {
-		log.Fatal("Error loading index.html: ", homeHtmlFileError.Error())
+	loadedAssets, assetsErr := loadAssets(config.DevMode)
+	if assetsErr != nil {
+		log.WithError(assetsErr).Fatal("Error loading static assets")
 		return
 	}
-	HOME_HTML = strings.Trim(string(homeHtmlFile), "\n ")
-	log.Info("Loaded home.html")
+	assets = loadedAssets
+	log.Info("Loaded static assets")
 
-	notFoundFile, notFoundFileError := ioutil.ReadFile("404.html")
-	if notFoundFileError != nil {
-		log.Fatal("Error loading 404.html: ", notFoundFileError.Error())
+	database, databaseErr := openDatabase(config.DatabaseDriver, config.DatabaseDsn)
+	if databaseErr != nil {
+		log.WithError(databaseErr).Fatal("Error opening database")
+		return
+	}
+	db = database
+	log.Info("Opened database")
+	if err := startAuditLog(); err != nil {
+		log.WithError(err).Fatal("Error sealing audit log")
 		return
 	}
-	NOT_FOUND_HTML = strings.Trim(string(notFoundFile), "\n ")
-	log.Info("Loaded 404.html")
+	books = ledger.New(db)
+	go ledgerSnapshotLoop()
 
-	redisKey, redisKeyError := ioutil.ReadFile("secure/redis_key.txt")
-	if redisKeyError != nil {
-		log.Fatal("Error loading redis password: ", notFoundFileError.Error())
+	if err := startPricing(config.Pricing); err != nil {
+		log.WithError(err).Fatal("Error starting pricing")
 		return
 	}
-	redisConn, connErr := redigo.Dial("tcp", ":6379")
-	if connErr != nil {
-		log.Fatal("Error connecting to redis: ", connErr.Error())
+	log.Info("Started pricing")
+
+	if err := startCompliance(config.Compliance); err != nil {
+		log.WithError(err).Fatal("Error opening GeoIP database")
+		return
+	}
+	log.Info("Loaded compliance settings")
+
+	if config.Bot.Enabled {
+		if err := startTradeBot(config.Bot); err != nil {
+			log.WithError(err).Fatal("Error starting trade bot")
+			return
+		}
+		log.Info("Started trade bot")
+	}
+
+	//The fake bot backend doubles as the fake inventory source, the community
+	//inventory endpoint needs no api key or session otherwise
+	if tradeBot != nil {
+		inventoryClient = tradeBot
+	} else {
+		steamService := tradebot.NewSteamService("", tradebot.WebSession{})
+		steamService.Client.Transport = newSteamTransport()
+		inventoryClient = steamService
+	}
+
+	if err := templates.Load(); err != nil {
+		log.WithError(err).Fatal("Error loading templates")
 		return
 	}
-	redis = redisConn
-	if _, err := redis.Do("AUTH", strings.Trim(string(redisKey), "\n")); err != nil {
-		log.Fatal("Error authenticating with redis: ", err.Error())
+	log.Info("Loaded templates")
+
+	var redisKey []byte
+	if config.Store == "redis" {
+		redisKeyFile, redisKeyError := ioutil.ReadFile("secure/redis_key.txt")
+		if redisKeyError != nil {
+			log.WithError(redisKeyError).Fatal("Error loading redis password")
+			return
+		}
+		redisKey = redisKeyFile
+	}
+	openedStore, storeErr := openStore(config, strings.Trim(string(redisKey), "\n"))
+	if storeErr != nil {
+		log.WithError(storeErr).WithField("store", config.Store).Fatal("Error opening store")
+		return
 	}
+	store = openedStore
 	go redisLoop(redisChan)
 	cleanup()
-	log.Info("Started redis")
+	log.WithField("store", config.Store).Info("Started store")
 
 	go broadcastLoop(broadcastChan)
 	go broadcastCleanup(broadcastChan)
 	log.Info("Started broadcast loop")
 
+	if config.Jackpot.Enabled {
+		if err := startJackpot(config.Jackpot); err != nil {
+			log.WithError(err).Fatal("Error starting jackpot")
+			return
+		}
+		log.Info("Started jackpot")
+	}
+	if config.Coinflip.Enabled {
+		if err := startCoinflip(config.Coinflip); err != nil {
+			log.WithError(err).Fatal("Error starting coinflip")
+			return
+		}
+		log.Info("Started coinflip")
+	}
+	if err := startRoundGames(); err != nil {
+		log.WithError(err).Fatal("Error starting round games")
+		return
+	}
+	log.Info("Started round games")
+
+	var metricsHandler http.Handler
+	if config.Metrics.Enabled {
+		handler, metricsErr := startMetrics(config.Metrics)
+		if metricsErr != nil {
+			log.WithError(metricsErr).Fatal("Error starting metrics")
+			return
+		}
+		metricsHandler = handler
+		if config.Metrics.Listen != "" {
+			log.WithField("listen", config.Metrics.Listen).Info("Serving metrics")
+		}
+	}
+
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt)
 	signal.Notify(c, syscall.SIGTERM)
     go func() {
         <-c
         cleanup()
+        if err := store.Close(); err != nil {
+            log.WithError(err).Error("Error closing store")
+        }
+        db.Close()
         os.Exit(1)
     }()
 
 	r := mux.NewRouter()
 	r.StrictSlash(true)
-	r.NotFoundHandler = http.HandlerFunc(NotFound)
-	chain := alice.New(RecoverHandler, LogHandler)
+	chain := alice.New(RequestIdHandler, RecoverHandler, LogHandler, SecurityHeaders, csrfHandler)
+	//Browsers send csp reports without csrf tokens
+	reportChain := alice.New(RequestIdHandler, RecoverHandler, LogHandler)
+	staticChain := alice.New(RequestIdHandler, RecoverHandler, SecurityHeaders)
+	r.NotFoundHandler = staticChain.ThenFunc(NotFound)
 
 	r.Handle("/", chain.ThenFunc(MainHandler)).Methods("GET")
 	r.Handle("/home", chain.ThenFunc(HomeHandler)).Methods("GET")
 	r.Handle("/sock", chain.ThenFunc(SockHandler)).Methods("GET")
+	r.Handle("/api/sock-ticket", chain.ThenFunc(SockTicketHandler)).Methods("POST")
+	r.Handle("/api/csrf-token", chain.ThenFunc(CsrfTokenHandler)).Methods("GET")
+	r.Handle("/api/trade-url", chain.ThenFunc(TradeUrlHandler)).Methods("GET", "POST")
+	r.Handle("/terms", chain.ThenFunc(TermsHandler)).Methods("GET", "POST")
+	r.Handle("/verify", chain.ThenFunc(VerifyHandler)).Methods("GET")
+	r.Handle("/api/verify", chain.ThenFunc(VerifyApiHandler)).Methods("GET")
+	r.Handle("/api/admin/prices", chain.Append(requirePermission(PERM_PRICES)).ThenFunc(PriceOverrideHandler)).Methods("GET", "POST", "DELETE")
+	r.Handle("/admin", chain.Append(requirePermission(PERM_ADMIN_VIEW)).ThenFunc(AdminHandler)).Methods("GET")
+	r.Handle("/admin/kick", chain.Append(requirePermission(PERM_KICK)).ThenFunc(AdminKickHandler)).Methods("POST")
+	r.Handle("/admin/ban", chain.Append(requirePermission(PERM_BAN)).ThenFunc(AdminBanHandler)).Methods("POST")
+	r.Handle("/admin/balance", chain.Append(requirePermission(PERM_BALANCE)).ThenFunc(AdminBalanceHandler)).Methods("POST")
+	r.Handle("/api/admin/audit", chain.Append(requirePermission(PERM_AUDIT)).ThenFunc(AuditHandler)).Methods("GET")
+	r.Handle("/api/admin/audit.jsonl", chain.Append(requirePermission(PERM_AUDIT)).ThenFunc(AuditExportHandler)).Methods("GET")
+	r.Handle("/admin/role", chain.Append(requirePermission(PERM_ROLES)).ThenFunc(AdminRoleHandler)).Methods("POST")
+	r.Handle("/admin/fair/rotate", chain.Append(requirePermission(PERM_FAIR)).ThenFunc(AdminFairRotateHandler)).Methods("POST")
+	r.Handle("/oid/logout", chain.ThenFunc(OidLogoutHandler)).Methods("POST")
 	r.Handle("/oid/{mode:[a-z_]+}", chain.ThenFunc(OidHandler)).Methods("GET")
-	r.PathPrefix("/static/").Handler(http.StripPrefix("/static/", NoDirListing(http.FileServer(http.Dir("./static/")))))
+	r.Handle("/csp-report", reportChain.ThenFunc(CspReportHandler)).Methods("POST")
+	//Scrapes are left out of the request metrics and logs
+	if metricsHandler != nil {
+		r.Handle("/metrics", alice.New(RecoverHandler).Then(metricsHandler)).Methods("GET")
+	}
+	r.PathPrefix(ASSET_PREFIX).Handler(staticChain.Then(assets))
 
 	http.Handle("/", r)
 